@@ -0,0 +1,96 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+// addrTimeout is how long an address of a cpu found with dnssd is
+// tried before the next one is. Tests change it.
+var addrTimeout = 2 * time.Second
+
+// entryAddrs returns the addresses of a cpu found with dnssd, as
+// host names. Link-local addresses are no use without their interface,
+// the zone, so they are given the one the answer came in on, or, if
+// that is not known, the one -ds-iface, or SIDECORE_IFACE, names.
+// If there is none, the address is left out.
+func entryAddrs(e dnssd.BrowseEntry) []string {
+	var addrs []string
+	for _, ip := range e.IPs {
+		if !ip.IsLinkLocalUnicast() {
+			addrs = append(addrs, ip.String())
+			continue
+		}
+		zone := e.IfaceName
+		if len(zone) == 0 && len(dsIfaces) == 1 {
+			zone = dsIfaces[0]
+		}
+		if len(zone) == 0 {
+			verbose("%s: %v: link-local, and no interface is known; skipping it", e.UnescapedName(), ip)
+			continue
+		}
+		addrs = append(addrs, ip.String()+"%"+zone)
+	}
+	return addrs
+}
+
+// dialable drops the cpus found with dnssd which have addresses,
+// but none that can be dialed. cpus with no addresses at all, e.g.
+// those in SRV records, are known by name, and are kept.
+func dialable(found []*ds.LookupResult) []*ds.LookupResult {
+	var c []*ds.LookupResult
+	for _, e := range found {
+		if len(e.Entry.IPs) > 0 && len(entryAddrs(e.Entry)) == 0 {
+			verbose("%s: no address can be dialed", e.Entry.UnescapedName())
+			continue
+		}
+		c = append(c, e)
+	}
+	return c
+}
+
+// addrErrors are the errors from each address tried.
+type addrErrors []error
+
+// Error implements error.
+func (a addrErrors) Error() string {
+	var s []string
+	for _, err := range a {
+		s = append(s, err.Error())
+	}
+	return "no address answered: " + strings.Join(s, "; ")
+}
+
+// Unwrap returns the errors, for errors.Is and errors.As.
+func (a addrErrors) Unwrap() []error {
+	return a
+}
+
+// dialAddrs connects to the first of a cpu's addresses which
+// answers. Each but the last is given addrTimeout, so that an
+// unreachable address, e.g. a stale DHCP lease, does not use
+// up all of -connect-timeout.
+func dialAddrs(addrs []string, port string) (net.Conn, error) {
+	var errs addrErrors
+	for i, a := range addrs {
+		d := net.Dialer{}
+		if i < len(addrs)-1 {
+			d.Timeout = addrTimeout
+		}
+		c, err := d.Dial("tcp", net.JoinHostPort(a, port))
+		if err == nil {
+			return c, nil
+		}
+		verbose("%s: %v", a, err)
+		errs = append(errs, err)
+	}
+	return nil, errs
+}
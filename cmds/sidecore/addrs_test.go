@@ -0,0 +1,101 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+func TestEntryAddrs(t *testing.T) {
+	defer func(i []string) { dsIfaces = i }(dsIfaces)
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fe80::1"), net.ParseIP("2001:db8::1")}
+	for _, tt := range []struct {
+		iface  string
+		ifaces []string
+		want   []string
+	}{
+		{iface: "eth0", want: []string{"10.0.0.1", "fe80::1%eth0", "2001:db8::1"}},
+		{iface: "eth0", ifaces: []string{"eth1"}, want: []string{"10.0.0.1", "fe80::1%eth0", "2001:db8::1"}},
+		{ifaces: []string{"eth1"}, want: []string{"10.0.0.1", "fe80::1%eth1", "2001:db8::1"}},
+		{ifaces: []string{"eth1", "eth2"}, want: []string{"10.0.0.1", "2001:db8::1"}},
+		{want: []string{"10.0.0.1", "2001:db8::1"}},
+	} {
+		dsIfaces = tt.ifaces
+		e := dnssd.BrowseEntry{IfaceName: tt.iface, IPs: ips}
+		if got := entryAddrs(e); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("entryAddrs(%v, %q, %q): %q != %q", e.IPs, tt.iface, tt.ifaces, got, tt.want)
+		}
+	}
+}
+
+func TestDialable(t *testing.T) {
+	defer func(i []string) { dsIfaces = i }(dsIfaces)
+	dsIfaces = nil
+	found := []*ds.LookupResult{
+		{Entry: dnssd.BrowseEntry{Name: "lladdr", IPs: []net.IP{net.ParseIP("fe80::1")}}},
+		{Entry: dnssd.BrowseEntry{Name: "both", IPs: []net.IP{net.ParseIP("fe80::2"), net.ParseIP("10.0.0.2")}}},
+		{Entry: dnssd.BrowseEntry{Name: "zoned", IfaceName: "eth0", IPs: []net.IP{net.ParseIP("fe80::3")}}},
+		{Entry: dnssd.BrowseEntry{Name: "srv.example.com"}},
+	}
+	var got []string
+	for _, e := range dialable(found) {
+		got = append(got, e.Entry.Name)
+	}
+	if want := []string{"both", "zoned", "srv.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dialable: %q != %q", got, want)
+	}
+}
+
+// closedPort returns a port nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	return port
+}
+
+func TestDialAddrs(t *testing.T) {
+	defer func(d time.Duration) { addrTimeout = d }(addrTimeout)
+	addrTimeout = 100 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	// 192.0.2.1 is for documentation: it either does not answer,
+	// or is unreachable.
+	c, err := dialAddrs([]string{"192.0.2.1", "127.0.0.1"}, port)
+	if err != nil {
+		t.Fatalf("dialAddrs(192.0.2.1 127.0.0.1, %s): %v != nil", port, err)
+	}
+	c.Close()
+
+	port = closedPort(t)
+	_, err = dialAddrs([]string{"127.0.0.1", "::1"}, port)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("dialAddrs(127.0.0.1 ::1, %s): %v != %v", port, err, syscall.ECONNREFUSED)
+	}
+	// Each address is named in the error.
+	for _, a := range []string{"127.0.0.1:" + port, "[::1]:" + port} {
+		if !strings.Contains(err.Error(), a) {
+			t.Errorf("dialAddrs(127.0.0.1 ::1, %s): %q does not name %s", port, err, a)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/u-root/sidecore/internal/cpu/client"
+)
+
+// The container is for an arch. Unless one is asked for, with -arch,
+// SIDECORE_ARCH, -requirements or the inventory, it is the cpu's
+// own, found once it is dialed: from its dnssd txt record, for cpus
+// found with dnssd, or else from uname -m. If one is asked for, and
+// the cpu is not of it, that is a warning.
+var archFlag = flag.String("arch", "", "architecture to run on, as Go names it, e.g. amd64 or riscv64, which chooses the container; the default is SIDECORE_ARCH, or else the cpu's own, found once it is dialed")
+
+// archTimeout is how long uname -m has to say what a cpu is.
+var archTimeout = 5 * time.Second
+
+// unameArchs are the Go names of uname -m's machines.
+var unameArchs = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"i386":    "386",
+	"i486":    "386",
+	"i586":    "386",
+	"i686":    "386",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv5l":  "arm",
+	"armv6l":  "arm",
+	"armv7l":  "arm",
+	"armv8l":  "arm",
+	"riscv64": "riscv64",
+	"ppc64le": "ppc64le",
+	"ppc64":   "ppc64",
+	"s390x":   "s390x",
+	"mips64":  "mips64",
+	"loong64": "loong64",
+}
+
+// goArch returns the Go name of a uname -m machine.
+func goArch(machine string) (string, error) {
+	m := strings.TrimSpace(machine)
+	if a, ok := unameArchs[m]; ok {
+		return a, nil
+	}
+	return "", fmt.Errorf("uname -m %q: unknown machine:%w", m, os.ErrInvalid)
+}
+
+// archContainer returns the name of the container for arch, of
+// SIDECORE_DISTRO and SIDECORE_VERSION.
+func archContainer(arch string) string {
+	return containerName(arch, envOrDefault("SIDECORE_DISTRO", "ubuntu"), envOrDefault("SIDECORE_VERSION", "latest"))
+}
+
+// containerName returns the name of a container in SIDECORE_IMAGES:
+// arch-distro@version.cpio.
+func containerName(arch, distro, version string) string {
+	return fmt.Sprintf("%s-%s@%s.cpio", arch, distro, version)
+}
+
+// archiveSuffixes are the suffixes of the archives containers may be.
+var archiveSuffixes = []string{".cpio", ".tar", ".sqfs", ".squashfs"}
+
+// parseContainerName returns the arch, distro and version of a
+// container named by containerName, or as a tar or squashfs image, or
+// compressed, e.g. amd64-ubuntu@latest.tar.gz, and whether it is one.
+func parseContainerName(n string) (arch, distro, version string, ok bool) {
+	n = trimCompressedSuffix(n)
+	for _, s := range archiveSuffixes {
+		if n, ok = strings.CutSuffix(n, s); ok {
+			break
+		}
+	}
+	if !ok {
+		return "", "", "", false
+	}
+	ad, version, ok := strings.Cut(n, "@")
+	if !ok {
+		return "", "", "", false
+	}
+	arch, distro, ok = strings.Cut(ad, "-")
+	if !ok || len(arch) == 0 || len(distro) == 0 || len(version) == 0 {
+		return "", "", "", false
+	}
+	return arch, distro, version, true
+}
+
+// remoteArch returns the arch of a cpu which has been dialed: the one
+// in its txt record, if it was found with dnssd, or else what uname -m
+// says, with a session of its own.
+func remoteArch(c *client.Cmd, cpu *cpu) (string, error) {
+	if len(cpu.txtArch) > 0 {
+		return cpu.txtArch, nil
+	}
+	s, err := c.Client().NewSession()
+	if err != nil {
+		return "", fmt.Errorf("uname -m: %w", err)
+	}
+	defer s.Close()
+	type out struct {
+		b   []byte
+		err error
+	}
+	o := make(chan out, 1)
+	go func() {
+		b, err := s.Output("uname -m")
+		o <- out{b: b, err: err}
+	}()
+	select {
+	case r := <-o:
+		if r.err != nil {
+			return "", fmt.Errorf("uname -m: %w", r.err)
+		}
+		return goArch(string(r.b))
+	case <-time.After(archTimeout):
+		return "", fmt.Errorf("uname -m: no answer in %v:%w", archTimeout, os.ErrDeadlineExceeded)
+	}
+}
+
+// checkArch finds the arch of a cpu which has been dialed, whose
+// container was chosen by arch, and returns the container for it.
+// If the arch was asked for, or, with -9p, the container has already
+// been served, the container stays as it is, and a cpu not of its
+// arch is only a warning. A cpu whose arch can not be found keeps
+// its container too.
+func checkArch(c *client.Cmd, cpu *cpu) string {
+	a, err := remoteArch(c, cpu)
+	if err != nil {
+		verbose("%s: arch: %v; using %s", cpu.host, err, cpu.container)
+		return cpu.container
+	}
+	verbose("%s: arch %s", cpu.host, a)
+	switch {
+	case a == cpu.arch:
+		return cpu.container
+	case cpu.archForced:
+		info("warning: %s is %s, not %s; using %s, as asked", cpu.host, a, cpu.arch, cpu.container)
+		return cpu.container
+	case *ninep:
+		info("warning: %s is %s, not %s; with -9p, the container is chosen before dialing, so set -arch %s", cpu.host, a, cpu.arch, a)
+		return cpu.container
+	}
+	cpu.arch = a
+	cpu.container, cpu.imageDirs = searchContainer(archContainer(a))
+	verbose("%s: container %s", cpu.host, cpu.container)
+	return cpu.container
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGoArch(t *testing.T) {
+	for _, tt := range []struct {
+		m    string
+		want string
+		err  error
+	}{
+		{m: "x86_64\n", want: "amd64"},
+		{m: "aarch64", want: "arm64"},
+		{m: "armv7l", want: "arm"},
+		{m: "riscv64\n", want: "riscv64"},
+		{m: "i686", want: "386"},
+		{m: "pdp11", err: os.ErrInvalid},
+		{m: "", err: os.ErrInvalid},
+	} {
+		got, err := goArch(tt.m)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("goArch(%q): (%q, %v) != (%q, %v)", tt.m, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestArchContainer(t *testing.T) {
+	t.Setenv("SIDECORE_DISTRO", "alpine")
+	t.Setenv("SIDECORE_VERSION", "edge")
+	if got, want := archContainer("arm64"), "arm64-alpine@edge.cpio"; got != want {
+		t.Errorf("archContainer(arm64): %q != %q", got, want)
+	}
+}
+
+func TestCheckArchTXT(t *testing.T) {
+	defer func(n bool) { *ninep = n }(*ninep)
+	images := t.TempDir()
+	t.Setenv("SIDECORE_IMAGES", images)
+	t.Setenv("SIDECORE_DISTRO", "ubuntu")
+	t.Setenv("SIDECORE_VERSION", "latest")
+	amd64 := filepath.Join(images, "amd64-ubuntu@latest.cpio")
+	arm64 := filepath.Join(images, "arm64-ubuntu@latest.cpio")
+	for _, tt := range []struct {
+		name   string
+		txt    string
+		forced bool
+		ninep  bool
+		want   string
+	}{
+		{name: "same", txt: "amd64", want: amd64},
+		{name: "detected", txt: "arm64", want: arm64},
+		{name: "forced", txt: "arm64", forced: true, want: amd64},
+		{name: "9p", txt: "arm64", ninep: true, want: amd64},
+	} {
+		*ninep = tt.ninep
+		cpu := &cpu{host: "rpi", arch: "amd64", archForced: tt.forced, txtArch: tt.txt, container: amd64}
+		if got := checkArch(nil, cpu); got != tt.want || cpu.container != tt.want {
+			t.Errorf("%s: checkArch: (%q, cpu.container %q) != %q", tt.name, got, cpu.container, tt.want)
+		}
+	}
+}
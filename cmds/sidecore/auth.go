@@ -0,0 +1,405 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/u-root/sidecore/internal/cpu/client"
+	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// sshAgent is a connection to ssh-agent.
+type sshAgent struct {
+	agent.ExtendedAgent
+	conn net.Conn
+}
+
+// dialAgent connects to the ssh-agent named by SSH_AUTH_SOCK.
+// It returns nil if -no-agent is set, SSH_AUTH_SOCK is not,
+// or the agent can not be reached; keys are then only read
+// from files.
+func dialAgent() *sshAgent {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if *noAgent || len(sock) == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		verbose("ssh-agent: %v", err)
+		return nil
+	}
+	return &sshAgent{ExtendedAgent: agent.NewClient(conn), conn: conn}
+}
+
+// Close closes the connection to the agent. It is safe
+// to call on a nil *sshAgent.
+func (a *sshAgent) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.conn.Close()
+}
+
+// signers returns the keys held by the agent, or none if
+// there is no agent, or it can not list its keys.
+func (a *sshAgent) signers() []ossh.Signer {
+	if a == nil {
+		return nil
+	}
+	s, err := a.Signers()
+	if err != nil {
+		verbose("ssh-agent: %v", err)
+		return nil
+	}
+	verbose("ssh-agent has %d keys", len(s))
+	for i := range s {
+		if as, ok := s[i].(ossh.AlgorithmSigner); ok && isSecurityKey(s[i].PublicKey()) {
+			s[i] = &skSigner{AlgorithmSigner: as}
+		}
+	}
+	return s
+}
+
+// skTouchTimeout is how long to wait for a security key to be
+// touched. It is a variable so that tests can shorten it.
+var skTouchTimeout = 30 * time.Second
+
+// isSecurityKey returns true if k is a security key (FIDO) key,
+// or a certificate for one.
+func isSecurityKey(k ossh.PublicKey) bool {
+	return strings.HasPrefix(k.Type(), "sk-")
+}
+
+// skSigner is a security key held by ssh-agent. The agent asks
+// for the PIN, if one is needed, and waits for the key to be
+// touched; skSigner says that a touch is needed, and gives up
+// if it does not happen in skTouchTimeout. Signing is done
+// while logging in, before the terminal is put in raw mode.
+type skSigner struct {
+	ossh.AlgorithmSigner
+}
+
+// Sign implements ssh.Signer.
+func (s *skSigner) Sign(rand io.Reader, data []byte) (*ossh.Signature, error) {
+	return s.touch(func() (*ossh.Signature, error) {
+		return s.AlgorithmSigner.Sign(rand, data)
+	})
+}
+
+// SignWithAlgorithm implements ssh.AlgorithmSigner.
+func (s *skSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ossh.Signature, error) {
+	return s.touch(func() (*ossh.Signature, error) {
+		return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	})
+}
+
+// touch asks for the security key to be touched, and waits
+// for sign to return, or skTouchTimeout.
+func (s *skSigner) touch(sign func() (*ossh.Signature, error)) (*ossh.Signature, error) {
+	type signed struct {
+		sig *ossh.Signature
+		err error
+	}
+	c := make(chan signed, 1)
+	fmt.Fprintln(os.Stderr, "Confirm user presence on the security key")
+	go func() {
+		sig, err := sign()
+		c <- signed{sig: sig, err: err}
+	}()
+	select {
+	case r := <-c:
+		return r.sig, r.err
+	case <-time.After(skTouchTimeout):
+		return nil, fmt.Errorf("%s: security key not touched in %v:%w", s.PublicKey().Type(), skTouchTimeout, os.ErrDeadlineExceeded)
+	}
+}
+
+// passphraseTries is how many times a passphrase is asked
+// for before giving up on a key, as in ssh.
+const passphraseTries = 3
+
+// passwordTries is how many times a password is asked for.
+const passwordTries = 3
+
+// askSecret asks for a passphrase or password. Tests replace it.
+var askSecret = readSecret
+
+// promptMu keeps cpus running in parallel from
+// prompting on the terminal at the same time.
+var promptMu sync.Mutex
+
+// readSecret reads a secret from the terminal, without echo, or,
+// if there is no terminal, from the program named by SSH_ASKPASS.
+// The prompt goes to the terminal, not stdout, so that it does not
+// end up in piped output.
+func readSecret(prompt string) ([]byte, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		fmt.Fprint(tty, prompt)
+		defer fmt.Fprintln(tty)
+		return term.ReadPassword(int(tty.Fd()))
+	}
+	// There is no /dev/tty on Windows.
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		defer fmt.Fprintln(os.Stderr)
+		return term.ReadPassword(fd)
+	}
+	return askPass(prompt)
+}
+
+// askPass runs SSH_ASKPASS with the prompt, and returns
+// the first line it prints.
+func askPass(prompt string) ([]byte, error) {
+	p := os.Getenv("SSH_ASKPASS")
+	if len(p) == 0 {
+		return nil, fmt.Errorf("no terminal, and SSH_ASKPASS is not set:%w", os.ErrNotExist)
+	}
+	cmd := exec.Command(p, prompt)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("SSH_ASKPASS %s: %w", p, err)
+	}
+	if i := bytes.IndexAny(out, "\r\n"); i >= 0 {
+		out = out[:i]
+	}
+	return out, nil
+}
+
+// decryptKey asks for the passphrase of an encrypted key,
+// up to passphraseTries times.
+func decryptKey(n string, b []byte) (ossh.Signer, error) {
+	for i := 0; i < passphraseTries; i++ {
+		p, err := askSecret(fmt.Sprintf("Enter passphrase for key '%s': ", n))
+		if err != nil {
+			return nil, err
+		}
+		s, err := ossh.ParsePrivateKeyWithPassphrase(b, p)
+		for i := range p {
+			p[i] = 0
+		}
+		if !errors.Is(err, x509.IncorrectPasswordError) {
+			return s, err
+		}
+		info("Bad passphrase for %s", n)
+	}
+	return nil, fmt.Errorf("%d bad passphrases:%w", passphraseTries, x509.IncorrectPasswordError)
+}
+
+// signerCache holds the keys which have been loaded, so that a
+// passphrase is only asked for once, even if cpus run in parallel.
+var signerCache = struct {
+	sync.Mutex
+	m map[string]ossh.Signer
+}{m: map[string]ossh.Signer{}}
+
+// loadKey reads and parses a private key file.
+// If the key is encrypted, its passphrase is asked for.
+func loadKey(n string) (ossh.Signer, error) {
+	signerCache.Lock()
+	defer signerCache.Unlock()
+	if s, ok := signerCache.m[n]; ok {
+		return s, nil
+	}
+	b, err := os.ReadFile(n)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ossh.ParsePrivateKey(b)
+	if _, ok := err.(*ossh.PassphraseMissingError); ok {
+		s, err = decryptKey(n, b)
+	}
+	if err != nil {
+		if pub, perr := os.ReadFile(n + ".pub"); perr == nil {
+			if k, _, _, _, perr := ossh.ParseAuthorizedKey(pub); perr == nil && isSecurityKey(k) {
+				return nil, fmt.Errorf("%s is a security key; add it to ssh-agent with ssh-add:%w", n, os.ErrInvalid)
+			}
+		}
+		return nil, fmt.Errorf("%s: %w", n, err)
+	}
+	signerCache.m[n] = s
+	return s, nil
+}
+
+// loadKeys loads the usable keys in files, in order.
+// It is an error if none of them can be used.
+func loadKeys(files []string) ([]ossh.Signer, error) {
+	var (
+		signers []ossh.Signer
+		errs    []error
+	)
+	for _, n := range files {
+		s, err := loadKey(n)
+		if err != nil {
+			verbose("key file: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		signers = append(signers, s)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no usable key file in %q: %w", files, errors.Join(errs...))
+	}
+	return signers, nil
+}
+
+// loadCert reads an ssh certificate. A certificate which is not
+// valid now is an error, so that an expired certificate is not
+// reported as just an authentication failure.
+func loadCert(n string) (*ossh.Certificate, error) {
+	b, err := os.ReadFile(n)
+	if err != nil {
+		return nil, err
+	}
+	k, _, _, _, err := ossh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n, err)
+	}
+	c, ok := k.(*ossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is not a certificate:%w", n, k.Type(), os.ErrInvalid)
+	}
+	now := time.Now()
+	if after := time.Unix(int64(c.ValidAfter), 0); now.Before(after) {
+		return nil, fmt.Errorf("%s: certificate is not valid until %v", n, after)
+	}
+	if c.ValidBefore != ossh.CertTimeInfinity {
+		if before := time.Unix(int64(c.ValidBefore), 0); !now.Before(before) {
+			return nil, fmt.Errorf("%s: certificate expired at %v", n, before)
+		}
+	}
+	verbose("certificate %s: serial %d, principals %q", n, c.Serial, c.ValidPrincipals)
+	return c, nil
+}
+
+// certSigners returns signers for the certificates in files, for
+// those of signers whose public key they certify. A key file's
+// certificate, if any, is found next to it, with -cert.pub added
+// to its name. Certificates which can not be used are reported
+// and skipped.
+func certSigners(signers []ossh.Signer, files []string) []ossh.Signer {
+	var certs []ossh.Signer
+	for _, n := range files {
+		c, err := loadCert(n)
+		if err != nil {
+			info("%v", err)
+			continue
+		}
+		found := false
+		for _, s := range signers {
+			if !bytes.Equal(s.PublicKey().Marshal(), c.Key.Marshal()) {
+				continue
+			}
+			cs, err := ossh.NewCertSigner(c, s)
+			if err != nil {
+				info("%s: %v", n, err)
+				break
+			}
+			certs = append(certs, cs)
+			found = true
+			break
+		}
+		if !found {
+			verbose("certificate %s: no matching key", n)
+		}
+	}
+	return certs
+}
+
+// keys returns the keys to offer: those held by the agent, if
+// there is one, then the certificates for, and the usable keys in,
+// files. certs names more certificate files. Files need not be
+// usable if the agent has keys.
+func keys(a *sshAgent, files, certs []string) ([]ossh.Signer, error) {
+	signers := a.signers()
+	s, err := loadKeys(files)
+	if err != nil && len(signers) == 0 {
+		return nil, err
+	}
+	for _, n := range files {
+		if _, err := os.Stat(n + "-cert.pub"); err == nil {
+			certs = append(certs, n+"-cert.pub")
+		}
+	}
+	signers = append(signers, certSigners(s, certs)...)
+	return append(signers, s...), nil
+}
+
+// withKeys sets up public key authentication with the keys held
+// by the agent, if there is one, and the keys and certificates in
+// files and certs. All keys are offered, agent keys first, until one
+// is accepted. It is an error if there are no keys. The agent must
+// not be closed until the client has connected.
+func withKeys(a *sshAgent, files, certs []string) client.Set {
+	return func(c *client.Cmd) error {
+		signers, err := keys(a, files, certs)
+		if err != nil {
+			return err
+		}
+		// ssh only tries one method of each kind, so all
+		// the keys must be in the one method.
+		return client.WithAuth(ossh.PublicKeys(signers...))(c)
+	}
+}
+
+// passwordPrompts returns a function which asks for a secret
+// with prompt, and fails once it has been asked passwordTries times.
+func passwordPrompts(what, dest string) func(prompt string) (string, error) {
+	tries := 0
+	return func(prompt string) (string, error) {
+		if tries >= passwordTries {
+			return "", fmt.Errorf("%s: %d bad %ss", dest, passwordTries, what)
+		}
+		tries++
+		b, err := askSecret(prompt)
+		return string(b), err
+	}
+}
+
+// passwordAuth returns password and keyboard-interactive auth
+// methods, which ask for secrets up to passwordTries times.
+func passwordAuth(user, host string) []ossh.AuthMethod {
+	dest := user + "@" + host
+	password := passwordPrompts("password", dest)
+	answer := passwordPrompts("keyboard-interactive answer", dest)
+	return []ossh.AuthMethod{
+		ossh.RetryableAuthMethod(ossh.PasswordCallback(func() (string, error) {
+			return password(dest + "'s password: ")
+		}), 0),
+		ossh.RetryableAuthMethod(ossh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i, q := range questions {
+				a, err := answer(fmt.Sprintf("(%s) %s", dest, q))
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = a
+			}
+			return answers, nil
+		}), 0),
+	}
+}
+
+// withPassword sets up password and keyboard-interactive
+// authentication, which are tried if no key is accepted.
+func withPassword(user, host string) client.Set {
+	return client.WithAuth(passwordAuth(user, host)...)
+}
@@ -0,0 +1,504 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testKey writes a new private key to a file, and returns its name.
+func testKey(t *testing.T) string {
+	t.Helper()
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	b, err := ossh.MarshalPrivateKey(k, "")
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey: %v != nil", err)
+	}
+	n := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(n, pem.EncodeToMemory(b), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestLoadKeys(t *testing.T) {
+	d := t.TempDir()
+	good := testKey(t)
+	bad := filepath.Join(d, "bad")
+	if err := os.WriteFile(bad, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(d, "missing")
+
+	s, err := loadKeys([]string{missing, bad, good})
+	if err != nil {
+		t.Fatalf("loadKeys(%q, %q, %q): %v != nil", missing, bad, good, err)
+	}
+	if len(s) != 1 {
+		t.Errorf("loadKeys(%q, %q, %q): %d keys != 1", missing, bad, good, len(s))
+	}
+
+	_, err = loadKeys([]string{missing, bad})
+	if err == nil {
+		t.Fatalf("loadKeys(%q, %q): nil != an error", missing, bad)
+	}
+	for _, n := range []string{missing, bad} {
+		if !strings.Contains(err.Error(), n) {
+			t.Errorf("error %q does not name %q", err, n)
+		}
+	}
+}
+
+// testAgent starts an ssh-agent holding one new key, sets
+// SSH_AUTH_SOCK to it, and returns the key's public half.
+func testAgent(t *testing.T) ossh.PublicKey {
+	t.Helper()
+	pub, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	kr := agent.NewKeyring()
+	if err := kr.Add(agent.AddedKey{PrivateKey: k}); err != nil {
+		t.Fatalf("Add: %v != nil", err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("Listen(unix, %q): %v", sock, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				agent.ServeAgent(kr, c)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	p, err := ossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v != nil", err)
+	}
+	return p
+}
+
+func TestKeysAgent(t *testing.T) {
+	pub := testAgent(t)
+	good := testKey(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	a := dialAgent()
+	if a == nil {
+		t.Fatalf("dialAgent: nil != an agent")
+	}
+	defer a.Close()
+
+	s, err := keys(a, []string{good}, nil)
+	if err != nil {
+		t.Fatalf("keys(agent, %q): %v != nil", good, err)
+	}
+	if len(s) != 2 {
+		t.Fatalf("keys(agent, %q): %d keys != 2", good, len(s))
+	}
+	if got, want := s[0].PublicKey().Marshal(), pub.Marshal(); string(got) != string(want) {
+		t.Errorf("keys(agent, %q): first key is not the agent's", good)
+	}
+
+	// The agent's keys are enough.
+	if s, err := keys(a, []string{missing}, nil); err != nil || len(s) != 1 {
+		t.Errorf("keys(agent, %q): (%d keys, %v) != (1 key, nil)", missing, len(s), err)
+	}
+
+	// Without an agent, the files must be usable.
+	if _, err := keys(nil, []string{missing}, nil); err == nil {
+		t.Errorf("keys(nil, %q): nil != an error", missing)
+	}
+}
+
+func TestDialAgent(t *testing.T) {
+	testAgent(t)
+	*noAgent = true
+	defer func() { *noAgent = false }()
+	if a := dialAgent(); a != nil {
+		a.Close()
+		t.Errorf("dialAgent with -no-agent: %v != nil", a)
+	}
+	*noAgent = false
+
+	t.Setenv("SSH_AUTH_SOCK", filepath.Join(t.TempDir(), "gone"))
+	if a := dialAgent(); a != nil {
+		a.Close()
+		t.Errorf("dialAgent with no agent listening: %v != nil", a)
+	}
+
+	// A nil agent has no keys, and closes.
+	var a *sshAgent
+	if s := a.signers(); len(s) != 0 {
+		t.Errorf("nil agent: %d keys != 0", len(s))
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("nil agent Close: %v != nil", err)
+	}
+}
+
+// testEncryptedKey writes a new private key, encrypted with
+// passphrase, to a file, and returns its name.
+func testEncryptedKey(t *testing.T, passphrase string) string {
+	t.Helper()
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	b, err := ossh.MarshalPrivateKeyWithPassphrase(k, "", []byte(passphrase))
+	if err != nil {
+		t.Fatalf("MarshalPrivateKeyWithPassphrase: %v != nil", err)
+	}
+	n := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(n, pem.EncodeToMemory(b), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// setSecrets makes askSecret return each of secrets in
+// turn, and returns a count of the times it was called.
+func setSecrets(t *testing.T, secrets ...string) *int {
+	t.Helper()
+	old := askSecret
+	t.Cleanup(func() { askSecret = old })
+	n := new(int)
+	askSecret = func(string) ([]byte, error) {
+		if *n >= len(secrets) {
+			return nil, fmt.Errorf("no more secrets:%w", os.ErrNotExist)
+		}
+		*n++
+		return []byte(secrets[*n-1]), nil
+	}
+	return n
+}
+
+func TestLoadKeyPassphrase(t *testing.T) {
+	kf := testEncryptedKey(t, "sesame")
+	asked := setSecrets(t, "wrong", "sesame")
+	if _, err := loadKey(kf); err != nil {
+		t.Fatalf("loadKey(%q): %v != nil", kf, err)
+	}
+	if *asked != 2 {
+		t.Errorf("passphrase asked for %d times != 2", *asked)
+	}
+	// The key is only decrypted once.
+	if _, err := loadKey(kf); err != nil {
+		t.Fatalf("loadKey(%q) again: %v != nil", kf, err)
+	}
+	if *asked != 2 {
+		t.Errorf("passphrase asked for %d times != 2", *asked)
+	}
+
+	kf = testEncryptedKey(t, "sesame")
+	asked = setSecrets(t, "a", "b", "c", "sesame")
+	if _, err := loadKey(kf); !errors.Is(err, x509.IncorrectPasswordError) {
+		t.Errorf("loadKey(%q) with bad passphrases: %v != %v", kf, err, x509.IncorrectPasswordError)
+	}
+	if *asked != passphraseTries {
+		t.Errorf("passphrase asked for %d times != %d", *asked, passphraseTries)
+	}
+}
+
+func TestAskPass(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("no sh on %s", runtime.GOOS)
+	}
+	p := filepath.Join(t.TempDir(), "askpass")
+	if err := os.WriteFile(p, []byte("#!/bin/sh\necho \"sesame for $1\"\necho ignored\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSH_ASKPASS", p)
+	b, err := askPass("key")
+	if err != nil {
+		t.Fatalf("askPass: %v != nil", err)
+	}
+	if string(b) != "sesame for key" {
+		t.Errorf("askPass: %q != %q", b, "sesame for key")
+	}
+
+	t.Setenv("SSH_ASKPASS", "")
+	if _, err := askPass("key"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("askPass with no SSH_ASKPASS: %v != %v", err, os.ErrNotExist)
+	}
+}
+
+// testPasswordLogin logs in to an ssh server which only accepts
+// the secret, with password or keyboard-interactive authentication.
+func testPasswordLogin(t *testing.T, interactive bool, secret string) error {
+	t.Helper()
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	hk, err := ossh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v != nil", err)
+	}
+	cfg := &ossh.ServerConfig{}
+	if interactive {
+		cfg.KeyboardInteractiveCallback = func(_ ossh.ConnMetadata, ask ossh.KeyboardInteractiveChallenge) (*ossh.Permissions, error) {
+			a, err := ask("", "", []string{"Password: "}, []bool{false})
+			if err != nil || len(a) != 1 || a[0] != secret {
+				return nil, fmt.Errorf("wrong answer")
+			}
+			return nil, nil
+		}
+	} else {
+		cfg.PasswordCallback = func(_ ossh.ConnMetadata, pw []byte) (*ossh.Permissions, error) {
+			if string(pw) != secret {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		}
+	}
+	cfg.AddHostKey(hk)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v != nil", err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		ossh.NewServerConn(s, cfg)
+	}()
+	c, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v != nil", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	cc, _, _, err := ossh.NewClientConn(c, "cpu", &ossh.ClientConfig{
+		User:            "glenda",
+		Auth:            passwordAuth("glenda", "cpu"),
+		HostKeyCallback: ossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		cc.Close()
+	}
+	return err
+}
+
+func TestPasswordAuth(t *testing.T) {
+	for _, interactive := range []bool{false, true} {
+		asked := setSecrets(t, "wrong", "sesame")
+		if err := testPasswordLogin(t, interactive, "sesame"); err != nil {
+			t.Errorf("interactive %v: login: %v != nil", interactive, err)
+		}
+		if *asked != 2 {
+			t.Errorf("interactive %v: asked %d times != 2", interactive, *asked)
+		}
+
+		asked = setSecrets(t, "a", "b", "c", "sesame")
+		err := testPasswordLogin(t, interactive, "sesame")
+		if err == nil || !strings.Contains(err.Error(), "3 bad") {
+			t.Errorf("interactive %v: login with bad secrets: %v != an error about 3 bad tries", interactive, err)
+		}
+		if *asked != passwordTries {
+			t.Errorf("interactive %v: asked %d times != %d", interactive, *asked, passwordTries)
+		}
+	}
+}
+
+// testCert writes a certificate for the key in kf, signed by a
+// new CA and valid from after to before, to n.
+func testCert(t *testing.T, kf, n string, after, before time.Time) {
+	t.Helper()
+	s, err := loadKey(kf)
+	if err != nil {
+		t.Fatalf("loadKey(%q): %v != nil", kf, err)
+	}
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	ca, err := ossh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v != nil", err)
+	}
+	c := &ossh.Certificate{
+		Key:             s.PublicKey(),
+		Serial:          42,
+		CertType:        ossh.UserCert,
+		KeyId:           "glenda",
+		ValidPrincipals: []string{"glenda"},
+		ValidAfter:      uint64(after.Unix()),
+		ValidBefore:     uint64(before.Unix()),
+	}
+	if err := c.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("SignCert: %v != nil", err)
+	}
+	if err := os.WriteFile(n, ossh.MarshalAuthorizedKey(c), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeysCert(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	now := time.Now()
+	kf := testKey(t)
+	testCert(t, kf, kf+"-cert.pub", now.Add(-time.Hour), now.Add(time.Hour))
+	s, err := keys(nil, []string{kf}, nil)
+	if err != nil {
+		t.Fatalf("keys(%q): %v != nil", kf, err)
+	}
+	if len(s) != 2 {
+		t.Fatalf("keys(%q): %d keys != 2", kf, len(s))
+	}
+	if c, ok := s[0].PublicKey().(*ossh.Certificate); !ok || c.Serial != 42 {
+		t.Errorf("keys(%q): first key is %T, not the certificate", kf, s[0].PublicKey())
+	}
+
+	// A certificate named in ~/.ssh/config need not be next to the key.
+	kf = testKey(t)
+	cf := filepath.Join(t.TempDir(), "cert")
+	testCert(t, kf, cf, now.Add(-time.Hour), now.Add(time.Hour))
+	if s, err := keys(nil, []string{kf}, []string{cf}); err != nil || len(s) != 2 {
+		t.Errorf("keys(%q, %q): (%d keys, %v) != (2 keys, nil)", kf, cf, len(s), err)
+	}
+
+	// A certificate for another key is not used.
+	if s, err := keys(nil, []string{testKey(t)}, []string{cf}); err != nil || len(s) != 1 {
+		t.Errorf("keys(other key, %q): (%d keys, %v) != (1 key, nil)", cf, len(s), err)
+	}
+}
+
+func TestLoadCertValidity(t *testing.T) {
+	now := time.Now()
+	kf := testKey(t)
+	d := t.TempDir()
+	for _, tt := range []struct {
+		name          string
+		after, before time.Time
+		err           string
+	}{
+		{name: "valid", after: now.Add(-time.Hour), before: now.Add(time.Hour)},
+		{name: "expired", after: now.Add(-2 * time.Hour), before: now.Add(-time.Hour), err: "certificate expired"},
+		{name: "early", after: now.Add(time.Hour), before: now.Add(2 * time.Hour), err: "certificate is not valid until"},
+	} {
+		n := filepath.Join(d, tt.name)
+		testCert(t, kf, n, tt.after, tt.before)
+		_, err := loadCert(n)
+		if len(tt.err) == 0 {
+			if err != nil {
+				t.Errorf("%s: loadCert: %v != nil", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: loadCert: %v != an error containing %q", tt.name, err, tt.err)
+		}
+	}
+	if _, err := loadCert(kf); err == nil {
+		t.Errorf("loadCert(private key): nil != an error")
+	}
+}
+
+// testSKKey returns a security key public key.
+func testSKKey(t *testing.T) ossh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	k, err := ossh.ParsePublicKey(ossh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{Name: ossh.KeyAlgoSKED25519, KeyBytes: pub, Application: "ssh:"}))
+	if err != nil {
+		t.Fatalf("ParsePublicKey: %v != nil", err)
+	}
+	return k
+}
+
+// touchSigner is a security key which signs when touched.
+type touchSigner struct {
+	pub     ossh.PublicKey
+	touched chan struct{}
+}
+
+func (s *touchSigner) PublicKey() ossh.PublicKey { return s.pub }
+
+func (s *touchSigner) Sign(rand io.Reader, data []byte) (*ossh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, s.pub.Type())
+}
+
+func (s *touchSigner) SignWithAlgorithm(_ io.Reader, _ []byte, algorithm string) (*ossh.Signature, error) {
+	<-s.touched
+	return &ossh.Signature{Format: algorithm}, nil
+}
+
+func TestSKSigner(t *testing.T) {
+	k := testSKKey(t)
+	if !isSecurityKey(k) {
+		t.Fatalf("isSecurityKey(%s): false != true", k.Type())
+	}
+	old := skTouchTimeout
+	skTouchTimeout = 10 * time.Millisecond
+	defer func() { skTouchTimeout = old }()
+
+	ts := &touchSigner{pub: k, touched: make(chan struct{})}
+	s := &skSigner{AlgorithmSigner: ts}
+	if _, err := s.Sign(rand.Reader, nil); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Sign, not touched: %v != %v", err, os.ErrDeadlineExceeded)
+	}
+	close(ts.touched)
+	skTouchTimeout = 5 * time.Second
+	sig, err := s.SignWithAlgorithm(rand.Reader, nil, ossh.KeyAlgoSKED25519)
+	if err != nil {
+		t.Fatalf("SignWithAlgorithm, touched: %v != nil", err)
+	}
+	if sig.Format != ossh.KeyAlgoSKED25519 {
+		t.Errorf("signature format: %q != %q", sig.Format, ossh.KeyAlgoSKED25519)
+	}
+}
+
+func TestLoadKeySecurityKey(t *testing.T) {
+	n := filepath.Join(t.TempDir(), "id_ed25519_sk")
+	if err := os.WriteFile(n, []byte("a key only the agent can use"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(n+".pub", ossh.MarshalAuthorizedKey(testSKKey(t)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadKey(n)
+	if err == nil || !strings.Contains(err.Error(), "ssh-add") {
+		t.Errorf("loadKey(%q): %v != an error about ssh-add", n, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// sidecore build makes a container in SIDECORE_IMAGES from an image,
+// e.g. sidecore build -from docker.io/library/alpine:3.20 -arch arm64
+// makes arm64-alpine@3.20.cpio. The image is exported with podman or
+// docker, whichever is installed, or else pulled from its registry, as
+// an oci:// container is, and flattened into a cpio.
+
+// buildTools are the tools which can export an image, in the order
+// they are looked for.
+var buildTools = []string{"podman", "docker"}
+
+// ociTool is the -tool which pulls the image from its registry.
+const ociTool = "oci"
+
+// buildChecks are paths a rootfs has. A container without them is
+// a warning, since it may not be one.
+var buildChecks = []string{"bin", "etc", "usr"}
+
+// buildTool returns the tool -tool t asks for: the path of podman or
+// docker, or oci. If it is not set, it is the first of buildTools which
+// is installed, or, if neither is, oci.
+func buildTool(t string) (string, error) {
+	switch t {
+	case ociTool:
+		return t, nil
+	case "":
+		for _, b := range buildTools {
+			if p, err := exec.LookPath(b); err == nil {
+				return p, nil
+			}
+		}
+		return ociTool, nil
+	}
+	for _, b := range buildTools {
+		if t == b {
+			p, err := exec.LookPath(t)
+			if err != nil {
+				return "", fmt.Errorf("-tool %s: %w", t, err)
+			}
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("-tool %s: want %s or %s:%w", t, strings.Join(buildTools, ", "), ociTool, os.ErrInvalid)
+}
+
+// runTool runs a tool, and returns its output. Its errors are on its
+// stderr, which is in the error.
+func runTool(tool string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if s := strings.TrimSpace(stderr.String()); len(s) > 0 {
+			return "", fmt.Errorf("%s %s: %v: %s", tool, args[0], err, s)
+		}
+		return "", fmt.Errorf("%s %s: %w", tool, args[0], err)
+	}
+	return string(out), nil
+}
+
+// exportImage makes a container of an image, for arch, with a tool,
+// which pulls the image, if it does not have it, and exports the
+// container's rootfs, as a tar, which is flattened into dst.
+func exportImage(tool, image, arch, dst string) error {
+	name := filepath.Base(tool)
+	info("%s: creating a container of %s for linux/%s", name, image, arch)
+	// The container is never started, so the command, which an
+	// image with no entrypoint needs, is never run.
+	out, err := runTool(tool, "create", "--platform", "linux/"+arch, image, "/bin/sh")
+	if err != nil {
+		return err
+	}
+	lines := strings.Fields(out)
+	if len(lines) == 0 {
+		return fmt.Errorf("%s create: no container ID:%w", name, os.ErrInvalid)
+	}
+	id := lines[len(lines)-1]
+	// The container is removed, even if sidecore is stopped.
+	var removed bool
+	remove := func() {
+		if removed {
+			return
+		}
+		removed = true
+		if _, err := runTool(tool, "rm", id); err != nil {
+			info("warning: %v", err)
+		}
+	}
+	atExit(remove)
+	defer remove()
+
+	info("%s: exporting %s into %s", name, id, dst)
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool, "export", id)
+	cmd.Stderr = &stderr
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = flattenImage([]io.Reader{r}, dst)
+	// The rest of the tar, if flattening failed, is not wanted.
+	io.Copy(io.Discard, r)
+	if werr := cmd.Wait(); werr != nil {
+		if s := strings.TrimSpace(stderr.String()); len(s) > 0 {
+			werr = fmt.Errorf("%v: %s", werr, s)
+		}
+		return fmt.Errorf("%s export: %w", name, werr)
+	}
+	return err
+}
+
+// verifyBuild opens a container, as it will be served, and checks its
+// root is a directory. The paths of buildChecks it does not have are
+// a warning.
+func verifyBuild(c string) error {
+	fs, err := NewfsCPIO(c)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c, err)
+	}
+	fi, err := fs.Stat(".")
+	if err != nil {
+		return fmt.Errorf("%s: %w", c, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: its root is not a directory:%w", c, os.ErrInvalid)
+	}
+	var missing []string
+	for _, p := range buildChecks {
+		if _, err := fs.Lstat(p); err != nil {
+			missing = append(missing, "/"+p)
+		}
+	}
+	if len(missing) > 0 {
+		info("warning: %s has no %s; is it a rootfs?", c, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// buildImage builds the container of an image, for arch, with tool, as
+// buildTool finds it, and returns it. An existing container is an
+// error, unless force is set.
+func buildImage(from, arch, tool string, force bool) (string, error) {
+	image := strings.TrimPrefix(from, ociPrefix)
+	ref, err := parseOCIRef(image)
+	if err != nil {
+		return "", fmt.Errorf("sidecore build: -from %w", err)
+	}
+	t, err := buildTool(tool)
+	if err != nil {
+		return "", fmt.Errorf("sidecore build: %w", err)
+	}
+	dst, _ := searchContainer(ref.container(arch))
+	if _, err := os.Stat(dst); err == nil {
+		if !force {
+			return "", fmt.Errorf("sidecore build: %s exists; -force overwrites it:%w", dst, os.ErrExist)
+		}
+		// What was kept beside it is of the container it replaces.
+		if err := os.Remove(dst + ".digest"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("sidecore build: %w", err)
+		}
+		if _, err := os.Stat(dst + ".sha256"); err == nil {
+			info("warning: %s.sha256 is the sum of the container it replaces; update, or remove, it", dst)
+		}
+	}
+	if t == ociTool {
+		info("%s%s: pulling for %s", ociPrefix, image, arch)
+		if _, err := pullImage(image, arch, true); err != nil {
+			return "", fmt.Errorf("sidecore build: %w", err)
+		}
+	} else if err := exportImage(t, image, arch, dst); err != nil {
+		return "", fmt.Errorf("sidecore build: %w", err)
+	}
+	if err := verifyBuild(dst); err != nil {
+		return "", fmt.Errorf("sidecore build: %w", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return "", fmt.Errorf("sidecore build: %w", err)
+	}
+	info("built %s, %s", dst, humanSize(fi.Size()))
+	return dst, nil
+}
+
+// buildCommand is sidecore build.
+func buildCommand(args []string) error {
+	usage := fmt.Errorf("usage: sidecore build -from image [-arch arch] [-tool podman|docker|oci] [-force]:%w", os.ErrInvalid)
+	f := flag.NewFlagSet("sidecore build", flag.ContinueOnError)
+	from := f.String("from", "", "image to build the container from, e.g. docker.io/library/alpine:3.20")
+	arch := f.String("arch", envOrDefault("SIDECORE_ARCH", runtime.GOARCH), "arch of the container")
+	tool := f.String("tool", "", "podman or docker, to export the image with, or oci, to pull it from its registry; the default is podman or docker, whichever is installed, or else oci")
+	force := f.Bool("force", false, "overwrite the container, if there is one")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() > 0 || len(*from) == 0 {
+		return usage
+	}
+	exitOnSignal()
+	_, err := buildImage(*from, *arch, *tool, *force)
+	return err
+}
@@ -0,0 +1,115 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// fakeDocker installs a docker which exports rootfs, a tar, and keeps
+// its arguments in dir/args.
+func fakeDocker(t *testing.T, rootfs []byte) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake docker is a shell script")
+	}
+	d := t.TempDir()
+	if err := os.WriteFile(filepath.Join(d, "rootfs.tar"), rootfs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+echo "$@" >> ` + filepath.Join(d, "args") + `
+case $1 in
+create) echo "Pulling" >&2; echo 0123abcd;;
+export) cat ` + filepath.Join(d, "rootfs.tar") + `;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(d, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", d+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	return d
+}
+
+func TestBuild(t *testing.T) {
+	images := t.TempDir()
+	t.Setenv("SIDECORE_IMAGES", images)
+	d := fakeDocker(t, layer(t, false,
+		tarFile{name: "./", typ: tar.TypeDir},
+		tarFile{name: "bin/busybox", body: "busybox", typ: tar.TypeReg},
+		tarFile{name: "bin/sh", link: "bin/busybox", typ: tar.TypeLink},
+		tarFile{name: "etc/os-release", body: "ID=alpine\n", typ: tar.TypeReg},
+		tarFile{name: "usr/bin/env", link: "/bin/busybox", typ: tar.TypeSymlink},
+	))
+	img := "docker.io/library/alpine:3.20"
+	want := filepath.Join(images, "arm64-alpine@3.20.cpio")
+	if c, err := buildImage(img, "arm64", "docker", false); err != nil || c != want {
+		t.Fatalf("buildImage(%s, arm64, docker): %q, %v != %q, nil", img, c, err, want)
+	}
+	names, body := cpioFiles(t, want)
+	wantNames := []string{".", "bin", "bin/busybox", "bin/sh", "etc", "etc/os-release", "usr", "usr/bin", "usr/bin/env"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("files: %q != %q", names, wantNames)
+	}
+	for n, b := range map[string]string{"bin/sh": "busybox", "usr/bin/env": "/bin/busybox"} {
+		if body[n] != b {
+			t.Errorf("%s: %q != %q", n, body[n], b)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(d, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantArgs := "create --platform linux/arm64 " + img + " /bin/sh\nexport 0123abcd\nrm 0123abcd\n"
+	if string(b) != wantArgs {
+		t.Errorf("docker was run as %q, not %q", b, wantArgs)
+	}
+
+	// It is not overwritten, without -force.
+	if _, err := buildImage(img, "arm64", "docker", false); !errors.Is(err, os.ErrExist) {
+		t.Errorf("buildImage(%s) again: %v != %v", img, err, os.ErrExist)
+	}
+	if err := os.WriteFile(want+".digest", []byte("sha256:old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildImage(img, "arm64", "docker", true); err != nil {
+		t.Errorf("buildImage(%s), forced: %v != nil", img, err)
+	}
+	if _, err := os.Stat(want + ".digest"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("buildImage(%s), forced: %s.digest: %v != %v", img, want, err, os.ErrNotExist)
+	}
+}
+
+func TestBuildBad(t *testing.T) {
+	t.Setenv("SIDECORE_IMAGES", t.TempDir())
+	for _, args := range [][]string{
+		nil,
+		{"-from", "alpine", "extra"},
+		{"-arch", "arm64"},
+	} {
+		if err := buildCommand(args); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("sidecore build %q: %v != %v", args, err, os.ErrInvalid)
+		}
+	}
+	for _, tt := range []struct{ from, tool string }{
+		{from: "/alpine", tool: "docker"},
+		{from: "alpine", tool: "lxc"},
+	} {
+		if _, err := buildImage(tt.from, "amd64", tt.tool, false); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("buildImage(%s, amd64, %s): %v != %v", tt.from, tt.tool, err, os.ErrInvalid)
+		}
+	}
+	// What docker exports must be a tar.
+	fakeDocker(t, []byte("not a tar"))
+	if _, err := buildImage("alpine", "amd64", "docker", false); err == nil {
+		t.Errorf("buildImage(alpine), with no tar exported: nil != an error")
+	}
+}
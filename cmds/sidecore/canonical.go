@@ -0,0 +1,55 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"net"
+	"strings"
+)
+
+// With -canonicalize, a short host name, e.g. buildbox, is made a
+// full one, e.g. buildbox.corp.example.com, before it is looked up
+// in ~/.ssh/config and the config file, as ssh does with
+// CanonicalizeHostname, so that Host *.corp.example.com matches it.
+var (
+	canonicalize     = flag.Bool("canonicalize", false, "make short host names full ones, with -canonical-domains, before looking them up in ~/.ssh/config")
+	canonicalDomains = flag.String("canonical-domains", "", "comma-separated domains for -canonicalize to try, in order; the default is CanonicalDomains in ~/.ssh/config")
+	canonicalMaxDots = flag.Int("canonical-max-dots", 1, "with -canonicalize, names with more dots than this are already full")
+)
+
+// resolveHost looks up a host name, to check that a canonical name
+// exists. Tests replace it.
+var resolveHost = net.LookupHost
+
+// canonicalHost returns the full name of host: the first of host.d,
+// for each of domains, which resolves. A name with more than maxDots
+// dots, or ending in one, an address, or a name which does not
+// resolve in any of the domains, is returned as it is, as ssh does
+// with CanonicalizeFallbackLocal yes.
+func canonicalHost(host string, domains []string, maxDots int) string {
+	if strings.HasSuffix(host, ".") || strings.Count(host, ".") > maxDots || net.ParseIP(host) != nil {
+		return host
+	}
+	for _, d := range domains {
+		n := host + "." + strings.Trim(d, ".")
+		if _, err := resolveHost(n); err != nil {
+			verbose("canonicalize %s: %v", n, err)
+			continue
+		}
+		verbose("canonicalize %s: %s", host, n)
+		return n
+	}
+	return host
+}
+
+// canonicalDomainList returns the domains of -canonical-domains, or,
+// if it is not set, of CanonicalDomains in ~/.ssh/config for host.
+func canonicalDomainList(host string) []string {
+	if len(*canonicalDomains) > 0 {
+		return strings.FieldsFunc(*canonicalDomains, func(r rune) bool { return r == ',' })
+	}
+	return strings.Fields(sshConfig.Get(host, "CanonicalDomains"))
+}
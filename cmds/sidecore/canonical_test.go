@@ -0,0 +1,56 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalHost(t *testing.T) {
+	defer func(r func(string) ([]string, error)) { resolveHost = r }(resolveHost)
+	resolveHost = func(n string) ([]string, error) {
+		switch n {
+		case "buildbox.corp.example.com", "rpi.lab.example.com", "rpi.example.com":
+			return []string{"10.0.0.1"}, nil
+		}
+		return nil, fmt.Errorf("%s:%w", n, os.ErrNotExist)
+	}
+	domains := []string{"lab.example.com", "corp.example.com.", "example.com"}
+	for _, tt := range []struct {
+		host    string
+		maxDots int
+		want    string
+	}{
+		{host: "buildbox", maxDots: 1, want: "buildbox.corp.example.com"},
+		{host: "rpi", maxDots: 1, want: "rpi.lab.example.com"},
+		{host: "nosuch", maxDots: 1, want: "nosuch"},
+		{host: "rpi.lab", maxDots: 1, want: "rpi.lab.example.com"},
+		{host: "rpi.lab", maxDots: 0, want: "rpi.lab"},
+		{host: "rpi", maxDots: 0, want: "rpi.lab.example.com"},
+		{host: "buildbox.", maxDots: 1, want: "buildbox."},
+		{host: "10.0.0.1", maxDots: 3, want: "10.0.0.1"},
+		{host: "fe80::1", maxDots: 1, want: "fe80::1"},
+	} {
+		if got := canonicalHost(tt.host, domains, tt.maxDots); got != tt.want {
+			t.Errorf("canonicalHost(%q, %d): %q != %q", tt.host, tt.maxDots, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalDomainList(t *testing.T) {
+	defer func(d string) { *canonicalDomains = d }(*canonicalDomains)
+	setSSHConfig(t, "Host *\n\tCanonicalDomains lab.example.com corp.example.com\n")
+	*canonicalDomains = ""
+	if got, want := canonicalDomainList("buildbox"), []string{"lab.example.com", "corp.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("canonicalDomainList, from ~/.ssh/config: %q != %q", got, want)
+	}
+	*canonicalDomains = "example.org,,example.net"
+	if got, want := canonicalDomainList("buildbox"), []string{"example.org", "example.net"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("canonicalDomainList, -canonical-domains: %q != %q", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A cpio container may be compressed, with gzip, zstd or xz, as most
+// distro rootfs archives are. It is decompressed once, into the cache,
+// and the copy is used until the container changes. gzip is done here;
+// zstd and xz need the zstd or xz command.
+
+// compression is a format a container may be compressed with.
+type compression struct {
+	name  string
+	magic []byte
+	// command decompresses stdin to stdout, if this does not.
+	command []string
+}
+
+var compressions = []compression{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, command: []string{"zstd", "-d", "-c", "-q"}},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0}, command: []string{"xz", "-d", "-c", "-q"}},
+}
+
+// compressedSuffixes are the suffixes compressed containers are named
+// with, e.g. amd64-ubuntu@latest.cpio.gz. They are only for names: how
+// a container is compressed is found from what is in it.
+var compressedSuffixes = []string{".gz", ".zst", ".xz"}
+
+// trimCompressedSuffix returns a name without its compressed suffix.
+func trimCompressedSuffix(n string) string {
+	for _, s := range compressedSuffixes {
+		if t, ok := strings.CutSuffix(n, s); ok {
+			return t
+		}
+	}
+	return n
+}
+
+// sniffCompression returns how a file is compressed, if it is.
+func sniffCompression(f io.ReaderAt) (compression, bool) {
+	b := make([]byte, 6)
+	n, _ := f.ReadAt(b, 0)
+	for _, c := range compressions {
+		if bytes.HasPrefix(b[:n], c.magic) {
+			return c, true
+		}
+	}
+	return compression{}, false
+}
+
+// decompressedDir returns the directory decompressed containers are
+// kept in.
+func decompressedDir() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "sidecore", "cpio"), nil
+}
+
+// decompressedName returns the name of the decompressed copy of a
+// container, and the prefix which its copies, as it was before it
+// changed, share. The name has its size and mtime in it, so a changed
+// container has a new one.
+func decompressedName(c string, fi os.FileInfo) (string, string, error) {
+	p, err := filepath.Abs(c)
+	if err != nil {
+		return "", "", err
+	}
+	ps := sha256.Sum256([]byte(p))
+	prefix := hex.EncodeToString(ps[:8]) + "-"
+	ks := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", p, fi.Size(), fi.ModTime().UnixNano())))
+	return prefix + hex.EncodeToString(ks[:8]) + ".cpio", prefix, nil
+}
+
+var decompressMu sync.Mutex
+
+// uncompressed returns the path of a container's cpio: the container,
+// if it is not compressed, or else its decompressed copy, which is
+// made, if there is none, and older copies removed.
+func uncompressed(c string) (string, error) {
+	f, err := os.Open(c)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	z, ok := sniffCompression(f)
+	if !ok {
+		return c, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	d, err := decompressedDir()
+	if err != nil {
+		return "", err
+	}
+	n, prefix, err := decompressedName(c, fi)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(d, n)
+
+	decompressMu.Lock()
+	defer decompressMu.Unlock()
+	if _, err := os.Stat(dst); err == nil {
+		verbose("%s: using %s", c, dst)
+		return dst, nil
+	}
+	if old, err := filepath.Glob(filepath.Join(d, prefix+"*.cpio")); err == nil {
+		for _, o := range old {
+			verbose("%s: removing %s, as it has changed", c, o)
+			os.Remove(o)
+		}
+	}
+	info("%s: decompressing %s to %s", c, z.name, dst)
+	if err := decompress(z, f, dst); err != nil {
+		return "", fmt.Errorf("%s: %s: %w", c, z.name, err)
+	}
+	return dst, nil
+}
+
+// decompress decompresses r into dst, which is only there once it is
+// whole.
+func decompress(z compression, r io.Reader, dst string) error {
+	d := filepath.Dir(dst)
+	if err := os.MkdirAll(d, 0755); err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(d, filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	atExit(func() { os.Remove(out.Name()) })
+	defer os.Remove(out.Name())
+	bw := bufio.NewWriter(out)
+	if z.command == nil {
+		err = gunzip(r, bw)
+	} else {
+		err = decompressCommand(z.command, r, bw)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// gunzip decompresses gzip, of one or more members, from r to w.
+func gunzip(r io.Reader, w io.Writer) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	_, err = io.Copy(w, zr)
+	return err
+}
+
+// decompressCommand decompresses r to w with a command, e.g. zstd -d.
+func decompressCommand(command []string, r io.Reader, w io.Writer) error {
+	p, err := exec.LookPath(command[0])
+	if err != nil {
+		return fmt.Errorf("%s is needed to decompress it: %w", command[0], err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(p, command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r, w, &stderr
+	if err := cmd.Run(); err != nil {
+		if s := strings.TrimSpace(stderr.String()); len(s) > 0 {
+			return fmt.Errorf("%v: %s", err, s)
+		}
+		return err
+	}
+	return nil
+}
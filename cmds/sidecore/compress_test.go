@@ -0,0 +1,120 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// testCompressed returns a cpio, compressed with a command, e.g.
+// gzip, which reads stdin and writes stdout.
+func testCompressed(t *testing.T, command ...string) string {
+	d := t.TempDir()
+	c := writeCPIO(t, d, "c.cpio", cpio.Directory(".", 0755), cpio.StaticFile("hi", "hi", 0644))
+	b, err := os.ReadFile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if command == nil {
+		w := gzip.NewWriter(&out)
+		w.Write(b)
+		w.Close()
+	} else {
+		if _, err := exec.LookPath(command[0]); err != nil {
+			t.Skipf("%s: %v", command[0], err)
+		}
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin, cmd.Stdout = bytes.NewReader(b), &out
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+	}
+	z := c + ".z"
+	if err := os.WriteFile(z, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestUncompressed(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		command []string
+	}{
+		{name: "gzip"},
+		{name: "zstd", command: []string{"zstd", "-c", "-q"}},
+		{name: "xz", command: []string{"xz", "-c", "-q"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			z := testCompressed(t, tt.command...)
+			f, err := NewfsCPIO(z)
+			if err != nil {
+				t.Fatalf("NewfsCPIO(%s): %v != nil", z, err)
+			}
+			h, err := f.Open("hi")
+			if err != nil {
+				t.Fatalf("Open(hi): %v != nil", err)
+			}
+			b := make([]byte, 8)
+			n, _ := h.ReadAt(b, 0)
+			if got := string(b[:n]); got != "hi" {
+				t.Errorf("hi: %q != %q", got, "hi")
+			}
+
+			u, err := uncompressed(z)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The copy is used, not made again.
+			if u2, err := uncompressed(z); err != nil || u2 != u {
+				t.Errorf("uncompressed(%s) again: %q, %v != %q, nil", z, u2, err, u)
+			}
+			if fi2, err := os.Stat(u); err != nil || !fi2.ModTime().Equal(fi.ModTime()) {
+				t.Errorf("uncompressed(%s) again: the copy was made again", z)
+			}
+			// A changed container has a new copy, and the old one goes.
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(z, later, later); err != nil {
+				t.Fatal(err)
+			}
+			u3, err := uncompressed(z)
+			if err != nil || u3 == u {
+				t.Errorf("uncompressed(%s), changed: %q, %v != a new copy, nil", z, u3, err)
+			}
+			if _, err := os.Stat(u); !os.IsNotExist(err) {
+				t.Errorf("uncompressed(%s), changed: the old copy, %s, is still there", z, u)
+			}
+		})
+	}
+}
+
+func TestUncompressedPlain(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	c := writeCPIO(t, t.TempDir(), "c.cpio", cpio.Directory(".", 0755))
+	if u, err := uncompressed(c); err != nil || u != c {
+		t.Errorf("uncompressed(%s): %q, %v != %q, nil", c, u, err, c)
+	}
+	d, err := decompressedDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(d)); !os.IsNotExist(err) {
+		t.Errorf("uncompressed(%s): %s was made for a cpio which is not compressed", c, d)
+	}
+}
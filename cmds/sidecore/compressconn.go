@@ -0,0 +1,93 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// compressRequest is the global request which asks cpud to compress
+// the connections of a forwarded port. golang.org/x/crypto/ssh can not
+// negotiate zlib for the transport, so, with -C, the nfs stream is
+// compressed instead. A cpud which does not know the request refuses
+// it, and the stream is then sent as it is.
+const compressRequest = "compress-forward@sidecore"
+
+// requester sends global requests; *ossh.Client is one.
+type requester interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+}
+
+// compressListener asks r to compress the connections forwarded to
+// port, and, if it will, returns a listener whose connections are
+// compressed; otherwise it returns l.
+func compressListener(r requester, l net.Listener, port uint16) net.Listener {
+	ok, _, err := r.SendRequest(compressRequest, true, ossh.Marshal(struct{ Port uint32 }{uint32(port)}))
+	if err != nil || !ok {
+		info("-C: cpud can not compress the nfs stream (%v); it is not compressed", err)
+		return l
+	}
+	verbose("-C: the nfs stream on port %d is compressed", port)
+	return &flateListener{Listener: l}
+}
+
+// flateListener is a net.Listener whose connections are flateConns.
+type flateListener struct {
+	net.Listener
+}
+
+// Accept implements net.Listener.
+func (l *flateListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newFlateConn(c), nil
+}
+
+// flateConn is a net.Conn which is deflated, in each direction. Each
+// Write is flushed, so an RPC is not held back waiting for the next.
+type flateConn struct {
+	net.Conn
+	r io.ReadCloser
+
+	mu sync.Mutex
+	w  *flate.Writer
+}
+
+// newFlateConn returns c, deflated.
+func newFlateConn(c net.Conn) *flateConn {
+	// flate.NewWriter only fails for a bad level.
+	w, _ := flate.NewWriter(c, flate.DefaultCompression)
+	return &flateConn{Conn: c, r: flate.NewReader(c), w: w}
+}
+
+// Read implements net.Conn.
+func (c *flateConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write implements net.Conn.
+func (c *flateConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// Close implements net.Conn. Each Write was flushed, so there is
+// nothing left to send; the stream ends with the connection.
+func (c *flateConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
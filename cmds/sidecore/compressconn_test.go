@@ -0,0 +1,134 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// countConn counts the bytes written to a net.Conn.
+type countConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// compressible is a payload much like a build's output: text, which
+// repeats itself.
+var compressible = []byte(strings.Repeat("ok  \tgithub.com/u-root/sidecore/cmds/sidecore\t3.077s\n", 1024))
+
+func TestFlateConn(t *testing.T) {
+	a, b := net.Pipe()
+	var wire int64
+	ca, cb := newFlateConn(countConn{Conn: a, n: &wire}), newFlateConn(b)
+	defer ca.Close()
+	defer cb.Close()
+
+	go func() {
+		// Each Write is flushed, so it can be read before the next.
+		ca.Write(compressible[:100])
+		ca.Write(compressible[100:])
+	}()
+	got := make([]byte, len(compressible))
+	if _, err := io.ReadFull(cb, got[:100]); err != nil {
+		t.Fatalf("Read of first Write: %v != nil", err)
+	}
+	if _, err := io.ReadFull(cb, got[100:]); err != nil {
+		t.Fatalf("Read of second Write: %v != nil", err)
+	}
+	if !bytes.Equal(got, compressible) {
+		t.Errorf("Read: %d bytes, not what was written", len(got))
+	}
+	if w := atomic.LoadInt64(&wire); w >= int64(len(compressible))/10 {
+		t.Errorf("%d bytes on the wire for %d: not compressed", w, len(compressible))
+	}
+}
+
+// fakeRequester answers global requests with ok, or err.
+type fakeRequester struct {
+	ok   bool
+	err  error
+	name string
+	port uint32
+}
+
+func (r *fakeRequester) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	r.name = name
+	var p struct{ Port uint32 }
+	if err := ossh.Unmarshal(payload, &p); err == nil {
+		r.port = p.Port
+	}
+	return r.ok, nil, r.err
+}
+
+func TestCompressListener(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		r    *fakeRequester
+		want bool
+	}{
+		{name: "accepted", r: &fakeRequester{ok: true}, want: true},
+		{name: "refused", r: &fakeRequester{}},
+		{name: "error", r: &fakeRequester{err: errors.New("closed")}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Skip(err)
+			}
+			defer l.Close()
+			got := compressListener(tt.r, l, 2049)
+			if tt.r.name != compressRequest || tt.r.port != 2049 {
+				t.Errorf("request %q, port %d != %q, 2049", tt.r.name, tt.r.port, compressRequest)
+			}
+			if _, ok := got.(*flateListener); ok != tt.want {
+				t.Errorf("compressed: %v != %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkFlateConn reports the bytes on the wire for a
+// compressible payload, written plain, and through a flateConn.
+func BenchmarkFlateConn(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		conn func(net.Conn) net.Conn
+	}{
+		{name: "plain", conn: func(c net.Conn) net.Conn { return c }},
+		{name: "flate", conn: func(c net.Conn) net.Conn { return newFlateConn(c) }},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			a, r := net.Pipe()
+			go io.Copy(io.Discard, r)
+			var wire int64
+			c := tt.conn(countConn{Conn: a, n: &wire})
+			b.SetBytes(int64(len(compressible)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Write(compressible); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&wire))/float64(b.N), "wire-B/op")
+			c.Close()
+			r.Close()
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The sidecore config file looks a lot like ssh_config(5).
+// Lines are "Keyword value"; keywords are case-insensitive;
+// # starts a comment. Options that appear before the first
+// Host line are defaults for every host. Host lines take one
+// or more patterns, using the * and ? wildcards, and the options
+// that follow apply to hosts matching any of the patterns. For
+// a given host, the first value found wins, and host sections
+// are checked before the defaults. Command-line flags override
+// everything in the file.
+//
+// An example:
+//
+//	Network tcp
+//	Namespace /lib;/lib64;/usr;/bin;/etc;/home
+//
+//	Host rpi* arm-lab
+//		Port 17011
+//		KeyFile ~/.ssh/lab_rsa
+//		Container ~/sidecore-images/arm64-alpine@latest.cpio
+
+// hostKeywords are the keywords which may be set per host,
+// the flag, if any, which overrides them, and how they are
+// set in a cpu.
+var hostKeywords = map[string]struct {
+	flag string
+	set  func(*cpu, string)
+}{
+	"port": {flag: "sp", set: func(c *cpu, v string) {
+		// A port found by dnssd wins.
+		if len(c.port) == 0 {
+			c.port = v
+		}
+	}},
+	"keyfile":     {set: func(c *cpu, v string) { c.keyfiles = []string{v} }},
+	"hostkeyfile": {set: func(c *cpu, v string) { c.hostkey = v }},
+	"namespace":   {flag: "namespace", set: func(c *cpu, v string) { c.namespace = v }},
+	"container":   {set: func(c *cpu, v string) { c.container = v }},
+}
+
+// globalKeywords may only be set as defaults, and map to flags.
+var globalKeywords = map[string]string{
+	"network":   "net",
+	"root":      "root",
+	"timeout9p": "timeout9p",
+	"9p":        "9p",
+	"nfs":       "nfs",
+	"overlay":   "overlay",
+}
+
+// hostSection is a Host block in the config file.
+type hostSection struct {
+	patterns []string
+	opts     map[string]string
+}
+
+// sidecoreConfig is a parsed config file.
+type sidecoreConfig struct {
+	defaults map[string]string
+	hosts    []hostSection
+}
+
+// defaultConfigFile returns the path of the per-user config file.
+func defaultConfigFile() string {
+	d, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(d, "sidecore", "config")
+}
+
+// loadConfig reads the config file n. If n is empty, the default
+// file is used, and it not existing is not an error.
+func loadConfig(n string) (*sidecoreConfig, error) {
+	explicit := len(n) > 0
+	if !explicit {
+		n = defaultConfigFile()
+	}
+	f, err := os.Open(n)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return &sidecoreConfig{defaults: map[string]string{}}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return parseConfig(f, n)
+}
+
+// parseConfig parses a config file from r. The name is only used
+// in error messages.
+func parseConfig(r io.Reader, name string) (*sidecoreConfig, error) {
+	c := &sidecoreConfig{defaults: map[string]string{}}
+	cur := c.defaults
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		f := strings.Fields(l)
+		kw := strings.ToLower(f[0])
+		if len(f) < 2 {
+			return nil, fmt.Errorf("%s:%d: %q has no value:%w", name, line, f[0], os.ErrInvalid)
+		}
+		if kw == "host" {
+			c.hosts = append(c.hosts, hostSection{patterns: f[1:], opts: map[string]string{}})
+			cur = c.hosts[len(c.hosts)-1].opts
+			continue
+		}
+		_, host := hostKeywords[kw]
+		_, global := globalKeywords[kw]
+		switch {
+		case !host && !global:
+			return nil, fmt.Errorf("%s:%d: unknown keyword %q:%w", name, line, f[0], os.ErrInvalid)
+		case global && len(c.hosts) > 0:
+			return nil, fmt.Errorf("%s:%d: %q can not be set in a Host section:%w", name, line, f[0], os.ErrInvalid)
+		}
+		if len(f) > 2 {
+			return nil, fmt.Errorf("%s:%d: %q takes one value, not %d:%w", name, line, f[0], len(f)-1, os.ErrInvalid)
+		}
+		if _, ok := cur[kw]; !ok {
+			cur[kw] = f[1]
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return c, nil
+}
+
+// match returns true if host matches one of the patterns.
+func (h *hostSection) match(host string) bool {
+	for _, p := range h.patterns {
+		if ok, err := path.Match(p, host); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the value of kw for a host, checking host
+// sections first and then the defaults.
+func (c *sidecoreConfig) get(host, kw string) string {
+	for _, h := range c.hosts {
+		if !h.match(host) {
+			continue
+		}
+		if v, ok := h.opts[kw]; ok {
+			return v
+		}
+	}
+	return c.defaults[kw]
+}
+
+// setFlagDefaults sets flags from the defaults in the config
+// file, unless they were set on the command line.
+func (c *sidecoreConfig) setFlagDefaults(set map[string]bool) error {
+	for kw, f := range globalKeywords {
+		v, ok := c.defaults[kw]
+		if !ok || set[f] {
+			continue
+		}
+		if err := flag.Set(f, v); err != nil {
+			return fmt.Errorf("config %s: %w", kw, err)
+		}
+	}
+	return nil
+}
+
+// apply fills in a cpu from the matching config sections.
+// Values from the command line, recorded in set, are not changed.
+func (c *sidecoreConfig) apply(cpu *cpu, set map[string]bool) {
+	for kw, k := range hostKeywords {
+		v := c.get(cpu.host, kw)
+		if len(v) == 0 || (len(k.flag) > 0 && set[k.flag]) {
+			continue
+		}
+		k.set(cpu, v)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig(strings.NewReader(`
+# defaults
+Network tcp
+Port 17011
+Namespace /lib;/usr
+
+Host rpi* arm-lab
+	port 17012
+	KeyFile ~/.ssh/lab_rsa
+	Container arm64-alpine@latest.cpio
+Host *
+	Port 17013
+`), "test")
+	if err != nil {
+		t.Fatalf("parseConfig: %v != nil", err)
+	}
+	for _, tt := range []struct {
+		host, kw, want string
+	}{
+		{host: "rpi4", kw: "port", want: "17012"},
+		{host: "arm-lab", kw: "keyfile", want: "~/.ssh/lab_rsa"},
+		{host: "arm-lab", kw: "container", want: "arm64-alpine@latest.cpio"},
+		{host: "x86", kw: "port", want: "17013"},
+		{host: "x86", kw: "keyfile", want: ""},
+		{host: "x86", kw: "namespace", want: "/lib;/usr"},
+		{host: "rpi4", kw: "network", want: "tcp"},
+	} {
+		if got := c.get(tt.host, tt.kw); got != tt.want {
+			t.Errorf("get(%q, %q): %q != %q", tt.host, tt.kw, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, conf, line string
+	}{
+		{name: "unknown keyword", conf: "Port 1\nBogus 2\n", line: "test:2:"},
+		{name: "no value", conf: "\n\nPort\n", line: "test:3:"},
+		{name: "too many values", conf: "Port 1 2\n", line: "test:1:"},
+		{name: "global in host", conf: "Host a\n\tNetwork tcp\n", line: "test:2:"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(strings.NewReader(tt.conf), "test")
+			if !errors.Is(err, os.ErrInvalid) {
+				t.Fatalf("parseConfig: %v != %v", err, os.ErrInvalid)
+			}
+			if !strings.HasPrefix(err.Error(), tt.line) {
+				t.Errorf("parseConfig: %q does not start with %q", err, tt.line)
+			}
+		})
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	c, err := parseConfig(strings.NewReader("Host a\n\tPort 17012\n\tNamespace /usr\n"), "test")
+	if err != nil {
+		t.Fatalf("parseConfig: %v != nil", err)
+	}
+	p := &cpu{host: "a"}
+	c.apply(p, map[string]bool{})
+	if p.port != "17012" || p.namespace != "/usr" {
+		t.Errorf("apply: port %q, namespace %q != \"17012\", \"/usr\"", p.port, p.namespace)
+	}
+
+	p = &cpu{host: "a"}
+	c.apply(p, map[string]bool{"sp": true, "namespace": true})
+	if p.port != "" || p.namespace != "" {
+		t.Errorf("apply with flags set: port %q, namespace %q != \"\", \"\"", p.port, p.namespace)
+	}
+
+	c, err = parseConfig(strings.NewReader("Host b\n\tPort 17012\n\tKeyFile k\n\tHostKeyFile hk\n\tContainer c.cpio\n"), "test")
+	if err != nil {
+		t.Fatalf("parseConfig: %v != nil", err)
+	}
+	p = &cpu{host: "b", port: "17099"}
+	c.apply(p, map[string]bool{})
+	if p.port != "17099" || len(p.keyfiles) != 1 || p.keyfiles[0] != "k" || p.hostkey != "hk" || p.container != "c.cpio" {
+		t.Errorf("apply: %+v: want port 17099, keyfiles [k], hostkey hk, container c.cpio", p)
+	}
+}
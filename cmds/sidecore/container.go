@@ -0,0 +1,176 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// -container chooses the container for a run, e.g. a cpio being
+// tried out, rather than SIDECORE_ARCH, SIDECORE_DISTRO and
+// SIDECORE_VERSION. It beats the config file and inventory.
+var containerFlag = flag.String("container", "", "container to use: a cpio file, the name of one in SIDECORE_IMAGES, cpio files, separated by commas, layered one over another, dir:path for a directory, oci://image to pull it from a registry, docker-archive:file for an image docker save wrote, none to serve only -root, or - to read it from stdin; the default is made from SIDECORE_ARCH, SIDECORE_DISTRO and SIDECORE_VERSION")
+
+// stdinContainer is the -container which is read from stdin, e.g.
+// u-root -o /dev/stdout | sidecore -container - host cmd.
+const stdinContainer = "-"
+
+// noContainer is the -container which serves no container, only -root,
+// as cpu does, so that the command runs with the cpu's own userland,
+// and this machine's files under -mountpoint.
+const noContainer = "none"
+
+// containerPath is the container -container chooses, if it is set.
+// flags sets it.
+var containerPath string
+
+// isPath reports whether a container is a path, rather than a name to
+// look for in SIDECORE_IMAGES.
+func isPath(c string) bool {
+	return filepath.IsAbs(c) || strings.ContainsRune(c, filepath.Separator) || strings.ContainsRune(c, '/') || strings.HasPrefix(c, "~") || c == "." || c == ".."
+}
+
+// checkContainer returns the container for -container c: c, made
+// absolute, if it exists, else, for a name, the name, which is looked
+// for in SIDECORE_IMAGES. It is an error if a path does not exist,
+// rather than it being looked for in SIDECORE_IMAGES.
+func checkContainer(c string) (string, error) {
+	// The container on stdin is read once the flags are checked.
+	if len(c) == 0 || c == stdinContainer {
+		return "", nil
+	}
+	if c == noContainer {
+		return c, nil
+	}
+	if strings.Contains(c, layerSeparator) {
+		return checkLayers(c)
+	}
+	// An oci: container is pulled once the arch is known.
+	if img, ok := ociContainer(c); ok {
+		if _, err := parseOCIRef(img); err != nil {
+			return "", fmt.Errorf("-container %s: %w", c, err)
+		}
+		return c, nil
+	}
+	// A docker-archive: container is flattened once the arch is
+	// known.
+	if a, ok := dockerArchive(c); ok {
+		if strings.HasPrefix(a, "~") {
+			a = findContainer(a)
+		}
+		a, err := filepath.Abs(a)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(a); err != nil {
+			return "", fmt.Errorf("-container %s: %w", c, err)
+		}
+		return dockerArchivePrefix + a, nil
+	}
+	if d, ok := dirContainer(c); ok {
+		if strings.HasPrefix(d, "~") {
+			d = findContainer(d)
+		}
+		d, err := filepath.Abs(d)
+		if err != nil {
+			return "", err
+		}
+		if _, err := NewfsDir(d); err != nil {
+			return "", fmt.Errorf("-container %s%s: %w", dirPrefix, d, err)
+		}
+		return dirPrefix + d, nil
+	}
+	if !isPath(c) {
+		if _, err := os.Stat(c); err != nil {
+			return c, nil
+		}
+	}
+	p := c
+	if strings.HasPrefix(p, "~") {
+		p = findContainer(p)
+	}
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(p); err != nil {
+		return "", fmt.Errorf("-container %s: %w", p, err)
+	}
+	return p, nil
+}
+
+// containerArg returns the container a subcommand's argument, c, names,
+// as checkContainer and searchContainer find it for -container c, and,
+// for a name, the directories it was looked for in.
+func containerArg(c string) (string, []string, error) {
+	c, err := checkContainer(c)
+	if err != nil {
+		return "", nil, err
+	}
+	p, dirs := searchContainer(c)
+	return p, dirs, nil
+}
+
+// readContainer copies a container from r to a temporary file in dir,
+// since it is opened by name, once for each server. It returns the
+// file's name, and a func which removes it, which exit also runs, so
+// that it is removed even if sidecore exits while it is being read.
+func readContainer(r io.Reader, dir string) (string, func(), error) {
+	f, err := os.CreateTemp(dir, "sidecore-container-*.cpio")
+	if err != nil {
+		return "", nil, fmt.Errorf("-container -: %w", err)
+	}
+	remove := func() { os.Remove(f.Name()) }
+	atExit(remove)
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n == 0 {
+		err = fmt.Errorf("nothing on stdin:%w", os.ErrInvalid)
+	}
+	if err != nil {
+		remove()
+		return "", nil, fmt.Errorf("-container -: %w", err)
+	}
+	verbose("-container -: %d bytes in %s", n, f.Name())
+	return f.Name(), remove, nil
+}
+
+// forwarding is the number of cpus which forward signals to their
+// commands.
+var forwarding atomic.Int32
+
+// exitOnSignal makes the signals which would stop sidecore exit it,
+// with exit, so that e.g. the container read from stdin is removed.
+// While cpus forward signals, they are left to them.
+func exitOnSignal() {
+	c := make(chan os.Signal, 1)
+	sigs := []os.Signal{}
+	for s := range sshSignals {
+		sigs = append(sigs, s)
+	}
+	signal.Notify(c, sigs...)
+	go func() {
+		for s := range c {
+			if forwarding.Load() > 0 && !*noSignals {
+				continue
+			}
+			code := exitFailure
+			if n, ok := signals[sshSignals[s]]; ok {
+				code = 128 + n
+			}
+			verbose("%v: exiting", s)
+			exit(code)
+		}
+	}()
+}
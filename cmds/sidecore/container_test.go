@@ -0,0 +1,150 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckContainer(t *testing.T) {
+	images := t.TempDir()
+	t.Setenv("SIDECORE_IMAGES", images)
+	d := t.TempDir()
+	exp := filepath.Join(d, "experimental.cpio")
+	if err := os.WriteFile(exp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		c    string
+		want string
+		err  error
+	}{
+		{name: "not set", c: "", want: ""},
+		{name: "absolute", c: exp, want: exp},
+		{name: "relative", c: rel, want: exp},
+		{name: "name", c: "arm64-alpine@edge.cpio", want: "arm64-alpine@edge.cpio"},
+		{name: "missing absolute", c: filepath.Join(d, "none.cpio"), err: os.ErrNotExist},
+		{name: "missing relative", c: filepath.Join("testdata", "none.cpio"), err: os.ErrNotExist},
+		{name: "home", c: "~/none.cpio", err: os.ErrNotExist},
+		{name: "dir", c: dirPrefix + d, want: dirPrefix + d},
+		{name: "dir, a file", c: dirPrefix + exp, err: os.ErrInvalid},
+		{name: "dir, missing", c: dirPrefix + filepath.Join(d, "none"), err: os.ErrNotExist},
+	} {
+		got, err := checkContainer(tt.c)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("%s: checkContainer(%q): (%q, %v) != (%q, %v)", tt.name, tt.c, got, err, tt.want, tt.err)
+		}
+		// The error must name the path, as it was looked for.
+		c, _ := dirContainer(tt.c)
+		if abs, _ := filepath.Abs(c); err != nil && !strings.HasPrefix(tt.c, "~") && !strings.Contains(err.Error(), abs) {
+			t.Errorf("%s: checkContainer(%q): %v does not name the path", tt.name, tt.c, err)
+		}
+	}
+}
+
+// errReader returns some of a container, then fails.
+type errReader struct{ n int }
+
+func (r *errReader) Read(b []byte) (int, error) {
+	if r.n > 0 {
+		r.n = 0
+		return copy(b, "070701"), nil
+	}
+	return 0, os.ErrClosed
+}
+
+func TestReadContainer(t *testing.T) {
+	d := t.TempDir()
+	want := "070701 a cpio"
+	c, remove, err := readContainer(strings.NewReader(want), d)
+	if err != nil {
+		t.Fatalf("readContainer: %v != nil", err)
+	}
+	if filepath.Dir(c) != d {
+		t.Errorf("readContainer: %s is not in %s", c, d)
+	}
+	b, err := os.ReadFile(c)
+	if err != nil || string(b) != want {
+		t.Errorf("readContainer: (%q, %v) != (%q, nil)", b, err, want)
+	}
+	remove()
+	if _, err := os.Stat(c); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("after remove, Stat(%s): %v != %v", c, err, os.ErrNotExist)
+	}
+
+	// A failed or empty read leaves nothing behind.
+	for _, tt := range []struct {
+		name string
+		r    io.Reader
+		err  error
+	}{
+		{name: "empty", r: strings.NewReader(""), err: os.ErrInvalid},
+		{name: "read error", r: &errReader{n: 1}, err: os.ErrClosed},
+	} {
+		if _, _, err := readContainer(tt.r, d); !errors.Is(err, tt.err) {
+			t.Errorf("%s: readContainer: %v != %v", tt.name, err, tt.err)
+		}
+	}
+	if ents, err := os.ReadDir(d); err != nil || len(ents) != 0 {
+		t.Errorf("after failed reads, ReadDir(%s): (%v, %v) != ([], nil)", d, ents, err)
+	}
+}
+
+func TestNoContainer(t *testing.T) {
+	t.Setenv("SIDECORE_IMAGES", t.TempDir())
+	if c, err := checkContainer(noContainer); err != nil || c != noContainer {
+		t.Errorf("checkContainer(%q): (%q, %v) != (%q, nil)", noContainer, c, err, noContainer)
+	}
+	if c, dirs := searchContainer(noContainer); c != noContainer || dirs != nil {
+		t.Errorf("searchContainer(%q): (%q, %q) != (%q, nil)", noContainer, c, dirs, noContainer)
+	}
+
+	defer func(r string) { *root = r }(*root)
+	*root = testRootfs(t)
+	home := t.TempDir()
+	if err := os.WriteFile(filepath.Join(home, "notes"), []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := newContainerFS(noContainer, MountPoint{n: "home/me", fs: NewOSFS(home)})
+	if err != nil {
+		t.Fatalf("newContainerFS(%q): %v != nil", noContainer, err)
+	}
+	for n, want := range map[string]string{"etc/hosts": "127.0.0.1 localhost\n", "home/me/notes": "notes"} {
+		f, err := fs.Open(n)
+		if err != nil {
+			t.Errorf("Open(%q): %v != nil", n, err)
+			continue
+		}
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(b) != want {
+			t.Errorf("%s: (%q, %v) != (%q, nil)", n, b, err, want)
+		}
+	}
+	// Only the mounts may be written, or changed.
+	if _, err := fs.Create("etc/new"); err == nil {
+		t.Errorf("Create(\"etc/new\"): nil != an error")
+	}
+	testChange(t, fs, *root, filepath.Join(home, "notes"))
+
+	u, err := newServer(noContainer, nil, "home")
+	if err != nil || u == nil {
+		t.Errorf("newServer(%q): (%v, %v) != (a server, nil)", noContainer, u, err)
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugelgupf/p9/p9"
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// A control master holds the connection to a cpu, and its nfs
+// server, so that later runs on the cpu, which talk ssh to the
+// master on a unix socket, need not set them up again. The master
+// opens a session on the cpu for each session opened on it, and
+// copies between the two. It needs no authentication: only its
+// owner can open its socket.
+
+// These are the global requests understood by a control master.
+const (
+	controlCheck = "check@sidecore.u-root.org"
+	controlExit  = "exit@sidecore.u-root.org"
+)
+
+// controlSocket returns the path of a cpu's control socket, with
+// a leading ~ and the %h, %p, %r, and %n tokens expanded, as for
+// ssh's ControlPath.
+func controlSocket(path string, cpu *cpu) string {
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return strings.NewReplacer("%%", "%", "%h", cpu.host, "%p", cpu.port, "%r", cpu.user, "%n", cpu.name).Replace(path)
+}
+
+// controlKeyFile returns the file holding a control master's host key.
+func controlKeyFile(sock string) string {
+	return sock + ".pub"
+}
+
+// startMaster makes sure that a control master for a cpu is
+// running, starting one if needed. The master is sidecore, run
+// with the flags it was run with, save that it is given just the
+// one cpu. It can ask for passphrases and passwords, so it shares
+// stdin and stderr until it is ready, which it says on a pipe.
+func startMaster(cpu *cpu) error {
+	if c, err := net.Dial("unix", cpu.control); err == nil {
+		c.Close()
+		verbose("using control master %s", cpu.control)
+		return nil
+	}
+	// A socket nobody answers on was left by a master which died.
+	if fi, err := os.Lstat(cpu.control); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(cpu.control)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	args := append([]string{}, os.Args[1:len(os.Args)-flag.NArg()]...)
+	if n := len(args); n > 0 && args[n-1] == "--" {
+		args = args[:n-1]
+	}
+	args = append(args, "-control-master", "-hosts", cpu.user+"@"+cpu.name, "-sp", cpu.port)
+	verbose("start control master %q %q", exe, args)
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("control master: %w", err)
+	}
+	w.Close()
+	l, err := bufio.NewReader(r).ReadString('\n')
+	if l == "ok\n" {
+		return cmd.Process.Release()
+	}
+	if err := cmd.Wait(); err != nil && len(l) == 0 {
+		return fmt.Errorf("control master: %w", err)
+	}
+	return fmt.Errorf("control master: %s", strings.TrimSpace(l))
+}
+
+// controlCommand sends a command, check or exit, to a cpu's
+// control master, as ssh -O does.
+func controlCommand(op string, cpu *cpu) (string, error) {
+	req, ok := map[string]string{"check": controlCheck, "exit": controlExit}[op]
+	if !ok {
+		return "", fmt.Errorf("-O %s: only check and exit are supported:%w", op, os.ErrInvalid)
+	}
+	hk, err := fixedHostKey(controlKeyFile(cpu.control))
+	if err != nil {
+		return "", fmt.Errorf("no control master for %s: %w", cpu.host, err)
+	}
+	conn, err := net.Dial("unix", cpu.control)
+	if err != nil {
+		return "", fmt.Errorf("no control master for %s: %w", cpu.host, err)
+	}
+	sc, chans, reqs, err := ossh.NewClientConn(conn, cpu.control, &ossh.ClientConfig{User: cpu.user, HostKeyCallback: hk})
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	cl := ossh.NewClient(sc, chans, reqs)
+	defer cl.Close()
+	ok, reply, err := cl.SendRequest(req, true, nil)
+	switch {
+	case err != nil:
+		return "", err
+	case !ok:
+		return "", fmt.Errorf("control master refused %s", op)
+	case op == "exit":
+		return "Exit request sent.", nil
+	}
+	var pid struct{ Pid uint32 }
+	if err := ossh.Unmarshal(reply, &pid); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Master running (pid=%d)", pid.Pid), nil
+}
+
+// master is a control master.
+type master struct {
+	up  *ossh.Client
+	l   net.Listener
+	cfg *ossh.ServerConfig
+	// nfs is the nfs server's export, which is added to each
+	// session's fstab.
+	nfs     *nfsExport
+	persist time.Duration
+
+	mu     sync.Mutex
+	active int
+	idle   *time.Timer
+
+	done chan struct{}
+	once sync.Once
+}
+
+// shutdown stops the master.
+func (m *master) shutdown() {
+	m.once.Do(func() { close(m.done) })
+}
+
+// busy counts sessions starting, for n = 1, and ending, for n = -1.
+// Once there are none, the master lingers for persist, if it is set,
+// then stops.
+func (m *master) busy(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active += n
+	if m.idle != nil {
+		m.idle.Stop()
+	}
+	if m.active == 0 && m.persist > 0 {
+		m.idle = time.AfterFunc(m.persist, m.shutdown)
+	}
+}
+
+// requests answers the global requests on a connection to the master.
+func (m *master) requests(reqs <-chan *ossh.Request) {
+	for r := range reqs {
+		switch r.Type {
+		case controlCheck:
+			r.Reply(true, ossh.Marshal(struct{ Pid uint32 }{uint32(os.Getpid())}))
+		case controlExit:
+			r.Reply(true, nil)
+			m.shutdown()
+		default:
+			r.Reply(false, nil)
+		}
+	}
+}
+
+// session copies between a session opened on the master and
+// one it opens on the cpu.
+func (m *master) session(nc ossh.NewChannel) {
+	up, upReqs, err := m.up.OpenChannel("session", nil)
+	if err != nil {
+		nc.Reject(ossh.ConnectionFailed, err.Error())
+		return
+	}
+	defer up.Close()
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	m.busy(1)
+	defer m.busy(-1)
+
+	go func() {
+		io.Copy(up, ch)
+		up.CloseWrite()
+	}()
+	go func() {
+		// The session's fstab, if any, is sent when the
+		// command starts, following the nfs server's.
+		var fstab string
+		for r := range reqs {
+			switch r.Type {
+			case "env":
+				var e struct{ Name, Value string }
+				if ossh.Unmarshal(r.Payload, &e) == nil && e.Name == "CPU_FSTAB" {
+					fstab += e.Value + "\n"
+					r.Reply(true, nil)
+					continue
+				}
+			case "exec", "shell":
+				if m.nfs != nil || len(fstab) > 0 {
+					e := struct{ Name, Value string }{"CPU_FSTAB", mergeFSTab(m.nfs, fstab)}
+					if _, err := up.SendRequest("env", true, ossh.Marshal(&e)); err != nil {
+						verbose("control: CPU_FSTAB: %v", err)
+					}
+				}
+			}
+			ok, err := up.SendRequest(r.Type, r.WantReply, r.Payload)
+			if err != nil {
+				verbose("control: %s: %v", r.Type, err)
+			}
+			r.Reply(ok, nil)
+		}
+	}()
+
+	var out sync.WaitGroup
+	out.Add(2)
+	go func() {
+		io.Copy(ch, up)
+		out.Done()
+	}()
+	go func() {
+		io.Copy(ch.Stderr(), up.Stderr())
+		out.Done()
+	}()
+	// The exit status must not pass the last of the output.
+	for r := range upReqs {
+		if r.Type == "exit-status" || r.Type == "exit-signal" {
+			out.Wait()
+		}
+		ok, _ := ch.SendRequest(r.Type, r.WantReply, r.Payload)
+		r.Reply(ok, nil)
+	}
+	out.Wait()
+}
+
+// serve serves a connection to the master.
+func (m *master) serve(c net.Conn) {
+	sc, chans, reqs, err := ossh.NewServerConn(c, m.cfg)
+	if err != nil {
+		verbose("control: %v", err)
+		return
+	}
+	defer sc.Close()
+	go m.requests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ossh.UnknownChannelType, nc.ChannelType())
+			continue
+		}
+		go m.session(nc)
+	}
+}
+
+// accept serves connections to the master until its listener is closed.
+func (m *master) accept() {
+	for {
+		c, err := m.l.Accept()
+		if err != nil {
+			return
+		}
+		go m.serve(c)
+	}
+}
+
+// runMaster runs a control master for a cpu, until it is told to
+// exit, has been idle for -control-persist, or loses the cpu. It
+// says whether it is ready on file descriptor 3, as startMaster
+// expects, then leaves the terminal.
+func runMaster(srv p9.Attacher, cpu *cpu) error {
+	ready := os.NewFile(3, "ready")
+	m, err := newMaster(srv, cpu)
+	if err != nil {
+		fmt.Fprintf(ready, "%v\n", err)
+		return err
+	}
+	defer os.Remove(controlKeyFile(cpu.control))
+	defer os.Remove(cpu.control)
+	defer m.up.Close()
+	fmt.Fprintf(ready, "ok\n")
+	ready.Close()
+	if err := detach(); err != nil {
+		verbose("control: detach: %v", err)
+	}
+
+	go m.accept()
+	lost := keepAlive(m.up, cpu.aliveInterval, cpu.aliveCount, m.done)
+	go func() {
+		m.up.Wait()
+		m.shutdown()
+	}()
+	select {
+	case <-m.done:
+	case err = <-lost:
+	}
+	m.l.Close()
+	return err
+}
+
+// newMaster connects to a cpu, starts the nfs server, and
+// listens on the cpu's control socket.
+func newMaster(srv p9.Attacher, cpu *cpu) (*master, error) {
+	// Someone else got there first.
+	if c, err := net.Dial("unix", cpu.control); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s: a control master is already running", cpu.control)
+	}
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hk, err := ossh.NewSignerFromKey(k)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ossh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(hk)
+
+	a := dialAgent()
+	defer a.Close()
+	c, err := newClient(srv, a, cpu)
+	if err != nil {
+		return nil, err
+	}
+	if err := dial(c, cpu); err != nil {
+		return nil, err
+	}
+	m := &master{up: c.Client(), cfg: cfg, persist: *controlPersist, done: make(chan struct{})}
+	if *srvnfs {
+		f, _, nfs, err := srvNFS(c, cpu.container, cpu.home, cpu.compress)
+		phase(cpu, "mount", err)
+		if err != nil {
+			m.up.Close()
+			return nil, err
+		}
+		// The nfs server stops when the connection is closed.
+		go func() {
+			info("nfs: %v", f())
+		}()
+		m.nfs = nfs
+	}
+	if m.l, err = listenControl(cpu.control, hk.PublicKey()); err != nil {
+		m.up.Close()
+		return nil, err
+	}
+	m.busy(0)
+	return m, nil
+}
+
+// listenControl listens on a control socket, and writes the master's
+// host key next to it. Only their owner may open either.
+func listenControl(sock string, key ossh.PublicKey) (net.Listener, error) {
+	if err := os.WriteFile(controlKeyFile(sock), ossh.MarshalAuthorizedKey(key), 0600); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", sock)
+	if err == nil {
+		err = os.Chmod(sock, 0600)
+	}
+	if err != nil {
+		if l != nil {
+			l.Close()
+		}
+		os.Remove(controlKeyFile(sock))
+		return nil, err
+	}
+	return l, nil
+}
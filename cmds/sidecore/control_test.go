@@ -0,0 +1,144 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+func TestControlSocket(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	c := &cpu{user: "me", host: "cpu.example.com", port: "17010", name: "cpu"}
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{path: "/tmp/sc-%r@%h:%p", want: "/tmp/sc-me@cpu.example.com:17010"},
+		{path: "~/.ssh/sc-%n-100%%", want: "/home/me/.ssh/sc-cpu-100%"},
+	} {
+		if got := controlSocket(tt.path, c); got != tt.want {
+			t.Errorf("controlSocket(%q): %q != %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// testMaster starts a control master for a fake cpud, with the
+// nfs export nfs, and returns it and its socket.
+func testMaster(t *testing.T, env chan<- string, nfs *nfsExport) (*master, string) {
+	t.Helper()
+	addr := testServerFunc(t, fakeCPUD(env))
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	s, err := ossh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v != nil", err)
+	}
+	up, err := ossh.Dial("tcp", addr, &ossh.ClientConfig{
+		User:            "me",
+		Auth:            []ossh.AuthMethod{ossh.PublicKeys(s)},
+		HostKeyCallback: ossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Dial(%q): %v != nil", addr, err)
+	}
+	t.Cleanup(func() { up.Close() })
+
+	cfg := &ossh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(s)
+	m := &master{up: up, cfg: cfg, nfs: nfs, done: make(chan struct{})}
+	sock := filepath.Join(t.TempDir(), "control")
+	if m.l, err = listenControl(sock, s.PublicKey()); err != nil {
+		t.Fatalf("listenControl(%q): %v != nil", sock, err)
+	}
+	t.Cleanup(func() { m.l.Close() })
+	go m.accept()
+	return m, sock
+}
+
+func TestControlMaster(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	env := make(chan string, 100)
+	nfs := &nfsExport{nonce: "n", port: 2049}
+	m, sock := testMaster(t, env, nfs)
+	for _, n := range []string{sock, controlKeyFile(sock)} {
+		fi, err := os.Stat(n)
+		if err != nil {
+			t.Fatalf("Stat(%q): %v != nil", n, err)
+		}
+		if got := fi.Mode().Perm(); got != 0600 {
+			t.Errorf("%s: mode %v != %v", n, got, os.FileMode(0600))
+		}
+	}
+
+	c := &cpu{host: "cpu", port: defaultPort, user: "me", fstab: "ns", control: sock, noStdin: true}
+	var wg sync.WaitGroup
+	err := runCPU(nil, &wg, "", c, "date")
+	wg.Wait()
+	if got := exitStatus(err); got != 3 {
+		t.Errorf("runCPU through %s: exit status %d (%v) != 3", sock, got, err)
+	}
+	// The nfs server's fstab comes first, and is only sent once.
+	close(env)
+	var fstabs []string
+	for e := range env {
+		if strings.HasPrefix(e, "CPU_FSTAB=") {
+			fstabs = append(fstabs, e)
+		}
+	}
+	if want := "CPU_FSTAB=" + nfs.fstab() + "ns"; len(fstabs) != 1 || !strings.HasPrefix(fstabs[0], want) {
+		t.Errorf("CPU_FSTAB sent to cpud: %q != one, starting %q", fstabs, want)
+	}
+
+	msg, err := controlCommand("check", c)
+	if want := fmt.Sprintf("Master running (pid=%d)", os.Getpid()); err != nil || msg != want {
+		t.Errorf("controlCommand(check): (%q, %v) != (%q, nil)", msg, err, want)
+	}
+	if _, err := controlCommand("stop", c); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("controlCommand(stop): %v != %v", err, os.ErrInvalid)
+	}
+	if msg, err := controlCommand("exit", c); err != nil || msg != "Exit request sent." {
+		t.Errorf("controlCommand(exit): (%q, %v) != (\"Exit request sent.\", nil)", msg, err)
+	}
+	select {
+	case <-m.done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("master did not stop on exit")
+	}
+}
+
+func TestControlNoMaster(t *testing.T) {
+	c := &cpu{host: "cpu", user: "me", control: filepath.Join(t.TempDir(), "control")}
+	if _, err := controlCommand("check", c); err == nil {
+		t.Errorf("controlCommand(check), no master: nil != an error")
+	}
+}
+
+func TestMasterPersist(t *testing.T) {
+	m := &master{persist: time.Millisecond, done: make(chan struct{})}
+	m.busy(1)
+	select {
+	case <-m.done:
+		t.Fatalf("master stopped with a session open")
+	case <-time.After(10 * time.Millisecond):
+	}
+	m.busy(-1)
+	select {
+	case <-m.done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("master did not stop once idle for %v", m.persist)
+	}
+}
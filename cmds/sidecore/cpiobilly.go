@@ -26,6 +26,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -33,15 +34,17 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/google/uuid"
-	"github.com/u-root/cpu/client"
+	"github.com/u-root/sidecore/internal/cpu/client"
 	"github.com/u-root/u-root/pkg/cpio"
 	nfs "github.com/willscott/go-nfs"
 	nfshelper "github.com/willscott/go-nfs/helpers"
@@ -56,13 +59,14 @@ func (*fsCPIO) Root() string {
 	return "/" // not os.PathSeparator; this is cpio.
 }
 
-// Name implements billy.Name
+// Name implements billy.Name, returning the base name of the record.
 func (f *file) Name() string {
-	var s string
-	if r, err := f.rec(); err != nil {
-		s = r.Name
+	r, err := f.rec()
+	if err != nil {
+		verbose("cpio: Name of %d: %v", f.Path, err)
+		return ""
 	}
-	return s
+	return path.Base(r.Name)
 }
 
 // Lock implements billy.Lock
@@ -74,21 +78,46 @@ func (*file) Lock() error { return nil }
 func (*file) Unlock() error { return nil }
 
 // Write does not implement billy.Write, since NFS does not use it.
-// NFS always specifies an offset.
-func (*file) Write(p []byte) (n int, err error) {
-	return -1, os.ErrInvalid
+// NFS always specifies an offset. A cpio can not be written.
+func (l *file) Write(p []byte) (n int, err error) {
+	verbose("cpio: Write of %d: unsupported", l.Path)
+	return 0, os.ErrPermission
 }
 
-// Read does not implement billy.Read, since NFS does not use it.
-// NFS always specifies an offset.
-func (*file) Read(p []byte) (n int, err error) {
-	return -1, os.ErrInvalid
+// Read implements billy.Read, reading from where the last Read, or
+// Seek, left off. NFS does not use it, since it always specifies an
+// offset, but other users of an fsCPIO may.
+func (l *file) Read(p []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err = l.ReadAt(p, l.off)
+	l.off += int64(n)
+	return n, err
 }
 
-// Seek does not implement billy.Seek, since NFS does not use it.
-// NFS always specifies an offset.
-func (*file) Seek(offset int64, whence int) (int64, error) {
-	return -1, os.ErrInvalid
+// Seek implements billy.Seek. The offset can not be moved before the
+// start of the file, or past its end.
+func (l *file) Seek(offset int64, whence int) (int64, error) {
+	r, err := l.rec()
+	if err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += l.off
+	case io.SeekEnd:
+		offset += int64(r.FileSize)
+	default:
+		return l.off, fmt.Errorf("seek whence %d:%w", whence, os.ErrInvalid)
+	}
+	if offset < 0 || offset > int64(r.FileSize) {
+		return l.off, fmt.Errorf("seek to %d, of %d bytes:%w", offset, r.FileSize, os.ErrInvalid)
+	}
+	l.off = offset
+	return offset, nil
 }
 
 // Close implements billy.Close.
@@ -111,32 +140,84 @@ type MountPoint struct {
 // rules: always check the mounts first, and always fall back to the
 // CPIO fs if those fail.
 type fsCPIO struct {
-	file *os.File
-	rr   cpio.RecordReader
-	m    map[string]uint64
-	recs []cpio.Record
-	mnts []MountPoint
+	files []*os.File
+	m     map[string]uint64
+	recs  []cpio.Record
+	mnts  []MountPoint
+	// mtime is the newest mtime of the archives, for records
+	// which have none.
+	mtime time.Time
+	// maxLinks is how many symlinks resolvelink follows.
+	maxLinks int
+	// overlay, if there is one, holds what is written outside
+	// the mounts.
+	overlay *overlay
+}
+
+// defaultMaxLinks is how many symlinks resolvelink follows, unless
+// WithMaxLinks says otherwise.
+const defaultMaxLinks = 20
+
+// A CPIOOption is an option of NewfsCPIO: a MountPoint,
+// WithMaxLinks, or WithOverlay.
+type CPIOOption interface {
+	apply(fs *fsCPIO) error
 }
 
+// apply mounts a MountPoint.
+func (m MountPoint) apply(fs *fsCPIO) error {
+	return fs.mount(m)
+}
+
+// maxLinks is the CPIOOption WithMaxLinks returns.
+type maxLinks int
+
+// apply sets how many symlinks are followed.
+func (n maxLinks) apply(fs *fsCPIO) error {
+	if n < 1 {
+		return fmt.Errorf("%d links:%w", n, os.ErrInvalid)
+	}
+	fs.maxLinks = int(n)
+	return nil
+}
+
+// WithMaxLinks sets how many symlinks an fsCPIO follows before it
+// gives up, with ELOOP.
+func WithMaxLinks(n int) CPIOOption {
+	return maxLinks(n)
+}
+
+// hasMount returns the mount n is in, if any, and n relative to it.
+// Mounts are matched on whole components, so a mount of usr does
+// not have usrlocal/bin, and, of nested mounts, e.g. home and
+// home/glenda/src, the longest is used.
 func (f *fsCPIO) hasMount(n string) (*MountPoint, string, error) {
+	n = archiveName(n)
+	var mp *MountPoint
+	var rel, longest string
 	for i, v := range f.mnts {
-		if strings.HasPrefix(n, v.n) {
-			rel, err := filepath.Rel(v.n, n)
-			if err != nil {
-				continue
-			}
-			return &f.mnts[i], rel, nil
+		m := archiveName(v.n)
+		r, ok := ".", n == m
+		if !ok {
+			r, ok = strings.CutPrefix(n, m+"/")
+		}
+		if ok && (mp == nil || len(m) > len(longest)) {
+			mp, rel, longest = &f.mnts[i], r, m
 		}
 	}
-	return nil, "", fmt.Errorf("%s:%w", n, os.ErrNotExist)
+	if mp == nil {
+		return nil, "", fmt.Errorf("%s:%w", n, os.ErrNotExist)
+	}
+	return mp, rel, nil
 }
 
 // mount adds a mountpoint to an fsCPIO.
 // It is only intended to be called from New, and only checks
-// for obvious errors such as duplicate entries.
+// for obvious errors such as duplicate entries. Mounts may be
+// nested.
 func (f *fsCPIO) mount(m MountPoint) error {
-	for _, m := range f.mnts {
-		if _, _, err := f.hasMount(m.n); err == nil {
+	for _, o := range f.mnts {
+		if archiveName(o.n) == archiveName(m.n) {
 			return fmt.Errorf("%q:%w", m.n, os.ErrExist)
 		}
 	}
@@ -155,12 +236,30 @@ func (fs *fsCPIO) ReadDir(filename string) ([]os.FileInfo, error) {
 		filename = s
 	}
 	verbose("fsCPIO readdir: %q", filename)
+	var fi []os.FileInfo
 	l, err := fs.lookup(filename)
+	if err == nil {
+		fi, err = l.(*file).ReadDir(0, 1048576) // no idea what to do for size.
+	}
+	if fs.overlay != nil {
+		fi, err = fs.mergeDir(archiveName(filename), fi, err)
+	}
 	if err != nil {
 		return nil, err
 	}
-	fi, err := l.(*file).ReadDir(0, 1048576) // no idea what to do for size.
-	if len(filename) == 0 {
+	if archiveName(filename) == "." {
+		// A mount point hides what the archive has of that name.
+		mounted := map[string]bool{}
+		for _, m := range fs.mnts {
+			mounted[m.n] = true
+		}
+		var kept []os.FileInfo
+		for _, f := range fi {
+			if !mounted[f.Name()] {
+				kept = append(kept, f)
+			}
+		}
+		fi = kept
 		for _, m := range fs.mnts {
 			// No clear union mount semantics on Linux
 			// for "some but not all". Oh well.
@@ -173,15 +272,19 @@ func (fs *fsCPIO) ReadDir(filename string) ([]os.FileInfo, error) {
 			}
 			fi = append(fi, &ufstat{FileInfo: mfi, name: m.n})
 		}
+		sort.Slice(fi, func(i, j int) bool { return fi[i].Name() < fi[j].Name() })
 	}
 	verbose("%v, %v", fi, err)
 	return fi, err
 }
 
+// Name returns the name of the root, ".".
 func (f *fsCPIO) Name() string {
 	return f.recs[0].Name
 }
 
+// Size returns the size of the root, which, as for any directory
+// in a cpio, is that of its record, 0.
 func (f *fsCPIO) Size() int64 {
 	return int64(f.recs[0].FileSize)
 }
@@ -223,20 +326,29 @@ func (f *fsCPIO) Mode() os.FileMode {
 	return m
 }
 
-// ModTime always returns 0.
+// ModTime returns the mtime of the root, record 0.
 func (f *fsCPIO) ModTime() time.Time {
-	return time.Unix(0, 0)
+	return recordTime(&f.recs[0], f.mtime)
+}
+
+// recordTime returns the mtime of a record, or, if it has none, as
+// archives made for reproducible builds do not, def.
+func recordTime(r *cpio.Record, def time.Time) time.Time {
+	if r.MTime == 0 {
+		return def
+	}
+	return time.Unix(int64(r.MTime), 0)
 }
 
-// IsDir always returns true.
+// IsDir reports whether the root is a directory, as it is, unless
+// the archive made it something else.
 func (f *fsCPIO) IsDir() bool {
-	verbose("fsCPIO mode: true")
-	return true
+	return f.Mode().IsDir()
 }
 
-// Sys returns nil, always.
+// Sys returns the syscall.Stat_t of the root, record 0.
 func (f *fsCPIO) Sys() any {
-	return nil
+	return recordSys(&f.recs[0])
 }
 
 // Readlink implements ReadLink
@@ -244,6 +356,9 @@ func (fs *fsCPIO) Readlink(link string) (string, error) {
 	if osfs, rel, err := fs.getfs(link); err == nil {
 		return osfs.Readlink(rel)
 	}
+	if _, ok := fs.upper(link); ok {
+		return fs.overlay.fs.Readlink(archiveName(link))
+	}
 	l, err := fs.lookup(link)
 	if err != nil {
 		return "", err
@@ -260,6 +375,9 @@ var _ billy.Filesystem = &fsCPIO{}
 type file struct {
 	fs   *fsCPIO
 	Path uint64
+	// mu guards off, where Read reads, and Seek moves it.
+	mu  sync.Mutex
+	off int64
 }
 
 var _ billy.File = &file{}
@@ -267,6 +385,7 @@ var _ billy.File = &file{}
 // fstat implements fs.FileInfo.
 type fstat struct {
 	*cpio.Record
+	mtime time.Time
 }
 
 // Name implements Name.
@@ -287,9 +406,10 @@ func (f *fstat) Mode() os.FileMode {
 	return m
 }
 
-// ModTime implements ModTime, always returning the Unix epoch.
+// ModTime implements ModTime. A record with no mtime has that
+// of the archive.
 func (f *fstat) ModTime() time.Time {
-	return time.Unix(0, 0)
+	return recordTime(f.Record, f.mtime)
 }
 
 // IsDir implements IsDir.
@@ -298,9 +418,10 @@ func (f *fstat) IsDir() bool {
 	return f.Mode().IsDir()
 }
 
-// Sys implements Sys, always returning nil.
+// Sys implements Sys, returning a syscall.Stat_t with the
+// owner, link count and device of the record.
 func (f *fstat) Sys() any {
-	return nil
+	return recordSys(f.Record)
 }
 
 // WithMount allows the addition of mounts to an fsCPIO,
@@ -322,31 +443,208 @@ func (u ufstat) Name() string {
 	return u.name
 }
 
-// NewfsCPIO returns a fsCPIO, properly initialized.
-func NewfsCPIO(c string, mounts ...MountPoint) (*fsCPIO, error) {
-	f, err := os.Open(c)
+// Sys implements Sys, returning a syscall.Stat_t, as fstat does.
+func (u ufstat) Sys() any {
+	return mountSys(u.FileInfo, u.name)
+}
+
+// readArchive opens a cpio file, a tar or a squashfs image, or its
+// decompressed copy, if it is compressed, and reads its records.
+func readArchive(c string) (*os.File, []cpio.Record, error) {
+	u, err := uncompressed(c)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	f, err := os.Open(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if isSquashfs(f) {
+		recs, err := readSquashfs(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s: squashfs: %w", c, err)
+		}
+		return f, recs, nil
+	}
+
+	if isTar(f, c) {
+		recs, err := readTar(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s: tar: %w", c, err)
+		}
+		return f, recs, nil
 	}
 
-	archive, err := cpio.Format("newc")
+	format, err := cpioFormat(f)
 	if err != nil {
-		return nil, err
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", c, err)
+	}
+	if format != "newc" {
+		recs, err := readOldCPIO(f, format)
+		if err == nil && len(recs) == 0 {
+			err = fmt.Errorf("No records: %w", os.ErrInvalid)
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s: cpio %s: %w", c, format, err)
+		}
+		return f, recs, nil
+	}
+
+	archive, err := cpio.Format(format)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
 	}
 
 	rr, err := archive.NewFileReader(f)
 	if err != nil {
-		return nil, err
+		f.Close()
+		return nil, nil, err
 	}
 
 	recs, err := cpio.ReadAllRecords(rr)
 	if len(recs) == 0 {
-		return nil, fmt.Errorf("cpio:No records: %w", os.ErrInvalid)
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: cpio:No records: %w", c, os.ErrInvalid)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, recs, nil
+}
+
+// readLayers opens the archives of a container, and reads their
+// records, merged, if there are more than one, as mergeCPIO merges
+// them.
+func readLayers(c string) ([]*os.File, []cpio.Record, error) {
+	var files []*os.File
+	var layers [][]cpio.Record
+	for _, l := range containerLayers(c) {
+		f, recs, err := readArchive(l)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		files = append(files, f)
+		layers = append(layers, recs)
+	}
+	if len(layers) == 1 {
+		return files, layers[0], nil
 	}
+	return files, mergeCPIO(layers), nil
+}
+
+// cleanRecords returns the records with their names as the index, and
+// lookup, has them: with no leading ./ or /, and cleaned. A record
+// whose name has .. in it, which could be anywhere, is a warning, and
+// left out.
+func cleanRecords(recs []cpio.Record) []cpio.Record {
+	out := make([]cpio.Record, 0, len(recs))
+	for _, r := range recs {
+		if r.Name == cpio.Trailer {
+			continue
+		}
+		if hasDotDot(r.Name) {
+			info("warning: %q: names with .. in them are left out", r.Name)
+			continue
+		}
+		r.Name = archiveName(r.Name)
+		out = append(out, r)
+	}
+	return out
+}
+
+// dropShadowed returns the records with one for each name: the last,
+// as cpio -i would leave it, where the first was, since what is in a
+// directory is found after it.
+func dropShadowed(recs []cpio.Record) []cpio.Record {
+	at := map[string]int{}
+	out := make([]cpio.Record, 0, len(recs))
+	var shadowed int
+	for _, r := range recs {
+		if i, ok := at[r.Name]; ok {
+			verbose("cpio: %q: record %d shadows an earlier one", r.Name, i)
+			out[i] = r
+			shadowed++
+			continue
+		}
+		at[r.Name] = len(out)
+		out = append(out, r)
+	}
+	if shadowed > 0 {
+		verbose("cpio: %d records were shadowed by later ones of the same name", shadowed)
+	}
+	return out
+}
 
+// hasDotDot reports whether a name has a .. in it.
+func hasDotDot(n string) bool {
+	for _, e := range strings.Split(n, "/") {
+		if e == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// addParents adds a directory, 0755, before the first record in it,
+// for each directory which has no record, e.g. usr and usr/bin of an
+// archive with only usr/bin/gcc, and for the root, if there is none.
+// readdir finds what is in a directory after it, so that is where
+// its record must be. The root, wherever the archive has it, is
+// record 0, which the fsCPIO is the FileInfo of.
+func addParents(recs []cpio.Record) []cpio.Record {
+	have := map[string]bool{}
+	for _, r := range recs {
+		have[r.Name] = true
+	}
+	var made []cpio.Record
+	add := func(d string) {
+		verbose("cpio: %q has no record; made a directory for it", d)
+		made = append(made, cpio.Directory(d, 0755))
+		have[d] = true
+	}
+	out := make([]cpio.Record, 0, len(recs)+1)
+	if !have["."] {
+		add(".")
+	}
+	for _, r := range recs {
+		if r.Name == "." {
+			out = append([]cpio.Record{r}, out...)
+			continue
+		}
+		var missing []string
+		for d := path.Dir(r.Name); d != "." && d != "/" && !have[d]; d = path.Dir(d) {
+			missing = append(missing, d)
+		}
+		for i := len(missing) - 1; i >= 0; i-- {
+			add(missing[i])
+		}
+		out = append(out, made...)
+		made = made[:0]
+		out = append(out, r)
+	}
+	return append(out, made...)
+}
+
+// NewfsCPIO returns a fsCPIO, properly initialized. c may be cpio
+// files, or tars, layered. Of records with the same name, the last
+// is used, and directories with no record are made.
+func NewfsCPIO(c string, opts ...CPIOOption) (*fsCPIO, error) {
+	files, recs, err := readLayers(c)
 	if err != nil {
 		return nil, err
 	}
+	recs = addParents(dropShadowed(cleanRecords(recs)))
 
 	m := map[string]uint64{}
 	for i, r := range recs {
@@ -354,9 +652,16 @@ func NewfsCPIO(c string, mounts ...MountPoint) (*fsCPIO, error) {
 		m[r.Info.Name] = uint64(i)
 	}
 
-	fs := &fsCPIO{file: f, rr: rr, recs: recs, m: m}
-	for _, m := range mounts {
-		if err := fs.mount(m); err != nil {
+	fs := &fsCPIO{files: files, recs: recs, m: m, maxLinks: defaultMaxLinks}
+	// A compressed layer is read from its cache, so it is the
+	// layer's mtime, not the cache's, which is used.
+	for _, l := range containerLayers(c) {
+		if fi, err := os.Stat(l); err == nil && fi.ModTime().After(fs.mtime) {
+			fs.mtime = fi.ModTime()
+		}
+	}
+	for _, o := range opts {
+		if err := o.apply(fs); err != nil {
 			return nil, err
 		}
 	}
@@ -364,23 +669,27 @@ func NewfsCPIO(c string, mounts ...MountPoint) (*fsCPIO, error) {
 }
 
 // resolvelink will try to follow the symlink to its resolution.
+// Each target is looked up as the first name is, so a link into a
+// mount is read from the mount.
 func (fs *fsCPIO) resolvelink(filename string) (string, error) {
 	// Fun. For as long as readlink works,
-	// and we've done less than (whatevs) 20 readlinks,
+	// and we've done less than fs.maxLinks readlinks,
 	// keep doing it. Then return what is left.
 	var linkcount int
 	var err error
+	name := filename
 	for {
 		var s string
-		if linkcount > 20 {
-			return "", syscall.ELOOP
+		if linkcount > fs.maxLinks {
+			return "", fmt.Errorf("%s: more than %d links: %w", name, fs.maxLinks, syscall.ELOOP)
 		}
 
 		s, err = fs.Readlink(filename)
 		// If we have walked it once, the first target was
 		// a symlink. If it fails the first read, that is an
-		// error.
-		if linkcount > 0 && err == os.ErrInvalid {
+		// error. A mount's Readlink returns EINVAL, which is
+		// not os.ErrInvalid, wrapped.
+		if linkcount > 0 && (errors.Is(err, os.ErrInvalid) || errors.Is(err, syscall.EINVAL)) {
 			err = nil
 			break
 		}
@@ -388,10 +697,12 @@ func (fs *fsCPIO) resolvelink(filename string) (string, error) {
 			break
 		}
 		linkcount++
+		// Names are relative to the root, as absolute
+		// links are.
 		if !path.IsAbs(s) {
 			s = filepath.Join(filepath.Dir(filename), s)
 		}
-		filename = s
+		filename = archiveName(s)
 	}
 	return filename, err
 }
@@ -416,13 +727,16 @@ func (fs *fsCPIO) Stat(filename string) (os.FileInfo, error) {
 	// Don't do this. The client does it.
 	// filename, err := fs.resolvelink(filename)
 
+	if fi, ok := fs.upper(filename); ok {
+		return fi, nil
+	}
+
 	l, err := fs.lookup(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	fi := &fstat{Record: &fs.recs[l.(*file).Path]}
-	return fi, nil
+	return fs.stat(&fs.recs[l.(*file).Path]), nil
 }
 
 // Lstat implements Lstat.
@@ -434,16 +748,24 @@ func (fs *fsCPIO) Lstat(filename string) (os.FileInfo, error) {
 		verbose("m %v err %v", m, err)
 		return m, err
 	}
+	if fi, ok := fs.upper(filename); ok {
+		return fi, nil
+	}
 	l, err := fs.lookup(filename)
 	if err != nil {
 		return nil, err
 	}
-	return &fstat{Record: &fs.recs[l.(*file).Path]}, nil
+	return fs.stat(&fs.recs[l.(*file).Path]), nil
+}
+
+// stat returns the fs.FileInfo of a record.
+func (fs *fsCPIO) stat(r *cpio.Record) *fstat {
+	return &fstat{Record: r, mtime: fs.mtime}
 }
 
 // rec returns a cpio.Record for a file.
 func (l *file) rec() (*cpio.Record, error) {
-	if int(l.Path) > len(l.fs.recs) {
+	if l.Path >= uint64(len(l.fs.recs)) {
 		return nil, os.ErrNotExist
 	}
 	v("cpio:rec for %v is %v", l, l.fs.recs[l.Path])
@@ -462,13 +784,16 @@ func (fs *fsCPIO) getfs(filename string) (billy.Filesystem, string, error) {
 
 // lookup looks up a name in the fsCPIO. If the name is "",
 // the root is assumed (this is what billy seems to require).
+// The name is cleaned as those of the records are, so ./etc/hosts
+// and /etc/hosts are etc/hosts, and . and / are the root. A record
+// with a whiteout in the overlay is not there.
 func (fs *fsCPIO) lookup(filename string) (billy.File, error) {
 	var ino uint64
-	if len(filename) > 0 {
+	if filename = archiveName(filename); filename != "." {
 		var ok bool
 		ino, ok = fs.m[filename]
 		verbose("lookup %q ino %d %v", filename, ino, ok)
-		if !ok {
+		if !ok || fs.overlay != nil && fs.overlay.whiteouts.covers(filename) {
 			return nil, os.ErrNotExist
 		}
 	}
@@ -483,12 +808,16 @@ func (fs *fsCPIO) Join(elem ...string) string {
 	return n
 }
 
-// Open implements Open, searching, first, the mount points.
+// Open implements Open, searching, first, the mount points, and then
+// the overlay.
 func (fs *fsCPIO) Open(filename string) (billy.File, error) {
 	verbose("fs: Open %q", filename)
 	if osfs, rel, err := fs.getfs(filename); err == nil {
 		return osfs.Open(rel)
 	}
+	if _, ok := fs.upper(filename); ok {
+		return fs.overlay.fs.Open(archiveName(filename))
+	}
 	return fs.lookup(filename)
 }
 
@@ -498,13 +827,51 @@ func (fs *fsCPIO) Create(filename string) (billy.File, error) {
 	if osfs, rel, err := fs.getfs(filename); err == nil {
 		return osfs.Create(rel)
 	}
+	if fs.overlay != nil {
+		return fs.overlayOpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	}
 	return nil, os.ErrPermission
 }
 
-// TempFile implements billy.TempFile
-// Not sure of all the implications of this just yet, especially the
-// default behavior, so for now, Just Don't Do It.
+// tempFile is a file TempFile made, in a mount or the overlay, with
+// the name it has in the fsCPIO, which the nfs client knows it by,
+// not the one it has where it was made.
+type tempFile struct {
+	billy.File
+	name string
+}
+
+// Name implements Name.
+func (t *tempFile) Name() string {
+	return t.name
+}
+
+// mergedName returns the name, in the fsCPIO, of a file, f, of bfs,
+// which is at n in it. An osfs names its files by their host paths,
+// which are under its root.
+func mergedName(n string, bfs billy.Filesystem, f string) string {
+	if filepath.IsAbs(f) {
+		if r, err := filepath.Rel(bfs.Root(), f); err == nil {
+			f = filepath.ToSlash(r)
+		}
+	}
+	return archiveName(path.Join(n, f))
+}
+
+// TempFile implements billy.TempFile, in the mount dir is in, or, if
+// it is in none, the overlay.
 func (fs *fsCPIO) TempFile(dir, prefix string) (billy.File, error) {
+	verbose("fs: TempFile %q %q", dir, prefix)
+	if m, rel, err := fs.hasMount(dir); err == nil {
+		f, err := m.fs.TempFile(rel, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return &tempFile{File: f, name: mergedName(m.n, m.fs, f.Name())}, nil
+	}
+	if fs.overlay != nil {
+		return fs.overlayTempFile(dir, prefix)
+	}
 	return nil, os.ErrPermission
 }
 
@@ -516,6 +883,9 @@ func (fs *fsCPIO) Symlink(value, path string) error {
 	if osfs, rel, err := fs.getfs(path); err == nil {
 		return osfs.Symlink(value, rel)
 	}
+	if fs.overlay != nil {
+		return fs.overlaySymlink(value, path)
+	}
 	return os.ErrPermission
 }
 
@@ -538,6 +908,9 @@ func (fs *fsCPIO) Rename(oldpath, newpath string) error {
 
 		return newosfs.Rename(oldrel, newrel)
 	}
+	if fs.overlay != nil {
+		return fs.overlayRename(oldpath, newpath)
+	}
 	return os.ErrPermission
 }
 
@@ -547,15 +920,27 @@ func (fs *fsCPIO) MkdirAll(filename string, perm os.FileMode) error {
 	if osfs, rel, err := fs.getfs(filename); err == nil {
 		return osfs.MkdirAll(rel, perm)
 	}
+	if fs.overlay != nil {
+		return fs.overlayMkdirAll(filename, perm)
+	}
 	return os.ErrPermission
 }
 
 // OpenFile implements OpenFile, searching, first, the mount points.
+// Outside them, a file opened to be read is opened as Open opens it,
+// and one opened to be written is written in the overlay, if there
+// is one.
 func (fs *fsCPIO) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
 	verbose("fs: OpenFile %q", filename)
 	if osfs, rel, err := fs.getfs(filename); err == nil {
 		return osfs.OpenFile(rel, flag, perm)
 	}
+	if flag&writeFlags == 0 {
+		return fs.Open(filename)
+	}
+	if fs.overlay != nil {
+		return fs.overlayOpenFile(filename, flag, perm)
+	}
 	return nil, os.ErrPermission
 }
 
@@ -563,7 +948,11 @@ func (fs *fsCPIO) OpenFile(filename string, flag int, perm os.FileMode) (billy.F
 func (l *file) ReadAt(p []byte, offset int64) (int, error) {
 	r, err := l.rec()
 	if err != nil {
-		return -1, err
+		return 0, err
+	}
+	// A record which is made, e.g. a directory, has nothing to read.
+	if r.ReaderAt == nil {
+		return 0, io.EOF
 	}
 	return r.ReadAt(p, offset)
 }
@@ -574,12 +963,16 @@ func (fs *fsCPIO) Remove(filename string) error {
 	if osfs, rel, err := fs.getfs(filename); err == nil {
 		return osfs.Remove(rel)
 	}
+	if fs.overlay != nil {
+		return fs.overlayRemove(filename)
+	}
 	return os.ErrPermission
 }
 
 // Write implements nfs.WriteAt.
 func (l *file) WriteAt(p []byte, offset int64) (int, error) {
-	return -1, os.ErrPermission
+	verbose("cpio: WriteAt of %d: a cpio can not be written", l.Path)
+	return 0, os.ErrPermission
 }
 
 // readdir returns a slice of indices for a directory, from
@@ -612,6 +1005,12 @@ func (l *file) readdir() ([]uint64, error) {
 		verbose("cpio:readdir: %v", i)
 		list = append(list, uint64(i)+l.Path+1)
 	}
+	// The order of the archive depends on the tool which wrote it;
+	// the order of the names does not.
+	recs := l.fs.recs
+	sort.Slice(list, func(i, j int) bool {
+		return path.Base(recs[list[i]].Name) < path.Base(recs[list[j]].Name)
+	})
 	return list, nil
 }
 
@@ -632,16 +1031,20 @@ func (l *file) ReadDir(offset uint64, count uint32) ([]fs.FileInfo, error) {
 	}
 	// NOTE: go-nfs takes care of . and .., so it is ok to skip it here.
 	verbose("cpio:readdir list %v", list)
+	list = list[offset:]
+	if uint64(count) < uint64(len(list)) {
+		list = list[:count]
+	}
 	dirents := make([]os.FileInfo, 0, len(list))
 	//verbose("cpio:readdir %q returns %d entries start at offset %d", l.Path, len(fi), offset)
-	for _, i := range list[offset:] {
-		entry := file{Path: i + offset, fs: l.fs}
+	for _, i := range list {
+		entry := file{Path: i, fs: l.fs}
 		r, err := entry.rec()
 		if err != nil {
 			continue
 		}
-		verbose("cpio:add path %d %q", i+offset, filepath.Base(r.Info.Name))
-		dirents = append(dirents, &fstat{Record: r})
+		verbose("cpio:add path %d %q", i, filepath.Base(r.Info.Name))
+		dirents = append(dirents, l.fs.stat(r))
 	}
 
 	verbose("cpio:readdir:return %v, nil", dirents)
@@ -655,7 +1058,7 @@ func (l *file) Readlink() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if (&fstat{Record: r}).Mode().Type() != fs.ModeSymlink {
+	if l.fs.stat(r).Mode().Type() != fs.ModeSymlink {
 		return "", os.ErrInvalid
 	}
 	link := make([]byte, r.FileSize, r.FileSize)
@@ -670,16 +1073,19 @@ func (l *file) Readlink() (string, error) {
 
 // srvNFS sets up an nfs server. dir string is for things like home.
 // it might be dir ...string some day?
-func srvNFS(cl *client.Cmd, n string, dir string) (func() error, string, error) {
-	mdir, err := filepath.Rel("/", dir)
+// The returned io.Closer closes the listener, which stops the server,
+// and the nfsExport is what it serves, for the fstab. If compress is
+// set, and cpud will, the stream is compressed.
+func srvNFS(cl *client.Cmd, n string, dir string, compress bool) (func() error, io.Closer, *nfsExport, error) {
+	mdir, err := exportPath(dir)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, nil, err
 	}
 	osfs := NewOSFS(dir)
 	verbose("Create New OSFS with %q", dir)
-	mem, err := NewfsCPIO(n, WithMount(mdir, osfs))
+	mem, err := newContainerFS(n, WithMount(mdir, osfs))
 	if err != nil {
-		return nil, "", err
+		return nil, nil, nil, err
 	}
 	l, err := cl.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -690,23 +1096,26 @@ func srvNFS(cl *client.Cmd, n string, dir string) (func() error, string, error)
 		// might not.
 		l, err = cl.Listen("tcp", "[::1]:0")
 		if err != nil {
-			return nil, "", fmt.Errorf("cpu client listen for forwarded nfs port %v", err)
+			return nil, nil, nil, fmt.Errorf("cpu client listen for forwarded nfs port %v", err)
 		}
 	}
 	verbose("ssh.listener %v", l.Addr().String())
 	ap := strings.Split(l.Addr().String(), ":")
 	if len(ap) == 0 {
-		return nil, "", fmt.Errorf("Can't find a port number in %v", l.Addr().String())
+		return nil, nil, nil, fmt.Errorf("Can't find a port number in %v", l.Addr().String())
 	}
 	portnfs, err := strconv.ParseUint(ap[len(ap)-1], 0, 16)
 	if err != nil {
-		return nil, "", fmt.Errorf("Can't find a 16-bit port number in %v", l.Addr().String())
+		return nil, nil, nil, fmt.Errorf("Can't find a 16-bit port number in %v", l.Addr().String())
 	}
 	verbose("listener %T %v addr %v port %v", l, l, l.Addr().String(), portnfs)
+	if compress {
+		l = compressListener(cl.Client(), l, uint16(portnfs))
+	}
 
 	u, err := uuid.NewRandom()
 	if err != nil {
-		return nil, "", err
+		return nil, nil, nil, err
 	}
 	handler := NewNullAuthHandler(l, COS{mem}, u.String())
 	verbose("uuid is %q", u.String())
@@ -714,8 +1123,7 @@ func srvNFS(cl *client.Cmd, n string, dir string) (func() error, string, error)
 	f := func() error {
 		return nfs.Serve(l, cacheHelper)
 	}
-	fstab := fmt.Sprintf("127.0.0.1:%s /tmp/cpu nfs rw,relatime,vers=3,rsize=1048576,wsize=1048576,namlen=255,hard,nolock,proto=tcp,port=%d,timeo=600,retrans=2,sec=sys,mountaddr=127.0.0.1,mountvers=3,mountport=%d,mountproto=tcp,local_lock=all,addr=127.0.0.1 0 0\n", u, portnfs, portnfs)
-	return f, fstab, nil
+	return f, l, &nfsExport{nonce: u.String(), port: portnfs}, nil
 }
 
 // auth handler for our special sauce.
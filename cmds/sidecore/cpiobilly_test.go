@@ -5,13 +5,25 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/u-root/u-root/pkg/cpio"
+	nfs "github.com/willscott/go-nfs"
 )
 
 func TestBillyFS(t *testing.T) {
@@ -391,3 +403,648 @@ func TestBillyFSSymlink(t *testing.T) {
 		t.Errorf("Symlink \"a/b\" -> \"value\": nil != an error")
 	}
 }
+
+func TestBillyModTime(t *testing.T) {
+	// The mtime of a/b/c/d/hosts, as cpio -tv shows it, is read from
+	// its newc header, 110 bytes before its name.
+	b, err := os.ReadFile("data/a.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(b, []byte("./a/b/c/d/hosts\x00"))
+	if i < 110 || string(b[i-110:i-104]) != "070701" {
+		t.Fatalf("data/a.cpio: no newc header for ./a/b/c/d/hosts")
+	}
+	s, err := strconv.ParseInt(string(b[i-110+46:i-110+54]), 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Unix(s, 0)
+
+	fs, err := NewfsCPIO("data/a.cpio")
+	if err != nil {
+		t.Fatalf("NewfsCPIO(\"data/a.cpio\"): %v != nil", err)
+	}
+	fi, err := fs.Stat("a/b/c/d/hosts")
+	if err != nil {
+		t.Fatalf("Stat(\"a/b/c/d/hosts\"): %v != nil", err)
+	}
+	if got := fi.ModTime(); !got.Equal(want) {
+		t.Errorf("a/b/c/d/hosts: ModTime %v != %v", got, want)
+	}
+	if got := nfs.ToFileAttribute(fi, "a/b/c/d/hosts").Mtime.Native(); !got.Equal(want) {
+		t.Errorf("a/b/c/d/hosts: NFS mtime %v != %v", got, want)
+	}
+	if got := fs.ModTime(); got.Unix() == 0 {
+		t.Errorf("fsCPIO ModTime: %v != the mtime of record 0", got)
+	}
+
+	// A record with no mtime, as in reproducible builds, has that of
+	// the archive.
+	p := writeCPIO(t, t.TempDir(), "zero.cpio",
+		cpio.Directory(".", 0755),
+		cpio.StaticFile("f", "f\n", 0644))
+	archive := time.Unix(1700000000, 0)
+	if err := os.Chtimes(p, archive, archive); err != nil {
+		t.Fatal(err)
+	}
+	zfs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+	zfi, err := zfs.Stat("f")
+	if err != nil {
+		t.Fatalf("Stat(\"f\"): %v != nil", err)
+	}
+	if got := zfi.ModTime(); !got.Equal(archive) {
+		t.Errorf("f: ModTime %v != %v", got, archive)
+	}
+	if got := zfs.ModTime(); !got.Equal(archive) {
+		t.Errorf("fsCPIO ModTime: %v != %v", got, archive)
+	}
+}
+
+func TestBillyFSMissingParents(t *testing.T) {
+	// The archive has no records for ., usr, usr/bin or usr/lib.
+	p := writeCPIO(t, t.TempDir(), "parents.cpio",
+		cpio.StaticFile("usr/bin/gcc", "gcc\n", 0755),
+		cpio.StaticFile("usr/bin/cc", "cc\n", 0755),
+		cpio.StaticFile("usr/lib/libc.so", "libc\n", 0644),
+		cpio.Directory("etc", 0700),
+		cpio.StaticFile("etc/hosts", "hosts\n", 0644))
+	fs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+	for _, tt := range []struct {
+		dir  string
+		want []string
+	}{
+		{dir: "", want: []string{"etc", "usr"}},
+		{dir: "usr", want: []string{"bin", "lib"}},
+		{dir: "usr/bin", want: []string{"cc", "gcc"}},
+		{dir: "usr/lib", want: []string{"libc.so"}},
+		{dir: "etc", want: []string{"hosts"}},
+	} {
+		if len(tt.dir) > 0 {
+			fi, err := fs.Stat(tt.dir)
+			if err != nil || !fi.IsDir() {
+				t.Errorf("Stat(%q): %v != a directory, nil", tt.dir, err)
+				continue
+			}
+			if tt.dir != "etc" && fi.Mode().Perm() != 0755 {
+				t.Errorf("Stat(%q): mode %v != %v", tt.dir, fi.Mode().Perm(), os.FileMode(0755))
+			}
+		}
+		ents, err := fs.ReadDir(tt.dir)
+		if err != nil {
+			t.Errorf("ReadDir(%q): %v != nil", tt.dir, err)
+			continue
+		}
+		var got []string
+		for _, e := range ents {
+			got = append(got, e.Name())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadDir(%q): %q != %q", tt.dir, got, tt.want)
+		}
+	}
+	if fi, err := fs.Stat("etc"); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("Stat(\"etc\"): the record, 0700, was not kept: %v", err)
+	}
+	f, err := fs.Open("usr/bin/gcc")
+	if err != nil {
+		t.Fatalf("Open(\"usr/bin/gcc\"): %v != nil", err)
+	}
+	defer f.Close()
+	b := make([]byte, 16)
+	if n, _ := f.ReadAt(b, 0); string(b[:n]) != "gcc\n" {
+		t.Errorf("usr/bin/gcc: %q != %q", b[:n], "gcc\n")
+	}
+}
+
+func TestBillyFSNames(t *testing.T) {
+	// find . | cpio -o writes ./ names, and some tools, / names.
+	p := writeCPIO(t, t.TempDir(), "names.cpio",
+		cpio.Directory(".", 0755),
+		cpio.Directory("./etc", 0755),
+		cpio.StaticFile("./etc/hosts", "hosts\n", 0644),
+		cpio.StaticFile("/etc/passwd", "passwd\n", 0644),
+		cpio.StaticFile("etc/group", "group\n", 0644),
+		cpio.StaticFile("etc/../../escape", "escape\n", 0644))
+	fs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+	for _, n := range []string{"etc/hosts", "./etc/hosts", "/etc/hosts", "etc//hosts", "etc/passwd", "./etc/passwd", "etc/group", "/etc/group"} {
+		if fi, err := fs.Stat(n); err != nil || fi.IsDir() {
+			t.Errorf("Stat(%q): %v != a file, nil", n, err)
+		}
+	}
+	for _, n := range []string{"", ".", "/", "./"} {
+		if fi, err := fs.Stat(n); err != nil || !fi.IsDir() {
+			t.Errorf("Stat(%q): %v != the root, nil", n, err)
+		}
+	}
+	ents, err := fs.ReadDir("etc")
+	if err != nil {
+		t.Fatalf("ReadDir(\"etc\"): %v != nil", err)
+	}
+	var got []string
+	for _, e := range ents {
+		got = append(got, e.Name())
+	}
+	if want := []string{"group", "hosts", "passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"etc\"): %q != %q", got, want)
+	}
+	for _, r := range fs.recs {
+		if hasDotDot(r.Name) || r.Name == "escape" {
+			t.Errorf("%q: a name with .. was not left out", r.Name)
+		}
+	}
+
+	recs := cleanRecords([]cpio.Record{
+		{Info: cpio.Info{Name: "./a/b"}},
+		{Info: cpio.Info{Name: "/a/c"}},
+		{Info: cpio.Info{Name: "a//d/"}},
+		{Info: cpio.Info{Name: "../e"}},
+		{Info: cpio.Info{Name: cpio.Trailer}},
+	})
+	got = nil
+	for _, r := range recs {
+		got = append(got, r.Name)
+	}
+	if want := []string{"a/b", "a/c", "a/d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cleanRecords: %q != %q", got, want)
+	}
+}
+
+func TestBillyFSDuplicates(t *testing.T) {
+	// The cpio writer writes a name only once, so the archive is
+	// written by two, as cat of two archives, less the first
+	// trailer, would be.
+	var b bytes.Buffer
+	for _, recs := range [][]cpio.Record{
+		{
+			cpio.Directory(".", 0755),
+			cpio.Directory("etc", 0755),
+			cpio.StaticFile("etc/hosts", "old\n", 0644),
+			cpio.StaticFile("etc/passwd", "passwd\n", 0644),
+		},
+		{cpio.StaticFile("etc/hosts", "the newer hosts\n", 0600)},
+	} {
+		if err := cpio.WriteRecords(cpio.Newc.Writer(&b), recs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cpio.WriteTrailer(cpio.Newc.Writer(&b)); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "dup.cpio")
+	if err := os.WriteFile(p, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+	fi, err := fs.Stat("etc/hosts")
+	if err != nil {
+		t.Fatalf("Stat(\"etc/hosts\"): %v != nil", err)
+	}
+	if fi.Size() != int64(len("the newer hosts\n")) || fi.Mode().Perm() != 0600 {
+		t.Errorf("Stat(\"etc/hosts\"): %d bytes, %v != %d bytes, %v", fi.Size(), fi.Mode().Perm(), len("the newer hosts\n"), os.FileMode(0600))
+	}
+	ents, err := fs.ReadDir("etc")
+	if err != nil {
+		t.Fatalf("ReadDir(\"etc\"): %v != nil", err)
+	}
+	var got []string
+	for _, e := range ents {
+		got = append(got, e.Name())
+		if e.Name() == "hosts" && e.Size() != fi.Size() {
+			t.Errorf("ReadDir(\"etc\"): hosts is %d bytes, Stat %d", e.Size(), fi.Size())
+		}
+	}
+	if want := []string{"hosts", "passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"etc\"): %q != %q", got, want)
+	}
+}
+
+func TestBillyReadDirChunks(t *testing.T) {
+	// The archive is not in name order, as find | cpio writes it.
+	names := []string{"m", "c", "x", "a", "q", "b", "z"}
+	recs := []cpio.Record{cpio.Directory(".", 0755), cpio.Directory("d", 0755)}
+	for _, n := range names {
+		recs = append(recs, cpio.StaticFile("d/"+n, n, 0644))
+	}
+	p := writeCPIO(t, t.TempDir(), "chunks.cpio", recs...)
+	fs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+	l, err := fs.lookup("d")
+	if err != nil {
+		t.Fatalf("lookup(\"d\"): %v != nil", err)
+	}
+	d := l.(*file)
+	var got []string
+	for off := uint64(0); ; {
+		ents, err := d.ReadDir(off, 3)
+		if err != nil {
+			t.Fatalf("ReadDir(%d, 3): %v != nil", off, err)
+		}
+		if len(ents) == 0 {
+			break
+		}
+		if len(ents) > 3 {
+			t.Fatalf("ReadDir(%d, 3): %d entries, more than 3", off, len(ents))
+		}
+		for _, e := range ents {
+			got = append(got, e.Name())
+		}
+		off += uint64(len(ents))
+	}
+	want := append([]string{}, names...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir in chunks of 3: %q != %q", got, want)
+	}
+	if _, err := d.ReadDir(uint64(len(names)+1), 3); err != io.EOF {
+		t.Errorf("ReadDir(%d, 3): %v != %v", len(names)+1, err, io.EOF)
+	}
+}
+
+func TestBillyReadDirPages(t *testing.T) {
+	// a is followed by b, whose entries an offset added twice reached.
+	recs := []cpio.Record{cpio.Directory(".", 0755), cpio.Directory("a", 0755)}
+	for i := 0; i < 40; i++ {
+		recs = append(recs, cpio.StaticFile(fmt.Sprintf("a/%02d", i), "a", 0644))
+	}
+	recs = append(recs, cpio.Directory("b", 0755))
+	for i := 0; i < 40; i++ {
+		recs = append(recs, cpio.StaticFile(fmt.Sprintf("b/b%02d", i), "b", 0644))
+	}
+	p := writeCPIO(t, t.TempDir(), "pages.cpio", recs...)
+	fs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+	l, err := fs.lookup("a")
+	if err != nil {
+		t.Fatalf("lookup(\"a\"): %v != nil", err)
+	}
+	for _, tt := range []struct {
+		offset uint64
+		count  uint32
+		want   []string
+	}{
+		{offset: 0, count: 2, want: []string{"00", "01"}},
+		{offset: 16, count: 3, want: []string{"16", "17", "18"}},
+		{offset: 38, count: 16, want: []string{"38", "39"}},
+		{offset: 40, count: 16},
+	} {
+		ents, err := l.(*file).ReadDir(tt.offset, tt.count)
+		if err != nil {
+			t.Errorf("ReadDir(%d, %d): %v != nil", tt.offset, tt.count, err)
+			continue
+		}
+		var got []string
+		for _, e := range ents {
+			got = append(got, e.Name())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadDir(%d, %d): %q != %q", tt.offset, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestBillyHasMount(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewfsCPIO("data/a.cpio",
+		WithMount("usr", NewOSFS(dir)),
+		WithMount("home", NewOSFS(dir)),
+		WithMount("home/glenda/src", NewOSFS(dir)))
+	if err != nil {
+		t.Fatalf("NewfsCPIO(\"data/a.cpio\", usr, home, home/glenda/src): %v != nil", err)
+	}
+	for _, tt := range []struct {
+		n     string
+		mount string
+		rel   string
+	}{
+		{n: "usr", mount: "usr", rel: "."},
+		{n: "usr/", mount: "usr", rel: "."},
+		{n: "/usr/bin", mount: "usr", rel: "bin"},
+		{n: "usr/bin/foo", mount: "usr", rel: "bin/foo"},
+		{n: "usrlocal"},
+		{n: "usrlocal/bin/foo"},
+		{n: "us"},
+		{n: "home/glenda", mount: "home", rel: "glenda"},
+		{n: "home/glenda/src", mount: "home/glenda/src", rel: "."},
+		{n: "home/glenda/src/x/y", mount: "home/glenda/src", rel: "x/y"},
+		{n: "home/glenda/srcx", mount: "home", rel: "glenda/srcx"},
+		{n: "a/b/c"},
+	} {
+		m, rel, err := fs.hasMount(tt.n)
+		if len(tt.mount) == 0 {
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("hasMount(%q): %v != %v", tt.n, err, os.ErrNotExist)
+			}
+			continue
+		}
+		if err != nil || m.n != tt.mount || rel != tt.rel {
+			t.Errorf("hasMount(%q): %v, %q, %v != %q, %q, nil", tt.n, m, rel, err, tt.mount, tt.rel)
+		}
+	}
+
+	if _, err := NewfsCPIO("data/a.cpio", WithMount("usr", NewOSFS(dir)), WithMount("usr/", NewOSFS(dir))); !errors.Is(err, os.ErrExist) {
+		t.Errorf("NewfsCPIO(\"data/a.cpio\", usr, usr/): %v != %v", err, os.ErrExist)
+	}
+}
+
+func TestBillyResolvelink(t *testing.T) {
+	// a/b/3 is 3 links, to 2, 1 and hosts, from a/b/c/d/hosts.
+	for _, tt := range []struct {
+		max int
+		err error
+	}{
+		{max: 4},
+		{max: 3, err: syscall.ELOOP},
+	} {
+		fs, err := NewfsCPIO("data/a.cpio", WithMaxLinks(tt.max))
+		if err != nil {
+			t.Fatalf("NewfsCPIO(\"data/a.cpio\", WithMaxLinks(%d)): %v != nil", tt.max, err)
+		}
+		n, err := fs.resolvelink("a/b/3")
+		if !errors.Is(err, tt.err) {
+			t.Errorf("WithMaxLinks(%d): resolvelink(\"a/b/3\"): %v != %v", tt.max, err, tt.err)
+			continue
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), "a/b/3") {
+				t.Errorf("WithMaxLinks(%d): resolvelink(\"a/b/3\"): %q does not name a/b/3", tt.max, err)
+			}
+			continue
+		}
+		if n != "a/b/c/d/hosts" {
+			t.Errorf("WithMaxLinks(%d): resolvelink(\"a/b/3\"): %q != %q", tt.max, n, "a/b/c/d/hosts")
+		}
+	}
+	if _, err := NewfsCPIO("data/a.cpio", WithMaxLinks(0)); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("NewfsCPIO(\"data/a.cpio\", WithMaxLinks(0)): %v != %v", err, os.ErrInvalid)
+	}
+
+	// A link in the archive to a link in a mount is followed there.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "real"), []byte("real\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	p := writeCPIO(t, t.TempDir(), "links.cpio",
+		cpio.Directory(".", 0755),
+		cpio.Symlink("tomount", "m/link"))
+	fs, err := NewfsCPIO(p, WithMount("m", NewOSFS(dir)))
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q, WithMount(\"m\", ...)): %v != nil", p, err)
+	}
+	if n, err := fs.resolvelink("tomount"); err != nil || n != "m/real" {
+		t.Errorf("resolvelink(\"tomount\"): %q, %v != %q, nil", n, err, "m/real")
+	}
+}
+
+func TestBillyFileUnsupported(t *testing.T) {
+	p := writeCPIO(t, t.TempDir(), "stubs.cpio", cpio.StaticFile("usr/bin/gcc", "gcc\n", 0755))
+	fs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+	f, err := fs.Open("usr/bin/gcc")
+	if err != nil {
+		t.Fatalf("Open(\"usr/bin/gcc\"): %v != nil", err)
+	}
+	if n := f.Name(); n != "gcc" {
+		t.Errorf("Name(): %q != %q", n, "gcc")
+	}
+	if n, err := f.Write([]byte("x")); n != 0 || !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Write: %d, %v != 0, %v", n, err, os.ErrPermission)
+	}
+	if n, err := f.(*file).WriteAt([]byte("x"), 0); n != 0 || !errors.Is(err, os.ErrPermission) {
+		t.Errorf("WriteAt: %d, %v != 0, %v", n, err, os.ErrPermission)
+	}
+	// A Read of -1 made io.ReadAll panic.
+	if b, err := io.ReadAll(f); err != nil || string(b) != "gcc\n" {
+		t.Errorf("io.ReadAll: %q, %v != %q, nil", b, err, "gcc\n")
+	}
+	if err := f.Truncate(0); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Truncate: %v != %v", err, os.ErrPermission)
+	}
+
+	// usr has no record, so there is nothing to read from it.
+	d, err := fs.Open("usr")
+	if err != nil {
+		t.Fatalf("Open(\"usr\"): %v != nil", err)
+	}
+	if n, err := d.ReadAt(make([]byte, 4), 0); n != 0 || err != io.EOF {
+		t.Errorf("usr: ReadAt: %d, %v != 0, %v", n, err, io.EOF)
+	}
+
+	past := &file{Path: uint64(len(fs.recs)), fs: fs}
+	if n := past.Name(); n != "" {
+		t.Errorf("Name() of no record: %q != \"\"", n)
+	}
+	if _, err := past.ReadAt(make([]byte, 4), 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadAt of no record: %v != %v", err, os.ErrNotExist)
+	}
+}
+
+func TestBillyFileRead(t *testing.T) {
+	p := writeCPIO(t, t.TempDir(), "read.cpio", cpio.StaticFile("f", "0123456789", 0644))
+	fs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+	f, err := fs.Open("f")
+	if err != nil {
+		t.Fatalf("Open(\"f\"): %v != nil", err)
+	}
+	b := make([]byte, 4)
+	for _, want := range []string{"0123", "4567", "89"} {
+		if n, err := f.Read(b); string(b[:n]) != want || err != nil && err != io.EOF {
+			t.Errorf("Read: %q, %v != %q, nil", b[:n], err, want)
+		}
+	}
+	if n, err := f.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end: %d, %v != 0, %v", n, err, io.EOF)
+	}
+
+	for _, tt := range []struct {
+		offset int64
+		whence int
+		want   int64
+		err    error
+	}{
+		{offset: 2, whence: io.SeekStart, want: 2},
+		{offset: 3, whence: io.SeekCurrent, want: 5},
+		{offset: -1, whence: io.SeekEnd, want: 9},
+		{offset: 0, whence: io.SeekEnd, want: 10},
+		{offset: -11, whence: io.SeekEnd, want: 10, err: os.ErrInvalid},
+		{offset: 11, whence: io.SeekStart, want: 10, err: os.ErrInvalid},
+		{offset: 0, whence: 7, want: 10, err: os.ErrInvalid},
+	} {
+		if got, err := f.Seek(tt.offset, tt.whence); got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("Seek(%d, %d): %d, %v != %d, %v", tt.offset, tt.whence, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	// ReadAt does not move the offset, and may be used while Read is.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 2)
+			if n, err := f.ReadAt(b, 0); n != 2 || string(b) != "01" {
+				t.Errorf("ReadAt(0): %q, %v != %q, nil", b[:n], err, "01")
+			}
+		}()
+	}
+	wg.Wait()
+	if n, _ := f.Read(b); string(b[:n]) != "6789" {
+		t.Errorf("Read after Seek(6): %q != %q", b[:n], "6789")
+	}
+}
+
+func TestBillyFSRoot(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		recs []cpio.Record
+		perm os.FileMode
+	}{
+		{
+			name: "root after a file",
+			recs: []cpio.Record{cpio.StaticFile("f", "a file, first\n", 0644), cpio.Directory(".", 0750), cpio.Directory("d", 0755)},
+			perm: 0750,
+		},
+		{
+			name: "no root",
+			recs: []cpio.Record{cpio.StaticFile("f", "a file, first\n", 0644), cpio.Directory("d", 0755)},
+			perm: 0755,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeCPIO(t, t.TempDir(), "root.cpio", tt.recs...)
+			fs, err := NewfsCPIO(p)
+			if err != nil {
+				t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+			}
+			if fs.Name() != "." || !fs.IsDir() || fs.Mode().Perm() != tt.perm || fs.Size() != 0 {
+				t.Errorf("fsCPIO: %q, %v, %d bytes != \".\", %v, 0 bytes", fs.Name(), fs.Mode(), fs.Size(), os.ModeDir|tt.perm)
+			}
+			for _, n := range []string{"", "."} {
+				fi, err := fs.Stat(n)
+				if err != nil {
+					t.Fatalf("Stat(%q): %v != nil", n, err)
+				}
+				if fi.Name() != "." || !fi.IsDir() || fi.Mode().Perm() != tt.perm {
+					t.Errorf("Stat(%q): %q, %v != \".\", %v", n, fi.Name(), fi.Mode(), os.ModeDir|tt.perm)
+				}
+			}
+			ents, err := fs.ReadDir("")
+			if err != nil {
+				t.Fatalf("ReadDir(\"\"): %v != nil", err)
+			}
+			var got []string
+			for _, e := range ents {
+				got = append(got, e.Name())
+			}
+			if want := []string{"d", "f"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("ReadDir(\"\"): %q != %q", got, want)
+			}
+		})
+	}
+}
+
+func TestBillyTempFile(t *testing.T) {
+	dir := t.TempDir()
+	rdir, err := filepath.Rel("/", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewfsCPIO("data/a.cpio", WithMount(rdir, NewOSFS(dir)))
+	if err != nil {
+		t.Fatalf("NewfsCPIO(\"data/a.cpio\", WithMount(%q, ...)): %v != nil", rdir, err)
+	}
+	f, err := fs.TempFile("/"+rdir, "tmp")
+	if err != nil {
+		t.Fatalf("TempFile(%q, \"tmp\"): %v != nil", "/"+rdir, err)
+	}
+	defer f.Close()
+	if !strings.HasPrefix(f.Name(), rdir+"/tmp") {
+		t.Errorf("TempFile(%q, \"tmp\"): Name() %q does not start with %q", "/"+rdir, f.Name(), rdir+"/tmp")
+	}
+	if _, err := f.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write(%q): %v != nil", f.Name(), err)
+	}
+	if fi, err := fs.Stat(f.Name()); err != nil || fi.Size() != 2 {
+		t.Errorf("Stat(%q): %v, %v != 2 bytes, nil", f.Name(), fi, err)
+	}
+
+	if _, err := fs.TempFile("a/b", "tmp"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("TempFile(\"a/b\", \"tmp\"): %v != %v", err, os.ErrPermission)
+	}
+}
+
+func TestBillyChange(t *testing.T) {
+	dir := t.TempDir()
+	rdir, err := filepath.Rel("/", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewfsCPIO("data/a.cpio", WithMount(rdir, NewOSFS(dir)))
+	if err != nil {
+		t.Fatalf("NewfsCPIO(\"data/a.cpio\", WithMount(%q, ...)): %v != nil", rdir, err)
+	}
+	p := filepath.Join(dir, "x")
+	if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var c billy.Change = fs
+	n := rdir + "/x"
+	if err := c.Chmod(n, 0600); err != nil {
+		t.Fatalf("Chmod(%q, 0600): %v != nil", n, err)
+	}
+	mtime := time.Unix(1<<30, 0)
+	if err := c.Chtimes(n, mtime, mtime); err != nil {
+		t.Fatalf("Chtimes(%q): %v != nil", n, err)
+	}
+	if err := c.Lchown(n, os.Getuid(), os.Getgid()); err != nil {
+		t.Errorf("Lchown(%q) to its owner: %v != nil", n, err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("%s: %v, %v != %v, %v", p, fi.Mode(), fi.ModTime(), os.FileMode(0600), mtime)
+	}
+
+	h := NewNullAuthHandler(nil, COS{fs}, "")
+	if h.Change(fs) == nil {
+		t.Fatalf("NullAuthHandler.Change: nil != a billy.Change")
+	}
+	if err := h.Change(fs).Chmod(n, 0640); err != nil {
+		t.Fatalf("NullAuthHandler.Change().Chmod(%q, 0640): %v != nil", n, err)
+	}
+	if fi, err := os.Stat(p); err != nil || fi.Mode() != 0640 {
+		t.Errorf("%s: %v, %v != %v, nil", p, fi.Mode(), err, os.FileMode(0640))
+	}
+
+	if err := c.Chmod("a/b/c/d/hosts", 0600); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Chmod(\"a/b/c/d/hosts\", 0600): %v != %v", err, os.ErrPermission)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// The cpio package only reads newc. Archives from older tools may be
+// odc, bin, little or big endian, or crc, which is newc with a
+// checksum; those are read here.
+
+// cpioFormats are the cpio formats which can be read.
+const cpioFormats = "newc, crc, odc and bin"
+
+// cpioFormat returns the format of a cpio archive, from its magic.
+func cpioFormat(r io.ReaderAt) (string, error) {
+	b := make([]byte, 6)
+	n, _ := r.ReadAt(b, 0)
+	b = b[:n]
+	switch {
+	case string(b) == "070701":
+		return "newc", nil
+	case string(b) == "070702":
+		return "crc", nil
+	case string(b) == "070707":
+		return "odc", nil
+	case len(b) >= 2 && b[0] == 0xc7 && b[1] == 0x71:
+		return "bin", nil
+	case len(b) >= 2 && b[0] == 0x71 && b[1] == 0xc7:
+		return "bin-be", nil
+	}
+	return "", fmt.Errorf("unsupported cpio format, with magic %q; only %s are supported:%w", b, cpioFormats, os.ErrInvalid)
+}
+
+// oldCPIO reads records of the formats the cpio package does not.
+type oldCPIO struct {
+	r      io.ReaderAt
+	format string
+	pos    int64
+}
+
+// readHeader reads n bytes of header.
+func (o *oldCPIO) readHeader(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := o.r.ReadAt(b, o.pos); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("%s header at %d: %w", o.format, o.pos, err)
+	}
+	o.pos += int64(n)
+	return b, nil
+}
+
+// number parses a field of a header, in base.
+func number(f []byte, base int) (uint64, error) {
+	v, err := strconv.ParseUint(string(f), base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("header field %q:%w", f, os.ErrInvalid)
+	}
+	return v, nil
+}
+
+// readRecord reads the next record. The name and the contents of bin
+// and crc records are padded, to 2 and 4 bytes.
+func (o *oldCPIO) readRecord() (cpio.Record, error) {
+	var i cpio.Info
+	var nameSize uint64
+	align := int64(1)
+	start := o.pos
+	switch o.format {
+	case "odc":
+		h, err := o.readHeader(76)
+		if err != nil {
+			return cpio.Record{}, err
+		}
+		var f [11]uint64
+		off := 6
+		for n, w := range []int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11} {
+			if f[n], err = number(h[off:off+w], 8); err != nil {
+				return cpio.Record{}, err
+			}
+			off += w
+		}
+		dev, rdev := f[0], f[6]
+		i = cpio.Info{Ino: f[1], Mode: f[2], UID: f[3], GID: f[4], NLink: f[5], MTime: f[7], FileSize: f[9]}
+		i.Major, i.Minor, i.Rmajor, i.Rminor = dev>>8, dev&0xff, rdev>>8, rdev&0xff
+		nameSize = f[8]
+	case "bin", "bin-be":
+		h, err := o.readHeader(26)
+		if err != nil {
+			return cpio.Record{}, err
+		}
+		var order binary.ByteOrder = binary.LittleEndian
+		if o.format == "bin-be" {
+			order = binary.BigEndian
+		}
+		var f [13]uint64
+		for n := range f {
+			f[n] = uint64(order.Uint16(h[2*n:]))
+		}
+		dev, rdev := f[1], f[7]
+		i = cpio.Info{Ino: f[2], Mode: f[3], UID: f[4], GID: f[5], NLink: f[6], MTime: f[8]<<16 | f[9], FileSize: f[11]<<16 | f[12]}
+		i.Major, i.Minor, i.Rmajor, i.Rminor = dev>>8, dev&0xff, rdev>>8, rdev&0xff
+		nameSize = f[10]
+		align = 2
+	case "crc":
+		h, err := o.readHeader(110)
+		if err != nil {
+			return cpio.Record{}, err
+		}
+		var f [13]uint64
+		for n := range f {
+			if f[n], err = number(h[6+8*n:14+8*n], 16); err != nil {
+				return cpio.Record{}, err
+			}
+		}
+		i = cpio.Info{Ino: f[0], Mode: f[1], UID: f[2], GID: f[3], NLink: f[4], MTime: f[5], FileSize: f[6], Major: f[7], Minor: f[8], Rmajor: f[9], Rminor: f[10]}
+		nameSize = f[11]
+		align = 4
+	default:
+		return cpio.Record{}, fmt.Errorf("cpio format %q:%w", o.format, os.ErrInvalid)
+	}
+	if nameSize == 0 || nameSize > 4096 {
+		return cpio.Record{}, fmt.Errorf("%s header at %d: name of %d bytes:%w", o.format, start, nameSize, os.ErrInvalid)
+	}
+	name, err := o.readHeader(int(nameSize))
+	if err != nil {
+		return cpio.Record{}, err
+	}
+	o.pos = (o.pos + align - 1) &^ (align - 1)
+	i.Name = cpio.Normalize(string(name[:nameSize-1]))
+	r := cpio.Record{
+		Info:     i,
+		ReaderAt: io.NewSectionReader(o.r, o.pos, int64(i.FileSize)),
+		RecPos:   start,
+		RecLen:   uint64(o.pos - start),
+		FilePos:  o.pos,
+	}
+	o.pos = (o.pos + int64(i.FileSize) + align - 1) &^ (align - 1)
+	return r, nil
+}
+
+// readOldCPIO reads the records of a cpio archive in one of the formats
+// the cpio package does not read, up to its trailer.
+func readOldCPIO(r io.ReaderAt, format string) ([]cpio.Record, error) {
+	o := &oldCPIO{r: r, format: format}
+	var recs []cpio.Record
+	for {
+		rec, err := o.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if rec.Name == cpio.Trailer {
+			return recs, nil
+		}
+		recs = append(recs, rec)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+)
+
+func TestCPIOFormats(t *testing.T) {
+	hosts, err := os.ReadFile("data/a/b/c/d/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newc, err := NewfsCPIO("data/a.cpio")
+	if err != nil {
+		t.Fatalf("NewfsCPIO(\"data/a.cpio\"): %v != nil", err)
+	}
+	want, err := newc.ReadDir("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		archive string
+		format  string
+	}{
+		{archive: "data/a.cpio", format: "newc"},
+		{archive: "data/a.crc.cpio", format: "crc"},
+		{archive: "data/a.odc.cpio", format: "odc"},
+		{archive: "data/a.bin.cpio", format: "bin"},
+		{archive: "data/a.binbe.cpio", format: "bin-be"},
+	} {
+		t.Run(tt.format, func(t *testing.T) {
+			f, err := os.Open(tt.archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if format, err := cpioFormat(f); err != nil || format != tt.format {
+				t.Errorf("cpioFormat(%s): %q, %v != %q, nil", tt.archive, format, err, tt.format)
+			}
+
+			fs, err := NewfsCPIO(tt.archive)
+			if err != nil {
+				t.Fatalf("NewfsCPIO(%q): %v != nil", tt.archive, err)
+			}
+			ents, err := fs.ReadDir("a/b")
+			if err != nil {
+				t.Fatalf("ReadDir(\"a/b\"): %v != nil", err)
+			}
+			var got, wantNames []string
+			for i := range ents {
+				got = append(got, ents[i].Name()+" "+ents[i].Mode().String())
+			}
+			for i := range want {
+				wantNames = append(wantNames, want[i].Name()+" "+want[i].Mode().String())
+			}
+			if !reflect.DeepEqual(got, wantNames) {
+				t.Errorf("ReadDir(\"a/b\"): %q != %q", got, wantNames)
+			}
+
+			h, err := fs.Open("a/b/c/d/hosts")
+			if err != nil {
+				t.Fatalf("Open(\"a/b/c/d/hosts\"): %v != nil", err)
+			}
+			defer h.Close()
+			b := make([]byte, len(hosts)+1)
+			if n, err := h.ReadAt(b, 0); string(b[:n]) != string(hosts) {
+				t.Errorf("a/b/c/d/hosts: %q, %v != %q", b[:n], err, hosts)
+			}
+			if l, err := fs.Readlink("a/b/hosts"); err != nil || len(l) == 0 {
+				t.Errorf("Readlink(\"a/b/hosts\"): %q, %v != a link, nil", l, err)
+			}
+
+			u, err := newServer(tt.archive, nil, "home")
+			if err != nil {
+				t.Fatalf("newServer(%s): %v != nil", tt.archive, err)
+			}
+			root, err := u.Attach()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, l, err := root.Walk([]string{"a", "b", "c", "d", "hosts"})
+			if err != nil {
+				t.Fatalf("9p Walk(a/b/c/d/hosts): %v != nil", err)
+			}
+			if _, _, err := l.Open(p9.ReadOnly); err != nil {
+				t.Fatalf("9p Open(a/b/c/d/hosts): %v != nil", err)
+			}
+			d := make([]byte, len(hosts))
+			if n, err := l.ReadAt(d, 0); n != len(hosts) || string(d) != string(hosts) {
+				t.Errorf("9p a/b/c/d/hosts: %q, %v != %q", d[:n], err, hosts)
+			}
+		})
+	}
+}
+
+func TestCPIOFormatUnsupported(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "x.cpio")
+	if err := os.WriteFile(p, []byte("hello, world, this is not a cpio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewfsCPIO(p)
+	if !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("NewfsCPIO(not a cpio): %v != %v", err, os.ErrInvalid)
+	}
+	if !strings.Contains(err.Error(), "unsupported cpio format") || !strings.Contains(err.Error(), cpioFormats) {
+		t.Errorf("NewfsCPIO(not a cpio): %q does not say which formats are supported", err)
+	}
+}
@@ -1 +1,6 @@
 find . -print | /usr/bin/cpio -o -H newc -F a.cpio > a.cpio
+find . -print | /usr/bin/cpio -o -H odc -F a.odc.cpio
+find . -print | /usr/bin/cpio -o -H crc -F a.crc.cpio
+find . -print | /usr/bin/cpio -o -H bin -F a.bin.cpio
+# a.binbe.cpio is a.bin.cpio as a big-endian machine writes it, with
+# each 16-bit word of the headers swapped.
@@ -0,0 +1,85 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// cpud runs the command in $PWD, which is, by default, the directory
+// sidecore is run in. -dir names another, as the cpu sees it, or, with
+// -dir auto, this one, as the cpu sees it, under -mountpoint.
+var dirFlag = flag.String("dir", "", "directory, on the cpu, for the remote command to start in; auto for this one, under -mountpoint; the default is $PWD")
+
+// dirAuto is the -dir for this directory, under -mountpoint.
+const dirAuto = "auto"
+
+// checkDir checks -dir, which must be absolute, since it is a path on
+// the cpu, or auto.
+func checkDir(d string) error {
+	if len(d) == 0 || d == dirAuto || path.IsAbs(d) {
+		return nil
+	}
+	return fmt.Errorf("-dir %q: want an absolute path on the cpu, or auto:%w", d, os.ErrInvalid)
+}
+
+// exportPath returns the path of dir, which is shared with the cpu,
+// under -mountpoint.
+func exportPath(dir string) (string, error) {
+	return filepath.Rel("/", dir)
+}
+
+// exportedPath returns the path, on the cpu, under -mountpoint, of f, which
+// is under home, the directory shared with the cpu.
+func exportedPath(home, f string) (string, error) {
+	e, err := exportPath(home)
+	if err != nil {
+		return "", err
+	}
+	r, err := filepath.Rel(home, f)
+	if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not under %s, the only directory the cpu sees:%w", f, home, os.ErrNotExist)
+	}
+	return path.Join(*mountpoint, filepath.ToSlash(e), filepath.ToSlash(r)), nil
+}
+
+// remoteDir returns the directory, on the cpu, for the remote command
+// to start in, for -dir d, or "" for $PWD. cwd is this directory, and
+// home the one shared with the cpu, under -mountpoint, which is all of
+// this machine the cpu sees. A directory under it is checked here, so
+// that a missing one is an error which names it, rather than one from
+// cpud.
+func remoteDir(d, cwd, home string) (string, error) {
+	if len(d) == 0 {
+		return "", nil
+	}
+	if d == dirAuto {
+		if !*srvnfs {
+			return "", fmt.Errorf("-dir auto: nothing is mounted on %s with -nfs=false:%w", *mountpoint, os.ErrInvalid)
+		}
+		r, err := exportedPath(home, cwd)
+		if err != nil {
+			return "", fmt.Errorf("-dir auto: %w", err)
+		}
+		return r, nil
+	}
+	export, err := exportedPath(home, home)
+	if err != nil {
+		return "", err
+	}
+	d = path.Clean(d)
+	if *srvnfs && (d == export || strings.HasPrefix(d, export+"/")) {
+		l := filepath.Join(home, filepath.FromSlash(strings.TrimPrefix(d, export)))
+		if fi, err := os.Stat(l); err != nil || !fi.IsDir() {
+			return "", fmt.Errorf("-dir %s: %s, which it is on this machine, is not a directory:%w", d, l, os.ErrNotExist)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDir(t *testing.T) {
+	for _, tt := range []struct {
+		dir  string
+		want error
+	}{
+		{dir: ""},
+		{dir: "auto"},
+		{dir: "/tmp"},
+		{dir: "src", want: os.ErrInvalid},
+	} {
+		if err := checkDir(tt.dir); !errors.Is(err, tt.want) {
+			t.Errorf("checkDir(%q): %v != %v", tt.dir, err, tt.want)
+		}
+	}
+}
+
+func TestRemoteDir(t *testing.T) {
+	defer func(nfs bool) { *srvnfs = nfs }(*srvnfs)
+	home := t.TempDir()
+	src := filepath.Join(home, "me", "src")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatalf("MkdirAll(%q): %v != nil", src, err)
+	}
+	e, err := exportPath(home)
+	if err != nil {
+		t.Fatalf("exportPath(%q): %v != nil", home, err)
+	}
+	export := path.Join("/tmp/cpu", filepath.ToSlash(e))
+	for _, tt := range []struct {
+		name  string
+		dir   string
+		cwd   string
+		noNFS bool
+		want  string
+		err   error
+	}{
+		{name: "default", cwd: src},
+		{name: "auto", dir: "auto", cwd: src, want: export + "/me/src"},
+		{name: "auto, home", dir: "auto", cwd: home, want: export},
+		{name: "auto, outside home", dir: "auto", cwd: filepath.Dir(home), err: os.ErrNotExist},
+		{name: "auto, no nfs", dir: "auto", cwd: src, noNFS: true, err: os.ErrInvalid},
+		{name: "remote", dir: "/var/tmp/", want: "/var/tmp"},
+		{name: "exported", dir: export + "/me/src", want: export + "/me/src"},
+		{name: "exported, missing", dir: export + "/me/gone", err: os.ErrNotExist},
+		{name: "exported, no nfs", dir: export + "/me/gone", noNFS: true, want: export + "/me/gone"},
+	} {
+		*srvnfs = !tt.noNFS
+		got, err := remoteDir(tt.dir, tt.cwd, home)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: remoteDir(%q, %q, %q): %v != %v", tt.name, tt.dir, tt.cwd, home, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: remoteDir(%q, %q, %q): %q != %q", tt.name, tt.dir, tt.cwd, home, got, tt.want)
+		}
+	}
+}
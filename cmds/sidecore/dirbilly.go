@@ -0,0 +1,282 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// A container may be a directory, e.g. an unpacked rootfs being worked
+// on, named dir:/path/to/rootfs, rather than a cpio file, which would
+// have to be rebuilt after each change.
+const dirPrefix = "dir:"
+
+// dirContainer returns the directory of a dir: container, and whether
+// it is one.
+func dirContainer(c string) (string, bool) {
+	return strings.CutPrefix(c, dirPrefix)
+}
+
+// fsDir implements billy.Filesystem for a directory container. As
+// with fsCPIO, the mounts are checked first, and the directory is
+// read only. The directory is an OSFS bound to it, so that symlinks
+// in it can not reach files outside it.
+type fsDir struct {
+	dir  billy.Filesystem
+	mnts []MountPoint
+}
+
+var _ billy.Filesystem = &fsDir{}
+
+// NewfsDir returns an fsDir for the directory d, with mounts.
+func NewfsDir(d string, mounts ...MountPoint) (*fsDir, error) {
+	fi, err := os.Stat(d)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory:%w", d, os.ErrInvalid)
+	}
+	fs := &fsDir{dir: NewOSFS(d)}
+	for _, m := range mounts {
+		if _, _, ok := fs.hasMount(m.n); ok {
+			return nil, fmt.Errorf("%q:%w", m.n, os.ErrExist)
+		}
+		fs.mnts = append(fs.mnts, m)
+	}
+	return fs, nil
+}
+
+// hasMount returns the mount n is in, if any, and n relative to it.
+func (fs *fsDir) hasMount(n string) (billy.Filesystem, string, bool) {
+	n = path.Clean(n)
+	for _, m := range fs.mnts {
+		if n == m.n {
+			return m.fs, ".", true
+		}
+		if rel, ok := strings.CutPrefix(n, m.n+"/"); ok {
+			return m.fs, rel, true
+		}
+	}
+	return nil, "", false
+}
+
+// getfs returns the file system for a name, a mount, or the
+// directory, the name relative to it, and whether it is a mount,
+// which may be written.
+func (fs *fsDir) getfs(n string) (billy.Filesystem, string, bool) {
+	if m, rel, ok := fs.hasMount(n); ok {
+		return m, rel, true
+	}
+	return fs.dir, n, false
+}
+
+// Create implements billy.Create, on the mounts.
+func (fs *fsDir) Create(filename string) (billy.File, error) {
+	verbose("fsDir: Create %q", filename)
+	if m, rel, ok := fs.getfs(filename); ok {
+		return m.Create(rel)
+	}
+	return nil, os.ErrPermission
+}
+
+// Open implements billy.Open.
+func (fs *fsDir) Open(filename string) (billy.File, error) {
+	verbose("fsDir: Open %q", filename)
+	f, rel, _ := fs.getfs(filename)
+	return f.Open(rel)
+}
+
+// OpenFile implements billy.OpenFile. Only the mounts may be opened
+// for writing.
+func (fs *fsDir) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	verbose("fsDir: OpenFile %q %#x", filename, flag)
+	f, rel, ok := fs.getfs(filename)
+	if !ok && flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	return f.OpenFile(rel, flag, perm)
+}
+
+// Stat implements billy.Stat. As with fsCPIO, symlinks in the
+// directory are not followed: the cpu's nfs client does that.
+func (fs *fsDir) Stat(filename string) (os.FileInfo, error) {
+	verbose("fsDir: Stat %q", filename)
+	f, rel, ok := fs.getfs(filename)
+	if !ok {
+		return f.Lstat(rel)
+	}
+	return f.Stat(rel)
+}
+
+// Lstat implements billy.Lstat.
+func (fs *fsDir) Lstat(filename string) (os.FileInfo, error) {
+	verbose("fsDir: Lstat %q", filename)
+	f, rel, _ := fs.getfs(filename)
+	return f.Lstat(rel)
+}
+
+// Readlink implements billy.Readlink. The link is returned as it is,
+// for the cpu to follow in its own namespace.
+func (fs *fsDir) Readlink(link string) (string, error) {
+	f, rel, _ := fs.getfs(link)
+	return f.Readlink(rel)
+}
+
+// ReadDir implements billy.ReadDir. As with fsCPIO, the mounts are
+// added to the root.
+func (fs *fsDir) ReadDir(filename string) ([]os.FileInfo, error) {
+	verbose("fsDir: ReadDir %q", filename)
+	f, rel, _ := fs.getfs(filename)
+	fi, err := f.ReadDir(rel)
+	if err != nil || (filename != "" && path.Clean(filename) != ".") {
+		return fi, err
+	}
+	for _, m := range fs.mnts {
+		mfi, err := m.fs.Lstat(".")
+		if err != nil {
+			verbose("enumerating %q: %v", m.n, err)
+			continue
+		}
+		fi = append(fi, &ufstat{FileInfo: mfi, name: m.n})
+	}
+	return fi, nil
+}
+
+// Rename implements billy.Rename, within a mount.
+func (fs *fsDir) Rename(oldpath, newpath string) error {
+	verbose("fsDir: Rename %q %q", oldpath, newpath)
+	oldfs, oldrel, ok := fs.getfs(oldpath)
+	if !ok {
+		return os.ErrPermission
+	}
+	newfs, newrel, ok := fs.getfs(newpath)
+	if !ok {
+		return os.ErrPermission
+	}
+	if oldfs != newfs {
+		return fmt.Errorf("Rename(%q,%q): can not cross file systems", oldpath, newpath)
+	}
+	return newfs.Rename(oldrel, newrel)
+}
+
+// Remove implements billy.Remove, on the mounts.
+func (fs *fsDir) Remove(filename string) error {
+	verbose("fsDir: Remove %q", filename)
+	if m, rel, ok := fs.getfs(filename); ok {
+		return m.Remove(rel)
+	}
+	return os.ErrPermission
+}
+
+// MkdirAll implements billy.MkdirAll, on the mounts.
+func (fs *fsDir) MkdirAll(filename string, perm os.FileMode) error {
+	verbose("fsDir: MkdirAll %q", filename)
+	if m, rel, ok := fs.getfs(filename); ok {
+		return m.MkdirAll(rel, perm)
+	}
+	return os.ErrPermission
+}
+
+// Symlink implements billy.Symlink, on the mounts.
+func (fs *fsDir) Symlink(target, link string) error {
+	verbose("fsDir: Symlink %q -> %q", link, target)
+	if m, rel, ok := fs.getfs(link); ok {
+		return m.Symlink(target, rel)
+	}
+	return os.ErrPermission
+}
+
+// TempFile implements billy.TempFile. As with fsCPIO, it is not
+// supported.
+func (fs *fsDir) TempFile(dir, prefix string) (billy.File, error) {
+	return nil, os.ErrPermission
+}
+
+// Join implements billy.Join.
+func (fs *fsDir) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// Chroot is deprecated, as for fsCPIO.
+func (fs *fsDir) Chroot(_ string) (billy.Filesystem, error) {
+	return nil, os.ErrInvalid
+}
+
+// Root implements billy.Root. It is /, as for fsCPIO.
+func (fs *fsDir) Root() string {
+	return "/"
+}
+
+// change changes n, with f, in its mount, if it is in one and the
+// mount can be changed. The directory can not be.
+func (fs *fsDir) change(n string, f func(c billy.Change, n string) error) error {
+	m, rel, ok := fs.hasMount(n)
+	if !ok {
+		return os.ErrPermission
+	}
+	c, ok := m.(billy.Change)
+	if !ok {
+		return os.ErrPermission
+	}
+	return f(c, rel)
+}
+
+// Chmod implements billy.Change.
+func (fs *fsDir) Chmod(n string, mode os.FileMode) error {
+	return fs.change(n, func(c billy.Change, n string) error { return c.Chmod(n, mode) })
+}
+
+// Lchown implements billy.Change.
+func (fs *fsDir) Lchown(n string, uid, gid int) error {
+	return fs.change(n, func(c billy.Change, n string) error { return c.Lchown(n, uid, gid) })
+}
+
+// Chown implements billy.Change.
+func (fs *fsDir) Chown(n string, uid, gid int) error {
+	return fs.change(n, func(c billy.Change, n string) error { return c.Chown(n, uid, gid) })
+}
+
+// Chtimes implements billy.Change.
+func (fs *fsDir) Chtimes(n string, atime time.Time, mtime time.Time) error {
+	return fs.change(n, func(c billy.Change, n string) error { return c.Chtimes(n, atime, mtime) })
+}
+
+var _ billy.Change = &fsDir{}
+
+// newContainerFS returns the billy.Filesystem for a container, a cpio
+// file, which must match its sum, if it has one, or a dir: directory,
+// with mounts. For -container none, it is -root, read only, as a dir:
+// container is, but for the mounts. A cpio container has an overlay,
+// unless -overlay is off.
+func newContainerFS(c string, mounts ...MountPoint) (billy.Filesystem, error) {
+	if c == noContainer {
+		return NewfsDir(*root, mounts...)
+	}
+	if d, ok := dirContainer(c); ok {
+		return NewfsDir(d, mounts...)
+	}
+	if err := useContainer(c); err != nil {
+		return nil, err
+	}
+	opts := make([]CPIOOption, len(mounts))
+	for i := range mounts {
+		opts[i] = mounts[i]
+	}
+	if *overlayFlag == "on" {
+		d, err := newOverlayDir()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithOverlay(d))
+	}
+	return NewfsCPIO(c, opts...)
+}
@@ -0,0 +1,220 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// testRootfs makes a directory container, with a file, etc/hosts,
+// and symlinks which point out of it, and a secret outside it.
+func testRootfs(t *testing.T) string {
+	d := t.TempDir()
+	root := filepath.Join(d, "rootfs")
+	secret := filepath.Join(d, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "hosts"), []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []struct{ target, link string }{
+		{target: secret, link: "abs"},
+		{target: "../secret", link: "rel"},
+		{target: d, link: "etc/up"},
+	} {
+		if err := os.Symlink(l.target, filepath.Join(root, l.link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestNewfsDir(t *testing.T) {
+	root := testRootfs(t)
+	if _, err := NewfsDir(filepath.Join(root, "etc", "hosts")); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("NewfsDir(a file): %v != %v", err, os.ErrInvalid)
+	}
+	if _, err := NewfsDir(filepath.Join(root, "none")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("NewfsDir(missing): %v != %v", err, os.ErrNotExist)
+	}
+	home := NewOSFS(t.TempDir())
+	if _, err := NewfsDir(root, WithMount("home/me", home), WithMount("home/me", home)); !errors.Is(err, os.ErrExist) {
+		t.Errorf("NewfsDir(the same mount twice): %v != %v", err, os.ErrExist)
+	}
+}
+
+func TestFSDir(t *testing.T) {
+	v = t.Logf
+	root := testRootfs(t)
+	homeDir := t.TempDir()
+	f, err := newContainerFS(dirPrefix+root, WithMount("home/me", NewOSFS(homeDir)))
+	if err != nil {
+		t.Fatalf("newContainerFS(%s): %v != nil", dirPrefix+root, err)
+	}
+
+	h, err := f.Open("etc/hosts")
+	if err != nil {
+		t.Fatalf(`Open("etc/hosts"): %v != nil`, err)
+	}
+	b, err := io.ReadAll(h)
+	h.Close()
+	if err != nil || string(b) != "127.0.0.1 localhost\n" {
+		t.Errorf(`ReadAll("etc/hosts"): (%q, %v) != ("127.0.0.1 localhost\n", nil)`, b, err)
+	}
+
+	// Symlinks are not followed out of the directory.
+	for _, n := range []string{"abs", "rel", "etc/up/secret"} {
+		if h, err := f.Open(n); err == nil {
+			b, _ := io.ReadAll(h)
+			h.Close()
+			if string(b) == "secret" {
+				t.Errorf("Open(%q): read %q, from outside the directory", n, b)
+			}
+		}
+	}
+	fi, err := f.Stat("abs")
+	if err != nil || fi.Mode().Type() != fs.ModeSymlink {
+		t.Errorf(`Stat("abs"): (%v, %v) is not a symlink`, fi, err)
+	}
+	if l, err := f.Readlink("rel"); err != nil || l != "../secret" {
+		t.Errorf(`Readlink("rel"): (%q, %v) != ("../secret", nil)`, l, err)
+	}
+
+	// The directory is read only; the mount is not.
+	if _, err := f.Create("etc/new"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf(`Create("etc/new"): %v != %v`, err, os.ErrPermission)
+	}
+	if _, err := f.OpenFile("etc/hosts", os.O_WRONLY|os.O_TRUNC, 0); !errors.Is(err, os.ErrPermission) {
+		t.Errorf(`OpenFile("etc/hosts", O_WRONLY): %v != %v`, err, os.ErrPermission)
+	}
+	if err := f.Remove("etc/hosts"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf(`Remove("etc/hosts"): %v != %v`, err, os.ErrPermission)
+	}
+	if err := f.MkdirAll("etc/new", 0755); !errors.Is(err, os.ErrPermission) {
+		t.Errorf(`MkdirAll("etc/new"): %v != %v`, err, os.ErrPermission)
+	}
+	if h, err := f.OpenFile("etc/hosts", os.O_RDONLY, 0); err != nil {
+		t.Errorf(`OpenFile("etc/hosts", O_RDONLY): %v != nil`, err)
+	} else {
+		h.Close()
+	}
+	w, err := f.Create("home/me/x")
+	if err != nil {
+		t.Fatalf(`Create("home/me/x"): %v != nil`, err)
+	}
+	if _, err := w.Write([]byte("x")); err != nil {
+		t.Errorf(`Write("home/me/x"): %v != nil`, err)
+	}
+	w.Close()
+	if b, err := os.ReadFile(filepath.Join(homeDir, "x")); err != nil || string(b) != "x" {
+		t.Errorf("ReadFile(x): (%q, %v) != (\"x\", nil)", b, err)
+	}
+	if err := f.Rename("home/me/x", "etc/x"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf(`Rename("home/me/x", "etc/x"): %v != %v`, err, os.ErrPermission)
+	}
+	// home/meow is not in the mount.
+	if _, err := f.Stat("home/meow"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf(`Stat("home/meow"): %v != %v`, err, os.ErrNotExist)
+	}
+
+	// The mount is in the root.
+	fis, err := f.ReadDir("")
+	if err != nil {
+		t.Fatalf(`ReadDir(""): %v != nil`, err)
+	}
+	names := map[string]bool{}
+	for _, fi := range fis {
+		names[fi.Name()] = true
+	}
+	for _, n := range []string{"etc", "abs", "rel", "home/me"} {
+		if !names[n] {
+			t.Errorf(`ReadDir(""): %q not in %v`, n, names)
+		}
+	}
+}
+
+func TestFSDirChange(t *testing.T) {
+	root := testRootfs(t)
+	homeDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(homeDir, "x"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newContainerFS(dirPrefix+root, WithMount("home/me", NewOSFS(homeDir)))
+	if err != nil {
+		t.Fatalf("newContainerFS(%s): %v != nil", dirPrefix+root, err)
+	}
+	testChange(t, f, root, filepath.Join(homeDir, "x"))
+}
+
+// testChange checks that the nfs server, serving f, can change x, a
+// file of its mount, home/me, but not etc/hosts, or x by its name on
+// the host, which f does not have.
+func testChange(t *testing.T, f billy.Filesystem, root, x string) {
+	t.Helper()
+	c := NewNullAuthHandler(nil, COS{f}, "").Change(f)
+	if c == nil {
+		t.Fatalf("NullAuthHandler.Change: nil != a billy.Change")
+	}
+	mtime := time.Unix(1<<30, 0)
+	for _, n := range []string{"etc/hosts", x[1:]} {
+		if err := c.Chmod(n, 0600); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("Chmod(%q, 0600): %v != %v", n, err, os.ErrPermission)
+		}
+		if err := c.Chtimes(n, mtime, mtime); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("Chtimes(%q): %v != %v", n, err, os.ErrPermission)
+		}
+		if err := c.Lchown(n, os.Getuid(), os.Getgid()); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("Lchown(%q): %v != %v", n, err, os.ErrPermission)
+		}
+	}
+	for _, p := range []string{filepath.Join(root, "etc", "hosts"), x} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != 0644 || fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: %v, %v: it was changed", p, fi.Mode(), fi.ModTime())
+		}
+	}
+
+	n := "home/me/" + filepath.Base(x)
+	if err := c.Chmod(n, 0600); err != nil {
+		t.Fatalf("Chmod(%q, 0600): %v != nil", n, err)
+	}
+	if fi, err := os.Stat(x); err != nil || fi.Mode() != 0600 {
+		t.Errorf("%s: %v, %v != %v, nil", x, fi.Mode(), err, os.FileMode(0600))
+	}
+}
+
+func TestNewServerDir(t *testing.T) {
+	defer func(n bool) { *ninep = n }(*ninep)
+	root := testRootfs(t)
+	for _, tt := range []struct {
+		ninep bool
+		c     string
+		err   error
+	}{
+		{c: dirPrefix + root},
+		{ninep: true, c: dirPrefix + root, err: os.ErrInvalid},
+		{c: dirPrefix + filepath.Join(root, "none"), err: os.ErrNotExist},
+	} {
+		*ninep = tt.ninep
+		if _, err := newServer(tt.c, nil, "home"); !errors.Is(err, tt.err) {
+			t.Errorf("newServer(%s), -9p=%v: %v != %v", tt.c, tt.ninep, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A container may be an image which docker save, or podman save,
+// wrote, e.g. docker-archive:myimage.tar. The image for the arch is
+// chosen from it, its layers applied in order, as an oci: image's are,
+// and flattened into a cpio in SIDECORE_IMAGES, named as the others
+// are, e.g. amd64-myimage@latest.cpio, which is then used as any other.
+const dockerArchivePrefix = "docker-archive:"
+
+// dockerArchive returns the file of a docker-archive: container, and
+// whether it is one.
+func dockerArchive(c string) (string, bool) {
+	return strings.CutPrefix(c, dockerArchivePrefix)
+}
+
+// dockerManifest is an entry of the manifest.json docker save writes.
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// dockerImage is an image in an archive: its config, its arch, the
+// name it was saved as, if it has one, and its layers.
+type dockerImage struct {
+	config string
+	arch   string
+	tag    string
+	layers []string
+}
+
+// indexTar returns the regular files of a tar, by name, as sections
+// of it, with symlinks, as docker save makes for layers which images
+// share, resolved.
+func indexTar(f *os.File) (map[string]*io.SectionReader, error) {
+	tr := tar.NewReader(f)
+	files := map[string]*io.SectionReader{}
+	links := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		n := archiveName(h.Name)
+		switch h.Typeflag {
+		case tar.TypeReg:
+			// tar reads no further than the header, so the
+			// contents start where the file is.
+			off, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			files[n] = io.NewSectionReader(f, off, h.Size)
+		case tar.TypeSymlink:
+			links[n] = archiveName(path.Join(path.Dir(n), h.Linkname))
+		case tar.TypeLink:
+			links[n] = archiveName(h.Linkname)
+		}
+	}
+	for n, l := range links {
+		for i := 0; i < 8; i++ {
+			if s, ok := files[l]; ok {
+				files[n] = s
+				break
+			}
+			next, ok := links[l]
+			if !ok {
+				break
+			}
+			l = next
+		}
+	}
+	return files, nil
+}
+
+// readJSON reads a file of an archive, as JSON, into v.
+func readJSON(files map[string]*io.SectionReader, n string, v any) error {
+	s, ok := files[archiveName(n)]
+	if !ok {
+		return fmt.Errorf("no %s:%w", n, os.ErrNotExist)
+	}
+	b, err := io.ReadAll(io.NewSectionReader(s, 0, s.Size()))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", n, err)
+	}
+	return nil
+}
+
+// blobName returns the file of a blob in an OCI layout, as docker save
+// also writes, e.g. blobs/sha256/<hex>.
+func blobName(digest string) (string, error) {
+	h, err := digestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	return "blobs/sha256/" + h, nil
+}
+
+// dockerImages returns the images of an archive: those manifest.json
+// lists, and, if there is an index.json, as there is in an OCI layout,
+// the images of each platform it lists.
+func dockerImages(files map[string]*io.SectionReader) ([]dockerImage, error) {
+	var manifests []dockerManifest
+	if err := readJSON(files, "manifest.json", &manifests); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var images []dockerImage
+	add := func(i dockerImage) {
+		if seen[i.config] {
+			return
+		}
+		seen[i.config] = true
+		var c struct {
+			Architecture string `json:"architecture"`
+		}
+		if err := readJSON(files, i.config, &c); err != nil {
+			verbose("%s: %v", i.config, err)
+		}
+		if len(i.arch) == 0 {
+			i.arch = c.Architecture
+		}
+		images = append(images, i)
+	}
+	for _, m := range manifests {
+		i := dockerImage{config: m.Config, layers: m.Layers}
+		if len(m.RepoTags) > 0 {
+			i.tag = m.RepoTags[0]
+		}
+		add(i)
+	}
+	// walk adds the images of an index, and the indexes in it.
+	var walk func(n string, depth int) error
+	walk = func(n string, depth int) error {
+		var m ociManifest
+		if err := readJSON(files, n, &m); err != nil {
+			return err
+		}
+		if len(m.Config.Digest) > 0 {
+			c, err := blobName(m.Config.Digest)
+			if err != nil {
+				return err
+			}
+			i := dockerImage{config: c}
+			for _, l := range m.Layers {
+				b, err := blobName(l.Digest)
+				if err != nil {
+					return err
+				}
+				i.layers = append(i.layers, b)
+			}
+			add(i)
+		}
+		if depth > 4 {
+			return nil
+		}
+		for _, d := range m.Manifests {
+			if len(d.Platform.OS) > 0 && d.Platform.OS != "linux" {
+				continue
+			}
+			b, err := blobName(d.Digest)
+			if err != nil {
+				return err
+			}
+			// An index may list platforms which were not
+			// saved.
+			if err := walk(b, depth+1); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, ok := files["index.json"]; ok {
+		if err := walk("index.json", 0); err != nil {
+			return nil, err
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images; is it from docker save?:%w", os.ErrInvalid)
+	}
+	return images, nil
+}
+
+// chooseImage returns the image of an archive for arch. An archive of
+// one image, for another arch, is a warning.
+func chooseImage(images []dockerImage, arch string) (dockerImage, error) {
+	var have []string
+	for _, i := range images {
+		if i.arch == arch && len(i.layers) > 0 {
+			return i, nil
+		}
+		have = append(have, i.arch)
+	}
+	if len(images) == 1 {
+		info("warning: the image is for %s, not %s", images[0].arch, arch)
+		return images[0], nil
+	}
+	return dockerImage{}, fmt.Errorf("no %s image; there are %s:%w", arch, strings.Join(have, ", "), os.ErrNotExist)
+}
+
+// container returns the name, in SIDECORE_IMAGES, of the container of
+// an image, saved from archive, for arch: its repository's last name,
+// and its tag, or, if it was saved without one, the archive's name,
+// and its config's digest, e.g. amd64-myimage@latest.cpio.
+func (i dockerImage) container(archive, arch string) string {
+	if ref, err := parseOCIRef(i.tag); len(i.tag) > 0 && err == nil {
+		return ref.container(arch)
+	}
+	n := filepath.Base(archive)
+	n = strings.TrimSuffix(trimCompressedSuffix(n), ".tar")
+	id := i.id()
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return containerName(arch, n, "sha256-"+id)
+}
+
+// id returns the ID of an image, the hex of the digest of its config,
+// which names it, as <hex>.json, or, in an OCI layout, blobs/sha256/<hex>.
+func (i dockerImage) id() string {
+	return strings.TrimSuffix(path.Base(i.config), ".json")
+}
+
+// loadDockerArchive returns the container of a docker-archive: image,
+// for arch. The config of the image it was flattened from is kept
+// beside it, in name.digest, so an archive is flattened again only if
+// the image in it has changed. Without load, e.g. for -dry-run, only
+// the name of the container is returned.
+func loadDockerArchive(archive, arch string, load bool) (string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return "", fmt.Errorf("%s%s: %w", dockerArchivePrefix, archive, err)
+	}
+	defer f.Close()
+	files, err := indexTar(f)
+	if err != nil {
+		return "", fmt.Errorf("%s%s: %w", dockerArchivePrefix, archive, err)
+	}
+	images, err := dockerImages(files)
+	if err != nil {
+		return "", fmt.Errorf("%s%s: %w", dockerArchivePrefix, archive, err)
+	}
+	i, err := chooseImage(images, arch)
+	if err != nil {
+		return "", fmt.Errorf("%s%s: %w", dockerArchivePrefix, archive, err)
+	}
+	dst, _ := searchContainer(i.container(archive, arch))
+	if !load {
+		return dst, nil
+	}
+	digest := "sha256:" + i.id()
+	if b, err := os.ReadFile(dst + ".digest"); err == nil && strings.TrimSpace(string(b)) == digest {
+		if _, err := os.Stat(dst); err == nil {
+			verbose("%s%s: %s is %s", dockerArchivePrefix, archive, dst, digest)
+			return dst, nil
+		}
+	}
+	var layers []io.Reader
+	for _, l := range i.layers {
+		s, ok := files[archiveName(l)]
+		if !ok {
+			return "", fmt.Errorf("%s%s: no layer %s:%w", dockerArchivePrefix, archive, l, os.ErrNotExist)
+		}
+		layers = append(layers, io.NewSectionReader(s, 0, s.Size()))
+	}
+	if err := flattenImage(layers, dst); err != nil {
+		return "", fmt.Errorf("%s%s: %w", dockerArchivePrefix, archive, err)
+	}
+	if err := writeFileAtomic(dst+".digest", []byte(digest+"\n")); err != nil {
+		verbose("%s.digest: %v", dst, err)
+	}
+	info("%s%s: flattened into %s", dockerArchivePrefix, archive, dst)
+	return dst, nil
+}
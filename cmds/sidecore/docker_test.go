@@ -0,0 +1,192 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// archiveFile is a file of an archive docker save writes; with link,
+// a symlink.
+type archiveFile struct {
+	name, link string
+	body       []byte
+}
+
+// writeArchive writes files to a tar in dir.
+func writeArchive(t *testing.T, dir string, files ...archiveFile) string {
+	t.Helper()
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for _, f := range files {
+		h := &tar.Header{Name: f.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(f.body))}
+		if len(f.link) > 0 {
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, f.link, 0
+		}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "image.tar")
+	if err := os.WriteFile(p, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func jsonBytes(t *testing.T, v any) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// legacyArchive writes an archive as docker save did before OCI
+// layouts: manifest.json, the config, and a directory for each layer.
+// The second layer is a symlink, as docker save makes for a layer two
+// images share.
+func legacyArchive(t *testing.T, dir string, tags []string) (string, string) {
+	layers := testLayers(t)
+	config := jsonBytes(t, map[string]string{"architecture": "amd64", "os": "linux"})
+	id := fmt.Sprintf("%x", sha256.Sum256(config))
+	manifest := jsonBytes(t, []dockerManifest{{Config: id + ".json", RepoTags: tags, Layers: []string{"l0/layer.tar", "l1/layer.tar"}}})
+	return writeArchive(t, dir,
+		archiveFile{name: "manifest.json", body: manifest},
+		archiveFile{name: id + ".json", body: config},
+		archiveFile{name: "l0/layer.tar", body: layers[0]},
+		archiveFile{name: "shared/layer.tar", body: layers[1]},
+		archiveFile{name: "l1/layer.tar", link: "../shared/layer.tar"},
+	), id
+}
+
+func TestDockerArchive(t *testing.T) {
+	images := t.TempDir()
+	t.Setenv("SIDECORE_IMAGES", images)
+	a, id := legacyArchive(t, t.TempDir(), []string{"myimage:latest"})
+	c, err := checkContainer(dockerArchivePrefix + a)
+	if err != nil || c != dockerArchivePrefix+a {
+		t.Fatalf("checkContainer(%s%s): %q, %v != %q, nil", dockerArchivePrefix, a, c, err, dockerArchivePrefix+a)
+	}
+	want := filepath.Join(images, "amd64-myimage@latest.cpio")
+	if dst, err := loadDockerArchive(a, "amd64", false); err != nil || dst != want {
+		t.Fatalf("loadDockerArchive(%s), without load: %q, %v != %q, nil", a, dst, err, want)
+	}
+	if _, err := os.Stat(want); !os.IsNotExist(err) {
+		t.Errorf("loadDockerArchive(%s), without load: %s was made", a, want)
+	}
+	dst, err := loadDockerArchive(a, "amd64", true)
+	if err != nil || dst != want {
+		t.Fatalf("loadDockerArchive(%s): %q, %v != %q, nil", a, dst, err, want)
+	}
+	names, body := cpioFiles(t, dst)
+	wantNames := []string{".", "bin", "bin/ash", "bin/sh", "etc", "etc/passwd", "usr", "usr/lib", "usr/lib/new", "var"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("files: %q != %q", names, wantNames)
+	}
+	if body["usr/lib/new"] != "new" {
+		t.Errorf("usr/lib/new: %q != %q", body["usr/lib/new"], "new")
+	}
+	if b, err := os.ReadFile(dst + ".digest"); err != nil || strings.TrimSpace(string(b)) != "sha256:"+id {
+		t.Errorf("%s.digest: %q, %v != %q, nil", dst, b, err, "sha256:"+id)
+	}
+
+	// The same image is not flattened again.
+	if err := os.WriteFile(dst, []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDockerArchive(a, "amd64", true); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != "kept" {
+		t.Errorf("loadDockerArchive(%s) again: flattened again", a)
+	}
+}
+
+func TestDockerArchiveUntagged(t *testing.T) {
+	t.Setenv("SIDECORE_IMAGES", t.TempDir())
+	a, id := legacyArchive(t, t.TempDir(), nil)
+	dst, err := loadDockerArchive(a, "arm64", false)
+	if want := "arm64-image@sha256-" + id[:12] + ".cpio"; err != nil || filepath.Base(dst) != want {
+		t.Errorf("loadDockerArchive(%s): %q, %v != %q, nil", a, dst, err, want)
+	}
+}
+
+// ociArchive writes an archive as docker save does now, an OCI layout,
+// with an image for amd64 and one for arm64, each of one layer, and
+// an attestation, which is not an image.
+func ociArchive(t *testing.T, dir string) string {
+	var files []archiveFile
+	blob := func(b []byte) string {
+		d := fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+		files = append(files, archiveFile{name: "blobs/sha256/" + d[len("sha256:"):], body: b})
+		return d
+	}
+	var descs []map[string]any
+	for _, arch := range []string{"amd64", "arm64"} {
+		l := blob(layer(t, true, tarFile{name: "etc/arch", body: arch, typ: tar.TypeReg}))
+		c := blob(jsonBytes(t, map[string]string{"architecture": arch, "os": "linux"}))
+		m := blob(jsonBytes(t, map[string]any{
+			"config": map[string]string{"digest": c},
+			"layers": []map[string]string{{"digest": l}},
+		}))
+		descs = append(descs, map[string]any{"digest": m, "platform": map[string]string{"os": "linux", "architecture": arch}})
+	}
+	att := blob(jsonBytes(t, map[string]any{"layers": []map[string]string{}}))
+	descs = append(descs, map[string]any{"digest": att, "platform": map[string]string{"os": "unknown", "architecture": "unknown"}})
+	idx := blob(jsonBytes(t, map[string]any{"manifests": descs}))
+	files = append(files,
+		archiveFile{name: "index.json", body: jsonBytes(t, map[string]any{"manifests": []map[string]string{{"digest": idx}}})},
+		archiveFile{name: "oci-layout", body: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+	)
+	return writeArchive(t, dir, files...)
+}
+
+func TestDockerArchivePlatforms(t *testing.T) {
+	t.Setenv("SIDECORE_IMAGES", t.TempDir())
+	a := ociArchive(t, t.TempDir())
+	for _, arch := range []string{"amd64", "arm64"} {
+		dst, err := loadDockerArchive(a, arch, true)
+		if err != nil {
+			t.Fatalf("loadDockerArchive(%s, %s): %v != nil", a, arch, err)
+		}
+		if _, body := cpioFiles(t, dst); body["etc/arch"] != arch {
+			t.Errorf("loadDockerArchive(%s, %s): etc/arch is %q", a, arch, body["etc/arch"])
+		}
+	}
+	if _, err := loadDockerArchive(a, "riscv64", true); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loadDockerArchive(%s, riscv64): %v != %v", a, err, os.ErrNotExist)
+	}
+}
+
+func TestDockerArchiveBad(t *testing.T) {
+	d := t.TempDir()
+	a := writeArchive(t, d, archiveFile{name: "hello", body: []byte("hi")})
+	if _, err := loadDockerArchive(a, "amd64", false); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("loadDockerArchive(not from docker save): %v != %v", err, os.ErrInvalid)
+	}
+	if _, err := checkContainer(dockerArchivePrefix + filepath.Join(d, "nope.tar")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checkContainer(%snope.tar): %v != %v", dockerArchivePrefix, err, os.ErrNotExist)
+	}
+	if _, err := checkContainer(dockerArchivePrefix + a + ",x.cpio"); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("checkContainer(%s%s,x.cpio): %v != %v", dockerArchivePrefix, a, err, os.ErrInvalid)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// check returns "ok" if a file can be opened for reading,
+// or the error if not.
+func check(n string) (string, bool) {
+	if len(n) == 0 {
+		return "not set", true
+	}
+	f, err := os.Open(n)
+	if err != nil {
+		return err.Error(), false
+	}
+	f.Close()
+	return "ok", true
+}
+
+// printPlan writes what a run would do, for -dry-run, checking that
+// files which will be needed can be read. There is a result for each
+// cpu, followed by the results for hosts which could not be found.
+// It returns the exit status: 0 if all checks pass, else exitFailure.
+func printPlan(w io.Writer, cpus []cpu, results []result, args []string) int {
+	status := 0
+	a := dialAgent()
+	defer a.Close()
+	agentKeys := len(a.signers())
+	for i, cpu := range cpus {
+		if results[i].err != nil {
+			fmt.Fprintf(w, "%s: %v\n", cpu.host, results[i].err)
+			status = exitFailure
+			continue
+		}
+		fmt.Fprintf(w, "host %s\n", cpu.host)
+		if cpu.last {
+			fmt.Fprintf(w, "\tfrom: %s, the last cpu dialed\n", lastHost)
+		}
+		fmt.Fprintf(w, "\tuser: %s\n", cpu.user)
+		fmt.Fprintf(w, "\tport: %s\n", cpu.port)
+		if len(cpu.addrs) > 1 {
+			fmt.Fprintf(w, "\taddresses: %s\n", strings.Join(cpu.addrs, ","))
+		}
+		if len(*network) > 0 {
+			fmt.Fprintf(w, "\tnetwork: %s\n", *network)
+		}
+		// Only one of the agent keys and key files needs to be usable.
+		keyOK := agentKeys > 0
+		if a != nil {
+			fmt.Fprintf(w, "\tagent: %d keys\n", agentKeys)
+		}
+		for _, kf := range cpu.keyfiles {
+			r, ok := check(kf)
+			keyOK = keyOK || ok
+			fmt.Fprintf(w, "\tkeyfile: %s (%s)\n", kf, r)
+		}
+		if !keyOK {
+			status = exitFailure
+		}
+		for _, cf := range cpu.certs {
+			r, _ := check(cf)
+			fmt.Fprintf(w, "\tcertificate: %s (%s)\n", cf, r)
+		}
+		fmt.Fprintf(w, "\tpassword: %v\n", cpu.password)
+		if len(cpu.arch) > 0 {
+			how := "asked for"
+			if !cpu.archForced {
+				how = "unless the cpu is of another, once it is dialed"
+			}
+			fmt.Fprintf(w, "\tarch: %s (%s)\n", cpu.arch, how)
+		}
+		checks := []struct {
+			name, path, open string
+		}{
+			{name: "hostkey", path: cpu.hostkey, open: cpu.hostkey},
+		}
+		if cpu.container == noContainer {
+			fmt.Fprintf(w, "\tcontainer: none (only -root, %s, is served)\n", *root)
+		} else {
+			for _, l := range containerLayers(cpu.container) {
+				d, _ := dirContainer(l)
+				checks = append(checks, struct{ name, path, open string }{name: "container", path: l, open: d})
+			}
+		}
+		for _, f := range checks {
+			r, ok := check(f.open)
+			if !ok {
+				status = exitFailure
+			}
+			fmt.Fprintf(w, "\t%s: %s (%s)\n", f.name, f.path, r)
+		}
+		if len(cpu.imageDirs) > 1 {
+			fmt.Fprintf(w, "\tcontainer searched for in: %s\n", strings.Join(cpu.imageDirs, string(filepath.ListSeparator)))
+		}
+		if len(cpu.jumps) > 0 {
+			fmt.Fprintf(w, "\tproxyjump: %s\n", strings.Join(cpu.jumps, ","))
+		}
+		if len(cpu.proxyCommand) > 0 {
+			fmt.Fprintf(w, "\tproxycommand: %s\n", cpu.proxyCommand)
+		}
+		if cpu.proxy != nil {
+			fmt.Fprintf(w, "\tproxy: %s\n", cpu.proxy.Redacted())
+		}
+		if len(cpu.control) > 0 {
+			fmt.Fprintf(w, "\tcontrol: %s\n", cpu.control)
+		}
+		if cpu.aliveInterval > 0 {
+			fmt.Fprintf(w, "\tkeepalive: every %v, %d may be missed\n", cpu.aliveInterval, cpu.aliveCount)
+		}
+		if cpu.compress {
+			fmt.Fprintf(w, "\tcompress: nfs, if cpud can\n")
+		}
+		fmt.Fprintf(w, "\tnfs: %v\n", *srvnfs)
+		fmt.Fprintf(w, "\toverlay: %s\n", *overlayFlag)
+		fmt.Fprintf(w, "\t9p: %v\n", *ninep)
+		fmt.Fprintf(w, "\targs: %q\n", args)
+		if len(cpu.env) > 0 {
+			fmt.Fprintf(w, "\tenv: %s\n", strings.Join(cpu.env, " "))
+		}
+		fmt.Fprintf(w, "\tfstab:\n")
+		for _, l := range strings.Split(strings.TrimSpace(cpu.fstab), "\n") {
+			fmt.Fprintf(w, "\t\t%s\n", l)
+		}
+	}
+	for _, r := range results[len(cpus):] {
+		fmt.Fprintf(w, "%s: %v\n", r.host, r.err)
+		status = exitFailure
+	}
+	return status
+}
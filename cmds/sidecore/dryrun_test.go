@@ -0,0 +1,23 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPrintPlanNotFound(t *testing.T) {
+	var b bytes.Buffer
+	results := []result{{host: "dnssd://", status: exitFailure, err: fmt.Errorf("no cpus")}}
+	if s := printPlan(&b, nil, results, []string{"date"}); s != exitFailure {
+		t.Errorf("printPlan with a host not found: %d != %d", s, exitFailure)
+	}
+	if !strings.Contains(b.String(), "no cpus") {
+		t.Errorf("printPlan: %q does not contain \"no cpus\"", b.String())
+	}
+}
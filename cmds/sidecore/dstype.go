@@ -0,0 +1,57 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var dsType = flag.String("ds-type", "", "dnssd service type, e.g. _cpu-dev._tcp, for \".\" and dnssd: queries which do not name one; the default is SIDECORE_DS_TYPE, or _ncpu._tcp")
+
+// queryType is the service type of -ds-type, or SIDECORE_DS_TYPE, or
+// "" for the dnssd default. flags sets it.
+var queryType string
+
+// serviceType matches a dnssd service type, _service._proto.
+var serviceType = regexp.MustCompile(`^_[A-Za-z0-9][A-Za-z0-9-]*\._(tcp|udp)$`)
+
+// dsServiceType returns the service type of -ds-type, or, if it is
+// not set, SIDECORE_DS_TYPE, or "" if neither is.
+func dsServiceType() (string, error) {
+	t := *dsType
+	if len(t) == 0 {
+		t = os.Getenv("SIDECORE_DS_TYPE")
+	}
+	if len(t) > 0 && !serviceType.MatchString(t) {
+		return "", fmt.Errorf("-ds-type %q: want _service._tcp or _service._udp:%w", t, os.ErrInvalid)
+	}
+	return t, nil
+}
+
+// withType returns a dnssd: query with the service type t, if the
+// query does not name one of its own. A query which is not a
+// dnssd: query is returned as it is.
+func withType(query, t string) string {
+	u, err := url.Parse(query)
+	if len(t) == 0 || err != nil || u.Scheme != "dnssd" || len(u.Opaque) > 0 {
+		return query
+	}
+	for _, p := range strings.Split(u.Host, ".") {
+		if strings.HasPrefix(p, "_") {
+			return query
+		}
+	}
+	if len(u.Host) == 0 {
+		u.Host = t
+	} else {
+		u.Host = t + "." + u.Host
+	}
+	return u.String()
+}
@@ -0,0 +1,61 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+func TestDSServiceType(t *testing.T) {
+	defer func(s string) { *dsType = s }(*dsType)
+	for _, tt := range []struct {
+		flag, env string
+		want      string
+		err       error
+	}{
+		{},
+		{env: "_cpu-dev._tcp", want: "_cpu-dev._tcp"},
+		{flag: "_cpu-prod._tcp", env: "_cpu-dev._tcp", want: "_cpu-prod._tcp"},
+		{flag: "cpu-prod._tcp", err: os.ErrInvalid},
+		{flag: "_cpu-prod", err: os.ErrInvalid},
+		{env: "_cpu._sctp", err: os.ErrInvalid},
+	} {
+		*dsType = tt.flag
+		t.Setenv("SIDECORE_DS_TYPE", tt.env)
+		got, err := dsServiceType()
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("dsServiceType(%q, %q): (%q, %v) != (%q, %v)", tt.flag, tt.env, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestWithType(t *testing.T) {
+	for _, tt := range []struct {
+		query, typ string
+		want       string
+		domain     string
+	}{
+		{query: ds.Default, want: "_ncpu._tcp", domain: "local"},
+		{query: ds.Default, typ: "_cpu-dev._tcp", want: "_cpu-dev._tcp", domain: "local"},
+		{query: "dnssd:", typ: "_cpu-dev._tcp", want: "_cpu-dev._tcp", domain: "local"},
+		{query: "dnssd:?arch=arm64", typ: "_cpu-dev._tcp", want: "_cpu-dev._tcp", domain: "local"},
+		{query: "dnssd://example.com?arch=arm64", typ: "_cpu-dev._tcp", want: "_cpu-dev._tcp", domain: "example.com"},
+		{query: "dnssd://_cpu-prod._tcp.local", typ: "_cpu-dev._tcp", want: "_cpu-prod._tcp", domain: "local"},
+		{query: "dnssd://box._cpu-prod._tcp.local", typ: "_cpu-dev._tcp", want: "_cpu-prod._tcp", domain: "local"},
+	} {
+		q := withType(tt.query, tt.typ)
+		dq, err := ds.Parse(q)
+		if err != nil || dq.Type != tt.want || dq.Domain != tt.domain {
+			t.Errorf("ds.Parse(withType(%q, %q)): (%q, %q, %v) != (%q, %q, nil)", tt.query, tt.typ, dq.Type, dq.Domain, err, tt.want, tt.domain)
+		}
+	}
+	if got := withType("cpu.example.com", "_cpu-dev._tcp"); got != "cpu.example.com" {
+		t.Errorf("withType(cpu.example.com): %q != %q", got, "cpu.example.com")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Only the environment variables -send-env matches are sent to the
+// remote command, as with ssh's SendEnv, so that e.g.
+// AWS_SECRET_ACCESS_KEY and SSH_AUTH_SOCK stay here. Those set with
+// -env and -environment, and those sidecore sets, e.g. CPU_FSTAB and
+// SIDECORE_RANK, are always sent, as is PWD, which cpud runs the
+// command in; -env is sent last, so that it wins.
+var sendEnvFlag = flag.String("send-env", defaultSendEnv, "comma-separated glob patterns, e.g. LC_*, of the environment variables to send to the remote command; * sends them all")
+
+// defaultSendEnv are the variables sent by default: those for the
+// terminal and the locale, PATH, and CPU_FSTAB, which adds to the
+// namespace.
+const defaultSendEnv = "TERM,COLORTERM,LANG,LANGUAGE,LC_*,TZ,PATH,CPU_FSTAB"
+
+// sendEnvPats are the patterns of -send-env. flags sets them.
+var sendEnvPats []string
+
+// sendEnvPatterns returns the patterns of -send-env. It is an error if
+// one is not a valid pattern.
+func sendEnvPatterns() ([]string, error) {
+	var pats []string
+	for _, p := range strings.Split(*sendEnvFlag, ",") {
+		if len(p) == 0 {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("-send-env %q: %v:%w", p, err, os.ErrInvalid)
+		}
+		pats = append(pats, p)
+	}
+	return pats, nil
+}
+
+// sendEnv returns the variables of env, as os.Environ has them, whose
+// names match one of pats. It is never nil, since the client sends
+// all of os.Environ for a nil environment.
+func sendEnv(env, pats []string) []string {
+	send := []string{}
+	for _, e := range env {
+		n, _, _ := strings.Cut(e, "=")
+		for _, p := range pats {
+			if ok, _ := path.Match(p, n); ok {
+				send = append(send, e)
+				break
+			}
+		}
+	}
+	return send
+}
+
+// envNames returns the names of the variables of env, for -d, which
+// does not show the values, as they may be secrets.
+func envNames(env []string) string {
+	names := make([]string, 0, len(env))
+	for _, e := range env {
+		n, _, _ := strings.Cut(e, "=")
+		names = append(names, n)
+	}
+	return strings.Join(names, " ")
+}
+
+// envVars are the variables of -env, which may be repeated, each
+// KEY=VALUE, or KEY, for the value KEY has here.
+var envVars stringList
+
+// envSet are the variables of -env, as KEY=VALUE. flags sets them.
+var envSet []string
+
+// envValues returns vars, of -env, as KEY=VALUE. A KEY alone takes the
+// value lookup finds for it; if there is none, it is left out. The
+// value is taken as it is, so it may have spaces, = and ;.
+func envValues(vars []string, lookup func(string) (string, bool)) ([]string, error) {
+	var env []string
+	for _, v := range vars {
+		k, _, set := strings.Cut(v, "=")
+		if len(k) == 0 {
+			return nil, fmt.Errorf("-env %q: want KEY=VALUE or KEY:%w", v, os.ErrInvalid)
+		}
+		if set {
+			env = append(env, v)
+			continue
+		}
+		val, ok := lookup(k)
+		if !ok {
+			verbose("-env %s: not set here; not sending it", k)
+			continue
+		}
+		env = append(env, k+"="+val)
+	}
+	return env, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSendEnvPatterns(t *testing.T) {
+	defer func(s string) { *sendEnvFlag = s }(*sendEnvFlag)
+	for _, tt := range []struct {
+		flag string
+		want []string
+		err  error
+	}{
+		{flag: defaultSendEnv, want: strings.Split(defaultSendEnv, ",")},
+		{flag: "*", want: []string{"*"}},
+		{flag: "", want: nil},
+		{flag: "LC_*,,GOFLAGS", want: []string{"LC_*", "GOFLAGS"}},
+		{flag: "TERM,[", err: os.ErrInvalid},
+	} {
+		*sendEnvFlag = tt.flag
+		got, err := sendEnvPatterns()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("-send-env %q: %v != %v", tt.flag, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-send-env %q: %q != %q", tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestSendEnv(t *testing.T) {
+	env := []string{"TERM=xterm", "LC_ALL=C", "AWS_SECRET_ACCESS_KEY=s", "SSH_AUTH_SOCK=/tmp/agent", "PATH=/bin", "EMPTY="}
+	for _, tt := range []struct {
+		pats []string
+		want []string
+	}{
+		{pats: strings.Split(defaultSendEnv, ","), want: []string{"TERM=xterm", "LC_ALL=C", "PATH=/bin"}},
+		{pats: []string{"*"}, want: env},
+		{pats: nil, want: []string{}},
+		{pats: []string{"AWS_*", "EMPTY"}, want: []string{"AWS_SECRET_ACCESS_KEY=s", "EMPTY="}},
+	} {
+		if got := sendEnv(env, tt.pats); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sendEnv(%q): %q != %q", tt.pats, got, tt.want)
+		}
+	}
+}
+
+func TestEnvNames(t *testing.T) {
+	if got, want := envNames([]string{"TERM=xterm", "CPUNONCE=secret", "EMPTY"}), "TERM CPUNONCE EMPTY"; got != want {
+		t.Errorf("envNames: %q != %q", got, want)
+	}
+}
+
+func TestEnvValues(t *testing.T) {
+	lookup := func(k string) (string, bool) {
+		if k == "LOCAL" {
+			return "here; and = there", true
+		}
+		return "", false
+	}
+	for _, tt := range []struct {
+		vars []string
+		want []string
+		err  error
+	}{
+		{vars: nil, want: nil},
+		{vars: []string{"A=b c", "B=x=y;z", "C="}, want: []string{"A=b c", "B=x=y;z", "C="}},
+		{vars: []string{"LOCAL", "UNSET"}, want: []string{"LOCAL=here; and = there"}},
+		{vars: []string{"=v"}, err: os.ErrInvalid},
+		{vars: []string{""}, err: os.ErrInvalid},
+	} {
+		got, err := envValues(tt.vars, lookup)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("envValues(%q): %v != %v", tt.vars, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("envValues(%q): %q != %q", tt.vars, got, tt.want)
+		}
+	}
+}
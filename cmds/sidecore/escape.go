@@ -0,0 +1,33 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/u-root/sidecore/internal/cpu/client"
+)
+
+var escapeFlag = flag.String("e", "~", "escape character for interactive sessions, e.g. ~ or ^], or none, so that any input can be sent; ~? lists the escapes")
+
+// escape is the escape character of -e. flags sets it.
+var escape = int('~')
+
+// escapeChar returns the escape character of -e, as ssh has it: a
+// character, ^ and a character for a control character, or none,
+// for client.NoEscape.
+func escapeChar(e string) (int, error) {
+	switch {
+	case e == "none":
+		return client.NoEscape, nil
+	case len(e) == 1 && e[0] < 0x80:
+		return int(e[0]), nil
+	case len(e) == 2 && e[0] == '^' && e[1] >= '@' && e[1] <= '_':
+		return int(e[1] & 0x1f), nil
+	}
+	return 0, fmt.Errorf("-e %q: want a character, ^ and a character, or none:%w", e, os.ErrInvalid)
+}
@@ -0,0 +1,36 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/u-root/sidecore/internal/cpu/client"
+)
+
+func TestEscapeChar(t *testing.T) {
+	for _, tt := range []struct {
+		e    string
+		want int
+		err  error
+	}{
+		{e: "~", want: '~'},
+		{e: "#", want: '#'},
+		{e: "^]", want: 0x1d},
+		{e: "^@", want: 0},
+		{e: "none", want: client.NoEscape},
+		{e: "", err: os.ErrInvalid},
+		{e: "~~", err: os.ErrInvalid},
+		{e: "^a", err: os.ErrInvalid},
+		{e: "é", err: os.ErrInvalid},
+	} {
+		got, err := escapeChar(tt.e)
+		if !errors.Is(err, tt.err) || (err == nil && got != tt.want) {
+			t.Errorf("escapeChar(%q): (%#x, %v) != (%#x, %v)", tt.e, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+var exclude = flag.String("exclude", "", "comma-separated hosts, IPs, CIDRs or glob patterns, e.g. desk*,10.0.9.0/24, never to run on; added to SIDECORE_EXCLUDE")
+
+// exclusions returns the patterns of -exclude and SIDECORE_EXCLUDE.
+// It is an error if one is not a valid glob pattern.
+func exclusions() ([]string, error) {
+	var pats []string
+	for _, l := range []string{*exclude, os.Getenv("SIDECORE_EXCLUDE")} {
+		for _, p := range strings.Split(l, ",") {
+			if len(p) == 0 {
+				continue
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("exclude %q: %v:%w", p, err, os.ErrInvalid)
+			}
+			pats = append(pats, p)
+		}
+	}
+	return pats, nil
+}
+
+// excluded returns the pattern which excludes any of names,
+// which are the names and addresses of one host, if one does.
+// A pattern which is a CIDR matches the addresses in it.
+func excluded(pats []string, names ...string) (string, bool) {
+	for _, p := range pats {
+		_, n, err := net.ParseCIDR(p)
+		for _, name := range names {
+			if err == nil {
+				if ip := net.ParseIP(name); ip != nil && n.Contains(ip) {
+					return p, true
+				}
+				continue
+			}
+			if ok, _ := path.Match(p, name); ok {
+				return p, true
+			}
+		}
+	}
+	return "", false
+}
+
+// entryNames returns what a cpu found with dnssd may be excluded
+// by: its instance name, its host name, with and without its
+// domain, and its addresses.
+func entryNames(e ds.LookupResult) []string {
+	host := strings.TrimSuffix(e.Entry.Host, ".")
+	short, _, _ := strings.Cut(host, ".")
+	names := []string{e.Entry.UnescapedName(), host, short}
+	for _, ip := range e.Entry.IPs {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// excludeCPUs drops the cpus found with dnssd which the
+// patterns exclude.
+func excludeCPUs(found []*ds.LookupResult, pats []string) []*ds.LookupResult {
+	var c []*ds.LookupResult
+	for _, e := range found {
+		if p, ok := excluded(pats, entryNames(*e)...); ok {
+			verbose("%s: excluded by %q", e.Entry.UnescapedName(), p)
+			continue
+		}
+		c = append(c, e)
+	}
+	return c
+}
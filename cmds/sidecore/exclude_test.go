@@ -0,0 +1,86 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+func TestExclusions(t *testing.T) {
+	defer func(e string) { *exclude = e }(*exclude)
+	*exclude = "desk*,,10.0.9.0/24"
+	t.Setenv("SIDECORE_EXCLUDE", "box2")
+	got, err := exclusions()
+	if want := []string{"desk*", "10.0.9.0/24", "box2"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("exclusions: (%q, %v) != (%q, nil)", got, err, want)
+	}
+	*exclude = "box[1"
+	if _, err := exclusions(); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("exclusions, bad pattern: %v != %v", err, os.ErrInvalid)
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	pats := []string{"desk*", "10.0.9.0/24", "box2"}
+	for _, tt := range []struct {
+		names []string
+		pat   string
+		ok    bool
+	}{
+		{names: []string{"desktop-cpud"}, pat: "desk*", ok: true},
+		{names: []string{"lab-cpud", "lab.local", "lab", "10.0.9.7"}, pat: "10.0.9.0/24", ok: true},
+		{names: []string{"box2"}, pat: "box2", ok: true},
+		{names: []string{"box21", "10.0.10.1"}},
+	} {
+		pat, ok := excluded(pats, tt.names...)
+		if pat != tt.pat || ok != tt.ok {
+			t.Errorf("excluded(%q, %q): (%q, %v) != (%q, %v)", pats, tt.names, pat, ok, tt.pat, tt.ok)
+		}
+	}
+}
+
+func TestExcludeCPUs(t *testing.T) {
+	found := []*ds.LookupResult{
+		{Entry: dnssd.BrowseEntry{Name: "desk-cpud", Host: "desk.local.", IPs: []net.IP{net.ParseIP("10.0.0.1")}}},
+		{Entry: dnssd.BrowseEntry{Name: "lab1-cpud", Host: "lab1.local.", IPs: []net.IP{net.ParseIP("10.0.0.2")}}},
+		{Entry: dnssd.BrowseEntry{Name: "lab2-cpud", Host: "lab2.local.", IPs: []net.IP{net.ParseIP("10.0.0.3")}}},
+	}
+	for _, tt := range []struct {
+		pats []string
+		want []string
+	}{
+		{want: []string{"desk-cpud", "lab1-cpud", "lab2-cpud"}},
+		{pats: []string{"desk"}, want: []string{"lab1-cpud", "lab2-cpud"}},
+		{pats: []string{"lab2.local"}, want: []string{"desk-cpud", "lab1-cpud"}},
+		{pats: []string{"10.0.0.2"}, want: []string{"desk-cpud", "lab2-cpud"}},
+		{pats: []string{"*-cpud"}},
+	} {
+		if got := foundNames(excludeCPUs(found, tt.pats)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("excludeCPUs(%q): %q != %q", tt.pats, got, tt.want)
+		}
+	}
+}
+
+func TestLookupHostExcluded(t *testing.T) {
+	if _, err := lookupHost("box2", []string{"box*"}); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("lookupHost(box2), excluded: %v != %v", err, os.ErrInvalid)
+	}
+	old := dsLookup
+	defer func() { dsLookup = old }()
+	dsLookup = func(ds.Query, int, time.Duration) ([]*ds.LookupResult, error) {
+		return []*ds.LookupResult{{Entry: dnssd.BrowseEntry{Name: "desk-cpud", IPs: []net.IP{net.ParseIP("10.0.0.1")}, Port: 17010}}}, nil
+	}
+	if _, err := lookupHost(ds.Default, []string{"desk*"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lookupHost(%q), all excluded: %v != %v", ds.Default, err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// sidecore extract unpacks a container into a directory, e.g. to change
+// it, and serve it as dir:, rather than rebuild a cpio after each
+// change. Each record is made with cpio.CreateFileInRoot. Device nodes,
+// and the owners of files, need root: without -force-priv, those which
+// can not be made, or set, are skipped. Fifos and sockets are not made;
+// a cpu does not need them from the container. -list lists what is in
+// a container, and -verify compares a directory it was unpacked into
+// with it.
+
+// recordLink returns the target of a symlink record.
+func recordLink(r cpio.Record) (string, error) {
+	if r.ReaderAt == nil {
+		return "", nil
+	}
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, int64(r.FileSize)))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", r.Name, err)
+	}
+	return string(b), nil
+}
+
+// recordData returns the contents of a file record.
+func recordData(r cpio.Record) io.Reader {
+	if r.ReaderAt == nil {
+		return strings.NewReader("")
+	}
+	return io.NewSectionReader(r, 0, int64(r.FileSize))
+}
+
+// extractPath returns where a file of an archive, n, is extracted in
+// dir. n is cleaned, as archiveName cleans it, so .. can not leave dir,
+// but a file under a symlink, which the archive may have made, could,
+// and is an error.
+func extractPath(dir, n string) (string, error) {
+	p := dir
+	parts := strings.Split(n, "/")
+	for _, e := range parts[:len(parts)-1] {
+		p = filepath.Join(p, e)
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s: it is under the symlink %s:%w", n, p, os.ErrInvalid)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(n)), nil
+}
+
+// listRecords lists the files of an archive, as ls -l does.
+func listRecords(w io.Writer, recs []cpio.Record) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	for _, r := range recs {
+		if r.Name == cpio.Trailer {
+			continue
+		}
+		m := uToGo(r.Mode)
+		n := archiveName(r.Name)
+		if m&fs.ModeSymlink != 0 {
+			l, err := recordLink(r)
+			if err != nil {
+				return err
+			}
+			n += " -> " + l
+		}
+		fmt.Fprintf(tw, "%v\t%d\t%d\t%d\t %s\t%s\n", m, r.UID, r.GID, r.FileSize, time.Unix(int64(r.MTime), 0).UTC().Format("2006-01-02 15:04"), n)
+	}
+	return tw.Flush()
+}
+
+// extractRecords extracts the files of an archive into dir, with
+// cpio.CreateFileInRoot, which, with forcePriv, fails if a device node
+// can not be made, or an owner set. The modes of directories are set
+// once what is in them is, so that one which can not be written to
+// can still be filled.
+func extractRecords(recs []cpio.Record, dir string, forcePriv bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var dirs []cpio.Record
+	var skipped int
+	for _, r := range recs {
+		if r.Name == cpio.Trailer {
+			continue
+		}
+		n := archiveName(r.Name)
+		p, err := extractPath(dir, n)
+		if err != nil {
+			return err
+		}
+		m := uToGo(r.Mode)
+		if m&(fs.ModeNamedPipe|fs.ModeSocket) != 0 {
+			verbose("%s: %v: not made", n, m)
+			skipped++
+			continue
+		}
+		// What is there before, e.g. from an earlier extract, is
+		// replaced, not written, or, if it is a symlink, followed,
+		// through; a directory is kept.
+		if fi, err := os.Lstat(p); err == nil && !(fi.IsDir() && m.IsDir()) {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+		// CreateFileInRoot reads a record's contents to EOF, so
+		// they must end where the record does.
+		r.Name = n
+		if r.ReaderAt == nil {
+			r.ReaderAt = strings.NewReader("")
+		} else {
+			r.ReaderAt = io.NewSectionReader(r.ReaderAt, 0, int64(r.FileSize))
+		}
+		if err := cpio.CreateFileInRoot(r, dir, forcePriv); err != nil {
+			return fmt.Errorf("%s: %w", n, err)
+		}
+		switch {
+		case m.IsDir():
+			// It is filled first, and its mode set after.
+			if err := os.Chmod(p, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, r)
+		case m.IsRegular():
+			t := time.Unix(int64(r.MTime), 0)
+			if err := os.Chtimes(p, t, t); err != nil {
+				return err
+			}
+		case m&fs.ModeSymlink == 0:
+			if _, err := os.Lstat(p); err != nil {
+				verbose("%s: %v: not made", n, m)
+				skipped++
+			}
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p := filepath.Join(dir, filepath.FromSlash(dirs[i].Name))
+		// A later record may have replaced it, e.g. with a symlink,
+		// which is not followed.
+		if fi, err := os.Lstat(p); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := os.Chmod(p, uToGo(dirs[i].Mode).Perm()); err != nil {
+			return err
+		}
+		t := time.Unix(int64(dirs[i].MTime), 0)
+		if err := os.Chtimes(p, t, t); err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		info("%d device nodes, fifos or sockets were not made", skipped)
+	}
+	return nil
+}
+
+// fileSum returns the sha256 of what r reads.
+func fileSum(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyRecord returns how the file p differs from its record, or "",
+// if it does not.
+func verifyRecord(p string, r cpio.Record) (string, error) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return "missing", nil
+	}
+	m := uToGo(r.Mode)
+	if fi.Mode().Type() != m.Type() {
+		return fmt.Sprintf("is %v, not %v", fi.Mode().Type(), m.Type()), nil
+	}
+	switch {
+	case m&fs.ModeSymlink != 0:
+		want, err := recordLink(r)
+		if err != nil {
+			return "", err
+		}
+		if got, err := os.Readlink(p); err != nil || got != want {
+			return fmt.Sprintf("links to %q, not %q", got, want), nil
+		}
+		return "", nil
+	case fi.Mode().Perm() != m.Perm():
+		return fmt.Sprintf("mode %v, not %v", fi.Mode().Perm(), m.Perm()), nil
+	case m.IsRegular():
+		if fi.Size() != int64(r.FileSize) {
+			return fmt.Sprintf("%d bytes, not %d", fi.Size(), r.FileSize), nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		got, err := fileSum(f)
+		if err != nil {
+			return "", err
+		}
+		want, err := fileSum(recordData(r))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", r.Name, err)
+		}
+		if !bytes.Equal(got, want) {
+			return "contents differ", nil
+		}
+	}
+	return "", nil
+}
+
+// verifyTree compares dir with the archive it was extracted from, and
+// writes how they differ, including files the archive does not have,
+// to w. That they differ is an error.
+func verifyTree(w io.Writer, recs []cpio.Record, dir string) error {
+	names := map[string]bool{".": true}
+	var diffs int
+	for _, r := range recs {
+		if r.Name == cpio.Trailer {
+			continue
+		}
+		m := uToGo(r.Mode)
+		if !m.IsDir() && !m.IsRegular() && m&fs.ModeSymlink == 0 {
+			continue
+		}
+		n := archiveName(r.Name)
+		names[n] = true
+		d, err := verifyRecord(filepath.Join(dir, filepath.FromSlash(n)), r)
+		if err != nil {
+			return err
+		}
+		if len(d) > 0 {
+			fmt.Fprintf(w, "%s: %s\n", n, d)
+			diffs++
+		}
+	}
+	err := filepath.WalkDir(dir, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if n := filepath.ToSlash(rel); !names[n] {
+			fmt.Fprintf(w, "%s: not in the container\n", n)
+			diffs++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if diffs > 0 {
+		return fmt.Errorf("%s: %d differences from the container:%w", dir, diffs, os.ErrInvalid)
+	}
+	return nil
+}
+
+// extractCommand is sidecore extract.
+func extractCommand(args []string) error {
+	usage := fmt.Errorf("usage: sidecore extract [-force-priv] container dir | -list container | -verify container dir:%w", os.ErrInvalid)
+	f := flag.NewFlagSet("sidecore extract", flag.ContinueOnError)
+	list := f.Bool("list", false, "list the files of the container, rather than extract them")
+	check := f.Bool("verify", false, "compare dir, which the container was extracted into, with it, rather than extract it")
+	forcePriv := f.Bool("force-priv", false, "fail if a device node can not be made, or the owner of a file set, as they can not be without root, rather than skip it")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	want := 2
+	if *list {
+		want = 1
+	}
+	if f.NArg() != want || *list && *check || *forcePriv && (*list || *check) {
+		return usage
+	}
+	c, dirs, err := containerArg(f.Arg(0))
+	if err != nil {
+		return fmt.Errorf("sidecore extract: %w", err)
+	}
+	files, recs, err := readLayers(c)
+	if err != nil {
+		return fmt.Errorf("sidecore extract: %w", searchError(err, dirs))
+	}
+	defer func() {
+		for _, a := range files {
+			a.Close()
+		}
+	}()
+	switch {
+	case *list:
+		return listRecords(os.Stdout, recs)
+	case *check:
+		return verifyTree(os.Stdout, recs, f.Arg(1))
+	}
+	if err := extractRecords(recs, f.Arg(1), *forcePriv); err != nil {
+		return fmt.Errorf("sidecore extract: %w", err)
+	}
+	return nil
+}
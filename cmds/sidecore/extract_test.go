@@ -0,0 +1,152 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestExtract(t *testing.T) {
+	_, recs, err := readLayers("data/a.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := filepath.Join(t.TempDir(), "rootfs")
+	if err := extractRecords(recs, d, false); err != nil {
+		t.Fatalf("extractRecords(data/a.cpio, %s): %v != nil", d, err)
+	}
+	want, err := os.ReadFile("data/a/b/c/d/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(d, "a/b/c/d/hosts")); err != nil || string(got) != string(want) {
+		t.Errorf("a/b/c/d/hosts: %q, %v != %q, nil", got, err, want)
+	}
+	if l, err := os.Readlink(filepath.Join(d, "a/b/hosts")); err != nil || len(l) == 0 {
+		t.Errorf("Readlink(a/b/hosts): %q, %v != a link, nil", l, err)
+	}
+
+	var b bytes.Buffer
+	if err := verifyTree(&b, recs, d); err != nil {
+		t.Errorf("verifyTree(%s): %v, %q != nil", d, err, b.String())
+	}
+	// Extracting again replaces what is there.
+	if err := extractRecords(recs, d, false); err != nil {
+		t.Fatalf("extractRecords again: %v != nil", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(d, "a/b/c/d/hosts"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, "extra"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err := verifyTree(&b, recs, d); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("verifyTree(%s), changed: %v != %v", d, err, os.ErrInvalid)
+	}
+	for _, s := range []string{"a/b/c/d/hosts: 7 bytes", "extra: not in the container"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("verifyTree(%s), changed: %q does not say %q", d, b.String(), s)
+		}
+	}
+
+	b.Reset()
+	if err := listRecords(&b, recs); err != nil {
+		t.Fatalf("listRecords: %v != nil", err)
+	}
+	if !strings.Contains(b.String(), "a/b/hosts -> ") || !strings.Contains(b.String(), "a/b/c/d/hosts\n") {
+		t.Errorf("listRecords: %q does not list a/b/hosts, or a/b/c/d/hosts", b.String())
+	}
+}
+
+func TestExtractOutside(t *testing.T) {
+	top := t.TempDir()
+	d := filepath.Join(top, "rootfs")
+	// .. is cleaned away; a file under a symlink is an error.
+	if err := extractRecords([]cpio.Record{cpio.StaticFile("../../up", "up", 0644)}, d, false); err != nil {
+		t.Fatalf("extractRecords(../../up): %v != nil", err)
+	}
+	if _, err := os.Stat(filepath.Join(d, "up")); err != nil {
+		t.Errorf("../../up: %v != nil", err)
+	}
+	recs := []cpio.Record{
+		cpio.Symlink("l", top),
+		cpio.StaticFile("l/escaped", "x", 0644),
+	}
+	if err := extractRecords(recs, d, false); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("extractRecords(l -> %s, l/escaped): %v != %v", top, err, os.ErrInvalid)
+	}
+	if _, err := os.Stat(filepath.Join(top, "escaped")); err == nil {
+		t.Errorf("extractRecords(l -> %s, l/escaped): %s/escaped was made", top, top)
+	}
+}
+
+func TestExtractSymlinkDir(t *testing.T) {
+	top := t.TempDir()
+	out := filepath.Join(top, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := filepath.Join(top, "rootfs")
+	// A directory's mode and times are set once all is extracted;
+	// neither that of a symlink, before, nor after, it, is followed.
+	recs := []cpio.Record{
+		cpio.Symlink("x", out),
+		cpio.Directory("x", 0500),
+		cpio.Directory("y", 0500),
+		cpio.Symlink("y", out),
+	}
+	if err := extractRecords(recs, d, false); err != nil {
+		t.Fatalf("extractRecords(x -> %s, x/, y/, y -> %s): %v != nil", out, out, err)
+	}
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("%s: %v, %v != %v, nil", out, fi.Mode(), err, os.FileMode(0755))
+	}
+	if fi, err := os.Lstat(filepath.Join(d, "x")); err != nil || fi.Mode() != os.ModeDir|0500 {
+		t.Errorf("x: %v, %v != %v, nil", fi.Mode(), err, os.ModeDir|0500)
+	}
+	os.Chmod(filepath.Join(d, "x"), 0700)
+}
+
+func TestExtractDevices(t *testing.T) {
+	d := filepath.Join(t.TempDir(), "rootfs")
+	null := cpio.Record{Info: cpio.Info{Name: "dev/null", Mode: cpio.S_IFCHR | 0666, Rmajor: 1, Rminor: 3}}
+	fifo := cpio.Record{Info: cpio.Info{Name: "dev/fifo", Mode: cpio.S_IFIFO | 0666}}
+	// Without -force-priv, what can not be made is skipped.
+	if err := extractRecords([]cpio.Record{cpio.Directory("dev", 0755), null, fifo}, d, false); err != nil {
+		t.Fatalf("extractRecords(dev/null, dev/fifo): %v != nil", err)
+	}
+	if _, err := os.Lstat(filepath.Join(d, "dev/fifo")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("dev/fifo: %v != %v", err, os.ErrNotExist)
+	}
+	if os.Getuid() != 0 {
+		return
+	}
+	if fi, err := os.Lstat(filepath.Join(d, "dev/null")); err != nil || fi.Mode().Type() != os.ModeDevice|os.ModeCharDevice {
+		t.Errorf("dev/null, as root: %v, %v != a char device, nil", fi, err)
+	}
+}
+
+func TestExtractCommand(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"data/a.cpio"},
+		{"-list", "data/a.cpio", "dir"},
+		{"-list", "-verify", "data/a.cpio"},
+		{"-force-priv", "-list", "data/a.cpio"},
+	} {
+		if err := extractCommand(args); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("sidecore extract %q: %v != %v", args, err, os.ErrInvalid)
+		}
+	}
+}
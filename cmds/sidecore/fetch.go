@@ -0,0 +1,314 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// A container which is named, and is in none of the directories of
+// SIDECORE_IMAGES, is downloaded from -image-url, or
+// SIDECORE_IMAGE_URL, if it is set, into the first of them. It is
+// written to name.part, which a later download resumes, and only
+// renamed to name once it is whole, and, if there is a name.sha256,
+// its sum matches.
+var imageURL = flag.String("image-url", "", "base URL to download missing containers from, as <url>/<arch>-<distro>@<version>.cpio; the default is SIDECORE_IMAGE_URL")
+
+// imageBase is the URL of -image-url, or SIDECORE_IMAGE_URL, or nil
+// for neither. flags sets it.
+var imageBase *url.URL
+
+// imageBaseURL returns the URL of -image-url, or, if it is not set,
+// SIDECORE_IMAGE_URL, or nil if neither is.
+func imageBaseURL() (*url.URL, error) {
+	s := *imageURL
+	if len(s) == 0 {
+		s = os.Getenv("SIDECORE_IMAGE_URL")
+	}
+	if len(s) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("-image-url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("-image-url %q: want an http or https URL:%w", s, os.ErrInvalid)
+	}
+	return u, nil
+}
+
+// imageClient downloads containers. Tests replace it.
+var imageClient = http.DefaultClient
+
+// fetch is a download, which the cpus which need it share.
+type fetch struct {
+	once sync.Once
+	err  error
+}
+
+var (
+	fetchesMu sync.Mutex
+	fetches   = map[string]*fetch{}
+)
+
+// fetchContainer downloads a cpu's container, or each of its layers,
+// if it is a name which is not in SIDECORE_IMAGES, and there is an
+// image URL. cpus with the same container share a download.
+func fetchContainer(cpu *cpu) error {
+	if imageBase == nil || len(cpu.imageDirs) == 0 {
+		return nil
+	}
+	for _, l := range containerLayers(cpu.container) {
+		if err := fetchLayer(l, cpu.imageDirs[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchLayer downloads a container in the images directory dir, if it
+// is not there.
+func fetchLayer(c, dir string) error {
+	if _, ok := dirContainer(c); ok {
+		return nil
+	}
+	if _, err := os.Stat(c); err == nil {
+		return nil
+	}
+	name, err := filepath.Rel(dir, c)
+	if err != nil || !filepath.IsLocal(name) {
+		return nil
+	}
+	u := imageBase.JoinPath(filepath.ToSlash(name))
+	fetchesMu.Lock()
+	f, ok := fetches[c]
+	if !ok {
+		f = &fetch{}
+		fetches[c] = f
+	}
+	fetchesMu.Unlock()
+	f.once.Do(func() {
+		f.err = fetchImage(u.String(), c)
+	})
+	return f.err
+}
+
+// fetchImage downloads u to dst, by way of dst.part, resuming one left
+// by an earlier download. If there is a u.sha256, the download must
+// match it; if not, it is removed. dst only exists once it is whole.
+func fetchImage(u, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	sum, err := fetchSum(u + ".sha256")
+	if err != nil {
+		return err
+	}
+	part := dst + ".part"
+	// A part left by an earlier download may be of another
+	// image; if what it makes is bad, it is downloaded again,
+	// from the start.
+	_, err = os.Stat(part)
+	resumed := err == nil
+	for {
+		err := fetchPart(u, part, imageClient.Do)
+		if err == nil {
+			err = checkSum(part, sum)
+		}
+		if err == nil {
+			break
+		}
+		os.Remove(part)
+		if !resumed || !errors.Is(err, errBadSum) {
+			return err
+		}
+		resumed = false
+		info("%s: downloading it again", dst)
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return err
+	}
+	// The sum is kept, so that the container is checked each
+	// time it is used.
+	if sum != nil {
+		if err := writeFileAtomic(dst+".sha256", []byte(fmt.Sprintf("%x  %s\n", sum, filepath.Base(dst)))); err != nil {
+			verbose("%s.sha256: %v", dst, err)
+		}
+	}
+	return nil
+}
+
+// errBadSum is the error for a download which does not match its
+// .sha256.
+var errBadSum = errors.New("sha256 does not match")
+
+// fetchSum returns the sum in a .sha256 file, as sha256sum writes it,
+// or nil if there is none.
+func fetchSum(u string) ([]byte, error) {
+	resp, err := imageClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		verbose("%s: not found; the download is not checked", u)
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	l, err := bufio.NewReader(io.LimitReader(resp.Body, 4096)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	sum, err := parseSum(l)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	return sum, nil
+}
+
+// parseSum parses a sha256, as sha256sum writes it, with or without
+// the name after it.
+func parseSum(s string) ([]byte, error) {
+	f := strings.Fields(s)
+	if len(f) == 0 {
+		return nil, fmt.Errorf("no sum:%w", os.ErrInvalid)
+	}
+	sum, err := hex.DecodeString(f[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("%q is not a sha256:%w", f[0], os.ErrInvalid)
+	}
+	return sum, nil
+}
+
+// fetchPart downloads u to part, from where part ends, if it exists,
+// with do, which may e.g. add a registry's token.
+func fetchPart(u, part string, do func(*http.Request) (*http.Response, error)) error {
+	var have int64
+	if fi, err := os.Stat(part); err == nil {
+		have = fi.Size()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if have > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+	}
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The server does not do ranges: start again.
+		flags, have = flags|os.O_TRUNC, 0
+	case http.StatusPartialContent:
+		verbose("%s: resuming at %d bytes", u, have)
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The part is all there is.
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: %s:%w", u, resp.Status, os.ErrNotExist)
+	default:
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	p := newProgress(filepath.Base(u), have, have+resp.ContentLength)
+	_, err = io.Copy(f, io.TeeReader(resp.Body, p))
+	p.done(err)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", u, err)
+	}
+	return nil
+}
+
+// checkSum checks that f's sha256 is sum, unless sum is nil.
+func checkSum(f string, sum []byte) error {
+	if sum == nil {
+		return nil
+	}
+	r, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if got := h.Sum(nil); string(got) != string(sum) {
+		return fmt.Errorf("%s: %x, not %x:%w", f, got, sum, errBadSum)
+	}
+	return nil
+}
+
+// progress shows how much of a download has been done, every second
+// or so, on stderr, if it is a terminal.
+type progress struct {
+	name  string
+	n     int64
+	total int64
+	last  time.Time
+	tty   bool
+}
+
+func newProgress(name string, n, total int64) *progress {
+	info("downloading %s", name)
+	return &progress{name: name, n: n, total: total, tty: logLevel >= levelNormal && term.IsTerminal(int(os.Stderr.Fd()))}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.n += int64(len(b))
+	if p.tty && time.Since(p.last) >= time.Second {
+		p.last = time.Now()
+		fmt.Fprintf(os.Stderr, "\r%s", p)
+	}
+	return len(b), nil
+}
+
+func (p *progress) String() string {
+	const mb = 1 << 20
+	if p.total <= 0 {
+		return fmt.Sprintf("%s: %.1f MiB", p.name, float64(p.n)/mb)
+	}
+	return fmt.Sprintf("%s: %.1f of %.1f MiB, %d%%", p.name, float64(p.n)/mb, float64(p.total)/mb, p.n*100/p.total)
+}
+
+// done ends the progress line.
+func (p *progress) done(err error) {
+	if p.tty {
+		fmt.Fprintf(os.Stderr, "\r%s\n", p)
+	}
+	if err == nil {
+		info("downloaded %s", p.name)
+	}
+}
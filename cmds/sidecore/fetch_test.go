@@ -0,0 +1,240 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// imageServer serves files, with ranges, and records the Range of
+// each request.
+type imageServer struct {
+	files map[string][]byte
+	mu    sync.Mutex
+	gets  []string
+}
+
+func (s *imageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.gets = append(s.gets, r.URL.Path+" "+r.Header.Get("Range"))
+	s.mu.Unlock()
+	b, ok := s.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(b))
+}
+
+func TestImageBaseURL(t *testing.T) {
+	defer func(u string) { *imageURL = u }(*imageURL)
+	for _, tt := range []struct {
+		flag, env string
+		want      string
+		err       error
+	}{
+		{},
+		{env: "https://example.com/images", want: "https://example.com/images"},
+		{flag: "http://flag.example.com", env: "https://example.com/images", want: "http://flag.example.com"},
+		{flag: "ftp://example.com/images", err: os.ErrInvalid},
+		{env: "/images", err: os.ErrInvalid},
+		{flag: "https:///images", err: os.ErrInvalid},
+	} {
+		*imageURL = tt.flag
+		t.Setenv("SIDECORE_IMAGE_URL", tt.env)
+		u, err := imageBaseURL()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("imageBaseURL(%q, %q): %v != %v", tt.flag, tt.env, err, tt.err)
+			continue
+		}
+		var got string
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("imageBaseURL(%q, %q): %q != %q", tt.flag, tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestFetchImage(t *testing.T) {
+	image := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	sum := sha256.Sum256(image)
+	for _, tt := range []struct {
+		name  string
+		files map[string][]byte
+		part  []byte
+		want  []byte
+		gets  []string
+		err   error
+	}{
+		{
+			name:  "sha256",
+			files: map[string][]byte{"/i.cpio": image, "/i.cpio.sha256": []byte(fmt.Sprintf("%x  i.cpio\n", sum))},
+			want:  image,
+			gets:  []string{"/i.cpio.sha256 ", "/i.cpio "},
+		},
+		{
+			name:  "no sha256",
+			files: map[string][]byte{"/i.cpio": image},
+			want:  image,
+			gets:  []string{"/i.cpio.sha256 ", "/i.cpio "},
+		},
+		{
+			name:  "resume",
+			files: map[string][]byte{"/i.cpio": image, "/i.cpio.sha256": []byte(fmt.Sprintf("%x\n", sum))},
+			part:  image[:1000],
+			want:  image,
+			gets:  []string{"/i.cpio.sha256 ", "/i.cpio bytes=1000-"},
+		},
+		{
+			name:  "whole part",
+			files: map[string][]byte{"/i.cpio": image},
+			part:  image,
+			want:  image,
+			gets:  []string{"/i.cpio.sha256 ", fmt.Sprintf("/i.cpio bytes=%d-", len(image))},
+		},
+		{
+			name:  "bad part",
+			files: map[string][]byte{"/i.cpio": image, "/i.cpio.sha256": []byte(fmt.Sprintf("%x\n", sum))},
+			part:  []byte("not the image"),
+			want:  image,
+			gets:  []string{"/i.cpio.sha256 ", "/i.cpio bytes=13-", "/i.cpio "},
+		},
+		{
+			name:  "bad sha256",
+			files: map[string][]byte{"/i.cpio": image, "/i.cpio.sha256": []byte(fmt.Sprintf("%x\n", sha256.Sum256(nil)))},
+			gets:  []string{"/i.cpio.sha256 ", "/i.cpio "},
+			err:   errBadSum,
+		},
+		{
+			name:  "not a sha256",
+			files: map[string][]byte{"/i.cpio": image, "/i.cpio.sha256": []byte("deadbeef\n")},
+			gets:  []string{"/i.cpio.sha256 "},
+			err:   os.ErrInvalid,
+		},
+		{
+			name:  "no image",
+			files: map[string][]byte{},
+			gets:  []string{"/i.cpio.sha256 ", "/i.cpio "},
+			err:   os.ErrNotExist,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &imageServer{files: tt.files}
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			dst := filepath.Join(t.TempDir(), "images", "i.cpio")
+			if tt.part != nil {
+				if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(dst+".part", tt.part, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := fetchImage(ts.URL+"/i.cpio", dst)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("fetchImage: %v != %v", err, tt.err)
+			}
+			if got := strings.Join(s.gets, ","); got != strings.Join(tt.gets, ",") {
+				t.Errorf("requests: %q != %q", got, strings.Join(tt.gets, ","))
+			}
+			if tt.err != nil {
+				if _, err := os.Stat(dst); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("after a failed download, %s: %v != %v", dst, err, os.ErrNotExist)
+				}
+				if _, err := os.Stat(dst + ".part"); tt.err == errBadSum && !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("after a bad download, %s.part: %v != %v", dst, err, os.ErrNotExist)
+				}
+				return
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("%s: %d bytes != the %d of the image", dst, len(got), len(tt.want))
+			}
+			if _, err := os.Stat(dst + ".part"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s.part: %v != %v", dst, err, os.ErrNotExist)
+			}
+			// The sum is kept, to check the container with.
+			if _, ok := tt.files["/i.cpio.sha256"]; ok {
+				if err := verifyContainer(dst); err != nil {
+					t.Errorf("verifyContainer(%s): %v != nil", dst, err)
+				}
+				if _, err := os.Stat(dst + ".sha256"); err != nil {
+					t.Errorf("%s.sha256: %v != nil", dst, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchContainer(t *testing.T) {
+	defer func(u *url.URL) { imageBase = u }(imageBase)
+	s := &imageServer{files: map[string][]byte{"/images/amd64-ubuntu@latest.cpio": []byte("image")}}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	d, other := t.TempDir(), t.TempDir()
+	t.Setenv("SIDECORE_IMAGES", d+string(filepath.ListSeparator)+other)
+	if err := os.WriteFile(filepath.Join(other, "arm64-ubuntu@latest.cpio"), []byte("here"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a URL, nothing is downloaded.
+	imageBase = nil
+	c := &cpu{}
+	c.container, c.imageDirs = searchContainer("amd64-ubuntu@latest.cpio")
+	if err := fetchContainer(c); err != nil || len(s.gets) != 0 {
+		t.Fatalf("fetchContainer with no URL: %v, %q != nil, no requests", err, s.gets)
+	}
+
+	u, err := url.Parse(ts.URL + "/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageBase = u
+	for _, n := range []string{"amd64-ubuntu@latest.cpio", "amd64-ubuntu@latest.cpio"} {
+		c := &cpu{}
+		c.container, c.imageDirs = searchContainer(n)
+		if err := fetchContainer(c); err != nil {
+			t.Fatalf("fetchContainer(%s): %v != nil", n, err)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(d, "amd64-ubuntu@latest.cpio")); err != nil || string(b) != "image" {
+		t.Errorf("downloaded container: %q, %v != %q, nil", b, err, "image")
+	}
+	if len(s.gets) != 2 {
+		t.Errorf("requests: %q, want the image and its sha256 once", s.gets)
+	}
+
+	// A container which is there, or is a path, or a dir:, is not
+	// downloaded.
+	s.gets = nil
+	for _, n := range []string{"arm64-ubuntu@latest.cpio", "/no/such/container.cpio", dirPrefix + "rootfs"} {
+		c := &cpu{}
+		c.container, c.imageDirs = searchContainer(n)
+		if err := fetchContainer(c); err != nil {
+			t.Errorf("fetchContainer(%s): %v != nil", n, err)
+		}
+	}
+	if len(s.gets) != 0 {
+		t.Errorf("requests: %q, want none", s.gets)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// -fstab replaces the fstab made from -namespace with a file, for
+// layouts it can not make, e.g. overlays, or more than one home. The
+// nfs server's line is added to it, unless it has ${NFSPORT} or
+// ${NONCE}, which are replaced with the nfs server's port and nonce, so
+// that it can mount the nfs server itself, e.g. with other options.
+var fstabFlag = flag.String("fstab", "", "fstab file for the remote mounts, instead of the one -namespace makes; ${NFSPORT} and ${NONCE} are the nfs server's")
+
+// customFSTab is the contents of -fstab. flags sets it.
+var customFSTab string
+
+// nfsExport is what srvNFS serves: the nonce which names the export,
+// and the port on the cpu the nfs server is reached on.
+type nfsExport struct {
+	nonce string
+	port  uint64
+}
+
+// fstab returns the fstab line which mounts the export on -mountpoint,
+// with the options of the -nfs flags.
+func (e *nfsExport) fstab() string {
+	return fmt.Sprintf("127.0.0.1:%s %s nfs %s 0 0\n", e.nonce, *mountpoint, nfsMountOptions(nfsOptions, e.port))
+}
+
+// nfsPlaceholders are replaced, in an fstab, with the nfs server's
+// port and nonce.
+var nfsPlaceholders = []string{"${NFSPORT}", "${NONCE}"}
+
+// mountsNFS reports whether fstab mounts the nfs server itself, with
+// ${NFSPORT} or ${NONCE}.
+func mountsNFS(fstab string) bool {
+	for _, p := range nfsPlaceholders {
+		if strings.Contains(fstab, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFSTab returns the fstab for a session: the nfs server's line,
+// if there is an export, followed by the lines of fstabs, e.g. those
+// of the namespace and of CPU_FSTAB, in order. Blank lines are
+// dropped, as are lines which mount what an earlier one did, with the
+// same fields, however they are spaced. If fstabs mount the nfs server
+// themselves, their placeholders are replaced, and the nfs server's
+// line is left out.
+func mergeFSTab(e *nfsExport, fstabs ...string) string {
+	all := strings.Join(fstabs, "\n")
+	if e != nil {
+		if mountsNFS(all) {
+			all = strings.NewReplacer("${NFSPORT}", strconv.FormatUint(e.port, 10), "${NONCE}", e.nonce).Replace(all)
+		} else {
+			all = e.fstab() + all
+		}
+	}
+	var b strings.Builder
+	seen := map[string]bool{}
+	for _, l := range strings.Split(all, "\n") {
+		k := strings.Join(strings.Fields(l), " ")
+		if len(k) == 0 || seen[k] {
+			continue
+		}
+		seen[k] = true
+		b.WriteString(strings.TrimRight(l, "\r"))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// setFSTab returns env with its CPU_FSTAB variables, of which there
+// may be several, e.g. from here and from the namespace, replaced by
+// one, which merges them with the nfs server's line, if there is an
+// export, as mergeFSTab does. If there are none, and no export, env
+// is returned as it is.
+func setFSTab(env []string, e *nfsExport) []string {
+	var fstabs []string
+	rest := make([]string, 0, len(env)+1)
+	for _, v := range env {
+		if f, ok := strings.CutPrefix(v, "CPU_FSTAB="); ok {
+			fstabs = append(fstabs, f)
+			continue
+		}
+		rest = append(rest, v)
+	}
+	fstab := mergeFSTab(e, fstabs...)
+	if len(fstabs) == 0 && len(fstab) == 0 {
+		return env
+	}
+	return append(rest, "CPU_FSTAB="+fstab)
+}
+
+// readFSTab reads an fstab file, and checks that each line, other than
+// blank lines and comments, has the six fields of fstab(5).
+func readFSTab(f string) (string, error) {
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return "", fmt.Errorf("-fstab: %w", err)
+	}
+	for i, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if n := len(strings.Fields(l)); n != 6 {
+			return "", fmt.Errorf("-fstab %s:%d: %q has %d fields, not the 6 of spec, file, type, options, freq and passno:%w", f, i+1, l, n, os.ErrInvalid)
+		}
+	}
+	fstab := string(b)
+	if len(fstab) > 0 && !strings.HasSuffix(fstab, "\n") {
+		fstab += "\n"
+	}
+	return fstab, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadFSTab(t *testing.T) {
+	d := t.TempDir()
+	for _, tt := range []struct {
+		name  string
+		fstab string
+		want  string
+		err   error
+		line  string
+	}{
+		{name: "empty"},
+		{
+			name:  "bind",
+			fstab: "# data\n\n/tmp/cpu/data /data none defaults,bind 0 0",
+			want:  "# data\n\n/tmp/cpu/data /data none defaults,bind 0 0\n",
+		},
+		{
+			name:  "nfs",
+			fstab: "127.0.0.1:${NONCE} /tmp/cpu nfs ro,vers=3,port=${NFSPORT},mountport=${NFSPORT} 0 0\n",
+			want:  "127.0.0.1:${NONCE} /tmp/cpu nfs ro,vers=3,port=${NFSPORT},mountport=${NFSPORT} 0 0\n",
+		},
+		{name: "short", fstab: "# ok\n/tmp/cpu/data /data none\n", err: os.ErrInvalid, line: ":2:"},
+		{name: "long", fstab: "/a /b none bind 0 0 extra\n", err: os.ErrInvalid, line: ":1:"},
+	} {
+		f := filepath.Join(d, tt.name)
+		if err := os.WriteFile(f, []byte(tt.fstab), 0600); err != nil {
+			t.Fatalf("WriteFile(%q): %v != nil", f, err)
+		}
+		got, err := readFSTab(f)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: readFSTab: %v != %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), tt.line) {
+				t.Errorf("%s: readFSTab: %v does not name line %s", tt.name, err, tt.line)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: readFSTab: %q != %q", tt.name, got, tt.want)
+		}
+	}
+	if _, err := readFSTab(filepath.Join(d, "none")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("readFSTab(missing): %v != %v", err, os.ErrNotExist)
+	}
+}
+
+func TestMergeFSTab(t *testing.T) {
+	e := &nfsExport{nonce: "abc", port: 2049}
+	bind := "/tmp/cpu/lib /lib none defaults,bind 0 0\n"
+	for _, tt := range []struct {
+		name   string
+		e      *nfsExport
+		fstabs []string
+		want   string
+	}{
+		{name: "nothing", want: ""},
+		{name: "no nfs", fstabs: []string{bind}, want: bind},
+		{name: "nfs only", e: e, want: e.fstab()},
+		{name: "empty", e: e, fstabs: []string{""}, want: e.fstab()},
+		// With no newline at the end, the next line must
+		// not be run on.
+		{name: "single line", e: e, fstabs: []string{"/a /b none bind 0 0", "/c /d none bind 0 0"}, want: e.fstab() + "/a /b none bind 0 0\n/c /d none bind 0 0\n"},
+		{name: "trailing newline", e: e, fstabs: []string{bind, "/a /b none bind 0 0\n"}, want: e.fstab() + bind + "/a /b none bind 0 0\n"},
+		{name: "duplicates", e: e, fstabs: []string{bind, "/tmp/cpu/lib  /lib\tnone defaults,bind 0 0", e.fstab()}, want: e.fstab() + bind},
+		{name: "blank lines", fstabs: []string{"\n\n" + bind + "\r\n\n"}, want: bind},
+		{
+			name:   "placeholders",
+			e:      e,
+			fstabs: []string{"127.0.0.1:${NONCE} /tmp/cpu nfs ro,port=${NFSPORT},mountport=${NFSPORT} 0 0\n", bind},
+			want:   "127.0.0.1:abc /tmp/cpu nfs ro,port=2049,mountport=2049 0 0\n" + bind,
+		},
+	} {
+		if got := mergeFSTab(tt.e, tt.fstabs...); got != tt.want {
+			t.Errorf("%s: mergeFSTab: %q != %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetFSTab(t *testing.T) {
+	e := &nfsExport{nonce: "abc", port: 2049}
+	bind := "/tmp/cpu/lib /lib none defaults,bind 0 0\n"
+	for _, tt := range []struct {
+		name string
+		env  []string
+		e    *nfsExport
+		want []string
+	}{
+		{name: "none", env: []string{"TERM=xterm"}, want: []string{"TERM=xterm"}},
+		{name: "nfs", env: []string{"TERM=xterm"}, e: e, want: []string{"TERM=xterm", "CPU_FSTAB=" + e.fstab()}},
+		{
+			name: "replaced",
+			env:  []string{"CPU_FSTAB=/a /b none bind 0 0", "TERM=xterm", "CPU_FSTAB=" + bind},
+			e:    e,
+			want: []string{"TERM=xterm", "CPU_FSTAB=" + e.fstab() + "/a /b none bind 0 0\n" + bind},
+		},
+		{name: "no nfs", env: []string{"CPU_FSTAB=" + bind, "CPU_FSTAB=" + bind}, want: []string{"CPU_FSTAB=" + bind}},
+	} {
+		if got := setFSTab(tt.env, tt.e); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: setFSTab: %q != %q", tt.name, got, tt.want)
+		}
+	}
+}
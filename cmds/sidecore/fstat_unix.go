@@ -0,0 +1,55 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"hash/fnv"
+	"os"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"golang.org/x/sys/unix"
+)
+
+// go-nfs takes the owner, link count, device and file ID of a file
+// from a *syscall.Stat_t in its Sys(). Without one, all files are
+// owned by whoever the NFS client makes up, and sshd, sudo, and
+// others which check who owns a file, refuse them.
+
+// setStat sets a field of a syscall.Stat_t, whose type differs
+// between kernels and arches.
+func setStat[T ~uint16 | ~uint32 | ~uint64 | ~int16 | ~int32 | ~int64](f *T, v uint64) {
+	*f = T(v)
+}
+
+// recordSys returns the syscall.Stat_t of a record. Its file ID is a
+// hash of its name, as go-nfs makes when there is none, since inode
+// numbers of layers, or of archives written without them, collide.
+func recordSys(r *cpio.Record) any {
+	h := fnv.New64()
+	h.Write([]byte(r.Name))
+	s := &syscall.Stat_t{Uid: uint32(r.UID), Gid: uint32(r.GID)}
+	setStat(&s.Nlink, r.NLink)
+	setStat(&s.Rdev, unix.Mkdev(uint32(r.Rmajor), uint32(r.Rminor)))
+	setStat(&s.Ino, h.Sum64())
+	return s
+}
+
+// mountSys returns the syscall.Stat_t of a mount point. A billy
+// filesystem other than the host's may have none, and its files are
+// then those of whoever runs sidecore.
+func mountSys(fi os.FileInfo, name string) any {
+	if s, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return s
+	}
+	h := fnv.New64()
+	h.Write([]byte(name))
+	s := &syscall.Stat_t{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	setStat(&s.Nlink, 1)
+	setStat(&s.Ino, h.Sum64())
+	return s
+}
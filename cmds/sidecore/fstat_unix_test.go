@@ -0,0 +1,74 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	nfs "github.com/willscott/go-nfs"
+)
+
+func TestFstatSys(t *testing.T) {
+	f := cpio.StaticFile("f", "f\n", 0600)
+	f.UID, f.GID, f.NLink = 123, 456, 2
+	null := cpio.CharDev("null", 0666, 1, 3)
+	null.UID, null.GID, null.NLink = 123, 456, 1
+	p := writeCPIO(t, t.TempDir(), "owned.cpio", cpio.Directory(".", 0755), f, null)
+	fs, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q): %v != nil", p, err)
+	}
+
+	var ids []uint64
+	for _, tt := range []struct {
+		name  string
+		nlink uint32
+		spec  [2]uint32
+	}{
+		{name: "f", nlink: 2},
+		{name: "null", nlink: 1, spec: [2]uint32{1, 3}},
+	} {
+		fi, err := fs.Lstat(tt.name)
+		if err != nil {
+			t.Fatalf("Lstat(%q): %v != nil", tt.name, err)
+		}
+		a := nfs.ToFileAttribute(fi, tt.name)
+		if a.UID != 123 || a.GID != 456 {
+			t.Errorf("%s: uid %d, gid %d != 123, 456", tt.name, a.UID, a.GID)
+		}
+		if a.Nlink != tt.nlink {
+			t.Errorf("%s: nlink %d != %d", tt.name, a.Nlink, tt.nlink)
+		}
+		if a.SpecData != tt.spec {
+			t.Errorf("%s: device %v != %v", tt.name, a.SpecData, tt.spec)
+		}
+		ids = append(ids, a.Fileid)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("f and null: file ID %d == %d", ids[0], ids[1])
+	}
+
+	// A mount point's FileInfo with no Stat_t is of whoever runs sidecore.
+	root, err := fs.Stat(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &ufstat{FileInfo: memInfo{root}, name: "m"}
+	a := nfs.ToFileAttribute(u, "m")
+	if a.UID != uint32(os.Getuid()) || a.GID != uint32(os.Getgid()) {
+		t.Errorf("ufstat: uid %d, gid %d != %d, %d", a.UID, a.GID, os.Getuid(), os.Getgid())
+	}
+}
+
+// memInfo is a FileInfo with no Sys, as a billy memfs has.
+type memInfo struct {
+	os.FileInfo
+}
+
+func (memInfo) Sys() any { return nil }
@@ -0,0 +1,21 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// recordSys returns nil: go-nfs has no owners on windows.
+func recordSys(r *cpio.Record) any {
+	return nil
+}
+
+// mountSys returns what Sys of the mount point does.
+func mountSys(fi os.FileInfo, name string) any {
+	return fi.Sys()
+}
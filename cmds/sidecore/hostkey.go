@@ -0,0 +1,185 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// errHostKey is returned when a host key is not accepted.
+var errHostKey = errors.New("Host key verification failed")
+
+// confirm asks a yes or no question. Tests replace it.
+var confirm = readConfirm
+
+// readConfirm asks a yes or no question on the terminal.
+// With no terminal, the answer is no.
+func readConfirm(prompt string) (bool, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer tty.Close()
+	r := bufio.NewReader(tty)
+	for {
+		fmt.Fprint(tty, prompt)
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(l)) {
+		case "yes":
+			return true, nil
+		case "no":
+			return false, nil
+		}
+		prompt = "Please type 'yes' or 'no': "
+	}
+}
+
+// knownHostsFiles returns ssh's known_hosts file and sidecore's
+// own, to which the keys of new hosts are added.
+func knownHostsFiles() (string, string) {
+	ssh := filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	d, err := os.UserConfigDir()
+	if err != nil {
+		return ssh, ""
+	}
+	return ssh, filepath.Join(d, "sidecore", "known_hosts")
+}
+
+// keyName returns the name ssh uses for a key type, e.g. ED25519.
+func keyName(k ossh.PublicKey) string {
+	return strings.ToUpper(strings.TrimPrefix(k.Type(), "ssh-"))
+}
+
+// hostKeyChanged returns the error for a host whose key does not
+// match the one it is known by. It is as loud as ssh's.
+func hostKeyChanged(key ossh.PublicKey, want []knownhosts.KnownKey) error {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintln(&b, "@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @")
+	fmt.Fprintln(&b, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintln(&b, "IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!")
+	fmt.Fprintln(&b, "Someone could be eavesdropping on you right now (man-in-the-middle attack)!")
+	fmt.Fprintln(&b, "It is also possible that a host key has just been changed.")
+	fmt.Fprintf(&b, "The fingerprint for the %s key sent by the remote host is\n%s.\n", keyName(key), ossh.FingerprintSHA256(key))
+	for _, k := range want {
+		fmt.Fprintf(&b, "Offending %s key in %s:%d\n", keyName(k.Key), k.Filename, k.Line)
+	}
+	return fmt.Errorf("%s%w", b.String(), errHostKey)
+}
+
+// addKnownHost appends a host's key to a known_hosts file.
+func addKnownHost(file, host string, key ossh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(host)}, key)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// trustOnFirstUse returns a host key callback which checks keys
+// against ssh's known_hosts, and sidecore's. The key of a host in
+// neither is shown, and, if the user accepts it, added to sidecore's
+// known_hosts. Hosts are known by host:port, so that hosts found
+// with dnssd are known by IP and port.
+func trustOnFirstUse() ossh.HostKeyCallback {
+	return func(host string, remote net.Addr, key ossh.PublicKey) error {
+		ssh, own := knownHostsFiles()
+		var files []string
+		for _, f := range []string{ssh, own} {
+			if _, err := os.Stat(f); err == nil {
+				files = append(files, f)
+			}
+		}
+		var err error
+		if len(files) > 0 {
+			cb, kerr := knownhosts.New(files...)
+			if kerr != nil {
+				return kerr
+			}
+			// A unix socket has no port, but knownhosts wants
+			// one, for the host and the remote address. It leaves
+			// port 22 out, so the socket is looked up by its path,
+			// as it is added.
+			h, r := host, remote
+			if _, _, err := net.SplitHostPort(h); err != nil {
+				h, r = net.JoinHostPort(h, "22"), &net.TCPAddr{}
+			}
+			err = cb(h, r, key)
+		} else {
+			err = &knownhosts.KeyError{}
+		}
+		var ke *knownhosts.KeyError
+		if !errors.As(err, &ke) {
+			return err
+		}
+		if len(ke.Want) > 0 {
+			return hostKeyChanged(key, ke.Want)
+		}
+		ok, err := confirm(fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ", host, keyName(key), ossh.FingerprintSHA256(key)))
+		if err != nil {
+			verbose("confirm host key: %v", err)
+		}
+		if !ok {
+			return fmt.Errorf("%s: %w", host, errHostKey)
+		}
+		if len(own) == 0 {
+			return nil
+		}
+		if err := addKnownHost(own, host, key); err != nil {
+			info("Could not add %s to %s: %v", host, own, err)
+			return nil
+		}
+		info("Permanently added '%s' (%s) to the list of known hosts.", host, keyName(key))
+		return nil
+	}
+}
+
+// fixedHostKey returns a host key callback which only accepts the
+// key in a file. The file may hold the key as in known_hosts and
+// authorized_keys files, or in ssh wire format.
+func fixedHostKey(file string) (ossh.HostKeyCallback, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	k, _, _, _, err := ossh.ParseAuthorizedKey(b)
+	if err != nil {
+		if k, err = ossh.ParsePublicKey(b); err != nil {
+			return nil, fmt.Errorf("host key %s: %w", file, err)
+		}
+	}
+	return ossh.FixedHostKey(k), nil
+}
+
+// hostKeyCallback returns the host key callback for a cpu: the
+// host key file, if one is set, else trust on first use.
+func hostKeyCallback(file string) (ossh.HostKeyCallback, error) {
+	if len(file) > 0 {
+		return fixedHostKey(file)
+	}
+	return trustOnFirstUse(), nil
+}
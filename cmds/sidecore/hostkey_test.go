@@ -0,0 +1,176 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testHostKey returns a new public key.
+func testHostKey(t *testing.T) ossh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	k, err := ossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v != nil", err)
+	}
+	return k
+}
+
+// setHome makes HOME, and the config directory, empty temporary
+// directories, so that no known_hosts files exist.
+func setHome(t *testing.T) string {
+	t.Helper()
+	d := t.TempDir()
+	t.Setenv("HOME", d)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(d, ".config"))
+	return d
+}
+
+// setConfirm makes confirm answer yes or no, and returns
+// a count of the times it was called.
+func setConfirm(t *testing.T, yes bool) *int {
+	t.Helper()
+	old := confirm
+	t.Cleanup(func() { confirm = old })
+	n := new(int)
+	confirm = func(string) (bool, error) {
+		*n++
+		return yes, nil
+	}
+	return n
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	setHome(t)
+	_, own := knownHostsFiles()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 17010}
+	host := addr.String()
+	key := testHostKey(t)
+	cb := trustOnFirstUse()
+
+	asked := setConfirm(t, false)
+	if err := cb(host, addr, key); !errors.Is(err, errHostKey) {
+		t.Errorf("unknown host, not accepted: %v != %v", err, errHostKey)
+	}
+	if _, err := os.Stat(own); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s: %v != %v", own, err, os.ErrNotExist)
+	}
+
+	asked = setConfirm(t, true)
+	if err := cb(host, addr, key); err != nil {
+		t.Fatalf("unknown host, accepted: %v != nil", err)
+	}
+	b, err := os.ReadFile(own)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := knownhosts.Line([]string{"[10.0.0.1]:17010"}, key) + "\n"; string(b) != want {
+		t.Errorf("%s: %q != %q", own, b, want)
+	}
+
+	// Now it is known.
+	if err := cb(host, addr, key); err != nil {
+		t.Errorf("known host: %v != nil", err)
+	}
+	if *asked != 1 {
+		t.Errorf("asked %d times != 1", *asked)
+	}
+
+	err = cb(host, addr, testHostKey(t))
+	if !errors.Is(err, errHostKey) {
+		t.Fatalf("changed key: %v != %v", err, errHostKey)
+	}
+	for _, s := range []string{"REMOTE HOST IDENTIFICATION HAS CHANGED", "Offending ED25519 key in " + own + ":1"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("changed key: %q does not contain %q", err, s)
+		}
+	}
+	if *asked != 1 {
+		t.Errorf("asked %d times != 1", *asked)
+	}
+}
+
+func TestTrustOnFirstUseUnix(t *testing.T) {
+	setHome(t)
+	addr := &net.UnixAddr{Name: "/run/cpud.sock", Net: "unix"}
+	key := testHostKey(t)
+	cb := trustOnFirstUse()
+	asked := setConfirm(t, true)
+	for i := 0; i < 2; i++ {
+		if err := cb(addr.Name, addr, key); err != nil {
+			t.Fatalf("unix socket, try %d: %v != nil", i, err)
+		}
+	}
+	if *asked != 1 {
+		t.Errorf("asked %d times != 1", *asked)
+	}
+	if err := cb(addr.Name, addr, testHostKey(t)); !errors.Is(err, errHostKey) {
+		t.Errorf("unix socket, changed key: %v != %v", err, errHostKey)
+	}
+}
+
+func TestTrustOnFirstUseSSH(t *testing.T) {
+	home := setHome(t)
+	key := testHostKey(t)
+	ssh := filepath.Join(home, ".ssh", "known_hosts")
+	if err := os.MkdirAll(filepath.Dir(ssh), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ssh, []byte(knownhosts.Line([]string{"cpu.lab"}, key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	asked := setConfirm(t, false)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	if err := trustOnFirstUse()("cpu.lab:22", addr, key); err != nil {
+		t.Errorf("host in ssh's known_hosts: %v != nil", err)
+	}
+	if *asked != 0 {
+		t.Errorf("asked %d times != 0", *asked)
+	}
+}
+
+func TestFixedHostKey(t *testing.T) {
+	key := testHostKey(t)
+	d := t.TempDir()
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{name: "authorized", b: ossh.MarshalAuthorizedKey(key)},
+		{name: "wire", b: key.Marshal()},
+	} {
+		n := filepath.Join(d, tt.name)
+		if err := os.WriteFile(n, tt.b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		cb, err := hostKeyCallback(n)
+		if err != nil {
+			t.Fatalf("hostKeyCallback(%q): %v != nil", n, err)
+		}
+		if err := cb("cpu:17010", nil, key); err != nil {
+			t.Errorf("%s: right key: %v != nil", tt.name, err)
+		}
+		if err := cb("cpu:17010", nil, testHostKey(t)); err == nil {
+			t.Errorf("%s: wrong key: nil != an error", tt.name)
+		}
+	}
+	if _, err := hostKeyCallback(filepath.Join(d, "missing")); err == nil {
+		t.Errorf("hostKeyCallback(missing): nil != an error")
+	}
+}
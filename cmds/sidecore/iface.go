@@ -0,0 +1,60 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+var dsIface = flag.String("ds-iface", "", "comma-separated interfaces, e.g. eth1, to take dnssd answers from; the default is SIDECORE_IFACE, or all of them")
+
+// dsIfaces are the interfaces dnssd answers are taken from, or nil
+// for all of them. flags sets them.
+var dsIfaces []string
+
+// dsInterfaces returns the interfaces of -ds-iface, or, if it is not
+// set, SIDECORE_IFACE. It is an error if one does not exist, and the
+// error names those which do, since interface names vary from one
+// machine to the next.
+func dsInterfaces() ([]string, error) {
+	l := *dsIface
+	if len(l) == 0 {
+		l = os.Getenv("SIDECORE_IFACE")
+	}
+	var ifaces []string
+	for _, n := range strings.Split(l, ",") {
+		if len(n) == 0 {
+			continue
+		}
+		if _, err := net.InterfaceByName(n); err != nil {
+			return nil, fmt.Errorf("-ds-iface %s: no such interface; have %s:%w", n, multicastInterfaces(), os.ErrNotExist)
+		}
+		ifaces = append(ifaces, n)
+	}
+	return ifaces, nil
+}
+
+// multicastInterfaces returns the names of the interfaces dnssd
+// can use, for error messages.
+func multicastInterfaces() string {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return err.Error()
+	}
+	var names []string
+	for _, i := range ifs {
+		if i.Flags&net.FlagUp != 0 && i.Flags&net.FlagMulticast != 0 {
+			names = append(names, i.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,45 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDSInterfaces(t *testing.T) {
+	ifs, err := net.Interfaces()
+	if err != nil || len(ifs) == 0 {
+		t.Skipf("no interfaces: %v", err)
+	}
+	name := ifs[0].Name
+	defer func(i string) { *dsIface = i }(*dsIface)
+
+	*dsIface = ""
+	t.Setenv("SIDECORE_IFACE", name)
+	if got, err := dsInterfaces(); err != nil || !reflect.DeepEqual(got, []string{name}) {
+		t.Errorf("dsInterfaces, SIDECORE_IFACE=%s: (%q, %v) != (%q, nil)", name, got, err, []string{name})
+	}
+
+	*dsIface = name + ","
+	t.Setenv("SIDECORE_IFACE", "nosuchiface0")
+	if got, err := dsInterfaces(); err != nil || !reflect.DeepEqual(got, []string{name}) {
+		t.Errorf("dsInterfaces, -ds-iface %s: (%q, %v) != (%q, nil)", *dsIface, got, err, []string{name})
+	}
+
+	*dsIface = name + ",nosuchiface0"
+	if _, err := dsInterfaces(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("dsInterfaces, -ds-iface %s: %v != %v", *dsIface, err, os.ErrNotExist)
+	}
+
+	*dsIface = ""
+	t.Setenv("SIDECORE_IFACE", "")
+	if got, err := dsInterfaces(); err != nil || got != nil {
+		t.Errorf("dsInterfaces, unset: (%q, %v) != (nil, nil)", got, err)
+	}
+}
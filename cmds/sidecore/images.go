@@ -0,0 +1,325 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// sidecore images lists the containers in SIDECORE_IMAGES, and prunes
+// those which have not been used. When a container was last used is
+// kept in a file in the cache; one which has never been used, since
+// that was kept, was last used when it was made.
+
+// usedFile returns the file which holds when containers were last
+// used.
+func usedFile() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "sidecore", "used"), nil
+}
+
+// loadUsed returns when containers, by path, were last used.
+func loadUsed() map[string]time.Time {
+	used := map[string]time.Time{}
+	f, err := usedFile()
+	if err != nil {
+		return used
+	}
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return used
+	}
+	if err := json.Unmarshal(b, &used); err != nil {
+		verbose("%s: %v", f, err)
+	}
+	return used
+}
+
+// saveUsed saves when containers were last used.
+func saveUsed(used map[string]time.Time) error {
+	f, err := usedFile()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(used)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f, b)
+}
+
+var (
+	usedMu sync.Mutex
+	marked = map[string]bool{}
+)
+
+// markUsed records that a container has been used, once a run. Not
+// being able to is not an error.
+func markUsed(c string) {
+	if _, ok := dirContainer(c); ok {
+		return
+	}
+	usedMu.Lock()
+	defer usedMu.Unlock()
+	if marked[c] {
+		return
+	}
+	marked[c] = true
+	used := loadUsed()
+	used[c] = time.Now()
+	if err := saveUsed(used); err != nil {
+		verbose("used: %v", err)
+	}
+}
+
+// useContainer checks a container, each of its layers, which is about
+// to be served, and records that it was used. SIDECORE_IMAGE_SHA256 is
+// one sum, so layers must each have a .sha256 file instead.
+func useContainer(c string) error {
+	layers := containerLayers(c)
+	if s := os.Getenv("SIDECORE_IMAGE_SHA256"); len(layers) > 1 && len(s) > 0 {
+		return fmt.Errorf("-container %s: SIDECORE_IMAGE_SHA256 can not be the sum of several layers; use a .sha256 file for each:%w", c, os.ErrInvalid)
+	}
+	for _, l := range layers {
+		if err := verifyContainer(l); err != nil {
+			return err
+		}
+		markUsed(l)
+	}
+	return nil
+}
+
+// image is a container in SIDECORE_IMAGES.
+type image struct {
+	path                  string
+	name                  string
+	arch, distro, version string
+	size                  int64
+	used                  time.Time
+}
+
+// listImages returns the containers in dirs, most recently used first.
+func listImages(dirs []string) ([]image, error) {
+	used := loadUsed()
+	var images []image
+	for _, d := range dirs {
+		var m []string
+		for _, a := range archiveSuffixes {
+			for _, s := range append([]string{""}, compressedSuffixes...) {
+				g, err := filepath.Glob(filepath.Join(d, "*"+a+s))
+				if err != nil {
+					return nil, err
+				}
+				m = append(m, g...)
+			}
+		}
+		for _, p := range m {
+			fi, err := os.Stat(p)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			i := image{path: p, name: filepath.Base(p), size: fi.Size(), used: fi.ModTime()}
+			if t, ok := used[p]; ok && t.After(i.used) {
+				i.used = t
+			}
+			i.arch, i.distro, i.version, _ = parseContainerName(i.name)
+			images = append(images, i)
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].used.After(images[j].used)
+	})
+	return images, nil
+}
+
+// humanSize returns a size as ls -h shows it.
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatInt(n, 10)
+	}
+	f, u := float64(n)/1024, 0
+	for f >= 1024 && u < len(units)-1 {
+		f /= 1024
+		u++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[u])
+}
+
+// dash returns s, or - if it is empty.
+func dash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+// printImages prints images, with their directory, if there are
+// several.
+func printImages(w io.Writer, images []image, dirs []string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tARCH\tDISTRO\tVERSION\tSIZE\tLAST USED")
+	for _, i := range images {
+		n := i.name
+		if len(dirs) > 1 {
+			n = i.path
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", n, dash(i.arch), dash(i.distro), dash(i.version), humanSize(i.size), i.used.Format("2006-01-02 15:04"))
+	}
+	return tw.Flush()
+}
+
+// parseAge parses an age, as time.ParseDuration does, or in days, e.g.
+// 30d.
+func parseAge(s string) (time.Duration, error) {
+	if d, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(d, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%q: not a number of days:%w", s, os.ErrInvalid)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	a, err := time.ParseDuration(s)
+	if err != nil || a < 0 {
+		return 0, fmt.Errorf("%q: not an age, e.g. 30d or 12h:%w", s, os.ErrInvalid)
+	}
+	return a, nil
+}
+
+// ageFlag is a flag for an age, as parseAge parses it.
+type ageFlag time.Duration
+
+func (a *ageFlag) String() string {
+	return time.Duration(*a).String()
+}
+
+func (a *ageFlag) Set(s string) error {
+	d, err := parseAge(s)
+	*a = ageFlag(d)
+	return err
+}
+
+// pruneImages returns the images to prune: all but the keep most
+// recently used, and, of those, if older is not 0, only the ones not
+// used for that long. images are most recently used first.
+func pruneImages(images []image, keep int, older time.Duration, now time.Time) []image {
+	var prune []image
+	for n, i := range images {
+		if n < keep {
+			continue
+		}
+		if older > 0 && now.Sub(i.used) < older {
+			continue
+		}
+		prune = append(prune, i)
+	}
+	return prune
+}
+
+// removeImage removes a container, and what is kept beside it.
+func removeImage(p string) error {
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	for _, s := range []string{".sha256", ".digest", ".part"} {
+		if err := os.Remove(p + s); err != nil && !os.IsNotExist(err) {
+			verbose("%s: %v", p+s, err)
+		}
+	}
+	return nil
+}
+
+// imagesCommand is sidecore images list, or prune.
+func imagesCommand(args []string) error {
+	usage := fmt.Errorf("usage: sidecore images list | prune [-keep-last N] [-older-than age] [-f]:%w", os.ErrInvalid)
+	if len(args) == 0 {
+		return usage
+	}
+	dirs := imageDirs()
+	switch args[0] {
+	case "list", "ls":
+		if len(args) > 1 {
+			return usage
+		}
+		images, err := listImages(dirs)
+		if err != nil {
+			return err
+		}
+		return printImages(os.Stdout, images, dirs)
+	case "prune":
+	default:
+		return usage
+	}
+	f := flag.NewFlagSet("sidecore images prune", flag.ContinueOnError)
+	keep := f.Int("keep-last", 0, "keep this many of the most recently used containers")
+	var older ageFlag
+	f.Var(&older, "older-than", "only prune containers not used for this long, e.g. 30d or 12h")
+	force := f.Bool("f", false, "prune without asking")
+	if err := f.Parse(args[1:]); err != nil {
+		return err
+	}
+	if f.NArg() > 0 || *keep < 0 {
+		return usage
+	}
+	if *keep == 0 && older == 0 {
+		return fmt.Errorf("sidecore images prune: set -keep-last, -older-than, or both, rather than prune every container:%w", os.ErrInvalid)
+	}
+	images, err := listImages(dirs)
+	if err != nil {
+		return err
+	}
+	prune := pruneImages(images, *keep, time.Duration(older), time.Now())
+	if len(prune) == 0 {
+		info("nothing to prune")
+		return nil
+	}
+	var size int64
+	for _, i := range prune {
+		size += i.size
+	}
+	if !*force {
+		if err := printImages(os.Stdout, prune, dirs); err != nil {
+			return err
+		}
+		ok, err := confirm(fmt.Sprintf("Remove these %d containers, %s (yes/no)? ", len(prune), humanSize(size)))
+		if err != nil {
+			return fmt.Errorf("sidecore images prune: %v; -f prunes without asking", err)
+		}
+		if !ok {
+			return nil
+		}
+	}
+	used := loadUsed()
+	var errs []string
+	for _, i := range prune {
+		if err := removeImage(i.path); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(used, i.path)
+		info("removed %s", i.path)
+	}
+	if err := saveUsed(used); err != nil {
+		verbose("used: %v", err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("sidecore images prune: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseContainerName(t *testing.T) {
+	for _, tt := range []struct {
+		arch, distro, version string
+	}{
+		{"amd64", "ubuntu", "latest"},
+		{"arm64", "alpine-edge", "3.19"},
+		{"riscv64", "debian", "sha256-abababababab"},
+	} {
+		for _, s := range append(compressedSuffixes, ".tar", ".sqfs") {
+			n := containerName(tt.arch, tt.distro, tt.version) + s
+			if s == ".tar" || s == ".sqfs" {
+				n = strings.TrimSuffix(n, ".cpio"+s) + s
+			}
+			if a, d, v, ok := parseContainerName(n); !ok || a != tt.arch || d != tt.distro || v != tt.version {
+				t.Errorf("parseContainerName(%q): %q, %q, %q, %v != %q, %q, %q, true", n, a, d, v, ok, tt.arch, tt.distro, tt.version)
+			}
+		}
+		n := containerName(tt.arch, tt.distro, tt.version)
+		a, d, v, ok := parseContainerName(n)
+		if !ok || a != tt.arch || d != tt.distro || v != tt.version {
+			t.Errorf("parseContainerName(%q): %q, %q, %q, %v != %q, %q, %q, true", n, a, d, v, ok, tt.arch, tt.distro, tt.version)
+		}
+	}
+	for _, n := range []string{"experimental.cpio", "amd64-ubuntu@latest", "amd64@latest.cpio", "-ubuntu@latest.cpio", "amd64-ubuntu@.cpio"} {
+		if _, _, _, ok := parseContainerName(n); ok {
+			t.Errorf("parseContainerName(%q): ok, want not", n)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want time.Duration
+		err  error
+	}{
+		{in: "30d", want: 30 * 24 * time.Hour},
+		{in: "1.5d", want: 36 * time.Hour},
+		{in: "12h", want: 12 * time.Hour},
+		{in: "d", err: os.ErrInvalid},
+		{in: "-1d", err: os.ErrInvalid},
+		{in: "a week", err: os.ErrInvalid},
+	} {
+		got, err := parseAge(tt.in)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("parseAge(%q): %v, %v != %v, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestPruneImages(t *testing.T) {
+	now := time.Now()
+	var images []image
+	for i, age := range []int{1, 10, 40, 50} {
+		images = append(images, image{name: string(rune('a' + i)), used: now.Add(-time.Duration(age) * 24 * time.Hour)})
+	}
+	names := func(images []image) string {
+		var n []string
+		for _, i := range images {
+			n = append(n, i.name)
+		}
+		return strings.Join(n, "")
+	}
+	for _, tt := range []struct {
+		keep  int
+		older time.Duration
+		want  string
+	}{
+		{keep: 1, want: "bcd"},
+		{keep: 3, want: "d"},
+		{keep: 5, want: ""},
+		{older: 30 * 24 * time.Hour, want: "cd"},
+		{keep: 3, older: 30 * 24 * time.Hour, want: "d"},
+		{keep: 1, older: 5 * 24 * time.Hour, want: "bcd"},
+	} {
+		if got := names(pruneImages(images, tt.keep, tt.older, now)); got != tt.want {
+			t.Errorf("pruneImages(%d, %v): %q != %q", tt.keep, tt.older, got, tt.want)
+		}
+	}
+}
+
+// testImages makes containers in a SIDECORE_IMAGES of their own, each
+// made, and last used, days ago.
+func testImages(t *testing.T, days map[string]int) string {
+	t.Helper()
+	d := t.TempDir()
+	t.Setenv("SIDECORE_IMAGES", d)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	used := map[string]time.Time{}
+	for n, age := range days {
+		p := filepath.Join(d, n)
+		if err := os.WriteFile(p, bytes.Repeat([]byte{0}, 2048), 0644); err != nil {
+			t.Fatal(err)
+		}
+		made := time.Now().Add(-100 * 24 * time.Hour)
+		if err := os.Chtimes(p, made, made); err != nil {
+			t.Fatal(err)
+		}
+		used[p] = time.Now().Add(-time.Duration(age) * 24 * time.Hour)
+	}
+	if err := saveUsed(used); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestListImages(t *testing.T) {
+	d := testImages(t, map[string]int{"amd64-ubuntu@latest.cpio": 40, "arm64-alpine@edge.cpio.zst": 2})
+	if err := os.WriteFile(filepath.Join(d, "mine.cpio"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A container which is used is the most recent.
+	markUsed(filepath.Join(d, "amd64-ubuntu@latest.cpio"))
+	images, err := listImages(imageDirs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := printImages(&b, images, imageDirs()); err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, l := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		f := strings.Fields(l)
+		got = append(got, f[:5])
+	}
+	want := [][]string{
+		{"NAME", "ARCH", "DISTRO", "VERSION", "SIZE"},
+		{"amd64-ubuntu@latest.cpio", "amd64", "ubuntu", "latest", "2.0K"},
+		{"mine.cpio", "-", "-", "-", "3"},
+		{"arm64-alpine@edge.cpio.zst", "arm64", "alpine", "edge", "2.0K"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sidecore images list:\n%s\n%q != %q", b.String(), got, want)
+	}
+}
+
+func TestImagesPrune(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+		yes  bool
+		asks int
+		left []string
+		err  error
+	}{
+		{name: "no", args: []string{"prune", "-keep-last", "1"}, asks: 1, left: []string{"a", "b", "c"}},
+		{name: "yes", args: []string{"prune", "-keep-last", "1"}, yes: true, asks: 1, left: []string{"a"}},
+		{name: "force", args: []string{"prune", "-older-than", "30d", "-f"}, left: []string{"a", "b"}},
+		{name: "both", args: []string{"prune", "--keep-last", "2", "--older-than", "5d", "-f"}, left: []string{"a", "b"}},
+		{name: "nothing", args: []string{"prune", "-older-than", "100d"}, left: []string{"a", "b", "c"}},
+		{name: "everything", args: []string{"prune", "-f"}, left: []string{"a", "b", "c"}, err: os.ErrInvalid},
+		{name: "bad age", args: []string{"prune", "-older-than", "soon"}, left: []string{"a", "b", "c"}},
+		{name: "bad command", args: []string{"purge"}, left: []string{"a", "b", "c"}, err: os.ErrInvalid},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testImages(t, map[string]int{"amd64-a@1.cpio": 1, "amd64-b@1.cpio": 10, "amd64-c@1.cpio": 40})
+			if err := os.WriteFile(filepath.Join(d, "amd64-c@1.cpio.sha256"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			asks := setConfirm(t, tt.yes)
+			err := imagesCommand(tt.args)
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("images %q: %v != %v", tt.args, err, tt.err)
+			}
+			if *asks != tt.asks {
+				t.Errorf("images %q: asked %d times != %d", tt.args, *asks, tt.asks)
+			}
+			m, err := filepath.Glob(filepath.Join(d, "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var left []string
+			for _, p := range m {
+				_, dist, _, ok := parseContainerName(filepath.Base(p))
+				if !ok {
+					continue
+				}
+				left = append(left, dist)
+			}
+			if !reflect.DeepEqual(left, tt.left) {
+				t.Errorf("images %q: left %q != %q", tt.args, left, tt.left)
+			}
+			if _, err := os.Stat(filepath.Join(d, "amd64-c@1.cpio.sha256")); err == nil && !strings.Contains(strings.Join(left, ""), "c") {
+				t.Errorf("images %q: the sha256 of a pruned container was left", tt.args)
+			}
+		})
+	}
+}
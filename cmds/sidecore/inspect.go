@@ -0,0 +1,185 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+)
+
+// sidecore ls and sidecore cat look in a container, as it is served,
+// e.g. to see why a command is not found in it, without extracting it:
+// sidecore ls container [path] lists a directory, and sidecore cat
+// container path writes a file. Symlinks in the path are followed; -L
+// follows one at its end too, as cat does by default, and -P does not,
+// as ls does by default.
+
+// resolvePath returns the name, in fs, of n, with the symlinks in its
+// directories resolved, as resolvelink resolves them, and, if follow,
+// n itself, if it is one.
+func resolvePath(fs *fsCPIO, n string, follow bool) (string, error) {
+	n = archiveName(n)
+	if n == "." {
+		return n, nil
+	}
+	parts := strings.Split(n, "/")
+	r := "."
+	for i, e := range parts {
+		r = path.Join(r, e)
+		fi, err := fs.Lstat(r)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", r, err)
+		}
+		if fi.Mode().Type() != os.ModeSymlink || i == len(parts)-1 && !follow {
+			continue
+		}
+		if r, err = fs.resolvelink(r); err != nil {
+			return "", fmt.Errorf("%s: %w", n, err)
+		}
+	}
+	return r, nil
+}
+
+// lsLine writes the line ls writes for a file, n, of fs.
+func lsLine(w io.Writer, fs *fsCPIO, n string, fi os.FileInfo, name string) {
+	if fi.Mode().Type() == os.ModeSymlink {
+		if l, err := fs.Readlink(n); err == nil {
+			name += " -> " + l
+		}
+	}
+	fmt.Fprintf(w, "%v\t%d\t %s\n", fi.Mode(), fi.Size(), name)
+}
+
+// lsContainer lists n, in fs, as ls -l does: the files in it, if it is
+// a directory, or else n.
+func lsContainer(w io.Writer, fs *fsCPIO, n string, follow bool) error {
+	n, err := resolvePath(fs, n, follow)
+	if err != nil {
+		return err
+	}
+	fi, err := fs.Lstat(n)
+	if err != nil {
+		return fmt.Errorf("%s: %w", n, err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	if !fi.IsDir() {
+		lsLine(tw, fs, n, fi, n)
+		return tw.Flush()
+	}
+	ents, err := fs.ReadDir(n)
+	if err != nil {
+		return fmt.Errorf("%s: %w", n, err)
+	}
+	for _, e := range ents {
+		lsLine(tw, fs, path.Join(n, e.Name()), e, e.Name())
+	}
+	return tw.Flush()
+}
+
+// catContainer writes the file n, in fs, to w.
+func catContainer(w io.Writer, fs *fsCPIO, n string, follow bool) error {
+	n, err := resolvePath(fs, n, follow)
+	if err != nil {
+		return err
+	}
+	fi, err := fs.Lstat(n)
+	if err != nil {
+		return fmt.Errorf("%s: %w", n, err)
+	}
+	switch {
+	case fi.Mode().Type() == os.ModeSymlink:
+		return fmt.Errorf("%s: is a symlink; -L follows it:%w", n, os.ErrInvalid)
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("%s: is %v, not a file:%w", n, fi.Mode().Type(), os.ErrInvalid)
+	}
+	f, err := fs.Open(n)
+	if err != nil {
+		return fmt.Errorf("%s: %w", n, err)
+	}
+	defer f.Close()
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, fi.Size()))
+	return err
+}
+
+// inspectFlags parses the flags of sidecore ls or cat, and returns its
+// arguments, and whether a symlink at the end of a path is followed,
+// by default if follow.
+func inspectFlags(name string, args []string, follow bool) ([]string, bool, error) {
+	f := flag.NewFlagSet("sidecore "+name, flag.ContinueOnError)
+	l := f.Bool("L", false, "follow a symlink at the end of the path")
+	p := f.Bool("P", false, "do not follow a symlink at the end of the path")
+	if err := f.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if *l && *p {
+		return nil, false, fmt.Errorf("-L and -P can not both be set:%w", os.ErrInvalid)
+	}
+	if *l || *p {
+		follow = *l
+	}
+	return f.Args(), follow, nil
+}
+
+// openContainer opens the container a subcommand's argument names.
+func openContainer(name, c string) (*fsCPIO, error) {
+	c, dirs, err := containerArg(c)
+	if err != nil {
+		return nil, fmt.Errorf("sidecore %s: %w", name, err)
+	}
+	fs, err := NewfsCPIO(c)
+	if err != nil {
+		return nil, fmt.Errorf("sidecore %s: %w", name, searchError(err, dirs))
+	}
+	return fs, nil
+}
+
+// lsCommand is sidecore ls.
+func lsCommand(args []string) error {
+	usage := fmt.Errorf("usage: sidecore ls [-L|-P] container [path]:%w", os.ErrInvalid)
+	args, follow, err := inspectFlags("ls", args, false)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return usage
+	}
+	fs, err := openContainer("ls", args[0])
+	if err != nil {
+		return err
+	}
+	n := "."
+	if len(args) > 1 {
+		n = args[1]
+	}
+	if err := lsContainer(os.Stdout, fs, n, follow); err != nil {
+		return fmt.Errorf("sidecore ls: %w", err)
+	}
+	return nil
+}
+
+// catCommand is sidecore cat.
+func catCommand(args []string) error {
+	usage := fmt.Errorf("usage: sidecore cat [-L|-P] container path:%w", os.ErrInvalid)
+	args, follow, err := inspectFlags("cat", args, true)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return usage
+	}
+	fs, err := openContainer("cat", args[0])
+	if err != nil {
+		return err
+	}
+	if err := catContainer(os.Stdout, fs, args[1], follow); err != nil {
+		return fmt.Errorf("sidecore cat: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLsContainer(t *testing.T) {
+	fs, err := NewfsCPIO("data/a.cpio")
+	if err != nil {
+		t.Fatalf("NewfsCPIO(\"data/a.cpio\"): %v != nil", err)
+	}
+	for _, tt := range []struct {
+		n      string
+		follow bool
+		want   []string
+		not    []string
+	}{
+		{n: ".", want: []string{" a\n", " lib -> a\n"}},
+		{n: "/a/b", want: []string{" hosts -> c/d/hosts\n", " c\n"}},
+		// lib is a symlink to a, which is followed, as it is
+		// a directory of the path.
+		{n: "lib/b/c/d", want: []string{"355 hosts\n"}},
+		{n: "a/b/hosts", want: []string{"a/b/hosts -> c/d/hosts\n"}},
+		{n: "a/b/hosts", follow: true, want: []string{"355 a/b/c/d/hosts\n"}, not: []string{"->"}},
+		{n: "lib", want: []string{"lib -> a\n"}},
+		{n: "lib", follow: true, want: []string{" b\n"}},
+	} {
+		var b bytes.Buffer
+		if err := lsContainer(&b, fs, tt.n, tt.follow); err != nil {
+			t.Errorf("lsContainer(%q, %v): %v != nil", tt.n, tt.follow, err)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(b.String(), w) {
+				t.Errorf("lsContainer(%q, %v): %q does not have %q", tt.n, tt.follow, b.String(), w)
+			}
+		}
+		for _, w := range tt.not {
+			if strings.Contains(b.String(), w) {
+				t.Errorf("lsContainer(%q, %v): %q has %q", tt.n, tt.follow, b.String(), w)
+			}
+		}
+	}
+	if err := lsContainer(&bytes.Buffer{}, fs, "a/nope", false); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lsContainer(a/nope): %v != %v", err, os.ErrNotExist)
+	}
+}
+
+func TestCatContainer(t *testing.T) {
+	fs, err := NewfsCPIO("data/a.cpio")
+	if err != nil {
+		t.Fatalf("NewfsCPIO(\"data/a.cpio\"): %v != nil", err)
+	}
+	want, err := os.ReadFile("data/a/b/c/d/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"a/b/c/d/hosts", "/lib/b/hosts", "a/b/19"} {
+		var b bytes.Buffer
+		if err := catContainer(&b, fs, n, true); err != nil || b.String() != string(want) {
+			t.Errorf("catContainer(%q): %q, %v != %q, nil", n, b.String(), err, want)
+		}
+	}
+	for _, tt := range []struct {
+		n      string
+		follow bool
+		err    error
+	}{
+		{n: "a/b/hosts", err: os.ErrInvalid},
+		{n: "a/b", follow: true, err: os.ErrInvalid},
+		{n: "a/b/21", follow: true, err: syscall.ELOOP},
+		{n: "a/none", follow: true, err: os.ErrNotExist},
+	} {
+		if err := catContainer(&bytes.Buffer{}, fs, tt.n, tt.follow); !errors.Is(err, tt.err) {
+			t.Errorf("catContainer(%q, %v): %v != %v", tt.n, tt.follow, err, tt.err)
+		}
+	}
+}
+
+func TestInspectCommands(t *testing.T) {
+	for _, tt := range []struct {
+		c    func([]string) error
+		args []string
+	}{
+		{c: lsCommand},
+		{c: lsCommand, args: []string{"-L", "-P", "data/a.cpio"}},
+		{c: lsCommand, args: []string{"data/a.cpio", "a", "b"}},
+		{c: catCommand, args: []string{"data/a.cpio"}},
+	} {
+		if err := tt.c(tt.args); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("%q: %v != %v", tt.args, err, os.ErrInvalid)
+		}
+	}
+	if err := lsCommand([]string{"data/none.cpio"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("sidecore ls data/none.cpio: %v != %v", err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The inventory names groups of cpus, so that sidecore @group runs
+// on all of them. It is ini-style: a [group] line starts a group,
+// and each line after it is a host, or dnssd: query, with, if need
+// be, key=value options, or an @group, whose members are included.
+// # starts a comment. An example:
+//
+//	[builders]
+//	build1
+//	build2 port=17011 keyfile=~/.ssh/build_rsa
+//	@arm-lab
+//
+//	[arm-lab]
+//	rpi1 arch=arm64
+//	rpi2 arch=arm64
+
+var inventoryFile = flag.String("inventory", "", "file of named groups of cpus, for @group hosts (default "+defaultInventoryFile()+")")
+
+// inventoryKeys are the options a host in the inventory may have.
+// arch chooses the container.
+var inventoryKeys = map[string]bool{"port": true, "keyfile": true, "arch": true}
+
+// invHost is a host in the inventory, or an @group.
+type invHost struct {
+	host string
+	opts map[string]string
+}
+
+// inventory maps group names to their members.
+type inventory map[string][]invHost
+
+// defaultInventoryFile returns the path of the per-user inventory.
+func defaultInventoryFile() string {
+	d, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(d, "sidecore", "inventory")
+}
+
+// loadInventory reads the inventory file n. If n is empty, the
+// default file is used, and it not existing is not an error.
+func loadInventory(n string) (inventory, error) {
+	explicit := len(n) > 0
+	if !explicit {
+		n = defaultInventoryFile()
+	}
+	f, err := os.Open(n)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return inventory{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return parseInventory(f, n)
+}
+
+// parseInventory parses an inventory from r. The name is only used
+// in error messages.
+func parseInventory(r io.Reader, name string) (inventory, error) {
+	inv := inventory{}
+	group := ""
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		if l[0] == '[' {
+			if l[len(l)-1] != ']' || len(l) < 3 {
+				return nil, fmt.Errorf("%s:%d: %q: want [group]:%w", name, line, l, os.ErrInvalid)
+			}
+			group = l[1 : len(l)-1]
+			if _, ok := inv[group]; !ok {
+				inv[group] = nil
+			}
+			continue
+		}
+		if len(group) == 0 {
+			return nil, fmt.Errorf("%s:%d: %q is not in a [group]:%w", name, line, l, os.ErrInvalid)
+		}
+		f := strings.Fields(l)
+		h := invHost{host: f[0], opts: map[string]string{}}
+		for _, kv := range f[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			k = strings.ToLower(k)
+			if !ok || len(v) == 0 || !inventoryKeys[k] {
+				return nil, fmt.Errorf("%s:%d: %q: want port=, keyfile= or arch=:%w", name, line, kv, os.ErrInvalid)
+			}
+			if h.host[0] == '@' {
+				return nil, fmt.Errorf("%s:%d: %s: a group can not have options:%w", name, line, h.host, os.ErrInvalid)
+			}
+			h.opts[k] = v
+		}
+		inv[group] = append(inv[group], h)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return inv, nil
+}
+
+// expand returns the hosts in a group, with those of the groups it
+// includes, in order. It is an error if a group includes itself, by
+// way of any others.
+func (inv inventory) expand(group string) ([]invHost, error) {
+	return inv.expandPath(group, nil)
+}
+
+// expandPath expands a group, included by the groups in path.
+func (inv inventory) expandPath(group string, path []string) ([]invHost, error) {
+	for _, g := range path {
+		if g == group {
+			return nil, fmt.Errorf("inventory: group %s includes itself: %s:%w", group, strings.Join(append(path, group), " -> "), os.ErrInvalid)
+		}
+	}
+	members, ok := inv[group]
+	if !ok {
+		return nil, fmt.Errorf("inventory: no group %q:%w", group, os.ErrNotExist)
+	}
+	var hosts []invHost
+	for _, m := range members {
+		if m.host[0] != '@' {
+			hosts = append(hosts, m)
+			continue
+		}
+		h, err := inv.expandPath(m.host[1:], append(path, group))
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h...)
+	}
+	return hosts, nil
+}
+
+// apply sets a cpu's options from its entry in the inventory.
+// -sp and -i override the port and key file.
+func (h invHost) apply(cpu *cpu, set map[string]bool) {
+	if v, ok := h.opts["port"]; ok && !set["sp"] {
+		cpu.port = v
+	}
+	if v, ok := h.opts["keyfile"]; ok {
+		cpu.keyfiles = []string{v}
+	}
+	if v, ok := h.opts["arch"]; ok {
+		cpu.arch = v
+	}
+}
+
+// groupHosts returns the hosts in an inventory group, less those
+// excluded. If -n was set, only the first -n are returned.
+func groupHosts(inv inventory, group string, pats []string, n bool) ([]invHost, error) {
+	all, err := inv.expand(group)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []invHost
+	for _, h := range all {
+		if p, ok := excluded(pats, h.host); ok {
+			verbose("@%s: %s excluded by %q", group, h.host, p)
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	if n && numCPUs > 0 && int(numCPUs) < len(hosts) {
+		hosts = hosts[:numCPUs]
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("inventory: group %s has no hosts:%w", group, os.ErrNotExist)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testInventory = `
+# builders
+[builders]
+build1
+build2 port=17011 keyfile=~/.ssh/build_rsa
+@arm-lab
+
+[arm-lab]
+rpi1 arch=arm64
+root@rpi2 arch=arm64
+
+[loop]
+@loop2
+[loop2]
+box
+@loop
+`
+
+// invNames returns the hosts of inventory entries.
+func invNames(hosts []invHost) []string {
+	var names []string
+	for _, h := range hosts {
+		names = append(names, h.host)
+	}
+	return names
+}
+
+func TestParseInventory(t *testing.T) {
+	inv, err := parseInventory(strings.NewReader(testInventory), "test")
+	if err != nil {
+		t.Fatalf("parseInventory: %v != nil", err)
+	}
+	if got, want := invNames(inv["builders"]), []string{"build1", "build2", "@arm-lab"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("builders: %q != %q", got, want)
+	}
+	if got, want := inv["builders"][1].opts, map[string]string{"port": "17011", "keyfile": "~/.ssh/build_rsa"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("build2: %q != %q", got, want)
+	}
+	for _, bad := range []string{
+		"build1\n",
+		"[builders\nbuild1\n",
+		"[]\n",
+		"[builders]\nbuild1 cores=4\n",
+		"[builders]\nbuild1 port\n",
+		"[builders]\n@arm-lab port=1\n",
+	} {
+		if _, err := parseInventory(strings.NewReader(bad), "test"); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("parseInventory(%q): %v != %v", bad, err, os.ErrInvalid)
+		}
+	}
+}
+
+func TestExpandInventory(t *testing.T) {
+	inv, err := parseInventory(strings.NewReader(testInventory), "test")
+	if err != nil {
+		t.Fatalf("parseInventory: %v != nil", err)
+	}
+	got, err := inv.expand("builders")
+	if want := []string{"build1", "build2", "rpi1", "root@rpi2"}; err != nil || !reflect.DeepEqual(invNames(got), want) {
+		t.Errorf("expand(builders): (%q, %v) != (%q, nil)", invNames(got), err, want)
+	}
+	if _, err := inv.expand("loop"); !errors.Is(err, os.ErrInvalid) || !strings.Contains(err.Error(), "loop -> loop2 -> loop") {
+		t.Errorf("expand(loop): %v != a cycle, %v", err, os.ErrInvalid)
+	}
+	if _, err := inv.expand("nope"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expand(nope): %v != %v", err, os.ErrNotExist)
+	}
+}
+
+func TestGroupHosts(t *testing.T) {
+	defer func(n cpuCount) { numCPUs = n }(numCPUs)
+	inv, err := parseInventory(strings.NewReader(testInventory), "test")
+	if err != nil {
+		t.Fatalf("parseInventory: %v != nil", err)
+	}
+	for _, tt := range []struct {
+		n    cpuCount
+		set  bool
+		pats []string
+		want []string
+		err  error
+	}{
+		// The default -n, 1, is for dnssd; a group is used whole.
+		{n: 1, want: []string{"build1", "build2", "rpi1", "root@rpi2"}},
+		{n: 2, set: true, want: []string{"build1", "build2"}},
+		{n: 0, set: true, want: []string{"build1", "build2", "rpi1", "root@rpi2"}},
+		{n: 2, set: true, pats: []string{"build*"}, want: []string{"rpi1", "root@rpi2"}},
+		{n: 1, pats: []string{"*"}, err: os.ErrNotExist},
+	} {
+		numCPUs = tt.n
+		got, err := groupHosts(inv, "builders", tt.pats, tt.set)
+		if !errors.Is(err, tt.err) || !reflect.DeepEqual(invNames(got), tt.want) {
+			t.Errorf("groupHosts(builders, -n %d (set %v), exclude %q): (%q, %v) != (%q, %v)", tt.n, tt.set, tt.pats, invNames(got), err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestInventoryApply(t *testing.T) {
+	h := invHost{host: "build2", opts: map[string]string{"port": "17011", "keyfile": "k", "arch": "arm64"}}
+	c := cpu{host: "build2", port: "17010"}
+	h.apply(&c, map[string]bool{})
+	if c.port != "17011" || !reflect.DeepEqual(c.keyfiles, []string{"k"}) || c.arch != "arm64" {
+		t.Errorf("apply: port %q, keyfiles %q, arch %q != 17011, [k], arm64", c.port, c.keyfiles, c.arch)
+	}
+	c = cpu{host: "build2", port: "17010"}
+	h.apply(&c, map[string]bool{"sp": true})
+	if c.port != "17010" {
+		t.Errorf("apply, -sp set: port %q != 17010", c.port)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/u-root/sidecore/internal/cpu/client"
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// When sidecore is suspended, e.g. with ^Z when stdin is not the
+// terminal, its remote commands are too, and they are continued
+// when it is. These are the names cpud knows the signals by.
+const (
+	sshTSTP ossh.Signal = "TSTP"
+	sshCONT ossh.Signal = "CONT"
+)
+
+// jobs are the remote commands which are running.
+var jobs = struct {
+	sync.Mutex
+	cmds map[*client.Cmd]bool
+}{cmds: map[*client.Cmd]bool{}}
+
+// addJob adds a command which has started to the jobs.
+func addJob(c *client.Cmd) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	jobs.cmds[c] = true
+}
+
+// removeJob removes a command from the jobs, if it is there.
+func removeJob(c *client.Cmd) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	delete(jobs.cmds, c)
+}
+
+// suspendJobs suspends the jobs, and sidecore, with stop, which
+// returns when sidecore is continued; then it continues them. The
+// terminal is restored first, so that it is not left raw while
+// sidecore is stopped, and made raw again after. Errors are
+// logged, since there is no one to return them to.
+func suspendJobs(stop func() error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	for c := range jobs.cmds {
+		if err := c.Suspend(); err != nil {
+			verbose("suspend %q: %v", c.Args[0], err)
+		}
+		if err := c.Signal(sshTSTP); err != nil {
+			verbose("sending %v to %q: %v", sshTSTP, c.Args[0], err)
+		}
+	}
+	if err := stop(); err != nil {
+		verbose("stopping: %v", err)
+	}
+	for c := range jobs.cmds {
+		if err := c.Resume(); err != nil {
+			verbose("resume %q: %v", c.Args[0], err)
+		}
+		if err := c.Signal(sshCONT); err != nil {
+			verbose("sending %v to %q: %v", sshCONT, c.Args[0], err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// errConnectionLost is returned when a cpu stops answering keepalives.
+var errConnectionLost = errors.New("connection lost")
+
+// keepAlive sends a keepalive request on cl every interval, as ssh
+// does for ServerAliveInterval. Once count requests have gone
+// unanswered, it closes cl, which ends the session and the forwarded
+// listeners, and sends an error wrapping errConnectionLost. It stops
+// when done is closed. An interval of 0 turns keepalives off.
+func keepAlive(cl *ossh.Client, interval time.Duration, count int, done <-chan struct{}) <-chan error {
+	lost := make(chan error, 1)
+	if interval <= 0 {
+		return lost
+	}
+	if count < 1 {
+		count = 1
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		// Only one request is outstanding at a time, so
+		// replies never blocks, even after keepAlive returns.
+		replies := make(chan error, 1)
+		pending, missed := false, 0
+		for {
+			select {
+			case <-done:
+				return
+			case err := <-replies:
+				pending = false
+				// Any reply, even a refusal, means the cpu is there.
+				if err == nil {
+					missed = 0
+				}
+			case <-t.C:
+				if pending {
+					missed++
+				}
+				if missed >= count {
+					cl.Close()
+					lost <- fmt.Errorf("no reply to %d keepalives in %v:%w", missed, time.Duration(missed)*interval, errConnectionLost)
+					return
+				}
+				if pending {
+					continue
+				}
+				pending = true
+				go func() {
+					_, _, err := cl.SendRequest("keepalive@openssh.com", true, nil)
+					replies <- err
+				}()
+			}
+		}
+	}()
+	return lost
+}
+
+// aliveConfig returns the keepalive interval and count for a host
+// from ServerAliveInterval and ServerAliveCountMax in ~/.ssh/config.
+func aliveConfig(host string) (time.Duration, int) {
+	var (
+		interval time.Duration
+		count    = 3
+	)
+	if s, err := strconv.Atoi(sshConfig.Get(host, "ServerAliveInterval")); err == nil {
+		interval = time.Duration(s) * time.Second
+	}
+	if n, err := strconv.Atoi(sshConfig.Get(host, "ServerAliveCountMax")); err == nil {
+		count = n
+	}
+	return interval, count
+}
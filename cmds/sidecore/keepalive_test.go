@@ -0,0 +1,106 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// serveMute logs a client in, and then never answers it, like
+// a cpu whose network has gone away.
+func serveMute(c net.Conn, cfg *ossh.ServerConfig) {
+	_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+	if err != nil {
+		return
+	}
+	go func() {
+		for range chans {
+		}
+	}()
+	// Requests are taken, but never replied to.
+	for range reqs {
+	}
+}
+
+// testClient logs in to the ssh server at addr.
+func testClient(t *testing.T, addr string) *ossh.Client {
+	t.Helper()
+	s, err := loadKey(testKey(t))
+	if err != nil {
+		t.Fatalf("loadKey: %v != nil", err)
+	}
+	cl, err := ossh.Dial("tcp", addr, &ossh.ClientConfig{
+		User:            "glenda",
+		Auth:            []ossh.AuthMethod{ossh.PublicKeys(s)},
+		HostKeyCallback: ossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Dial(%q): %v != nil", addr, err)
+	}
+	t.Cleanup(func() { cl.Close() })
+	return cl
+}
+
+func TestKeepAlive(t *testing.T) {
+	cl := testClient(t, testServer(t))
+	done := make(chan struct{})
+	lost := keepAlive(cl, 10*time.Millisecond, 2, done)
+	select {
+	case err := <-lost:
+		t.Fatalf("keepAlive to a live server: %v != nil", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(done)
+	if _, _, err := cl.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("connection after keepAlive is done: %v != nil", err)
+	}
+}
+
+func TestKeepAliveLost(t *testing.T) {
+	cl := testClient(t, testServerFunc(t, serveMute))
+	done := make(chan struct{})
+	defer close(done)
+	select {
+	case err := <-keepAlive(cl, 10*time.Millisecond, 2, done):
+		if !errors.Is(err, errConnectionLost) {
+			t.Errorf("keepAlive to a mute server: %v != %v", err, errConnectionLost)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("keepAlive to a mute server: no error after 5s")
+	}
+	// The connection is closed, so that whatever is using it ends.
+	if err := cl.Wait(); err == nil {
+		t.Errorf("Wait after the connection is lost: nil != an error")
+	}
+}
+
+func TestKeepAliveOff(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	select {
+	case err := <-keepAlive(nil, 0, 3, done):
+		t.Errorf("keepAlive with interval 0: %v != nil", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAliveConfig(t *testing.T) {
+	setSSHConfig(t, `Host flaky
+	ServerAliveInterval 15
+	ServerAliveCountMax 5
+`)
+	if i, c := aliveConfig("flaky"); i != 15*time.Second || c != 5 {
+		t.Errorf("aliveConfig(flaky): (%v, %d) != (15s, 5)", i, c)
+	}
+	if i, c := aliveConfig("other"); i != 0 || c != 3 {
+		t.Errorf("aliveConfig(other): (%v, %d) != (0s, 3)", i, c)
+	}
+}
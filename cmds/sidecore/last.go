@@ -0,0 +1,116 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// The last cpu dialed is saved, so that sidecore - runs on it again.
+
+var lastFlag = flag.Bool("last", false, "run on the last cpu dialed, as the host - does; all the arguments are the command")
+
+// lastHost is the host which stands for the last cpu dialed.
+const lastHost = "-"
+
+// lastCPU is the last cpu dialed. Host is as it was named, before
+// ~/.ssh/config, or, for cpus found with dnssd, its address.
+type lastCPU struct {
+	Host       string `json:"host"`
+	Port       string `json:"port"`
+	Container  string `json:"container"`
+	Discovered bool   `json:"discovered,omitempty"`
+}
+
+// lastFile returns the file holding the last cpu dialed.
+func lastFile() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "sidecore", "last"), nil
+}
+
+// saveLast saves a cpu as the last one dialed. It is written to a
+// temporary file, then renamed, since cpus run in parallel; the last
+// to be dialed wins. It not being saved does not stop the run.
+func saveLast(cpu *cpu) {
+	f, err := lastFile()
+	if err != nil {
+		verbose("last: %v", err)
+		return
+	}
+	b, err := json.Marshal(lastCPU{Host: cpu.name, Port: cpu.port, Container: cpu.container, Discovered: cpu.discovered})
+	if err != nil {
+		verbose("last: %v", err)
+		return
+	}
+	if err := writeFileAtomic(f, b); err != nil {
+		verbose("last: %v", err)
+	}
+}
+
+// writeFileAtomic writes b to a temporary file, which it then renames
+// to f, so that a reader sees either the old contents or the new.
+func writeFileAtomic(f string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+		return err
+	}
+	t, err := os.CreateTemp(filepath.Dir(f), filepath.Base(f))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(t.Name())
+	if _, err := t.Write(b); err != nil {
+		t.Close()
+		return err
+	}
+	if err := t.Close(); err != nil {
+		return err
+	}
+	return os.Rename(t.Name(), f)
+}
+
+// loadLast returns the last cpu dialed, as a cpu to run on. It is an
+// error if there is none, if pats exclude it, or, on tcp, if its host
+// no longer resolves, e.g. it has been renamed, which would otherwise
+// fail later, with a less useful error.
+func loadLast(pats []string) (cpu, error) {
+	f, err := lastFile()
+	if err != nil {
+		return cpu{}, err
+	}
+	b, err := os.ReadFile(f)
+	if errors.Is(err, os.ErrNotExist) {
+		return cpu{}, fmt.Errorf("-: no cpu has been dialed yet; name a host:%w", os.ErrNotExist)
+	}
+	if err != nil {
+		return cpu{}, err
+	}
+	var l lastCPU
+	if err := json.Unmarshal(b, &l); err != nil || len(l.Host) == 0 {
+		return cpu{}, fmt.Errorf("-: %s is not a saved cpu (%v); name a host:%w", f, err, os.ErrInvalid)
+	}
+	if p, ok := excluded(pats, l.Host); ok {
+		return cpu{}, fmt.Errorf("-: the last cpu, %s, is excluded by %q:%w", l.Host, p, os.ErrInvalid)
+	}
+	if len(*network) == 0 || *network == "tcp" {
+		h, err := getHostName(l.Host, l.Port)
+		if err == nil && net.ParseIP(h) == nil {
+			_, err = resolveHost(h)
+		}
+		if err != nil {
+			return cpu{}, fmt.Errorf("-: the last cpu, %s, no longer resolves: %v; name a host:%w", l.Host, err, os.ErrNotExist)
+		}
+	}
+	verbose("-: %s:%s, %s", l.Host, l.Port, l.Container)
+	return cpu{host: l.Host, port: l.Port, container: l.Container, discovered: l.Discovered, last: true}, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestLast(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	setSSHConfig(t, "")
+	defer func(r func(string) ([]string, error)) { resolveHost = r }(resolveHost)
+	resolveHost = func(n string) ([]string, error) {
+		if n == "box.lab" {
+			return []string{"10.0.0.1"}, nil
+		}
+		return nil, fmt.Errorf("%s:%w", n, os.ErrNotExist)
+	}
+
+	if _, err := loadLast(nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("loadLast, none saved: %v != %v", err, os.ErrNotExist)
+	}
+
+	saveLast(&cpu{host: "10.0.0.1", name: "box.lab", port: "17011", container: "/images/arm64-ubuntu@latest.cpio"})
+	got, err := loadLast(nil)
+	if err != nil {
+		t.Fatalf("loadLast: %v != nil", err)
+	}
+	if got.host != "box.lab" || got.port != "17011" || got.container != "/images/arm64-ubuntu@latest.cpio" || !got.last {
+		t.Errorf("loadLast: %+v != box.lab:17011, /images/arm64-ubuntu@latest.cpio, last", got)
+	}
+	if _, err := loadLast([]string{"box*"}); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("loadLast, excluded: %v != %v", err, os.ErrInvalid)
+	}
+
+	saveLast(&cpu{host: "gone.lab", name: "gone.lab", port: "17010"})
+	if _, err := loadLast(nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loadLast, host gone: %v != %v", err, os.ErrNotExist)
+	}
+
+	saveLast(&cpu{host: "10.0.0.2", name: "10.0.0.2", port: "17010", discovered: true})
+	if got, err := loadLast(nil); err != nil || got.host != "10.0.0.2" || !got.discovered {
+		t.Errorf("loadLast, discovered: (%+v, %v) != (10.0.0.2, discovered, nil)", got, err)
+	}
+
+	f, err := lastFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f, []byte("box.lab"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLast(nil); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("loadLast, garbage: %v != %v", err, os.ErrInvalid)
+	}
+}
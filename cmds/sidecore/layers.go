@@ -0,0 +1,129 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// A container may be cpio files layered one over another, separated
+// by commas, e.g. -container amd64-ubuntu@latest.cpio,toolchain.cpio.
+// A file in a later one hides the one of the same name in an earlier
+// one, whatever its type, and a directory lists what is in all of them.
+const layerSeparator = ","
+
+// containerLayers returns the layers of a container, which, for most,
+// is the one.
+func containerLayers(c string) []string {
+	return strings.Split(c, layerSeparator)
+}
+
+// checkLayers checks the layers of a -container, each as a container
+// of its own, and returns them joined again. Only cpio files, tars and
+// squashfs images may be layered.
+func checkLayers(c string) (string, error) {
+	var layers []string
+	for _, l := range containerLayers(c) {
+		_, dir := dirContainer(l)
+		_, oci := ociContainer(l)
+		_, docker := dockerArchive(l)
+		if len(l) == 0 || l == stdinContainer || dir || oci || docker {
+			return "", fmt.Errorf("-container %s: %q: only cpio files, tars and squashfs images may be layered:%w", c, l, os.ErrInvalid)
+		}
+		p, err := checkContainer(l)
+		if err != nil {
+			return "", err
+		}
+		layers = append(layers, p)
+	}
+	return strings.Join(layers, layerSeparator), nil
+}
+
+// archiveName returns the name, in the container, of a file in an
+// archive: relative, and clean, with "." for the root.
+func archiveName(n string) string {
+	n = path.Clean("/" + n)
+	if n == "/" {
+		return "."
+	}
+	return n[1:]
+}
+
+// under reports whether n is in the directory dir.
+func under(n, dir string) bool {
+	if dir == "." {
+		return n != "."
+	}
+	return strings.HasPrefix(n, dir+"/")
+}
+
+// sortArchiveNames sorts names as fsCPIO needs them: the root first,
+// and each directory before what is in it.
+func sortArchiveNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == "." || names[j] == "." {
+			return names[i] == "."
+		}
+		return names[i] < names[j]
+	})
+}
+
+// mergeCPIO merges the records of layered archives. A record in a
+// later archive replaces the one of the same name in an earlier one;
+// if it replaces a directory with something else, what was in the
+// directory goes too. Directories which no archive has are made.
+func mergeCPIO(layers [][]cpio.Record) []cpio.Record {
+	type layered struct {
+		rec   cpio.Record
+		layer int
+	}
+	files := map[string]layered{}
+	for i, recs := range layers {
+		for _, r := range recs {
+			if r.Name == cpio.Trailer {
+				continue
+			}
+			n := archiveName(r.Name)
+			if o, ok := files[n]; ok && o.rec.Mode&cpio.S_IFMT == cpio.S_IFDIR && r.Mode&cpio.S_IFMT != cpio.S_IFDIR {
+				for k, e := range files {
+					if under(k, n) && e.layer < i {
+						delete(files, k)
+					}
+				}
+			}
+			r.Name = n
+			files[n] = layered{rec: r, layer: i}
+		}
+	}
+	for n := range files {
+		for d := path.Dir(n); ; d = path.Dir(d) {
+			if _, ok := files[d]; !ok {
+				files[d] = layered{rec: cpio.Directory(d, 0755)}
+			}
+			if d == "." {
+				break
+			}
+		}
+	}
+	if _, ok := files["."]; !ok {
+		files["."] = layered{rec: cpio.Directory(".", 0755)}
+	}
+	names := make([]string, 0, len(files))
+	for n := range files {
+		names = append(names, n)
+	}
+	sortArchiveNames(names)
+	recs := make([]cpio.Record, 0, len(names))
+	for _, n := range names {
+		recs = append(recs, files[n].rec)
+	}
+	return recs
+}
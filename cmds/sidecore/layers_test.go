@@ -0,0 +1,202 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+	"github.com/u-root/sidecore/internal/cpu/client"
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// writeCPIO writes records to a cpio file in dir.
+func writeCPIO(t *testing.T, dir, name string, recs ...cpio.Record) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := cpio.Newc.Writer(f)
+	for _, r := range recs {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testLayered returns a base cpio, and a cpio to layer over it, which
+// adds a file, changes one, and makes a directory a symlink. It does
+// not have a root, or all of its directories.
+func testLayered(t *testing.T) (string, string) {
+	d := t.TempDir()
+	base := writeCPIO(t, d, "base.cpio",
+		cpio.Directory(".", 0755),
+		cpio.Directory("bin", 0755),
+		cpio.StaticFile("bin/ls", "ls", 0755),
+		cpio.Directory("etc", 0755),
+		cpio.StaticFile("etc/os-release", "base", 0644),
+		cpio.Directory("lib", 0755),
+		cpio.StaticFile("lib/x", "x", 0644),
+	)
+	top := writeCPIO(t, d, "top.cpio",
+		cpio.StaticFile("bin/gcc", "gcc", 0755),
+		cpio.StaticFile("etc/os-release", "top", 0644),
+		cpio.Symlink("lib", "usr/lib"),
+		cpio.StaticFile("usr/lib/y", "y", 0644),
+	)
+	return base, top
+}
+
+func TestLayeredfsCPIO(t *testing.T) {
+	base, top := testLayered(t)
+	f, err := NewfsCPIO(base + layerSeparator + top)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%s,%s): %v != nil", base, top, err)
+	}
+	for _, tt := range []struct {
+		dir  string
+		want []string
+	}{
+		{dir: ".", want: []string{"bin", "etc", "lib", "usr"}},
+		{dir: "bin", want: []string{"gcc", "ls"}},
+		{dir: "usr/lib", want: []string{"y"}},
+	} {
+		ents, err := f.ReadDir(tt.dir)
+		if err != nil {
+			t.Errorf("ReadDir(%q): %v != nil", tt.dir, err)
+			continue
+		}
+		var got []string
+		for _, e := range ents {
+			got = append(got, e.Name())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadDir(%q): %q != %q", tt.dir, got, tt.want)
+		}
+	}
+	for n, want := range map[string]string{"etc/os-release": "top", "bin/ls": "ls", "bin/gcc": "gcc"} {
+		h, err := f.Open(n)
+		if err != nil {
+			t.Errorf("Open(%q): %v != nil", n, err)
+			continue
+		}
+		b := make([]byte, 16)
+		c, _ := h.ReadAt(b, 0)
+		if got := string(b[:c]); got != want {
+			t.Errorf("%s: %q != %q", n, got, want)
+		}
+	}
+	fi, err := f.Lstat("lib")
+	if err != nil || fi.Mode().Type() != fs.ModeSymlink {
+		t.Errorf("Lstat(lib): %v, %v != a symlink, nil", fi, err)
+	}
+	if _, err := f.Lstat("lib/x"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lstat(lib/x), under a directory made a symlink: %v != %v", err, os.ErrNotExist)
+	}
+}
+
+func TestLayered9P(t *testing.T) {
+	base, top := testLayered(t)
+	home := writeCPIO(t, t.TempDir(), "home.cpio", cpio.Directory(".", 0755), cpio.StaticFile("profile", "", 0644))
+	hs, err := client.NewCPIO9P(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf, err := hs.Attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := newServer(base+layerSeparator+top, hf, "home")
+	if err != nil {
+		t.Fatalf("newServer(%s,%s): %v != nil", base, top, err)
+	}
+	root, err := u.Attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range map[string]string{"etc/os-release": "top", "bin/ls": "ls", "bin/gcc": "gcc"} {
+		_, f, err := root.Walk(strings.Split(n, "/"))
+		if err != nil {
+			t.Errorf("Walk(%q): %v != nil", n, err)
+			continue
+		}
+		if _, _, err := f.Open(p9.ReadOnly); err != nil {
+			t.Errorf("Open(%q): %v != nil", n, err)
+			continue
+		}
+		b := make([]byte, 16)
+		c, _ := f.ReadAt(b, 0)
+		if got := string(b[:c]); got != want {
+			t.Errorf("%s: %q != %q", n, got, want)
+		}
+	}
+	if _, _, err := root.Walk([]string{"bin", "cc"}); err == nil {
+		t.Errorf("Walk(bin/cc): nil != an error")
+	}
+	d, err := root.Readdir(0, 1<<20)
+	if err != nil {
+		t.Fatalf("Readdir(/): %v != nil", err)
+	}
+	seen := map[string]bool{}
+	for _, e := range d {
+		if seen[e.Name] {
+			t.Errorf("Readdir(/): %q more than once", e.Name)
+		}
+		seen[e.Name] = true
+	}
+	for _, n := range []string{"bin", "etc", "profile"} {
+		if !seen[n] {
+			t.Errorf("Readdir(/): no %q in %v", n, d)
+		}
+	}
+}
+
+func TestCheckLayers(t *testing.T) {
+	base, top := testLayered(t)
+	t.Setenv("SIDECORE_IMAGES", filepath.Dir(base))
+	for _, tt := range []struct {
+		in, want string
+		err      error
+	}{
+		{in: base + "," + top, want: base + "," + top},
+		{in: "base.cpio,top.cpio", want: "base.cpio,top.cpio"},
+		{in: base + ",", err: os.ErrInvalid},
+		{in: base + ",-", err: os.ErrInvalid},
+		{in: base + ",dir:/tmp", err: os.ErrInvalid},
+		{in: "oci://alpine," + top, err: os.ErrInvalid},
+		{in: base + ",/no/such.cpio", err: os.ErrNotExist},
+	} {
+		got, err := checkContainer(tt.in)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("checkContainer(%q): %q, %v != %q, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+	if got, _ := searchContainer("base.cpio,top.cpio"); got != base+","+top {
+		t.Errorf("searchContainer(base.cpio,top.cpio): %q != %q", got, base+","+top)
+	}
+}
+
+func TestLayeredSum(t *testing.T) {
+	base, top := testLayered(t)
+	t.Setenv("SIDECORE_IMAGE_SHA256", strings.Repeat("0", 64))
+	if err := useContainer(base + layerSeparator + top); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("useContainer(%s,%s) with SIDECORE_IMAGE_SHA256: %v != %v", base, top, err, os.ErrInvalid)
+	}
+}
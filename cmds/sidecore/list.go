@@ -0,0 +1,160 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+// browse finds cpud servers. Tests replace it.
+var browse = ds.Browse
+
+// listEntry is a cpud server, as -list prints it.
+type listEntry struct {
+	// Event is "add" or "remove", for -watch.
+	Event    string            `json:"event,omitempty"`
+	Instance string            `json:"instance"`
+	Host     string            `json:"host"`
+	IPs      []string          `json:"ips"`
+	Port     int               `json:"port"`
+	Text     map[string]string `json:"txt"`
+}
+
+// newListEntry returns the listEntry for a dnssd entry.
+func newListEntry(e dnssd.BrowseEntry) listEntry {
+	return listEntry{Instance: e.UnescapedName(), Host: e.Host, IPs: entryAddrs(e), Port: e.Port, Text: e.Text}
+}
+
+// txt returns an entry's txt attributes as key=value, sorted.
+func (l listEntry) txt() string {
+	var kv []string
+	for k, v := range l.Text {
+		kv = append(kv, k+"="+v)
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, " ")
+}
+
+// listQuery returns the query for -list. It is a dnssd: query,
+// by default any server; unlike for running, a query which does
+// not name an arch or os matches any arch or os.
+func listQuery(args []string) (ds.Query, error) {
+	q := "dnssd:"
+	switch len(args) {
+	case 0:
+	case 1:
+		q = args[0]
+	default:
+		return ds.Query{}, fmt.Errorf("-list takes at most one dnssd: query:%w", os.ErrInvalid)
+	}
+	u, err := url.Parse(withType(q, queryType))
+	if err != nil || u.Scheme != "dnssd" {
+		return ds.Query{}, fmt.Errorf("%q is not a dnssd: query:%w", q, os.ErrInvalid)
+	}
+	vals := u.Query()
+	for _, k := range []string{"arch", "os"} {
+		if len(vals[k]) == 0 {
+			vals.Set(k, "*")
+		}
+	}
+	u.RawQuery = vals.Encode()
+	dq, err := ds.Parse(u.String())
+	dq.Interfaces = dsIfaces
+	return dq, err
+}
+
+// listCPUs prints the cpud servers which match a query, with
+// their addresses and txt attributes, as a table, or, with -json,
+// as JSON. With -watch, it prints them as they come and go, until
+// interrupted.
+func listCPUs(w io.Writer, args []string) error {
+	q, err := listQuery(args)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if *watch {
+		return watchCPUs(ctx, w, q)
+	}
+	ctx, cancel = context.WithTimeout(ctx, ds.Timeout)
+	defer cancel()
+	return printCPUs(ctx, w, q)
+}
+
+// printCPUs prints the servers found before ctx is done.
+func printCPUs(ctx context.Context, w io.Writer, q ds.Query) error {
+	var (
+		mu    sync.Mutex
+		found = map[string]listEntry{}
+	)
+	err := browse(ctx, q, func(e dnssd.BrowseEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+		l := newListEntry(e)
+		// A server is seen once for each interface it is on.
+		if old, ok := found[l.Instance]; ok {
+			l.IPs = append(old.IPs, l.IPs...)
+		}
+		found[l.Instance] = l
+	}, func(e dnssd.BrowseEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(found, e.UnescapedName())
+	})
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	entries := []listEntry{}
+	for _, l := range found {
+		entries = append(entries, l)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Instance < entries[j].Instance })
+	if *jsonList {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		return e.Encode(entries)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tIPS\tPORT\tTXT")
+	for _, l := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", l.Instance, strings.Join(l.IPs, ","), l.Port, l.txt())
+	}
+	return tw.Flush()
+}
+
+// watchCPUs prints servers as they are found, and go away,
+// until ctx is done.
+func watchCPUs(ctx context.Context, w io.Writer, q ds.Query) error {
+	var mu sync.Mutex
+	event := func(ev string, e dnssd.BrowseEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+		l := newListEntry(e)
+		if *jsonList {
+			l.Event = ev
+			json.NewEncoder(w).Encode(l)
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s %s %d %s\n", time.Now().Format("15:04:05"), ev, l.Instance, strings.Join(l.IPs, ","), l.Port, l.txt())
+	}
+	return browse(ctx, q, func(e dnssd.BrowseEntry) { event("add", e) }, func(e dnssd.BrowseEntry) { event("remove", e) })
+}
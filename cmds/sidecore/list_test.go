@@ -0,0 +1,133 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/brutella/dnssd"
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+// setBrowse replaces browse with a fake, which finds entries,
+// then, if remove is set, sees the first go away.
+func setBrowse(t *testing.T, remove bool, entries ...dnssd.BrowseEntry) *ds.Query {
+	t.Helper()
+	old := browse
+	t.Cleanup(func() { browse = old })
+	q := new(ds.Query)
+	browse = func(ctx context.Context, query ds.Query, add, rmv func(dnssd.BrowseEntry)) error {
+		*q = query
+		for _, e := range entries {
+			add(e)
+		}
+		if remove {
+			rmv(entries[0])
+		}
+		return nil
+	}
+	return q
+}
+
+var testEntries = []dnssd.BrowseEntry{
+	{Name: "b", Host: "b.local", IPs: []net.IP{net.ParseIP("10.0.0.2")}, Port: 17010, IfaceName: "eth0", Text: map[string]string{"arch": "arm64", "os": "linux"}},
+	{Name: "a", Host: "a.local", IPs: []net.IP{net.ParseIP("10.0.0.1")}, Port: 17010, IfaceName: "eth0", Text: map[string]string{"arch": "amd64", "os": "linux", "cores": "16"}},
+	{Name: "a", Host: "a.local", IPs: []net.IP{net.ParseIP("fe80::1")}, Port: 17010, IfaceName: "wlan0", Text: map[string]string{"arch": "amd64", "os": "linux", "cores": "16"}},
+}
+
+func TestListQuery(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		text map[string][]string
+		err  error
+	}{
+		{text: map[string][]string{"arch": {"*"}, "os": {"*"}}},
+		{args: []string{"dnssd://?arch=arm64"}, text: map[string][]string{"arch": {"arm64"}, "os": {"*"}}},
+		{args: []string{"cpu.example.com"}, err: os.ErrInvalid},
+		{args: []string{"dnssd:", "dnssd:"}, err: os.ErrInvalid},
+	} {
+		q, err := listQuery(tt.args)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("listQuery(%q): %v != %v", tt.args, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(q.Text, tt.text) {
+			t.Errorf("listQuery(%q): Text %v != %v", tt.args, q.Text, tt.text)
+		}
+	}
+}
+
+func TestPrintCPUs(t *testing.T) {
+	setBrowse(t, false, testEntries...)
+	defer func(j bool) { *jsonList = j }(*jsonList)
+	*jsonList = false
+	var b bytes.Buffer
+	if err := printCPUs(context.Background(), &b, ds.Query{}); err != nil {
+		t.Fatalf("printCPUs: %v != nil", err)
+	}
+	want := `INSTANCE  IPS                     PORT   TXT
+a         10.0.0.1,fe80::1%wlan0  17010  arch=amd64 cores=16 os=linux
+b         10.0.0.2                17010  arch=arm64 os=linux
+`
+	if b.String() != want {
+		t.Errorf("printCPUs: %q != %q", b.String(), want)
+	}
+
+	*jsonList = true
+	b.Reset()
+	if err := printCPUs(context.Background(), &b, ds.Query{}); err != nil {
+		t.Fatalf("printCPUs, -json: %v != nil", err)
+	}
+	var got []listEntry
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("printCPUs, -json: %v != nil", err)
+	}
+	if len(got) != 2 || got[0].Instance != "a" || !reflect.DeepEqual(got[0].IPs, []string{"10.0.0.1", "fe80::1%wlan0"}) || got[1].Text["arch"] != "arm64" {
+		t.Errorf("printCPUs, -json: %+v != a, with two IPs, and b, which is arm64", got)
+	}
+}
+
+func TestPrintCPUsNone(t *testing.T) {
+	setBrowse(t, false)
+	defer func(j bool) { *jsonList = j }(*jsonList)
+	*jsonList = true
+	var b bytes.Buffer
+	if err := printCPUs(context.Background(), &b, ds.Query{}); err != nil {
+		t.Fatalf("printCPUs: %v != nil", err)
+	}
+	if got := strings.TrimSpace(b.String()); got != "[]" {
+		t.Errorf("printCPUs, none found, -json: %q != \"[]\"", got)
+	}
+}
+
+func TestWatchCPUs(t *testing.T) {
+	setBrowse(t, true, testEntries[:2]...)
+	defer func(j bool) { *jsonList = j }(*jsonList)
+	*jsonList = true
+	var b bytes.Buffer
+	if err := watchCPUs(context.Background(), &b, ds.Query{}); err != nil {
+		t.Fatalf("watchCPUs: %v != nil", err)
+	}
+	var got []string
+	d := json.NewDecoder(&b)
+	for d.More() {
+		var l listEntry
+		if err := d.Decode(&l); err != nil {
+			t.Fatalf("Decode: %v != nil", err)
+		}
+		got = append(got, l.Event+" "+l.Instance)
+	}
+	if want := []string{"add b", "add a", "remove b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("watchCPUs: %q != %q", got, want)
+	}
+}
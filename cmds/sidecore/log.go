@@ -0,0 +1,232 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	// slog is in the standard library as of Go 1.21;
+	// we still support 1.20.
+	"golang.org/x/exp/slog"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// Levels for sidecore's own messages. Hard errors are always shown.
+const (
+	// levelQuiet shows only errors.
+	levelQuiet = iota
+	// levelNormal adds informational messages.
+	levelNormal
+	// levelVerbose adds debug prints.
+	levelVerbose
+)
+
+// logLevel is set by -q and -d.
+var logLevel = levelNormal
+
+// level returns the level for -q and -d. -q lowers the level,
+// and -d raises it, so -q -d is the normal level. -dump is not
+// a level: it writes debug prints to a file, whatever the level.
+func level(quiet, debug bool) int {
+	l := levelNormal
+	if quiet {
+		l--
+	}
+	if debug {
+		l++
+	}
+	return l
+}
+
+// info prints an informational message, unless -q was given.
+func info(f string, a ...interface{}) {
+	if logLevel >= levelNormal {
+		log.Printf(f, a...)
+	}
+}
+
+// jsonLog is the structured logger used with -log-format=json.
+// It is nil in the default, text, mode.
+var jsonLog *slog.Logger
+
+// slogWriter is an io.Writer which turns each write from
+// a log.Logger into a structured log record. This catches
+// everything logged with the log package, including by the
+// cpu client and the nfs server.
+type slogWriter struct {
+	l *slog.Logger
+}
+
+var _ io.Writer = &slogWriter{}
+
+// levels maps the level prefixes used by the nfs
+// server's logger to slog levels.
+var levels = map[string]slog.Level{
+	"[PANIC] ": slog.LevelError,
+	"[FATAL] ": slog.LevelError,
+	"[ERROR] ": slog.LevelError,
+	"[WARN] ":  slog.LevelWarn,
+	"[INFO] ":  slog.LevelInfo,
+	"[DEBUG] ": slog.LevelDebug,
+	"[TRACE] ": slog.LevelDebug,
+}
+
+// Write implements io.Writer. Messages are logged at
+// Info, unless they start with one of the levels.
+func (s *slogWriter) Write(b []byte) (int, error) {
+	m := strings.TrimRight(string(b), "\r\n")
+	l := slog.LevelInfo
+	for p, pl := range levels {
+		if strings.HasPrefix(m, p) {
+			m, l = m[len(p):], pl
+			break
+		}
+	}
+	s.l.Log(context.Background(), l, m)
+	return len(b), nil
+}
+
+// setupLogging sets up logging for a format, which is text or json.
+func setupLogging(format string) error {
+	switch format {
+	case "text":
+		return nil
+	case "json":
+		jsonLog = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		log.SetFlags(0)
+		log.SetOutput(&slogWriter{l: jsonLog})
+		return nil
+	}
+	return fmt.Errorf("log format %q: must be text or json:%w", format, os.ErrInvalid)
+}
+
+// fatalf logs an error and exits with exitFailure.
+func fatalf(f string, a ...interface{}) {
+	if jsonLog != nil {
+		jsonLog.Error(strings.TrimRight(fmt.Sprintf(f, a...), "\r\n"))
+	} else {
+		log.Printf(f, a...)
+	}
+	exit(exitFailure)
+}
+
+// exitHooks are run, last first, by exit, e.g. to remove temporary
+// files.
+var (
+	exitHooks   []func()
+	exitHooksMu sync.Mutex
+)
+
+// atExit adds f to the funcs run by exit.
+func atExit(f func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, f)
+}
+
+// exit runs the exit hooks, then exits with code.
+func exit(code int) {
+	exitHooksMu.Lock()
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	os.Exit(code)
+}
+
+// report logs the result of running on a cpu, if it failed.
+// A remote command failing is not a sidecore error, so it is
+// only informational.
+func report(r result) {
+	if r.err == nil {
+		return
+	}
+	sshErr := &ossh.ExitError{}
+	remote := errors.As(r.err, &sshErr)
+	if jsonLog != nil {
+		attrs := []any{"host", r.host, "port", r.port, "status", r.status, "error", r.err.Error()}
+		if !remote {
+			jsonLog.Error("failed", attrs...)
+		} else if logLevel >= levelNormal {
+			jsonLog.Info("exit", attrs...)
+		}
+		return
+	}
+	if remote {
+		info("%s: %v", r.host, r.err)
+		return
+	}
+	log.Printf("%s: %v", r.host, r.err)
+}
+
+// summarize logs how many cpus succeeded, failed, and were
+// skipped, when there was more than one, and, for those which ran
+// out of -max-time, which phase they were in.
+func summarize(results []result) {
+	if len(results) < 2 {
+		return
+	}
+	var ok, failed, skipped int
+	var timeouts []string
+	for _, r := range results {
+		var te *maxTimeError
+		if errors.As(r.err, &te) {
+			timeouts = append(timeouts, fmt.Sprintf("%s:%s during %s", r.host, r.port, te.phase))
+		}
+		switch {
+		case r.skipped:
+			skipped++
+		case r.status != 0:
+			failed++
+		default:
+			ok++
+		}
+	}
+	if jsonLog != nil {
+		if logLevel >= levelNormal {
+			attrs := []any{"succeeded", ok, "failed", failed, "skipped", skipped}
+			if len(timeouts) > 0 {
+				attrs = append(attrs, "timed_out", timeouts)
+			}
+			jsonLog.Info("summary", attrs...)
+		}
+		return
+	}
+	if len(timeouts) > 0 {
+		info("%d succeeded, %d failed, %d skipped; timed out: %s", ok, failed, skipped, strings.Join(timeouts, ", "))
+		return
+	}
+	info("%d succeeded, %d failed, %d skipped", ok, failed, skipped)
+}
+
+// jsonVerbose is the v function for -d in json mode.
+func jsonVerbose(f string, a ...interface{}) {
+	jsonLog.Debug(strings.TrimRight(fmt.Sprintf(f, a...), "\r\n"))
+}
+
+// phase logs that a cpu has reached a phase, e.g. dial,
+// mount, start, or wait, and the error, if any.
+// In text mode, only errors are shown, and only with -d.
+func phase(cpu *cpu, name string, err error) {
+	if jsonLog == nil {
+		if err != nil {
+			verbose("%s:%s: %s: %v", cpu.host, cpu.port, name, err)
+		}
+		return
+	}
+	attrs := []any{"host", cpu.host, "port", cpu.port, "phase", name}
+	if err != nil {
+		jsonLog.Error("phase failed", append(attrs, "error", err.Error())...)
+		return
+	}
+	jsonLog.Info("phase", attrs...)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+// testJSONLog sets jsonLog to log to a buffer, until the test ends.
+func testJSONLog(t *testing.T) *bytes.Buffer {
+	var b bytes.Buffer
+	jsonLog = slog.New(slog.NewJSONHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	t.Cleanup(func() { jsonLog = nil })
+	return &b
+}
+
+func TestSlogWriterLevels(t *testing.T) {
+	for _, tt := range []struct {
+		in, level, msg string
+	}{
+		{in: "[ERROR] mount failed\n", level: `"level":"ERROR"`, msg: `"msg":"mount failed"`},
+		{in: "[WARN] slow\n", level: `"level":"WARN"`, msg: `"msg":"slow"`},
+		{in: "nfs: closed\n", level: `"level":"INFO"`, msg: `"msg":"nfs: closed"`},
+	} {
+		b := testJSONLog(t)
+		w := &slogWriter{l: jsonLog}
+		if _, err := w.Write([]byte(tt.in)); err != nil {
+			t.Fatalf("Write(%q): %v != nil", tt.in, err)
+		}
+		if !strings.Contains(b.String(), tt.level) || !strings.Contains(b.String(), tt.msg) {
+			t.Errorf("Write(%q): %q does not contain %s and %s", tt.in, b.String(), tt.level, tt.msg)
+		}
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	b := testJSONLog(t)
+	report(result{host: "a", port: "17010", status: exitFailure, err: fmt.Errorf("Dial: no route to host")})
+	for _, want := range []string{`"level":"ERROR"`, `"host":"a"`, `"port":"17010"`, `"status":255`, `"error":"Dial: no route to host"`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("report: %q does not contain %s", b.String(), want)
+		}
+	}
+}
+
+func TestSummarizeJSON(t *testing.T) {
+	b := testJSONLog(t)
+	summarize([]result{{}, {status: 2}, {status: exitFailure, err: errSkipped, skipped: true}, {}})
+	for _, want := range []string{`"msg":"summary"`, `"succeeded":2`, `"failed":1`, `"skipped":1`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("summarize: %q does not contain %s", b.String(), want)
+		}
+	}
+}
+
+func TestSummarizeTimedOut(t *testing.T) {
+	b := testJSONLog(t)
+	summarize([]result{{}, {host: "a", port: "17010", status: 124, err: &maxTimeError{phase: "mount"}}})
+	for _, want := range []string{`"failed":1`, `"timed_out":["a:17010 during mount"]`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("summarize: %q does not contain %s", b.String(), want)
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	for _, tt := range []struct {
+		quiet, debug bool
+		want         int
+	}{
+		{want: levelNormal},
+		{quiet: true, want: levelQuiet},
+		{debug: true, want: levelVerbose},
+		{quiet: true, debug: true, want: levelNormal},
+	} {
+		if l := level(tt.quiet, tt.debug); l != tt.want {
+			t.Errorf("level(%v, %v): %d != %d", tt.quiet, tt.debug, l, tt.want)
+		}
+	}
+}
@@ -12,54 +12,135 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"os/user"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
-
-	// We use this ssh because it implements port redirection.
-	// It can not, however, unpack password-protected keys yet.
+	"time"
 
 	"github.com/hugelgupf/p9/p9"
 	config "github.com/kevinburke/ssh_config"
-	"github.com/u-root/cpu/client"
-	"github.com/u-root/cpu/ds"
+	"github.com/u-root/sidecore/internal/cpu/client"
+	"github.com/u-root/sidecore/internal/cpu/ds"
 	"github.com/u-root/u-root/pkg/ulog"
+	nfs "github.com/willscott/go-nfs"
 
 	// We use this ssh because it can unpack password-protected private keys.
 	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
 const defaultPort = "17010"
 
+// sshConfig is where ssh_config(5) settings are looked up.
+// Tests replace it.
+var sshConfig interface {
+	Get(alias, key string) string
+	GetAll(alias, key string) []string
+} = config.DefaultUserSettings
+
 type cpu struct {
-	host    string
-	port    string
-	keyfile string
-	hostkey string
-	fstab   string
-	home    string
+	user string
+	host string
+	port string
+	// name is the host as it was given, before
+	// ~/.ssh/config was applied.
+	name string
+	// keyfiles are tried in order.
+	keyfiles []string
+	// certs are certificate files, from CertificateFile
+	// in ~/.ssh/config. Certificates next to key files
+	// are found without being named.
+	certs []string
+	// jumps are the ProxyJump hosts, if any, and
+	// proxyCommand the ProxyCommand, if any.
+	jumps        []string
+	proxyCommand string
+	// proxy is the HTTP or SOCKS5 proxy, if any, for a cpu
+	// with no ProxyJump or ProxyCommand.
+	proxy *url.URL
+	// discovered is set for cpus found with dnssd, which
+	// are local, so they are not reached through a proxy.
+	discovered bool
+	// addrs are the addresses of a cpu found with dnssd,
+	// the first of which is host. They are tried in order.
+	addrs     []string
+	hostkey   string
+	fstab     string
+	home      string
+	namespace string
+	container string
+	// prefix, if set, is written before each line
+	// of output from the remote command; errPrefix
+	// makes the one for stderr.
+	prefix string
+	// noStdin is set when cpus run in parallel, so
+	// that they do not fight over reading stdin.
+	noStdin bool
+	// password is set if password authentication
+	// may be tried when no key is accepted.
+	password bool
+	// compress is set if the nfs stream is to be compressed.
+	compress bool
+	// aliveInterval is how often keepalives are sent, if at
+	// all, and aliveCount how many may go unanswered.
+	aliveInterval time.Duration
+	aliveCount    int
+	// control is the control master's socket, if there is one.
+	control string
+	// arch, if set, chooses the container, e.g. for a cpu
+	// in the inventory which is not of SIDECORE_ARCH.
+	// archForced is set if it was asked for, rather than
+	// being this machine's, which the cpu's own then beats.
+	// txtArch is the arch in the txt record of a cpu found
+	// with dnssd.
+	arch       string
+	archForced bool
+	txtArch    string
+	// imageDirs are the directories of SIDECORE_IMAGES the
+	// container was looked for in, if it is a name.
+	imageDirs []string
+	// env is added to the command's environment, e.g. its rank.
+	env []string
+	// stop is closed, for -fail-fast, when another cpu fails.
+	// The command is then sent SIGTERM.
+	stop <-chan struct{}
+	// last is set for the last cpu dialed, named as -.
+	last bool
+	// deadline, with -max-time, is when the cpu is given up on.
+	deadline time.Time
 }
 
 var (
 	defaultKeyFile = filepath.Join(os.Getenv("HOME"), ".ssh/cpu_rsa")
 	// For the ssh server part
 	debug     = flag.Bool("d", false, "enable debug prints")
+	quiet     = flag.Bool("q", false, "quiet: only print errors; -q -d is the normal level")
 	dbg9p     = flag.Bool("dbg9p", false, "show 9p io")
 	dump      = flag.Bool("dump", false, "Dump copious output, including a 9p trace, to a temp file at exit")
-	network   = flag.String("net", "", "network type to use. Defaults to whatever the cpu client defaults to")
+	network   = flag.String("net", "", "network type to use, e.g. vsock, with hosts written as cid:port, or unix, with hosts written as a path. Defaults to whatever the cpu client defaults to")
 	port      = flag.String("sp", "", "cpu default port")
 	root      = flag.String("root", "/", "9p root")
 	timeout9P = flag.String("timeout9p", "100ms", "time to wait for the 9p mount to happen.")
 	ninep     = flag.Bool("9p", false, "Enable the 9p mount in the client")
-	env       = flag.String("environment", "", "extra environment variables, useful for debug, especially on windows")
+	env       = flag.String("environment", "", "extra environment variables, separated by ;, useful for debug, especially on windows; -env is easier to get right")
 
 	srvnfs = flag.Bool("nfs", true, "start nfs")
 
+	configFile = flag.String("F", "", "config file (default "+defaultConfigFile()+")")
+
+	logFormat = flag.String("log-format", "text", "format of sidecore's own log messages: text or json")
+
+	showVersion = flag.Bool("version", false, "print version information and exit")
+
+	identities stringList
+
 	// v allows debug printing.
 	// Do not call it directly, call verbose instead.
 	v          = func(string, ...interface{}) {}
@@ -68,10 +149,85 @@ var (
 
 // These variables are in addition to the regular CPU command, for ds support.
 var (
-	numCPUs = flag.Int("n", 1, "number CPUs to run on")
+	numCPUs   = cpuCount(1)
+	dsTimeout = flag.Duration("ds-timeout", ds.Timeout, "how long to wait for dnssd servers to answer")
+	dsRetries = flag.Int("ds-retries", 2, "if dnssd finds no cpus, ask again this many times, waiting longer each time")
+	hostList  = flag.String("hosts", "", "comma-separated list of hosts to run on; if set, all arguments are the command")
+	serial    = flag.Bool("serial", false, "run on CPUs one at a time, rather than in parallel")
+	failFast  = flag.Bool("fail-fast", false, "when a cpu fails, stop the commands on the others, with SIGTERM, and skip those not yet started")
+	minOK     = flag.Int("min-success", 0, "the run succeeds if at least this many cpus run the command with exit status 0; 0 for all of them")
+	dryRun    = flag.Bool("dry-run", false, "print what would be done, and check that keys and containers can be read, but do not connect")
+	noPrefix  = flag.Bool("no-prefix", false, "do not prefix output lines with the host name when running on more than one CPU")
+	noAgent   = flag.Bool("no-agent", false, "do not use ssh-agent, even if SSH_AUTH_SOCK is set")
+	noSignals = flag.Bool("no-forward-signals", false, "do not forward SIGINT, SIGTERM, SIGHUP, SIGQUIT, SIGUSR1, SIGUSR2 and SIGTSTP to the remote command; they act on sidecore itself")
+	termGrace = flag.Duration("term-grace", 5*time.Second, "after forwarding SIGTERM, wait this long for the remote command to exit before closing the connection and exiting 143; 0 to wait for as long as it takes")
+	password  = flag.Bool("pw", false, "if no key is accepted, ask for a password on the terminal; defaults to PasswordAuthentication in ~/.ssh/config")
+	compress  = flag.Bool("C", false, "compress the nfs stream, if cpud can; defaults to Compression in ~/.ssh/config")
+
+	connectTimeout = flag.Duration("connect-timeout", 30*time.Second, "give up on a cpu which can not be connected to in this time; 0 for no limit")
+	proxyFlag      = flag.String("proxy", "", "HTTP (CONNECT) or SOCKS5 proxy to reach cpus through, e.g. socks5://proxy:1080; default ALL_PROXY or HTTPS_PROXY")
+	reconnect      = flag.Int("reconnect", 0, "if the connection to a cpu is lost, try this many times to reconnect, and, each time, run the command again, from the start, as cpud can not resume it; 0 for none")
+	aliveInterval  = flag.Duration("alive-interval", 0, "send a keepalive this often, and give up on a cpu which does not answer; 0 for none; defaults to ServerAliveInterval in ~/.ssh/config")
+	aliveCount     = flag.Int("alive-count", 3, "keepalives which may go unanswered before a cpu is given up on; defaults to ServerAliveCountMax in ~/.ssh/config")
+	listFlag       = flag.Bool("list", false, "list the cpud servers found with dnssd, and their attributes, and exit; an argument, if any, is a dnssd: query")
+	jsonList       = flag.Bool("json", false, "with -list, print JSON")
+	watch          = flag.Bool("watch", false, "with -list, print servers as they come and go, until interrupted")
+	controlPath    = flag.String("control-path", "", "share one connection to a cpu between runs, through a control master listening on this socket; %h, %p, %r and %n are replaced as in ProxyCommand")
+	controlPersist = flag.Duration("control-persist", 10*time.Minute, "how long a control master lingers once its last session ends; 0 for as long as the cpu is there")
+	controlOp      = flag.String("O", "", "send a command to the control master: check, or exit")
+	controlMaster  = flag.Bool("control-master", false, "run as a control master; sidecore does this itself for -control-path")
 )
 
+func init() {
+	flag.Var(&numCPUs, "n", "number of CPUs a dnssd query runs on; 0, or all, for every one found")
+	flag.Var(&requirements, "requirements", "txt attributes, e.g. os=linux,cores>=16, which cpus found for the . host must have; may be repeated; arch here beats SIDECORE_ARCH")
+	flag.Var(&identities, "i", "identity (private key) file; may be repeated, and keys are tried in order")
+	flag.Var(&envVars, "env", "KEY=VALUE to set in the remote command's environment, or KEY, to send KEY's value here; may be repeated")
+}
+
+// stringList is a flag.Value for flags which may be repeated.
+type stringList []string
+
+// String implements flag.Value.
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set implements flag.Value.
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// cpuCount is a flag.Value for -n, which may be a number, or all,
+// which is 0.
+type cpuCount int
+
+// String implements flag.Value.
+func (n *cpuCount) String() string {
+	return strconv.Itoa(int(*n))
+}
+
+// Set implements flag.Value.
+func (n *cpuCount) Set(v string) error {
+	if v == "all" {
+		*n = 0
+		return nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return fmt.Errorf("%q is not a number of cpus, or all:%w", v, os.ErrInvalid)
+	}
+	*n = cpuCount(i)
+	return nil
+}
+
+// verbose prints debug messages, if the level is verbose,
+// or to the dump file, if there is one.
 func verbose(f string, a ...interface{}) {
+	if logLevel < levelVerbose && dumpWriter == nil {
+		return
+	}
 	v("CPU:"+f+"\r\n", a...)
 }
 
@@ -82,43 +238,100 @@ func envOrDefault(name, defaultName string) string {
 	return defaultName
 }
 
-func flags(arch string) ([]cpu, []string, error) {
+// isSet reports whether the flag name was given.
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// flags parses the flags and finds the cpus to run on. Hosts
+// which could not be found are returned as failed results.
+func flags(arch string) ([]cpu, []result, []string, error) {
 	flag.Parse()
+	if len(*archFlag) > 0 {
+		arch = *archFlag
+	}
+	// -version works even if the config file is broken.
+	if *showVersion {
+		fmt.Print(version())
+		os.Exit(0)
+	}
+	if err := setupLogging(*logFormat); err != nil {
+		return nil, nil, nil, err
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := setSSHConfigFile(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := cfg.setFlagDefaults(set); err != nil {
+		return nil, nil, nil, err
+	}
 	if *dump && *debug {
-		return nil, nil, fmt.Errorf("You can only set either dump OR debug")
+		return nil, nil, nil, fmt.Errorf("You can only set either dump OR debug")
+	}
+	logLevel = level(*quiet, *debug)
+	if logLevel < levelNormal {
+		nfs.Log.SetLevel(nfs.ErrorLevel)
 	}
-	if *debug {
+	if logLevel >= levelVerbose {
 		v = log.Printf
+		if jsonLog != nil {
+			v = jsonVerbose
+		}
 		client.SetVerbose(verbose)
 	}
 	if *dump {
 		var err error
 		dumpWriter, err = ioutil.TempFile("", "cpu")
 		if err != nil {
-			log.Fatal(err)
+			fatalf("%v", err)
 		}
-		log.Printf("Logging to %s", dumpWriter.Name())
+		info("Logging to %s", dumpWriter.Name())
+		fmt.Fprint(dumpWriter, version())
 		*dbg9p = true
 		ulog.Log = log.New(dumpWriter, "", log.Ltime|log.Lmicroseconds)
 		v = ulog.Log.Printf
 	}
+	if dsIfaces, err = dsInterfaces(); err != nil {
+		return nil, nil, nil, err
+	}
+	if queryType, err = dsServiceType(); err != nil {
+		return nil, nil, nil, err
+	}
 	args := flag.Args()
-	host := ds.Default
+	if *listFlag {
+		if err := listCPUs(os.Stdout, args); err != nil {
+			fatalf("-list: %v", err)
+		}
+		os.Exit(0)
+	}
+	hosts := []string{ds.Default}
 
 	a := []string{}
-	if len(args) > 0 {
-		host = args[0]
+	switch {
+	case *lastFlag:
+		hosts = []string{lastHost}
+		a = args
+	case len(*hostList) > 0:
+		hosts = splitHosts(*hostList)
+		a = args
+	case len(args) > 0:
+		hosts = splitHosts(args[0])
 		a = args[1:]
 	}
-	if host == "." {
-		host = fmt.Sprintf("%s&arch=%s", ds.Default, arch)
-		v("host specification is %q", host)
-	}
 
-	if len(a) == 0 {
-		if *numCPUs > 1 {
-			log.Fatal("Interactive access with more than one CPU is not supported (yet)")
-		}
+	interactive := len(a) == 0
+	if interactive {
 		shellEnv := os.Getenv("SHELL")
 		if len(shellEnv) > 0 {
 			a = []string{shellEnv}
@@ -127,54 +340,347 @@ func flags(arch string) ([]cpu, []string, error) {
 		}
 	}
 
-	// Try to parse it as a dnssd: path.
-	// If that fails, we will run as though
-	// it were just a host name.
-	dq, err := ds.Parse(host)
+	if len(hosts) == 0 {
+		return nil, nil, nil, fmt.Errorf("no hosts given:%w", os.ErrInvalid)
+	}
 
-	var cpus []cpu
+	if err := checkSelect(*selectFlag); err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := rankEnvNames(*rankEnv); err != nil {
+		return nil, nil, nil, err
+	}
+	if escape, err = escapeChar(*escapeFlag); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkStdin(); err != nil {
+		return nil, nil, nil, err
+	}
+	if sendEnvPats, err = sendEnvPatterns(); err != nil {
+		return nil, nil, nil, err
+	}
+	if *mountpoint, err = checkMountpoint(*mountpoint); err != nil {
+		return nil, nil, nil, err
+	}
+	if containerPath, err = checkContainer(*containerFlag); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkOverlay(*overlayFlag); err != nil {
+		return nil, nil, nil, err
+	}
+	if imageBase, err = imageBaseURL(); err != nil {
+		return nil, nil, nil, err
+	}
+	if nfsOptions, err = nfsFlagOptions(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkDir(*dirFlag); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkScript(*scriptFlag); err != nil {
+		return nil, nil, nil, err
+	}
+	if len(*fstabFlag) > 0 {
+		if set["namespace"] {
+			return nil, nil, nil, fmt.Errorf("-fstab and -namespace can not both be set:%w", os.ErrInvalid)
+		}
+		if customFSTab, err = readFSTab(*fstabFlag); err != nil {
+			return nil, nil, nil, err
+		}
+		if mountsNFS(customFSTab) && !*srvnfs {
+			return nil, nil, nil, fmt.Errorf("-fstab %s: there is no nfs server for %s with -nfs=false:%w", *fstabFlag, strings.Join(nfsPlaceholders, " and "), os.ErrInvalid)
+		}
+	}
+	if envSet, err = envValues(envVars, os.LookupEnv); err != nil {
+		return nil, nil, nil, err
+	}
+	if *canonicalMaxDots < 0 {
+		return nil, nil, nil, fmt.Errorf("-canonical-max-dots %d: want 0 or more:%w", *canonicalMaxDots, os.ErrInvalid)
+	}
+	pats, err := exclusions()
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	if err == nil {
-		c, err := ds.Lookup(dq, *numCPUs)
-		if err != nil {
-			log.Printf("%v", err)
+	reqs, err := parseRequirements(requirements)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := requiredArch(reqs); err != nil {
+		return nil, nil, nil, err
+	}
+
+	inv, err := loadInventory(*inventoryFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var (
+		cpus   []cpu
+		failed []result
+		// invs are the inventory entries of the cpus,
+		// which are applied after the config file.
+		invs []invHost
+	)
+	for _, host := range hosts {
+		user, host := splitUser(host)
+		members := []invHost{{host: host}}
+		if strings.HasPrefix(host, "@") {
+			if members, err = groupHosts(inv, host[1:], pats, set["n"]); err != nil {
+				failed = append(failed, result{host: host, status: exitFailure, err: err})
+				continue
+			}
+		}
+		for _, m := range members {
+			u, host := splitUser(m.host)
+			if len(u) == 0 {
+				u = user
+			}
+			if host == "." {
+				host = dotQuery(arch, reqs)
+				v("host specification is %q", host)
+			}
+			var c []cpu
+			if host == lastHost {
+				var l cpu
+				l, err = loadLast(pats)
+				c = []cpu{l}
+			} else {
+				c, err = lookupHost(host, pats)
+			}
+			if err != nil {
+				failed = append(failed, result{host: host, status: exitFailure, err: err})
+				continue
+			}
+			for _, c := range c {
+				c.user = u
+				// Names from dnssd are addresses, and vsock and
+				// unix hosts are not names at all.
+				if *canonicalize && !c.discovered && (len(*network) == 0 || *network == "tcp") {
+					c.host = canonicalHost(c.host, canonicalDomainList(c.host), *canonicalMaxDots)
+				}
+				cpus = append(cpus, c)
+				invs = append(invs, m)
+			}
+		}
+	}
+
+	if numCPUs == 0 {
+		info("running on all %d cpus found", len(cpus))
+	}
+
+	if interactive && len(cpus) > 1 {
+		return nil, nil, nil, fmt.Errorf("Interactive access with more than one CPU is not supported (yet):%w", os.ErrInvalid)
+	}
+	if *containerFlag == stdinContainer {
+		if interactive {
+			return nil, nil, nil, fmt.Errorf("-container - reads the container from stdin, so there is no interactive shell; give a command:%w", os.ErrInvalid)
+		}
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, nil, nil, fmt.Errorf("-container -: stdin is a terminal; pipe the container in:%w", os.ErrInvalid)
+		}
+	}
+
+	for i := range cpus {
+		cfg.apply(&cpus[i], set)
+		invs[i].apply(&cpus[i], set)
+		cpus[i].password = *password
+		if !set["pw"] {
+			cpus[i].password = sshConfig.Get(cpus[i].host, "PasswordAuthentication") == "yes"
+		}
+		cpus[i].compress = *compress
+		if !set["C"] {
+			cpus[i].compress = sshConfig.Get(cpus[i].host, "Compression") == "yes"
+		}
+		interval, count := aliveConfig(cpus[i].host)
+		cpus[i].aliveInterval, cpus[i].aliveCount = *aliveInterval, *aliveCount
+		if !set["alive-interval"] {
+			cpus[i].aliveInterval = interval
+		}
+		if !set["alive-count"] {
+			cpus[i].aliveCount = count
 		}
-		for _, e := range c {
-			cpus = append(cpus, cpu{host: e.Entry.IPs[0].String(), port: strconv.Itoa(e.Entry.Port)})
+	}
+
+	return cpus, failed, a, nil
+
+}
+
+// splitHosts splits a comma-separated list of hosts.
+// A dnssd: query containing a comma must escape it as %2C;
+// ds.Parse unescapes it.
+func splitHosts(l string) []string {
+	var hosts []string
+	for _, h := range strings.Split(l, ",") {
+		if len(h) > 0 {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// splitUser splits a leading user@ from a host.
+// The @ must come before any : or /, so that
+// an @ inside a dnssd: query is not taken as a user.
+func splitUser(host string) (string, string) {
+	i := strings.Index(host, "@")
+	// A leading @ is an inventory group.
+	if i < 1 || strings.ContainsAny(host[:i], ":/?") {
+		return "", host
+	}
+	return host[:i], host[i+1:]
+}
+
+// lookupHost returns the cpus for a host.
+// A srv: host is looked up in DNS SRV records.
+// Try to parse it as a dnssd: path, in which case
+// up to numCPUs cpus, or, if it is 0, all of them, are returned,
+// chosen as -select says.
+// If that fails, we will run as though
+// it were just a host name.
+// Hosts, and cpus found, which pats exclude are not returned.
+// It is an error if a dnssd: path finds no cpus.
+func lookupHost(host string, pats []string) ([]cpu, error) {
+	var c []*ds.LookupResult
+	if name, ok := strings.CutPrefix(host, "srv:"); ok {
+		var err error
+		if c, err = lookupSRV(name); err != nil {
+			return nil, err
 		}
 	} else {
-		cpus = append(cpus, cpu{host: host, port: *port})
+		dq, err := ds.Parse(withType(host, queryType))
+		if err != nil {
+			if p, ok := excluded(pats, host); ok {
+				return nil, fmt.Errorf("%s is excluded by %q:%w", host, p, os.ErrInvalid)
+			}
+			return []cpu{{host: host, port: *port}}, nil
+		}
+		dq.Interfaces = dsIfaces
+		// Find them all, so that -select can choose among them.
+		if c, err = lookupDS(dq, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	var cpus []cpu
+	if c = excludeCPUs(c, pats); len(c) == 0 {
+		return nil, fmt.Errorf("%s: every cpu found is excluded:%w", host, os.ErrNotExist)
 	}
+	if !*allowDuplicate {
+		c = dedupeCPUs(c)
+	}
+	if c = dialable(c); len(c) == 0 {
+		return nil, fmt.Errorf("%s: no cpu found has an address which can be dialed:%w", host, os.ErrNotExist)
+	}
+	c = selectCPUs(c, int(numCPUs), *selectFlag, host)
+	for _, e := range c {
+		// cpus in SRV records are known by name, and
+		// may be far away.
+		addrs := entryAddrs(e.Entry)
+		if len(addrs) == 0 {
+			cpus = append(cpus, cpu{host: e.Entry.Name, port: strconv.Itoa(e.Entry.Port)})
+			continue
+		}
+		cpus = append(cpus, cpu{host: addrs[0], addrs: addrs, port: strconv.Itoa(e.Entry.Port), discovered: true, txtArch: e.Entry.Text["arch"]})
+	}
+	return cpus, nil
+}
+
+// dsLookup finds cpus with dnssd. Tests replace it.
+var dsLookup = ds.LookupTimeout
 
-	return cpus, a, nil
+// dsBackoff is how long to wait before asking dnssd again, the
+// first time no cpu is found. It doubles with each try.
+var dsBackoff = 250 * time.Millisecond
 
+// lookupDS finds up to n cpus, or all of them, if n is 0, for a
+// dnssd query, waiting -ds-timeout for them to answer. If none are
+// found, it asks again, up to -ds-retries times, since mDNS
+// responders can be slow to wake up.
+func lookupDS(dq ds.Query, n int) ([]*ds.LookupResult, error) {
+	wait := dsBackoff
+	for try := 0; ; try++ {
+		c, err := dsLookup(dq, n, *dsTimeout)
+		if err == nil || try >= *dsRetries || !errors.Is(err, os.ErrNotExist) {
+			return c, err
+		}
+		verbose("%v; asking again in %v", err, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
 }
 
-// getKeyFile picks a keyfile if none has been set.
-// It will use sshconfig, else use a default.
-func getKeyFile(host, kf string) string {
-	verbose("getKeyFile for %q", kf)
-	if len(kf) == 0 {
-		kf = config.Get(host, "IdentityFile")
-		verbose("key file from config is %q", kf)
-		if len(kf) == 0 {
-			kf = defaultKeyFile
+// getKeyFile returns the key files to try, in order.
+// If no candidates are given, it will use sshconfig, else use a default.
+// port is only used for %p in the IdentityFiles in sshconfig.
+func getKeyFile(host, port string, kfs []string) ([]string, error) {
+	verbose("getKeyFile for %q", kfs)
+	if len(kfs) == 0 {
+		var err error
+		if kfs, err = configKeyFiles(host, port); err != nil {
+			return nil, err
+		}
+		if len(kfs) == 0 {
+			kfs = []string{defaultKeyFile}
 		}
 	}
-	// The kf will always be non-zero at this point.
-	if strings.HasPrefix(kf, "~") {
-		kf = filepath.Join(os.Getenv("HOME"), kf[1:])
+	var files []string
+	for _, kf := range kfs {
+		// this is a tad annoying, but the config package doesn't handle ~.
+		if strings.HasPrefix(kf, "~") {
+			kf = filepath.Join(os.Getenv("HOME"), kf[1:])
+		}
+		files = append(files, kf)
+	}
+	verbose("getKeyFile returns %q", files)
+	return files, nil
+}
+
+// configKeyFiles returns the IdentityFiles for a host from
+// sshconfig, if any are set, with their % tokens expanded.
+func configKeyFiles(host, port string) ([]string, error) {
+	kfs := sshConfig.GetAll(host, "IdentityFile")
+	verbose("key files from config are %q", kfs)
+	// The config package returns its own default if there
+	// is no IdentityFile; we have a better one.
+	if len(kfs) == 1 && kfs[0] == config.Default("IdentityFile") {
+		return nil, nil
+	}
+	var files []string
+	for _, kf := range kfs {
+		f, err := expandTokens(kf, sshTokens(host, port))
+		if err != nil {
+			return nil, fmt.Errorf("%s: IdentityFile %w", host, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// certFiles returns the CertificateFiles for a host from
+// sshconfig, if any are set.
+func certFiles(host string) []string {
+	var files []string
+	for _, f := range sshConfig.GetAll(host, "CertificateFile") {
+		if strings.HasPrefix(f, "~") {
+			f = filepath.Join(os.Getenv("HOME"), f[1:])
+		}
+		files = append(files, f)
 	}
-	verbose("getKeyFile returns %q", kf)
-	// this is a tad annoying, but the config package doesn't handle ~.
-	return kf
+	verbose("certificate files from config are %q", files)
+	return files
 }
 
 // getHostName reads the host name from the config file,
-// if needed. If it is not found, the host name is returned.
-func getHostName(host string) (string, error) {
-	h := config.Get(host, "HostName")
+// if needed, with its % tokens expanded. If it is not found,
+// the host name is returned. port is only used for %p.
+func getHostName(host, port string) (string, error) {
+	h := sshConfig.Get(host, "HostName")
 	if len(h) != 0 {
+		var err error
+		if h, err = expandTokens(h, sshTokens(host, port)); err != nil {
+			return "", fmt.Errorf("%s: HostName %w", host, err)
+		}
 		host = h
 	}
 	if !net.ParseIP(host).IsLinkLocalUnicast() {
@@ -187,16 +693,35 @@ func getHostName(host string) (string, error) {
 	return fmt.Sprintf("%s%%%s", host, iface), nil
 }
 
-// getPort gets a port.
-// The rules here are messy, since config.Get will return "22" if
+// getUser gets the user to log in as from the config file.
+// If it is not set, the current user is returned.
+func getUser(host string) string {
+	if u := sshConfig.Get(host, "User"); len(u) != 0 {
+		verbose("sshConfig.Get(%q, \"User\"): %q", host, u)
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		// On Windows, the name is DOMAIN\user.
+		n := u.Username
+		return n[strings.LastIndex(n, `\`)+1:]
+	}
+	return os.Getenv("USER")
+}
+
+// getPort gets a port: port, from -sp, if set, else SIDECORE_PORT,
+// else the one in .ssh/config.
+// The rules here are messy, since sshConfig.Get will return "22" if
 // there is no entry in .ssh/config. 22 is not allowed. So in the case
 // of "22", convert to defaultPort
 func getPort(host, port string) string {
 	p := port
 	verbose("getPort(%q, %q)", host, port)
-	if len(port) == 0 {
-		if cp := config.Get(host, "Port"); len(cp) != 0 {
-			verbose("config.Get(%q,%q): %q", host, port, cp)
+	if len(p) == 0 {
+		p = os.Getenv("SIDECORE_PORT")
+	}
+	if len(p) == 0 {
+		if cp := sshConfig.Get(host, "Port"); len(cp) != 0 {
+			verbose("sshConfig.Get(%q,%q): %q", host, port, cp)
 			p = cp
 		}
 	}
@@ -208,101 +733,417 @@ func getPort(host, port string) string {
 	return p
 }
 
-func newCPU(srv p9.Attacher, wg sync.WaitGroup, container string, cpu *cpu, args ...string) (retErr error) {
-	// note that 9P is enabled if namespace is not empty OR if ninep is true
-	c := client.Command(cpu.host, args...)
-	defer func() {
-		verbose("close")
-		if err := c.Close(); err != nil && retErr == nil {
-			retErr = fmt.Errorf("Close: %v", err)
+// exitFailure is the exit status used when sidecore itself,
+// rather than the remote command, fails, e.g. when a host can not
+// be reached. It is the same as ssh uses.
+const exitFailure = 255
+
+// signals maps ssh signal names to Linux signal numbers,
+// so that a command killed by a signal can be reported as
+// 128+signum, as shells and ssh do.
+var signals = map[ossh.Signal]int{
+	ossh.SIGHUP:  1,
+	ossh.SIGINT:  2,
+	ossh.SIGQUIT: 3,
+	ossh.SIGILL:  4,
+	ossh.SIGABRT: 6,
+	ossh.SIGFPE:  8,
+	ossh.SIGKILL: 9,
+	ossh.SIGUSR1: 10,
+	ossh.SIGSEGV: 11,
+	ossh.SIGUSR2: 12,
+	ossh.SIGPIPE: 13,
+	ossh.SIGALRM: 14,
+	ossh.SIGTERM: 15,
+}
+
+// result is the outcome of running a command on a cpu.
+type result struct {
+	host   string
+	port   string
+	status int
+	err    error
+	// skipped is set for a cpu which was not run, since,
+	// with -fail-fast, another had failed.
+	skipped bool
+}
+
+// errSkipped is the error for a cpu which was skipped.
+var errSkipped = errors.New("skipped, since another cpu failed, and -fail-fast is set")
+
+// errTerminated is the error for a cpu whose command was given up on
+// after sidecore was sent SIGTERM. Its exit status is 143, as if the
+// command had been killed by the SIGTERM.
+var errTerminated = errors.New("terminated")
+
+// exitStatus converts an error from running a command
+// to an exit status.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, errTimedOut) {
+		return 124
+	}
+	if errors.Is(err, errTerminated) {
+		return 128 + signals[ossh.SIGTERM]
+	}
+	sshErr := &ossh.ExitError{}
+	if !errors.As(err, &sshErr) {
+		return exitFailure
+	}
+	if sig := sshErr.Signal(); len(sig) > 0 {
+		if n, ok := signals[ossh.Signal(sig)]; ok {
+			return 128 + n
 		}
-		verbose("close done")
-	}()
+		return exitFailure
+	}
+	return sshErr.ExitStatus()
+}
 
-	c.Env = os.Environ()
-	if len(*env) > 0 {
-		c.Env = append(c.Env, strings.Split(*env, ";")...)
+// newCPU runs a command on a cpu, and returns the result.
+func newCPU(srv p9.Attacher, wg *sync.WaitGroup, container string, cpu *cpu, args ...string) result {
+	if *maxTime > 0 {
+		cpu.deadline = time.Now().Add(*maxTime)
+	}
+	run := func() error { return runCPU(srv, wg, container, cpu, args...) }
+	if *reconnect <= 0 {
+		err := run()
+		return result{host: cpu.host, port: cpu.port, status: exitStatus(err), err: err}
 	}
+	// ^C stops reconnecting; while the command runs, runCPU
+	// forwards it.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	defer signal.Stop(sigChan)
+	err := restartLost(cpu.host+":"+cpu.port, *reconnect, sigChan, run, func() error {
+		a := dialAgent()
+		defer a.Close()
+		rc, err := newClient(srv, a, cpu, args...)
+		if err != nil {
+			return err
+		}
+		if err := dial(rc, cpu); err != nil {
+			return err
+		}
+		return rc.Client().Close()
+	})
+	return result{host: cpu.host, port: cpu.port, status: exitStatus(err), err: err}
+}
 
-	client.Debug9p = *dbg9p
+// newClient returns a client for a cpu, set up, but not connected.
+// The agent must not be closed until the client has connected.
+func newClient(srv p9.Attacher, a *sshAgent, cpu *cpu, args ...string) (*client.Cmd, error) {
+	// note that 9P is enabled if namespace is not empty OR if ninep is true
+	c := client.Command(cpu.host, args...)
+
+	hostkey, keys, network := cpu.hostkey, withKeys(a, cpu.keyfiles, cpu.certs), *network
+	// The control master only lets its owner in, so it needs no
+	// keys. ssh tries no authentication first, which the master
+	// accepts, but with no methods the client reads a key file.
+	// The master is reached with a dialer, which is only used
+	// for tcp.
+	if len(cpu.control) > 0 && !*controlMaster {
+		hostkey, keys, network = controlKeyFile(cpu.control), client.WithAuth(ossh.PublicKeys()), "tcp"
+	}
+	hk, err := hostKeyCallback(hostkey)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := c.SetOptions(
-		client.WithPrivateKeyFile(cpu.keyfile),
-		client.WithHostKeyFile(cpu.hostkey),
+		client.WithUser(cpu.user),
+		keys,
+		client.WithHostKeyFile(hostkey),
+		client.WithHostKeyCallback(hk),
 		client.WithPort(cpu.port),
 		client.WithRoot(*root),
 		client.With9P(*ninep),
-		client.WithNetwork(*network),
+		client.WithNetwork(network),
 		client.WithServer(srv),
-		client.WithTimeout(*timeout9P)); err != nil {
-		log.Fatal(err)
+		client.WithTimeout(*timeout9P),
+		client.WithConnectTimeout(dialTime(cpu)),
+		client.WithEscape(escape),
+		client.WithSuspend(suspendSelf)); err != nil {
+		return nil, fmt.Errorf("SetOptions: %w", err)
 	}
 
 	c.FSTab = cpu.fstab
 
+	if len(cpu.control) > 0 && !*controlMaster {
+		return c, c.SetOptions(client.WithDialer(func(string, string) (net.Conn, error) {
+			return net.Dial("unix", cpu.control)
+		}))
+	}
+
+	// Passwords are typed, so there must be someone to type them.
+	if cpu.password && term.IsTerminal(int(os.Stdin.Fd())) {
+		if err := c.SetOptions(withPassword(cpu.user, cpu.host)); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case len(cpu.jumps) > 0 || len(cpu.proxyCommand) > 0 || cpu.proxy != nil:
+		if err := c.SetOptions(client.WithDialer(func(string, string) (net.Conn, error) {
+			return dialTimeout(dialTime(cpu), func() (net.Conn, error) { return dialProxy(cpu) })
+		})); err != nil {
+			return nil, err
+		}
+	case len(cpu.addrs) > 1:
+		if err := c.SetOptions(client.WithDialer(func(string, string) (net.Conn, error) {
+			return dialTimeout(dialTime(cpu), func() (net.Conn, error) { return dialAddrs(cpu.addrs, cpu.port) })
+		})); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// dial connects a client to a cpu.
+func dial(c *client.Cmd, cpu *cpu) error {
 	if err := c.Dial(); err != nil {
+		phase(cpu, "dial", err)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return fmt.Errorf("Dial: %v:%w", err, errConnectTimeout)
+		}
 		return fmt.Errorf("Dial: %v", err)
 	}
+	phase(cpu, "dial", nil)
+	return nil
+}
+
+func runCPU(srv p9.Attacher, wg *sync.WaitGroup, container string, cpu *cpu, args ...string) (retErr error) {
+	// The agent signs during Dial, so it is kept
+	// open until runCPU returns.
+	a := dialAgent()
+	defer a.Close()
+
+	c, err := newClient(srv, a, cpu, args...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		verbose("close")
+		if err := c.Close(); err != nil && retErr == nil {
+			retErr = fmt.Errorf("Close: %v", err)
+		}
+		verbose("close done")
+	}()
+
+	if len(cpu.prefix) > 0 {
+		stdout := newPrefixWriter(os.Stdout, cpu.prefix)
+		defer stdout.Close()
+		stderr := newPrefixWriter(os.Stderr, errPrefix(cpu.prefix))
+		defer stderr.Close()
+		c.Stdout, c.Stderr = stdout, stderr
+	}
+	in, err := cpuStdin(cpu)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		defer in.Close()
+		c.Stdin = in
+	}
+
+	c.Env = sendEnv(os.Environ(), sendEnvPats)
+	c.Env = append(c.Env, "SIDECORE_MOUNTPOINT="+*mountpoint)
+	// cpud runs the command in $PWD, so it is always sent.
+	var cwd string
+	if *dirFlag == dirAuto {
+		if cwd, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	dir, err := remoteDir(*dirFlag, cwd, cpu.home)
+	if err != nil {
+		return err
+	}
+	if len(dir) > 0 {
+		verbose("dir: %s", dir)
+		c.Env = append(c.Env, "PWD="+dir)
+	} else if pwd, ok := os.LookupEnv("PWD"); ok {
+		c.Env = append(c.Env, "PWD="+pwd)
+	}
+	if len(*env) > 0 {
+		c.Env = append(c.Env, strings.Split(*env, ";")...)
+	}
+	c.Env = append(c.Env, cpu.env...)
+	c.Env = append(c.Env, envSet...)
 
+	if err := dial(c, cpu); err != nil {
+		if timedOut(cpu) {
+			return &maxTimeError{phase: "dial", err: err}
+		}
+		return err
+	}
+	// The container served is for the cpu's arch.
+	if *srvnfs && len(cpu.control) == 0 && len(cpu.arch) > 0 {
+		container = checkArch(c, cpu)
+		if err := fetchContainer(cpu); err != nil {
+			return fmt.Errorf("Can not download container: %w", err)
+		}
+	}
+	saveLast(cpu)
+
+	// Each cpu registers its own channel. The signal package
+	// delivers to every registered channel, so one ^C is
+	// forwarded to all the remote commands.
 	sigChan := make(chan os.Signal, 1)
 	defer close(sigChan)
 	notify(sigChan)
 	defer signal.Stop(sigChan)
+	forwarding.Add(1)
+	defer forwarding.Add(-1)
+	// errChan is not closed: if the connection is lost,
+	// runCPU returns before the command's goroutine sends.
 	errChan := make(chan error, 1)
-	defer close(errChan)
 
-	if *srvnfs {
-		f, fstab, err := srvNFS(c, container, cpu.home)
+	// If the cpu stops answering, the connection is closed, which
+	// ends the session, and the nfs server, once its listener
+	// is closed, below.
+	done := make(chan struct{})
+	defer close(done)
+	lost := keepAlive(c.Client(), cpu.aliveInterval, cpu.aliveCount, done)
+
+	// A control master has its own nfs server.
+	var export *nfsExport
+	if *srvnfs && len(cpu.control) == 0 {
+		f, l, nfs, err := srvNFS(c, container, cpu.home, cpu.compress)
+		err = searchError(err, cpu.imageDirs)
+		phase(cpu, "mount", err)
 		if err != nil {
 			return err
 		}
+		// Closing the listener stops the server.
+		defer l.Close()
 		wg.Add(1)
 		go func() {
 			err := f()
-			log.Printf("nfs: %v", err)
+			info("nfs: %v", err)
 			wg.Done()
 		}()
-		var oldenv string
-		for _, r := range c.Env {
-			if !strings.HasPrefix(r, "CPU_FSTAB=") {
-				continue
-			}
-			s := strings.SplitN(r, "=", 2)
-			if len(s) == 2 {
-				oldenv = s[1]
-			}
-			break
-		}
-
-		c.Env = append(c.Env, "CPU_FSTAB="+fstab+oldenv)
+		export = nfs
+	}
+	// The namespace's fstab, and any CPU_FSTAB from here, are
+	// merged with the nfs server's, and sent as one.
+	c.Env = setFSTab(c.Env, export)
+	if timedOut(cpu) {
+		return &maxTimeError{phase: "mount"}
 	}
 
+	// The command can only be stopped once it has started.
+	started := make(chan struct{})
 	go func() {
-		verbose("start")
-		if err := c.Start(); err != nil {
+		// The pty starts at the terminal's size now,
+		// not when the client was made.
+		if cols, rows, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
+			c.Row, c.Col = rows, cols
+		}
+		verbose("start, sending %s", envNames(c.Env))
+		err := c.Start()
+		phase(cpu, "start", err)
+		if err != nil {
 			errChan <- fmt.Errorf("Start: %v", err)
 			return
 		}
+		close(started)
 		verbose("wait")
-		errChan <- c.Wait()
+		err = c.Wait()
+		phase(cpu, "wait", err)
+		errChan <- err
 	}()
 
-	var err error
+	var (
+		stop     <-chan struct{}
+		grace    <-chan time.Time
+		deadline <-chan time.Time
+		// expired is set once -max-time has sent SIGTERM.
+		expired bool
+	)
+	if !cpu.deadline.IsZero() {
+		t := time.NewTimer(time.Until(cpu.deadline))
+		defer t.Stop()
+		deadline = t.C
+	}
+	defer removeJob(c)
 loop:
 	for {
 		select {
+		case <-started:
+			started, stop = nil, cpu.stop
+			go watchWindow(c, done)
+			addJob(c)
+		case <-deadline:
+			if started != nil {
+				return &maxTimeError{phase: "start"}
+			}
+			expired = true
+			if err := sigerrors(c, sigTerm); err != nil {
+				verbose("timing out %q: %v", c.Args[0], err)
+			}
+			if *killAfter == 0 {
+				err = &maxTimeError{phase: "run"}
+				break loop
+			}
+			grace = time.After(*killAfter)
+		case <-stop:
+			// Only once: stop stays closed.
+			stop = nil
+			if err := sigerrors(c, sigTerm); err != nil {
+				verbose("stopping %q: %v", c.Args[0], err)
+			}
 		case sig := <-sigChan:
+			// There is no pty to resize until the
+			// command starts, and it starts at the
+			// terminal's size.
+			if started != nil && sig == sigWinch {
+				continue
+			}
+			// There is nothing to signal yet, so
+			// stopping sidecore stops the run.
+			if started != nil {
+				switch sig {
+				case sigTerm:
+					return fmt.Errorf("%v before %q started:%w", sig, c.Args[0], errTerminated)
+				case os.Interrupt:
+					return fmt.Errorf("%v before %q started", sig, c.Args[0])
+				}
+				verbose("%v before %q started; dropping it", sig, c.Args[0])
+				continue
+			}
 			sigErr := sigerrors(c, sig)
 			if sigErr != nil {
 				verbose("sending %v to %q: %v", sig, c.Args[0], sigErr)
 			} else {
 				verbose("signal %v sent to %q", sig, c.Args[0])
 			}
+			if sig == sigTerm && grace == nil && *termGrace > 0 {
+				grace = time.After(*termGrace)
+			}
+		case <-grace:
+			if expired {
+				err = &maxTimeError{phase: "run", err: fmt.Errorf("%q did not exit %v after SIGTERM", c.Args[0], *killAfter)}
+				break loop
+			}
+			err = fmt.Errorf("%q did not exit %v after SIGTERM:%w", c.Args[0], *termGrace, errTerminated)
+			break loop
 		case err = <-errChan:
 			break loop
+		case err = <-lost:
+			phase(cpu, "keepalive", err)
+			break loop
 		}
 	}
 
+	// The command's own exit, after SIGTERM, is still a timeout.
+	var te *maxTimeError
+	if expired && !errors.As(err, &te) {
+		return &maxTimeError{phase: "run", err: err}
+	}
+
 	return err
 }
 
@@ -311,14 +1152,39 @@ func usage(err error) {
 	flag.CommandLine.SetOutput(&b)
 	flag.PrintDefaults()
 	b.WriteString(`environment variables:
-SIDECORE_ARCH -- architecture to run on. There are Go names: riscv64, amd64, and so on -- default runtime.GOOS
+SIDECORE_ARCH -- architecture to run on. There are Go names: riscv64, amd64, and so on -- default the cpu's own, found once it is dialed; -arch overrides it
 SIDECORE_DISTRO -- which distro to use -- ubuntu, alpin, etc. -- default "ubuntu"
 SIDECORE_VERSION -- which version of the distro to use -- default "latest"
-SIDECORE_IMAGES -- where the flattened cpio images are kept -- default ~/sidecore-images
-SIDECORE_KEYFILE -- key file, e.g. ~/.ssh/cpu_rsa -- default "", since it can be looked up in ~/.ssh/config for non-mDNS cases
+SIDECORE_IMAGES -- where the flattened cpio images are kept; a list of directories, separated as in PATH, searched in order -- default ~/sidecore-images
+SIDECORE_IMAGE_URL -- base URL, http or https, to download containers missing from SIDECORE_IMAGES from -- default "", not to download them; -image-url overrides it
+SIDECORE_IMAGE_SHA256 -- sha256 every container must have, rather than the one in its .sha256 file -- default ""; -insecure-no-verify uses one which does not match
+SIDECORE_KEYFILE -- key file, e.g. ~/.ssh/cpu_rsa -- default "", since it can be looked up in ~/.ssh/config for non-mDNS cases; -i overrides it
 SIDECORE_HOSTKEYFILE -- host key file, it can be empty. -- default ""
+SIDECORE_NAMESPACE -- namespace for the remote process, as -namespace takes it, e.g. /usr:ro;/home, or none -- default /lib;/lib64;/usr;/bin;/etc;$HOME; -namespace overrides it
+SIDECORE_SSH_CONFIG -- ssh_config file to use instead of ~/.ssh/config; -ssh-config overrides it
+SIDECORE_PORT -- cpu port, if -sp is not set; .ssh/config Port is used if it is empty -- default 17010
+SSH_AUTH_SOCK -- ssh-agent socket; its keys are tried before key files, unless -no-agent is set
+ALL_PROXY, HTTPS_PROXY -- HTTP (CONNECT) or SOCKS5 proxy for cpus named by host, unless NO_PROXY names them; -proxy overrides them
+SIDECORE_EXCLUDE -- comma-separated hosts, IPs, CIDRs or glob patterns never to run on; -exclude adds to them
+SIDECORE_IFACE -- interface for IPv6 link-local addresses; comma-separated, the interfaces to take dnssd answers from; -ds-iface overrides it
+SIDECORE_DS_TYPE -- dnssd service type, e.g. _cpu-dev._tcp, for queries which do not name one -- default _ncpu._tcp; -ds-type overrides it
+
+hosts:
+host may be a comma-separated list of hosts, dnssd: queries,
+and srv:domain, for cpus in DNS SRV records.
+A comma inside a dnssd: query must be written as %2C,
+e.g. dnssd://?arch=amd64%2Carm64.
+@group is the hosts of a group in the inventory, by default
+` + defaultInventoryFile() + `, or named with -inventory;
+see inventory.go.
+- is the last cpu dialed, as is no host at all, with -last.
+
+config file:
+Defaults for flags, and per-host settings, can be kept in a config
+file, by default ` + defaultConfigFile() + `, or named with -F.
+The format is similar to ssh_config; see config.go.
 `)
-	log.Fatalf("%v:Usage: sidecore [options] host [shell command]:\n%v", err, b.String())
+	fatalf("%v:Usage: sidecore [options] host[,host...] [shell command]\n       sidecore [options] -hosts host[,host...] [shell command]\n       sidecore version:\n%v", err, b.String())
 }
 
 // Windows breaks all the rules, so we generate a
@@ -326,18 +1192,210 @@ SIDECORE_HOSTKEYFILE -- host key file, it can be empty. -- default ""
 // If we ever run cpud on windows, we'll need to write code to translate
 // unix-style fstab to windows paths, but that is for another time.
 // Nobody seems to care about windows cpud servers yet.
+// A namespace of none, or "", is no mounts. An entry may end in
+// mount options, e.g. /usr:ro, which are added to those of its mount.
 func namespaceToFSTab(ns string) string {
+	if ns == "none" {
+		return ""
+	}
 	fstab := ""
 	for _, ent := range strings.Split(ns, ";") {
+		ent, opts := namespaceOptions(ent)
 		if len(ent) == 0 {
-			break
+			continue
 		}
-		fstab += fmt.Sprintf("%s %s none defaults,bind 0 0\n", path.Join("/tmp/cpu", ent), ent)
+		fstab += fmt.Sprintf("%s %s none defaults,bind%s 0 0\n", path.Join(*mountpoint, ent), ent, opts)
 	}
 	return fstab
 }
 
+// resolveNamespace returns the namespace to use: ns, from -namespace,
+// if set is true, else SIDECORE_NAMESPACE, if lookup finds it, else
+// ns, the default. It is a namespace, with none and mount options, as
+// -namespace is; an empty SIDECORE_NAMESPACE is no mounts.
+func resolveNamespace(ns string, set bool, lookup func(string) (string, bool)) string {
+	if set {
+		return ns
+	}
+	if v, ok := lookup("SIDECORE_NAMESPACE"); ok {
+		verbose("namespace from SIDECORE_NAMESPACE: %q", v)
+		return v
+	}
+	return ns
+}
+
+// namespaceMountOptions are the mount options a namespace entry may
+// have, after a :.
+var namespaceMountOptions = map[string]bool{"ro": true, "rw": true, "nosuid": true, "nodev": true, "noexec": true}
+
+// namespaceOptions splits a namespace entry, e.g. /usr:ro,nosuid, into
+// its path, and its mount options, as ",ro,nosuid". An entry whose
+// last : is not followed by mount options is all path, since paths
+// may have a : in them.
+func namespaceOptions(ent string) (string, string) {
+	i := strings.LastIndex(ent, ":")
+	if i < 0 {
+		return ent, ""
+	}
+	opts := strings.Split(ent[i+1:], ",")
+	for _, o := range opts {
+		if !namespaceMountOptions[o] {
+			return ent, ""
+		}
+	}
+	return ent[:i], "," + strings.Join(opts, ",")
+}
+
+// findContainer returns the path of a container. Names which
+// are not absolute are looked for in SIDECORE_IMAGES. A dir:
+// container stays one.
+func findContainer(container string) string {
+	p, _ := searchContainer(container)
+	return p
+}
+
+// imageDirs returns the directories of SIDECORE_IMAGES, a list, as
+// PATH is, or, if it is not set, ~/sidecore-images.
+func imageDirs() []string {
+	cdirs, ok := os.LookupEnv("SIDECORE_IMAGES")
+	if !ok {
+		return []string{filepath.Join(os.Getenv("HOME"), "sidecore-images")}
+	}
+	var dirs []string
+	for _, d := range filepath.SplitList(cdirs) {
+		if len(d) > 0 {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// searchContainer returns the path of a container, and, for a name,
+// the directories it was looked for in. A name is in the first of
+// the directories of SIDECORE_IMAGES which has it; if none does, or
+// they do not exist, it is in the first.
+func searchContainer(container string) (string, []string) {
+	if container == noContainer {
+		return container, nil
+	}
+	if strings.Contains(container, layerSeparator) {
+		var layers, dirs []string
+		for _, l := range containerLayers(container) {
+			p, d := searchContainer(l)
+			layers = append(layers, p)
+			if d != nil {
+				dirs = d
+			}
+		}
+		return strings.Join(layers, layerSeparator), dirs
+	}
+	if d, ok := dirContainer(container); ok {
+		p, dirs := searchContainer(d)
+		return dirPrefix + p, dirs
+	}
+	if strings.HasPrefix(container, "~") {
+		container = filepath.Join(os.Getenv("HOME"), container[1:])
+	}
+	if filepath.IsAbs(container) {
+		return container, nil
+	}
+	// Find the flattened container to use
+	dirs := imageDirs()
+	if len(dirs) == 0 {
+		return container, nil
+	}
+	for _, d := range dirs {
+		p := filepath.Join(d, container)
+		if _, err := os.Stat(p); err == nil {
+			return p, dirs
+		}
+	}
+	return filepath.Join(dirs[0], container), dirs
+}
+
+// searchError adds, to a container not being found, the directories
+// it was looked for in.
+func searchError(err error, dirs []string) error {
+	if err == nil || len(dirs) < 2 || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return fmt.Errorf("%w; SIDECORE_IMAGES is %s, and none of them has it", err, strings.Join(dirs, string(filepath.ListSeparator)))
+}
+
+// newServer creates a 9p server which is a union of the local
+// file system, fs, bound at h, and the container. There is no 9p
+// server for a dir: container, which is only served with nfs. For
+// -container none, fs is all there is.
+func newServer(container string, fs p9.File, h string) (p9.Attacher, error) {
+	if container == noContainer {
+		u, err := client.NewUnion9P([]client.UnionMount{client.NewUnionMount([]string{}, fs)})
+		if err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+	if d, ok := dirContainer(container); ok {
+		if *ninep {
+			return nil, fmt.Errorf("%s: -9p can not serve a directory container; it is served with nfs:%w", container, os.ErrInvalid)
+		}
+		_, err := NewfsDir(d)
+		return nil, err
+	}
+	layers := containerLayers(container)
+	for _, l := range layers {
+		if _, err := os.Stat(l); err != nil {
+			return nil, err
+		}
+	}
+	if err := useContainer(container); err != nil {
+		return nil, err
+	}
+
+	// create 9p servers for the cpio and /. Layers are
+	// merged into one, and a tar is read as a cpio.
+	_, recs, err := readLayers(container)
+	if err != nil {
+		return nil, err
+	}
+	cpiofs, err := client.NewCPIO9PRecords(recs).Attach()
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := client.NewUnion9P([]client.UnionMount{
+		client.NewUnionMount([]string{h}, fs),
+		client.NewUnionMount([]string{}, cpiofs),
+	})
+	verbose("u is %v", u)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// commands are the sidecore subcommands. A subcommand is
+// selected if it is the first argument.
+var commands = map[string]func(args []string) error{
+	"build":   buildCommand,
+	"cat":     catCommand,
+	"extract": extractCommand,
+	"images":  imagesCommand,
+	"ls":      lsCommand,
+	"version": func([]string) error {
+		fmt.Print(version())
+		return nil
+	},
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if c, ok := commands[os.Args[1]]; ok {
+			if err := c(os.Args[2:]); err != nil {
+				fatalf("%v", err)
+			}
+			return
+		}
+	}
 	root := "/"
 	home := filepath.Dir(os.Getenv("HOME"))
 	verbose("GOOS is %v, home %v", runtime.GOOS, home)
@@ -361,94 +1419,356 @@ func main() {
 	verbose("h %v", h)
 
 	// Because Windows paths contain :, we can't use that as the separator any more. I am pretty sure ; is safe. The horror.
-	var namespace = flag.String("namespace", "/lib;/lib64;/usr;/bin;/etc;"+home, "Default namespace for the remote process -- set to none for none")
+	var namespace = flag.String("namespace", "/lib;/lib64;/usr;/bin;/etc;"+home, "Default namespace for the remote process, ;-separated, e.g. /usr:ro;/home; an entry may end in :ro, :nosuid, etc. -- set to none for none; the default is SIDECORE_NAMESPACE, if it is set")
 	arch := envOrDefault("SIDECORE_ARCH", runtime.GOARCH)
-	cpus, args, err := flags(arch)
+	_, archForced := os.LookupEnv("SIDECORE_ARCH")
+	cpus, failed, args, err := flags(arch)
 	if err != nil {
 		usage(err)
 	}
+	if len(*archFlag) > 0 {
+		arch, archForced = *archFlag, true
+	}
+	if len(*scriptFlag) > 0 {
+		args = append([]string{*scriptFlag}, args...)
+	}
+	if *containerFlag == stdinContainer {
+		exitOnSignal()
+		c, _, err := readContainer(os.Stdin, os.TempDir())
+		if err != nil {
+			fatalf("%v", err)
+		}
+		containerPath = c
+	}
+	// The container is for the arch the cpus were asked to have.
+	if reqs, err := parseRequirements(requirements); err == nil {
+		if a, err := requiredArch(reqs); err == nil && len(a) > 0 {
+			arch, archForced = a, true
+		}
+	}
+	if img, ok := ociContainer(containerPath); ok {
+		exitOnSignal()
+		if containerPath, err = pullImage(img, arch, !*dryRun); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if a, ok := dockerArchive(containerPath); ok {
+		exitOnSignal()
+		if containerPath, err = loadDockerArchive(a, arch, !*dryRun); err != nil {
+			fatalf("%v", err)
+		}
+	}
 	verbose("home is %q", home)
 	var wg sync.WaitGroup
 	// The remote system, for now, is always Linux or a standard Unix (or Plan 9)
 	// It will never be darwin (go argue with Apple)
 	// so /tmp is *always* /tmp
 	if err := os.Setenv("TMPDIR", "/tmp"); err != nil {
-		log.Printf("Warning: could not set TMPDIR: %v", err)
+		info("Warning: could not set TMPDIR: %v", err)
 	}
 
-	distro := envOrDefault("SIDECORE_DISTRO", "ubuntu")
-	version := envOrDefault("SIDECORE_VERSION", "latest")
-	container := fmt.Sprintf("%s-%s@%s.cpio", arch, distro, version)
+	container := archContainer(arch)
 	verbose("Using container %s", container)
-	fstab := namespaceToFSTab(*namespace)
-
-	if !filepath.IsAbs(container) {
-		// Find the flattened container to use
-		cdir, ok := os.LookupEnv("SIDECORE_IMAGES")
-		if !ok {
-			cdir = filepath.Join(os.Getenv("HOME"), "sidecore-images")
-		}
-		container = filepath.Join(cdir, container)
-	}
-	if _, err := os.Stat(container); err != nil {
-		log.Fatalf("Can not open container: %v", err)
-	}
-
-	// create 9p servers for the cpio and /.
-	cpioserv, err := client.NewCPIO9P(container)
-	if err != nil {
-		log.Fatal(err)
-	}
-	cpiofs, err := cpioserv.Attach()
-	if err != nil {
-		log.Fatal(err)
+	fstab := namespaceToFSTab(resolveNamespace(*namespace, isSet("namespace"), os.LookupEnv))
+	if len(*fstabFlag) > 0 {
+		fstab = customFSTab
 	}
 
 	// NewCPU9P returns a CPU9P, properly initialized.
 	fssrv := client.NewCPU9P(root)
 	fs, err := fssrv.Attach()
 	if err != nil {
-		log.Fatal(err)
+		fatalf("%v", err)
 	}
 	verbose("fs %v, root %v, bind at %v", fs, root, h)
 
-	u, err := client.NewUnion9P([]client.UnionMount{
-		client.NewUnionMount([]string{h}, fs),
-		client.NewUnionMount([]string{}, cpiofs),
-	})
-	verbose("u is %v", u)
-	if err != nil {
-		log.Fatal(err)
+	// Hosts can use different containers, so servers are
+	// created as needed, and shared between hosts.
+	servers := map[string]p9.Attacher{}
+	server := func(container string) (p9.Attacher, error) {
+		if u, ok := servers[container]; ok {
+			return u, nil
+		}
+		u, err := newServer(container, fs, h)
+		if err != nil {
+			return nil, err
+		}
+		servers[container] = u
+		return u, nil
 	}
 
 	keyFile := os.Getenv("SIDECORE_KEYFILE")
 	hostKeyFile := os.Getenv("SIDECORE_HOSTKEYFILE")
 
-	for _, cpu := range cpus {
+	names, _ := rankEnvNames(*rankEnv)
+	setRankEnv(cpus, names)
+
+	// Resolve everything about each cpu before starting any of them.
+	results := make([]result, len(cpus))
+	servers9p := make([]p9.Attacher, len(cpus))
+	for i := range cpus {
 		var err error
-		wg.Add(1)
-		cpu.keyfile = getKeyFile(cpu.host, keyFile)
-		cpu.port = getPort(cpu.host, cpu.port)
-		if cpu.host, err = getHostName(cpu.host); err != nil {
-			log.Printf("%v", err)
-			wg.Done()
+		cpu := &cpus[i]
+		// -i, then the environment, then the config file.
+		kfs := []string(identities)
+		if len(kfs) == 0 && len(keyFile) > 0 {
+			kfs = []string{keyFile}
+		}
+		if len(kfs) == 0 {
+			kfs = cpu.keyfiles
+		}
+		if cpu.keyfiles, err = getKeyFile(cpu.host, getPort(cpu.host, cpu.port), kfs); err != nil {
+			results[i] = result{host: cpu.host, status: exitFailure, err: err}
+			continue
+		}
+		cpu.certs = certFiles(cpu.host)
+		if len(cpu.user) == 0 {
+			cpu.user = getUser(cpu.host)
+		}
+		cpu.name = cpu.host
+		// vsock hosts are a cid:port, and unix hosts a path,
+		// which ~/.ssh/config knows nothing of, and neither
+		// can be proxied.
+		switch *network {
+		case "vsock":
+			if err = vsockAvailable(); err == nil {
+				cpu.host, cpu.port, err = vsockAddr(cpu.host, cpu.port)
+			}
+			if err != nil {
+				results[i] = result{host: cpu.host, status: exitFailure, err: err}
+				continue
+			}
+		case "unix":
+			if cpu.host, err = unixPath(cpu.host); err != nil {
+				results[i] = result{host: cpu.host, status: exitFailure, err: err}
+				continue
+			}
+			// A socket has no port, but the client wants one.
+			cpu.port = defaultPort
+		default:
+			cpu.port = getPort(cpu.host, cpu.port)
+			alias := cpu.host
+			if cpu.host, err = getHostName(cpu.host, cpu.port); err != nil {
+				results[i] = result{host: cpu.host, status: exitFailure, err: err}
+				continue
+			}
+			cpu.jumps, cpu.proxyCommand = getProxy(alias, cpu.host, cpu.port, cpu.user)
+		}
+		if (len(cpu.jumps) > 0 || len(cpu.proxyCommand) > 0) && len(*network) > 0 && *network != "tcp" {
+			results[i] = result{host: cpu.host, status: exitFailure, err: fmt.Errorf("-net %s can not be used with ProxyJump or ProxyCommand:%w", *network, os.ErrInvalid)}
 			continue
 		}
-		cpu.hostkey = hostKeyFile
+		// ProxyJump and ProxyCommand, as in ssh, and other
+		// networks, e.g. vsock, do not go through a proxy.
+		if len(cpu.jumps) == 0 && len(cpu.proxyCommand) == 0 && !cpu.discovered && (len(*network) == 0 || *network == "tcp") {
+			if cpu.proxy, err = getProxyURL(cpu.host, cpu.port); err != nil {
+				results[i] = result{host: cpu.host, port: cpu.port, status: exitFailure, err: fmt.Errorf("proxy: %w", err)}
+				continue
+			}
+		}
+		if len(hostKeyFile) > 0 {
+			cpu.hostkey = hostKeyFile
+		}
 		cpu.fstab = fstab
+		// -fstab beats a namespace in the config file.
+		if len(cpu.namespace) > 0 && len(*fstabFlag) == 0 {
+			cpu.fstab = namespaceToFSTab(cpu.namespace)
+		}
 		cpu.home = home
+		// Only a container chosen by arch has one, which
+		// the cpu's own may change.
+		switch {
+		case len(containerPath) > 0:
+			cpu.container, cpu.arch = containerPath, ""
+		case len(cpu.container) > 0:
+			cpu.arch = ""
+		case len(cpu.arch) > 0:
+			cpu.container, cpu.archForced = archContainer(cpu.arch), true
+		default:
+			cpu.container, cpu.arch, cpu.archForced = container, arch, archForced
+		}
+		cpu.container, cpu.imageDirs = searchContainer(cpu.container)
+		verbose("%s: container %s", cpu.host, cpu.container)
+		if len(cpus) > 1 && !*noPrefix {
+			cpu.prefix = fmt.Sprintf("%s:%s ", cpu.host, cpu.port)
+		}
+		// The container on stdin has used it up.
+		cpu.noStdin = len(cpus) > 1 && !*serial || *containerFlag == stdinContainer
+		if len(*controlPath) > 0 {
+			// The 9p server is not shared through the master.
+			if *ninep {
+				results[i] = result{host: cpu.host, port: cpu.port, status: exitFailure, err: fmt.Errorf("-9p can not be used with -control-path:%w", os.ErrInvalid)}
+				continue
+			}
+			cpu.control = controlSocket(*controlPath, cpu)
+		}
+		if *dryRun || len(*controlOp) > 0 {
+			continue
+		}
+		// A container which the cpu's arch may change is
+		// downloaded once it is dialed.
+		if *ninep || !*srvnfs || len(cpu.control) > 0 || len(cpu.arch) == 0 {
+			if err := fetchContainer(cpu); err != nil {
+				results[i] = result{host: cpu.host, port: cpu.port, status: exitFailure, err: fmt.Errorf("Can not download container: %w", err)}
+				continue
+			}
+		}
+		if servers9p[i], err = server(cpu.container); err != nil {
+			results[i] = result{host: cpu.host, port: cpu.port, status: exitFailure, err: fmt.Errorf("Can not open container: %w", searchError(err, cpu.imageDirs))}
+		}
+	}
+
+	// This is global in the client, so it must be
+	// set before any cpus are started.
+	client.Debug9p = *dbg9p
+
+	// Hosts which could not be found are failures too.
+	results = append(results, failed...)
+
+	if *dryRun {
+		exit(printPlan(os.Stdout, cpus, results, args))
+	}
+
+	if *controlMaster {
+		if len(cpus) != 1 || len(cpus[0].control) == 0 {
+			fatalf("-control-master needs one cpu, and -control-path")
+		}
+		if results[0].err != nil {
+			fatalf("control master: %v", results[0].err)
+		}
+		// runMaster reports its errors to startMaster.
+		if err := runMaster(servers9p[0], &cpus[0]); err != nil {
+			verbose("control master: %v", err)
+			exit(exitFailure)
+		}
+		exit(0)
+	}
+
+	if len(*controlOp) > 0 {
+		for i := range cpus {
+			if results[i].err != nil {
+				continue
+			}
+			msg, err := controlCommand(*controlOp, &cpus[i])
+			results[i] = result{host: cpus[i].host, port: cpus[i].port, err: err}
+			if err != nil {
+				results[i].status = exitFailure
+				continue
+			}
+			info("%s", msg)
+		}
+		for _, r := range results {
+			report(r)
+		}
+		exit(runStatus(results, 0))
+	}
+
+	// Masters are started one at a time, since
+	// they may ask for passphrases and passwords.
+	for i := range cpus {
+		if results[i].err != nil || len(cpus[i].control) == 0 {
+			continue
+		}
+		if err := startMaster(&cpus[i]); err != nil {
+			results[i] = result{host: cpus[i].host, port: cpus[i].port, status: exitFailure, err: err}
+		}
+	}
+
+	if !*noSignals {
+		go jobControl()
+	}
 
-		verbose("cpu to %v:%v", cpu.host, cpu.port)
-		if err := newCPU(u, wg, container, &cpu, args...); err != nil {
-			e := 1
-			log.Printf("SSH error %s", err)
-			sshErr := &ossh.ExitError{}
-			if errors.As(err, &sshErr) {
-				e = sshErr.ExitStatus()
+	// Signals are forwarded, or end the run, so that the
+	// script is removed, unless sidecore is killed.
+	removeScript := func() {}
+	if len(*scriptFlag) > 0 {
+		if args[0], removeScript, err = stageScript(*scriptFlag, os.Getenv("HOME"), home); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	// With -fail-fast, the first cpu to fail stops the rest.
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	fail := func(r result) {
+		if *failFast && r.status != 0 {
+			stopOnce.Do(func() { close(stop) })
+		}
+	}
+	for _, r := range results {
+		fail(r)
+	}
+	for i := range cpus {
+		if results[i].err != nil {
+			continue
+		}
+		cpus[i].stop = stop
+		run := func(i int) {
+			defer wg.Done()
+			select {
+			case <-stop:
+				results[i] = result{host: cpus[i].host, port: cpus[i].port, status: exitFailure, err: errSkipped, skipped: true}
+				return
+			default:
 			}
-			log.Printf("%v", e)
+			verbose("cpu to %v:%v", cpus[i].host, cpus[i].port)
+			results[i] = newCPU(servers9p[i], &wg, cpus[i].container, &cpus[i], args...)
+			fail(results[i])
+		}
+		wg.Add(1)
+		if *serial {
+			run(i)
+			continue
 		}
-		wg.Done()
+		go run(i)
 	}
 	wg.Wait()
+	removeScript()
+
+	// A remote command failing is not a sidecore error;
+	// its status is our exit status.
+	for _, r := range results {
+		report(r)
+	}
+	summarize(results)
+	exit(runStatus(results, *minOK))
+}
+
+// runStatus returns the exit status for a run: 0, if at least
+// min hosts, or, if min is 0, all of them, succeeded, or the
+// status of the first host to fail, not counting those skipped.
+func runStatus(results []result, min int) int {
+	ok := 0
+	for _, r := range results {
+		if r.status == 0 {
+			ok++
+		}
+	}
+	if min > 0 && ok >= min {
+		return 0
+	}
+	status := 0
+	for _, r := range results {
+		if r.status == 0 {
+			continue
+		}
+		if !r.skipped {
+			return r.status
+		}
+		status = r.status
+	}
+	// Too few succeeded, though none failed.
+	if status == 0 && ok < min {
+		status = exitFailure
+	}
+	return status
+}
+
+// resizeWindow tells a cpu's pty the terminal's size.
+func resizeWindow(c *client.Cmd) error {
+	cols, rows, err := term.GetSize(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	return c.WindowChange(rows, cols)
 }
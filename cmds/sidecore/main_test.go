@@ -0,0 +1,395 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+// TestMain keeps the tests' cache, e.g. the last cpu dialed,
+// out of the user's.
+func TestMain(m *testing.M) {
+	d, err := os.MkdirTemp("", "sidecore-cache")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("XDG_CACHE_HOME", d)
+	s := m.Run()
+	os.RemoveAll(d)
+	os.Exit(s)
+}
+
+func TestExitStatus(t *testing.T) {
+	if s := exitStatus(nil); s != 0 {
+		t.Errorf("exitStatus(nil): %d != 0", s)
+	}
+	if s := exitStatus(fmt.Errorf("Dial: no route to host")); s != exitFailure {
+		t.Errorf("exitStatus(dial error): %d != %d", s, exitFailure)
+	}
+	if s := exitStatus(fmt.Errorf("\"sleep\" did not exit 5s after SIGTERM:%w", errTerminated)); s != 143 {
+		t.Errorf("exitStatus(terminated): %d != 143", s)
+	}
+	if s := exitStatus(&maxTimeError{phase: "dial"}); s != 124 {
+		t.Errorf("exitStatus(timed out): %d != 124", s)
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		statuses []int
+		min      int
+		want     int
+	}{
+		{name: "none", want: 0},
+		{name: "all ok", statuses: []int{0, 0}, want: 0},
+		{name: "first failure", statuses: []int{0, 2, exitFailure}, want: 2},
+		{name: "unreachable", statuses: []int{exitFailure, 1}, want: exitFailure},
+		{name: "enough", statuses: []int{0, 2, 0}, min: 2, want: 0},
+		{name: "too few", statuses: []int{0, 2, 3}, min: 2, want: 2},
+		{name: "more than there are", statuses: []int{0, 0}, min: 3, want: exitFailure},
+		{name: "skipped", statuses: []int{0, -1, 2}, want: 2},
+		{name: "all skipped", statuses: []int{-1, -1}, want: exitFailure},
+	} {
+		var results []result
+		for _, s := range tt.statuses {
+			// -1 is a cpu skipped for -fail-fast.
+			if s < 0 {
+				results = append(results, result{status: exitFailure, err: errSkipped, skipped: true})
+				continue
+			}
+			results = append(results, result{status: s})
+		}
+		if s := runStatus(results, tt.min); s != tt.want {
+			t.Errorf("%s: runStatus(%v, %d): %d != %d", tt.name, tt.statuses, tt.min, s, tt.want)
+		}
+	}
+}
+
+func TestSplitHosts(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{in: "a", want: []string{"a"}},
+		{in: "a,b,c", want: []string{"a", "b", "c"}},
+		{in: "a,,b,", want: []string{"a", "b"}},
+		{in: "dnssd://?arch=amd64%2Carm64,host", want: []string{"dnssd://?arch=amd64%2Carm64", "host"}},
+		{in: ".,host", want: []string{".", "host"}},
+	} {
+		got := splitHosts(tt.in)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitHosts(%q): %q != %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitUser(t *testing.T) {
+	for _, tt := range []struct {
+		in, user, host string
+	}{
+		{in: "box", host: "box"},
+		{in: "root@box", user: "root", host: "box"},
+		{in: "root@dnssd://?arch=amd64", user: "root", host: "dnssd://?arch=amd64"},
+		{in: "dnssd://?owner=me@example.com", host: "dnssd://?owner=me@example.com"},
+		{in: "root@fe80::1", user: "root", host: "fe80::1"},
+		{in: "root@.", user: "root", host: "."},
+		{in: "@builders", host: "@builders"},
+		{in: "root@@builders", user: "root", host: "@builders"},
+	} {
+		user, host := splitUser(tt.in)
+		if user != tt.user || host != tt.host {
+			t.Errorf("splitUser(%q): (%q, %q) != (%q, %q)", tt.in, user, host, tt.user, tt.host)
+		}
+	}
+}
+
+func TestGetKeyFile(t *testing.T) {
+	t.Setenv("HOME", "/home/glenda")
+	got, err := getKeyFile("localhost", defaultPort, []string{"~/.ssh/a", "/b"})
+	want := []string{"/home/glenda/.ssh/a", "/b"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("getKeyFile: (%q, %v) != (%q, nil)", got, err, want)
+	}
+}
+
+// setSSHConfig uses an ssh_config from a temporary file
+// until the test ends.
+func setSSHConfig(t *testing.T, conf string) {
+	t.Helper()
+	n := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(n, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadSSHConfig(n)
+	if err != nil {
+		t.Fatalf("loadSSHConfig: %v != nil", err)
+	}
+	old := sshConfig
+	sshConfig = c
+	t.Cleanup(func() { sshConfig = old })
+}
+
+func TestGetUser(t *testing.T) {
+	t.Setenv("HOME", "/home/glenda")
+	setSSHConfig(t, "Host *.lab\n\tUser glenda\n\tPort 17011\n\tIdentityFile ~/.ssh/lab\n")
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("user.Current: %v", err)
+	}
+	me := u.Username[strings.LastIndex(u.Username, `\`)+1:]
+	for _, tt := range []struct {
+		host, user, port, key string
+	}{
+		{host: "rpi.lab", user: "glenda", port: "17011", key: "/home/glenda/.ssh/lab"},
+		{host: "box", user: me, port: defaultPort, key: defaultKeyFile},
+	} {
+		if got := getUser(tt.host); got != tt.user {
+			t.Errorf("getUser(%q): %q != %q", tt.host, got, tt.user)
+		}
+		// Wildcards match the same way for User, Port and IdentityFile.
+		if got := getPort(tt.host, ""); got != tt.port {
+			t.Errorf("getPort(%q, \"\"): %q != %q", tt.host, got, tt.port)
+		}
+		if got, err := getKeyFile(tt.host, tt.port, nil); err != nil || len(got) != 1 || got[0] != tt.key {
+			t.Errorf("getKeyFile(%q, nil): (%q, %v) != ([%q], nil)", tt.host, got, err, tt.key)
+		}
+	}
+}
+
+func TestGetPort(t *testing.T) {
+	setSSHConfig(t, "Host *.lab\n\tPort 17011\n")
+	for _, tt := range []struct {
+		host, flag, env, want string
+	}{
+		{host: "rpi.lab", flag: "17013", env: "17012", want: "17013"},
+		{host: "rpi.lab", env: "17012", want: "17012"},
+		{host: "rpi.lab", want: "17011"},
+		{host: "box", want: defaultPort},
+		{host: "box", env: "22", want: defaultPort},
+		{host: "box", flag: "22", env: "17012", want: defaultPort},
+	} {
+		t.Setenv("SIDECORE_PORT", tt.env)
+		if got := getPort(tt.host, tt.flag); got != tt.want {
+			t.Errorf("getPort(%q, %q), SIDECORE_PORT=%q: %q != %q", tt.host, tt.flag, tt.env, got, tt.want)
+		}
+	}
+}
+
+// setDSLookup replaces dsLookup with a fake which fails with
+// each of errs in turn, then finds a cpu at 10.0.0.1.
+func setDSLookup(t *testing.T, errs ...error) *int {
+	t.Helper()
+	old, oldBackoff := dsLookup, dsBackoff
+	t.Cleanup(func() { dsLookup, dsBackoff = old, oldBackoff })
+	dsBackoff = time.Millisecond
+	tries := new(int)
+	dsLookup = func(ds.Query, int, time.Duration) ([]*ds.LookupResult, error) {
+		*tries++
+		if *tries <= len(errs) {
+			return nil, errs[*tries-1]
+		}
+		return []*ds.LookupResult{{Entry: dnssd.BrowseEntry{IPs: []net.IP{net.ParseIP("10.0.0.1")}, Port: 17010}}}, nil
+	}
+	return tries
+}
+
+func TestLookupDS(t *testing.T) {
+	defer func(r int) { *dsRetries = r }(*dsRetries)
+	for _, tt := range []struct {
+		retries int
+		errs    []error
+		tries   int
+		err     error
+	}{
+		{retries: 2, tries: 1},
+		{retries: 2, errs: []error{ds.ErrNoServers, ds.ErrNoMatch}, tries: 3},
+		{retries: 1, errs: []error{ds.ErrNoServers, ds.ErrNoMatch}, tries: 2, err: ds.ErrNoMatch},
+		{retries: 0, errs: []error{ds.ErrNoServers}, tries: 1, err: ds.ErrNoServers},
+		{retries: 2, errs: []error{os.ErrPermission}, tries: 1, err: os.ErrPermission},
+	} {
+		*dsRetries = tt.retries
+		tries := setDSLookup(t, tt.errs...)
+		c, err := lookupDS(ds.Query{}, 1)
+		if !errors.Is(err, tt.err) || *tries != tt.tries {
+			t.Errorf("lookupDS, -ds-retries %d, failing with %v: (%v, %d tries) != (%v, %d tries)", tt.retries, tt.errs, err, *tries, tt.err, tt.tries)
+			continue
+		}
+		if err == nil && len(c) != 1 {
+			t.Errorf("lookupDS: %d cpus != 1", len(c))
+		}
+	}
+}
+
+func TestCPUCount(t *testing.T) {
+	for _, tt := range []struct {
+		v    string
+		want cpuCount
+		err  error
+	}{
+		{v: "3", want: 3},
+		{v: "0", want: 0},
+		{v: "all", want: 0},
+		{v: "-1", want: 1, err: os.ErrInvalid},
+		{v: "some", want: 1, err: os.ErrInvalid},
+	} {
+		n := cpuCount(1)
+		if err := n.Set(tt.v); !errors.Is(err, tt.err) || n != tt.want {
+			t.Errorf("Set(%q): (%d, %v) != (%d, %v)", tt.v, n, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestLookupHostAll(t *testing.T) {
+	defer func(n cpuCount) { numCPUs = n }(numCPUs)
+	old := dsLookup
+	defer func() { dsLookup = old }()
+	dsLookup = func(_ ds.Query, n int, _ time.Duration) ([]*ds.LookupResult, error) {
+		var r []*ds.LookupResult
+		for i := 1; i <= 3 && (n == 0 || i <= n); i++ {
+			ip := net.IPv4(10, 0, 0, byte(i))
+			r = append(r, &ds.LookupResult{Entry: dnssd.BrowseEntry{Name: ip.String(), IPs: []net.IP{ip}, Port: 17010}})
+		}
+		return r, nil
+	}
+	for _, tt := range []struct {
+		n    cpuCount
+		want int
+	}{
+		{n: 1, want: 1},
+		{n: 2, want: 2},
+		{n: 0, want: 3},
+	} {
+		numCPUs = tt.n
+		c, err := lookupHost(ds.Default, nil)
+		if err != nil || len(c) != tt.want {
+			t.Errorf("lookupHost(%q), -n %d: (%d cpus, %v) != (%d cpus, nil)", ds.Default, tt.n, len(c), err, tt.want)
+		}
+	}
+}
+
+func TestNamespaceToFSTab(t *testing.T) {
+	for _, tt := range []struct {
+		ns   string
+		want string
+	}{
+		{ns: "none", want: ""},
+		{ns: "", want: ""},
+		{ns: ";;", want: ""},
+		{ns: "/lib", want: "/tmp/cpu/lib /lib none defaults,bind 0 0\n"},
+		// Empty entries are skipped, not the end.
+		{ns: "/lib;;/usr;", want: "/tmp/cpu/lib /lib none defaults,bind 0 0\n/tmp/cpu/usr /usr none defaults,bind 0 0\n"},
+		{ns: "/usr:ro;/home", want: "/tmp/cpu/usr /usr none defaults,bind,ro 0 0\n/tmp/cpu/home /home none defaults,bind 0 0\n"},
+		{ns: "/etc:ro,nosuid", want: "/tmp/cpu/etc /etc none defaults,bind,ro,nosuid 0 0\n"},
+		// A : which is not followed by options is part of the path.
+		{ns: "/data:2024", want: "/tmp/cpu/data:2024 /data:2024 none defaults,bind 0 0\n"},
+		{ns: ":ro", want: ""},
+	} {
+		if got := namespaceToFSTab(tt.ns); got != tt.want {
+			t.Errorf("namespaceToFSTab(%q): %q != %q", tt.ns, got, tt.want)
+		}
+	}
+}
+
+func TestResolveNamespace(t *testing.T) {
+	const def = "/lib;/usr"
+	for _, tt := range []struct {
+		name string
+		ns   string
+		set  bool
+		env  map[string]string
+		want string
+		tab  string
+	}{
+		{name: "default", ns: def, want: def, tab: "/tmp/cpu/lib /lib none defaults,bind 0 0\n/tmp/cpu/usr /usr none defaults,bind 0 0\n"},
+		{name: "env", ns: def, env: map[string]string{"SIDECORE_NAMESPACE": "/usr:ro"}, want: "/usr:ro", tab: "/tmp/cpu/usr /usr none defaults,bind,ro 0 0\n"},
+		{name: "env none", ns: def, env: map[string]string{"SIDECORE_NAMESPACE": "none"}, want: "none", tab: ""},
+		{name: "env empty", ns: def, env: map[string]string{"SIDECORE_NAMESPACE": ""}, want: "", tab: ""},
+		{name: "flag beats env", ns: "/etc", set: true, env: map[string]string{"SIDECORE_NAMESPACE": "/usr:ro"}, want: "/etc", tab: "/tmp/cpu/etc /etc none defaults,bind 0 0\n"},
+		// -namespace set to its default still beats the env.
+		{name: "flag set to default", ns: def, set: true, env: map[string]string{"SIDECORE_NAMESPACE": "none"}, want: def},
+	} {
+		lookup := func(k string) (string, bool) {
+			v, ok := tt.env[k]
+			return v, ok
+		}
+		got := resolveNamespace(tt.ns, tt.set, lookup)
+		if got != tt.want {
+			t.Errorf("%s: resolveNamespace: %q != %q", tt.name, got, tt.want)
+		}
+		if len(tt.tab) > 0 || len(tt.want) == 0 || tt.want == "none" {
+			if tab := namespaceToFSTab(got); tab != tt.tab {
+				t.Errorf("%s: namespaceToFSTab(%q): %q != %q", tt.name, got, tab, tt.tab)
+			}
+		}
+	}
+}
+
+func TestSearchContainer(t *testing.T) {
+	d := t.TempDir()
+	blessed, mine, missing := filepath.Join(d, "blessed"), filepath.Join(d, "mine"), filepath.Join(d, "missing")
+	for _, dir := range []string{blessed, mine} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(blessed, "both.cpio"), filepath.Join(mine, "both.cpio"), filepath.Join(mine, "mine.cpio")} {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("SIDECORE_IMAGES", strings.Join([]string{missing, blessed, "", mine}, string(filepath.ListSeparator)))
+	dirs := []string{missing, blessed, mine}
+	for _, tt := range []struct {
+		c    string
+		want string
+		dirs []string
+	}{
+		{c: "both.cpio", want: filepath.Join(blessed, "both.cpio"), dirs: dirs},
+		{c: "mine.cpio", want: filepath.Join(mine, "mine.cpio"), dirs: dirs},
+		// If none has it, it is in the first.
+		{c: "none.cpio", want: filepath.Join(missing, "none.cpio"), dirs: dirs},
+		{c: dirPrefix + "rootfs", want: dirPrefix + filepath.Join(missing, "rootfs"), dirs: dirs},
+		{c: "/abs.cpio", want: "/abs.cpio"},
+	} {
+		got, gotDirs := searchContainer(tt.c)
+		if got != tt.want || !reflect.DeepEqual(gotDirs, tt.dirs) {
+			t.Errorf("searchContainer(%q): (%q, %q) != (%q, %q)", tt.c, got, gotDirs, tt.want, tt.dirs)
+		}
+	}
+
+	_, err := os.Stat(filepath.Join(missing, "none.cpio"))
+	err = searchError(err, dirs)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("searchError: %v != %v", err, os.ErrNotExist)
+	}
+	for _, d := range dirs {
+		if !strings.Contains(err.Error(), d) {
+			t.Errorf("searchError: %q does not name %s", err, d)
+		}
+	}
+	if err := searchError(os.ErrPermission, dirs); err != os.ErrPermission {
+		t.Errorf("searchError(%v): %v != %v", os.ErrPermission, err, os.ErrPermission)
+	}
+
+	t.Setenv("HOME", d)
+	os.Unsetenv("SIDECORE_IMAGES")
+	if got, want := imageDirs(), []string{filepath.Join(d, "sidecore-images")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("imageDirs, SIDECORE_IMAGES not set: %q != %q", got, want)
+	}
+}
@@ -10,22 +10,94 @@ import (
 	"os"
 	"os/signal"
 
-	"github.com/u-root/cpu/client"
+	"github.com/u-root/sidecore/internal/cpu/client"
 	ossh "golang.org/x/crypto/ssh"
 	"golang.org/x/sys/unix"
 )
 
+// sigTerm is the signal -fail-fast sends to stop a command.
+var sigTerm os.Signal = unix.SIGTERM
+
+// sigWinch is the signal that the terminal was resized.
+var sigWinch os.Signal = unix.SIGWINCH
+
+// sshSignals are the signals forwarded to the remote command.
+var sshSignals = map[os.Signal]ossh.Signal{
+	unix.SIGINT:  ossh.SIGINT,
+	unix.SIGTERM: ossh.SIGTERM,
+	unix.SIGHUP:  ossh.SIGHUP,
+	unix.SIGQUIT: ossh.SIGQUIT,
+	unix.SIGUSR1: ossh.SIGUSR1,
+	unix.SIGUSR2: ossh.SIGUSR2,
+}
+
+// notify asks for the signals forwarded to the remote command,
+// unless -no-forward-signals is set, and SIGWINCH.
 func notify(c chan os.Signal) {
-	signal.Notify(c, unix.SIGINT, unix.SIGTERM)
+	sigs := []os.Signal{unix.SIGWINCH}
+	if !*noSignals {
+		for s := range sshSignals {
+			sigs = append(sigs, s)
+		}
+	}
+	signal.Notify(c, sigs...)
 }
 
+// sigerrors forwards a signal to the remote command. A signal with
+// no ssh equivalent is dropped.
 func sigerrors(c *client.Cmd, sig os.Signal) error {
-	var sigErr error
-	switch sig {
-	case unix.SIGINT:
-		sigErr = c.Signal(ossh.SIGINT)
-	case unix.SIGTERM:
-		sigErr = c.Signal(ossh.SIGTERM)
+	if sig == unix.SIGWINCH {
+		// Not a signal for the command: the pty is resized.
+		return resizeWindow(c)
+	}
+	s, ok := sshSignals[sig]
+	if !ok {
+		verbose("%v has no ssh equivalent; dropping it", sig)
+		return nil
+	}
+	return c.Signal(s)
+}
+
+// jobControl suspends the remote commands, and sidecore, when it is
+// sent SIGTSTP, and continues them when it is continued. Stopping
+// itself with SIGSTOP, which can not be caught, lets the shell's
+// job control work as it does for any program.
+func jobControl() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, unix.SIGTSTP)
+	for range c {
+		suspendSelf()
+	}
+}
+
+// suspendSelf suspends sidecore, and its remote commands, for the
+// ~^Z escape, as SIGTSTP does.
+func suspendSelf() {
+	suspendJobs(func() error {
+		return unix.Kill(os.Getpid(), unix.SIGSTOP)
+	})
+}
+
+// watchWindow does nothing: SIGWINCH says when the terminal is resized.
+func watchWindow(c *client.Cmd, done <-chan struct{}) {
+}
+
+// detach puts sidecore in a session of its own, with stdin, stdout
+// and stderr on /dev/null, so that a control master outlives the
+// terminal it was started from.
+func detach() error {
+	if _, err := unix.Setsid(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for fd := 0; fd < 3; fd++ {
+		if err := unix.Dup2(int(f.Fd()), fd); err != nil {
+			return err
+		}
 	}
-	return sigErr
+	return nil
 }
@@ -0,0 +1,623 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+func TestRunCPUForwardSignal(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool) { *network, *srvnfs = n, nfs }(*network, *srvnfs)
+	*network, *srvnfs = "unix", false
+
+	// Until runCPU asks for it, SIGUSR1 would stop the test. It is
+	// not stopped, since the last SIGUSR1 sent may arrive after the
+	// test is over.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, unix.SIGUSR1)
+
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	testServerOn(t, l, signalCPUD)
+
+	cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true}
+	var wg sync.WaitGroup
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runCPU(nil, &wg, "", cpu, "sleep", "1000")
+	}()
+	// The signal is only forwarded once the command has started,
+	// so keep sending it until it has been.
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case err = <-errc:
+		case <-tick.C:
+			unix.Kill(os.Getpid(), unix.SIGUSR1)
+			continue
+		case <-timeout:
+			t.Fatalf("runCPU: SIGUSR1 was not forwarded")
+		}
+		break
+	}
+	wg.Wait()
+	if got, want := exitStatus(err), 128+10; got != want {
+		t.Errorf("runCPU, SIGUSR1: exit status %d (%v) != %d", got, err, want)
+	}
+}
+
+func TestRunCPUNoForwardSignals(t *testing.T) {
+	defer func(n bool) { *noSignals = n }(*noSignals)
+	for _, tt := range []struct {
+		no   bool
+		want bool
+	}{
+		{no: false, want: true},
+		{no: true, want: false},
+	} {
+		*noSignals = tt.no
+		c := make(chan os.Signal, 1)
+		// Something else must catch SIGUSR2 if notify does not.
+		catch := make(chan os.Signal, 1)
+		signal.Notify(catch, unix.SIGUSR2)
+		notify(c)
+		unix.Kill(os.Getpid(), unix.SIGUSR2)
+		<-catch
+		got := false
+		select {
+		case <-c:
+			got = true
+		case <-time.After(100 * time.Millisecond):
+		}
+		signal.Stop(c)
+		signal.Stop(catch)
+		if got != tt.want {
+			t.Errorf("notify, -no-forward-signals=%v: got SIGUSR2 %v != %v", tt.no, got, tt.want)
+		}
+	}
+}
+
+// deafCPUD is a cpud whose commands never exit, even when signalled.
+func deafCPUD(c net.Conn, cfg *ossh.ServerConfig) {
+	_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+	if err != nil {
+		return
+	}
+	go ossh.DiscardRequests(reqs)
+	for nc := range chans {
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for r := range creqs {
+				r.Reply(true, nil)
+			}
+		}()
+	}
+}
+
+func TestRunCPUTermGrace(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool, g time.Duration) { *network, *srvnfs, *termGrace = n, nfs, g }(*network, *srvnfs, *termGrace)
+	*network, *srvnfs, *termGrace = "unix", false, 100*time.Millisecond
+
+	// Until runCPU asks for it, SIGTERM would stop the test. It is
+	// not stopped, since the last SIGTERM sent may arrive after the
+	// test is over.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, unix.SIGTERM)
+
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	testServerOn(t, l, deafCPUD)
+
+	cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true}
+	var wg sync.WaitGroup
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runCPU(nil, &wg, "", cpu, "sleep", "1000")
+	}()
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case err = <-errc:
+		case <-tick.C:
+			unix.Kill(os.Getpid(), unix.SIGTERM)
+			continue
+		case <-timeout:
+			t.Fatalf("runCPU: did not give up after SIGTERM")
+		}
+		break
+	}
+	wg.Wait()
+	if got, want := exitStatus(err), 128+15; got != want || !errors.Is(err, errTerminated) {
+		t.Errorf("runCPU, SIGTERM ignored: exit status %d (%v) != %d (%v)", got, err, want, errTerminated)
+	}
+}
+
+func TestNewCPUMaxTime(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool, m, k time.Duration) { *network, *srvnfs, *maxTime, *killAfter = n, nfs, m, k }(*network, *srvnfs, *maxTime, *killAfter)
+	*network, *srvnfs, *maxTime, *killAfter = "unix", false, 500*time.Millisecond, 100*time.Millisecond
+
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	testServerOn(t, l, deafCPUD)
+
+	cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true}
+	var wg sync.WaitGroup
+	rc := make(chan result, 1)
+	go func() {
+		rc <- newCPU(nil, &wg, "", cpu, "sleep", "1000")
+	}()
+	var r result
+	select {
+	case r = <-rc:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("newCPU: did not give up after -max-time")
+	}
+	wg.Wait()
+	var te *maxTimeError
+	if !errors.As(r.err, &te) || te.phase != "run" {
+		t.Fatalf("newCPU: %v is not a -max-time error during run", r.err)
+	}
+	if r.status != 124 {
+		t.Errorf("newCPU: exit status %d != 124", r.status)
+	}
+}
+
+// recordCPUD is a cpud which sends the names of the signals its
+// command is sent to sigs, and whose command exits after CONT.
+func recordCPUD(sigs chan<- string) func(net.Conn, *ossh.ServerConfig) {
+	return func(c net.Conn, cfg *ossh.ServerConfig) {
+		_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+		if err != nil {
+			return
+		}
+		go ossh.DiscardRequests(reqs)
+		for nc := range chans {
+			ch, creqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for r := range creqs {
+					r.Reply(true, nil)
+					var sig struct{ Signal string }
+					if r.Type != "signal" || ossh.Unmarshal(r.Payload, &sig) != nil {
+						continue
+					}
+					sigs <- sig.Signal
+					if sig.Signal == string(sshCONT) {
+						ch.SendRequest("exit-status", false, ossh.Marshal(struct{ Status uint32 }{0}))
+						return
+					}
+				}
+			}()
+		}
+	}
+}
+
+func TestSuspendJobs(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool) { *network, *srvnfs = n, nfs }(*network, *srvnfs)
+	*network, *srvnfs = "unix", false
+
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	sigs := make(chan string, 2)
+	testServerOn(t, l, recordCPUD(sigs))
+
+	cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true}
+	var wg sync.WaitGroup
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runCPU(nil, &wg, "", cpu, "sleep", "1000")
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		jobs.Lock()
+		n := len(jobs.cmds)
+		jobs.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("runCPU: the command never started")
+		}
+	}
+	var got []string
+	suspendJobs(func() error {
+		got = append(got, <-sigs, "stopped")
+		return nil
+	})
+	got = append(got, <-sigs)
+	if err := <-errc; err != nil {
+		t.Errorf("runCPU: %v != nil", err)
+	}
+	wg.Wait()
+	if want := []string{"TSTP", "stopped", "CONT"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("suspendJobs: %q != %q", got, want)
+	}
+}
+
+// capture replaces *f, e.g. os.Stdout, with a pipe, until the
+// function it returns is called, which returns what was written.
+func capture(t *testing.T, f **os.File) func() []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v != nil", err)
+	}
+	out := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(r)
+		r.Close()
+		out <- b
+	}()
+	old := *f
+	*f = w
+	return func() []byte {
+		*f = old
+		w.Close()
+		return <-out
+	}
+}
+
+// sumCPUD is a cpud whose command writes the sha256 of its input, in
+// hex, when the input ends, and exits.
+func sumCPUD(c net.Conn, cfg *ossh.ServerConfig) {
+	_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+	if err != nil {
+		return
+	}
+	go ossh.DiscardRequests(reqs)
+	for nc := range chans {
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for r := range creqs {
+				r.Reply(true, nil)
+				if r.Type != "exec" {
+					continue
+				}
+				go func() {
+					defer ch.Close()
+					h := sha256.New()
+					if _, err := io.Copy(h, ch); err != nil {
+						return
+					}
+					fmt.Fprintf(ch, "%x\n", h.Sum(nil))
+					ch.SendRequest("exit-status", false, ossh.Marshal(struct{ Status uint32 }{0}))
+				}()
+			}
+		}()
+	}
+}
+
+func TestRunCPUStdin(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool, in string, no bool) {
+		*network, *srvnfs, *stdinFlag, *noStdinFlag = n, nfs, in, no
+	}(*network, *srvnfs, *stdinFlag, *noStdinFlag)
+	*network, *srvnfs = "unix", false
+
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	testServerOn(t, l, sumCPUD)
+
+	// A few MB, so that the input takes many ssh packets,
+	// and the window fills.
+	data := make([]byte, 5<<20+17)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("rand.Read: %v != nil", err)
+	}
+	in := filepath.Join(t.TempDir(), "in")
+	if err := os.WriteFile(in, data, 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v != nil", in, err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		stdin string
+		no    bool
+		want  []byte
+	}{
+		{name: "-stdin", stdin: in, want: data},
+		{name: "-no-stdin", no: true},
+	} {
+		*stdinFlag, *noStdinFlag = tt.stdin, tt.no
+		stdout := capture(t, &os.Stdout)
+
+		cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}}
+		var wg sync.WaitGroup
+		errc := make(chan error, 1)
+		go func() {
+			errc <- runCPU(nil, &wg, "", cpu, "sha256sum")
+		}()
+		select {
+		case err = <-errc:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("%s: runCPU: the command did not see the end of its input", tt.name)
+		}
+		got := stdout()
+		if err != nil {
+			t.Errorf("%s: runCPU: %v != nil", tt.name, err)
+		}
+		if want := []byte(fmt.Sprintf("%x\n", sha256.Sum256(tt.want))); !bytes.Equal(got, want) {
+			t.Errorf("%s: runCPU: output %q != %q", tt.name, got, want)
+		}
+	}
+}
+
+// streamsCPUD is a cpud whose command writes a line to stdout, and
+// another to stderr, and exits.
+func streamsCPUD(c net.Conn, cfg *ossh.ServerConfig) {
+	_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+	if err != nil {
+		return
+	}
+	go ossh.DiscardRequests(reqs)
+	for nc := range chans {
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for r := range creqs {
+				r.Reply(true, nil)
+				if r.Type != "exec" {
+					continue
+				}
+				fmt.Fprintf(ch, "out\n")
+				fmt.Fprintf(ch.Stderr(), "err\n")
+				ch.SendRequest("exit-status", false, ossh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+func TestRunCPUStreams(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool) { *network, *srvnfs = n, nfs }(*network, *srvnfs)
+	*network, *srvnfs = "unix", false
+
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	testServerOn(t, l, streamsCPUD)
+
+	for _, tt := range []struct {
+		prefix string
+		out    string
+		err    string
+	}{
+		{out: "out\n", err: "err\n"},
+		{prefix: "a:17010 ", out: "a:17010 out\n", err: "a:17010! err\n"},
+	} {
+		stdout, stderr := capture(t, &os.Stdout), capture(t, &os.Stderr)
+		cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true, prefix: tt.prefix}
+		var wg sync.WaitGroup
+		err := runCPU(nil, &wg, "", cpu, "echo")
+		out, errs := stdout(), stderr()
+		if err != nil {
+			t.Errorf("prefix %q: runCPU: %v != nil", tt.prefix, err)
+		}
+		if string(out) != tt.out || string(errs) != tt.err {
+			t.Errorf("prefix %q: runCPU: (stdout %q, stderr %q) != (%q, %q)", tt.prefix, out, errs, tt.out, tt.err)
+		}
+	}
+}
+
+// envCPUD is a cpud which sends the environment its command is
+// given, as KEY=VALUE, to env, and whose command then exits.
+func envCPUD(env chan<- []string) func(net.Conn, *ossh.ServerConfig) {
+	return func(c net.Conn, cfg *ossh.ServerConfig) {
+		_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+		if err != nil {
+			return
+		}
+		go ossh.DiscardRequests(reqs)
+		for nc := range chans {
+			ch, creqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				var vars []string
+				for r := range creqs {
+					r.Reply(true, nil)
+					var e struct{ Name, Value string }
+					switch {
+					case r.Type == "env" && ossh.Unmarshal(r.Payload, &e) == nil:
+						vars = append(vars, e.Name+"="+e.Value)
+					case r.Type == "exec":
+						env <- vars
+						ch.SendRequest("exit-status", false, ossh.Marshal(struct{ Status uint32 }{0}))
+						return
+					}
+				}
+			}()
+		}
+	}
+}
+
+func TestRunCPUEnv(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	t.Setenv("LC_ALL", "C")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("PWD", "/home/me/src")
+	defer func(n string, nfs bool, set []string, pats []string) {
+		*network, *srvnfs, envSet, sendEnvPats = n, nfs, set, pats
+	}(*network, *srvnfs, envSet, sendEnvPats)
+	*network, *srvnfs = "unix", false
+	sendEnvPats = strings.Split(defaultSendEnv, ",")
+	envSet = []string{"LC_ALL=en_US.UTF-8", "ARGS=-a b;c=d"}
+
+	env := make(chan []string, 1)
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	testServerOn(t, l, envCPUD(env))
+
+	cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true, env: []string{"SIDECORE_RANK=0"}}
+	var wg sync.WaitGroup
+	if err := runCPU(nil, &wg, "", cpu, "env"); err != nil {
+		t.Fatalf("runCPU: %v != nil", err)
+	}
+	got := <-env
+	// The last of a name wins.
+	sent := map[string]string{}
+	for _, e := range got {
+		k, v, _ := strings.Cut(e, "=")
+		sent[k] = v
+	}
+	for k, want := range map[string]string{"LC_ALL": "en_US.UTF-8", "ARGS": "-a b;c=d", "SIDECORE_RANK": "0", "PWD": "/home/me/src", "SIDECORE_MOUNTPOINT": "/tmp/cpu"} {
+		if v, ok := sent[k]; !ok || v != want {
+			t.Errorf("runCPU: %s=%q (sent %v) != %q", k, v, ok, want)
+		}
+	}
+	for _, k := range []string{"AWS_SECRET_ACCESS_KEY", "SSH_AUTH_SOCK", "HOME"} {
+		if _, ok := sent[k]; ok {
+			t.Errorf("runCPU: %s was sent, and should not have been", k)
+		}
+	}
+}
+
+// unameCPUD runs uname -m on a cpu which is machine, and nothing else.
+func unameCPUD(machine string) func(net.Conn, *ossh.ServerConfig) {
+	return func(c net.Conn, cfg *ossh.ServerConfig) {
+		_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+		if err != nil {
+			return
+		}
+		go ossh.DiscardRequests(reqs)
+		for nc := range chans {
+			ch, creqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for r := range creqs {
+					var cmd struct{ Command string }
+					if r.Type != "exec" || ossh.Unmarshal(r.Payload, &cmd) != nil || cmd.Command != "uname -m" {
+						r.Reply(false, nil)
+						continue
+					}
+					r.Reply(true, nil)
+					fmt.Fprintln(ch, machine)
+					ch.SendRequest("exit-status", false, ossh.Marshal(struct{ Status uint32 }{0}))
+					return
+				}
+			}()
+		}
+	}
+}
+
+func TestCheckArchUname(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	t.Setenv("SIDECORE_IMAGES", "/images")
+	defer func(n string, to time.Duration) { *network, archTimeout = n, to }(*network, archTimeout)
+	*network, archTimeout = "unix", 200*time.Millisecond
+
+	for _, tt := range []struct {
+		name string
+		cpud func(net.Conn, *ossh.ServerConfig)
+		want string
+	}{
+		{name: "uname", cpud: unameCPUD("aarch64"), want: "arm64"},
+		{name: "unknown machine", cpud: unameCPUD("pdp11"), want: "amd64"},
+		{name: "no answer", cpud: deafCPUD, want: "amd64"},
+	} {
+		sock := filepath.Join(t.TempDir(), "cpud.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+		}
+		testServerOn(t, l, tt.cpud)
+		cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, arch: "amd64", container: findContainer(archContainer("amd64"))}
+		a := dialAgent()
+		c, err := newClient(nil, a, cpu)
+		if err != nil {
+			t.Fatalf("%s: newClient: %v != nil", tt.name, err)
+		}
+		if err := dial(c, cpu); err != nil {
+			t.Fatalf("%s: dial: %v != nil", tt.name, err)
+		}
+		want := findContainer(archContainer(tt.want))
+		if got := checkArch(c, cpu); got != want {
+			t.Errorf("%s: checkArch: %q != %q", tt.name, got, want)
+		}
+		c.Close()
+		a.Close()
+	}
+}
@@ -6,14 +6,85 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/u-root/cpu/client"
+	"github.com/u-root/sidecore/internal/cpu/client"
+	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
-func notify(c chan os.Signal) {
+// sigTerm is the signal -fail-fast sends to stop a command. It is
+// also what windows sends when the console is closed, or the user
+// logs off, or the machine shuts down.
+var sigTerm os.Signal = syscall.SIGTERM
+
+// sigWinch is never sent: windows has no SIGWINCH.
+var sigWinch os.Signal
 
+// sshSignals are the signals forwarded to the remote command.
+var sshSignals = map[os.Signal]ossh.Signal{
+	os.Interrupt:    ossh.SIGINT,
+	syscall.SIGTERM: ossh.SIGTERM,
 }
 
+// notify asks for ^C, and the console being closed, unless
+// -no-forward-signals is set.
+func notify(c chan os.Signal) {
+	if *noSignals {
+		return
+	}
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+}
+
+// sigerrors forwards a signal to the remote command.
 func sigerrors(c *client.Cmd, sig os.Signal) error {
+	s, ok := sshSignals[sig]
+	if !ok {
+		verbose("%v has no ssh equivalent; dropping it", sig)
+		return nil
+	}
+	return c.Signal(s)
+}
+
+// jobControl does nothing: windows has no job control.
+func jobControl() {
+}
+
+// suspendSelf does nothing: windows has no job control.
+func suspendSelf() {
+}
+
+// windowPoll is how often watchWindow checks the console's size.
+const windowPoll = 250 * time.Millisecond
+
+// watchWindow polls the console's size, since windows has no
+// SIGWINCH, and resizes the remote pty when it changes, until
+// done is closed.
+func watchWindow(c *client.Cmd, done <-chan struct{}) {
+	cols, rows, _ := term.GetSize(int(os.Stdin.Fd()))
+	t := time.NewTicker(windowPoll)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		w, h, err := term.GetSize(int(os.Stdin.Fd()))
+		if err != nil || (w == cols && h == rows) {
+			continue
+		}
+		cols, rows = w, h
+		if err := c.WindowChange(rows, cols); err != nil {
+			verbose("window change: %v", err)
+		}
+	}
+}
+
+// detach does nothing. Control masters are not supported on
+// windows, where a master can not be passed its ready pipe.
+func detach() error {
 	return nil
 }
@@ -0,0 +1,68 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// With -max-time, each cpu has that long, from when it is dialed,
+// to run the command. The command is then sent SIGTERM, and, if it
+// has not exited after -kill-after, the session is closed. Either
+// way, sidecore exits 124, as timeout(1) does.
+var (
+	maxTime   = flag.Duration("max-time", 0, "give each cpu this long, from dialing it to the command exiting, then send the command SIGTERM and exit 124; 0 for no limit")
+	killAfter = flag.Duration("kill-after", 5*time.Second, "after -max-time sends SIGTERM, wait this long for the command to exit before closing the session; 0 to close it at once")
+)
+
+// errTimedOut is the error for a cpu which ran out of -max-time. Its
+// exit status is 124.
+var errTimedOut = errors.New("timed out")
+
+// maxTimeError is the error for a cpu which ran out of -max-time, and
+// says which phase, dial, mount, start or run, it was in. err is the
+// error of that phase, e.g. from a dial cut short, if any.
+type maxTimeError struct {
+	phase string
+	err   error
+}
+
+func (e *maxTimeError) Error() string {
+	s := fmt.Sprintf("-max-time %v reached during %s", *maxTime, e.phase)
+	if e.err != nil {
+		s += ": " + e.err.Error()
+	}
+	return s
+}
+
+func (e *maxTimeError) Unwrap() error {
+	return errTimedOut
+}
+
+// timedOut reports whether a cpu has run out of -max-time.
+func timedOut(cpu *cpu) bool {
+	return !cpu.deadline.IsZero() && !time.Now().Before(cpu.deadline)
+}
+
+// dialTime returns how long a cpu has to connect: -connect-timeout,
+// or, if it is sooner, what is left of -max-time. 0 is no limit.
+func dialTime(cpu *cpu) time.Duration {
+	d := *connectTimeout
+	if cpu.deadline.IsZero() {
+		return d
+	}
+	// A deadline which has passed must still be a limit.
+	left := time.Until(cpu.deadline)
+	if left <= 0 {
+		left = time.Nanosecond
+	}
+	if d == 0 || left < d {
+		return left
+	}
+	return d
+}
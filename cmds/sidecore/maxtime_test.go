@@ -0,0 +1,41 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDialTime(t *testing.T) {
+	defer func(d time.Duration) { *connectTimeout = d }(*connectTimeout)
+	for _, tt := range []struct {
+		name    string
+		connect time.Duration
+		left    time.Duration
+		noLimit bool
+		min     time.Duration
+		max     time.Duration
+	}{
+		{name: "no -max-time", connect: 30 * time.Second, noLimit: true, min: 30 * time.Second, max: 30 * time.Second},
+		{name: "no limits", noLimit: true},
+		{name: "-max-time sooner", connect: 30 * time.Second, left: time.Second, min: time.Second / 2, max: time.Second},
+		{name: "-connect-timeout sooner", connect: time.Second, left: time.Hour, min: time.Second, max: time.Second},
+		{name: "no -connect-timeout", left: time.Second, min: time.Second / 2, max: time.Second},
+		{name: "passed", connect: 30 * time.Second, left: -time.Second, min: time.Nanosecond, max: time.Nanosecond},
+	} {
+		*connectTimeout = tt.connect
+		c := &cpu{}
+		if !tt.noLimit {
+			c.deadline = time.Now().Add(tt.left)
+		}
+		if d := dialTime(c); d < tt.min || d > tt.max {
+			t.Errorf("%s: dialTime: %v not in [%v, %v]", tt.name, d, tt.min, tt.max)
+		}
+		if got, want := timedOut(c), !tt.noLimit && tt.left < 0; got != want {
+			t.Errorf("%s: timedOut: %v != %v", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// This machine's files are mounted on the cpu on -mountpoint, by
+// default /tmp/cpu, e.g. for images which have something else there.
+// The command is told where, in SIDECORE_MOUNTPOINT.
+var mountpoint = flag.String("mountpoint", "/tmp/cpu", "directory, on the cpu, to mount this machine's files on; it is passed to the command as SIDECORE_MOUNTPOINT")
+
+// checkMountpoint checks -mountpoint, which must be an absolute path,
+// other than /, with no white space, which fstab can not hold, and
+// returns it cleaned.
+func checkMountpoint(m string) (string, error) {
+	if strings.IndexFunc(m, unicode.IsSpace) >= 0 {
+		return "", fmt.Errorf("-mountpoint %q: fstab can not hold white space:%w", m, os.ErrInvalid)
+	}
+	if !path.IsAbs(m) {
+		return "", fmt.Errorf("-mountpoint %q: want an absolute path on the cpu:%w", m, os.ErrInvalid)
+	}
+	if m = path.Clean(m); m == "/" {
+		return "", fmt.Errorf("-mountpoint /: would hide the cpu's own files:%w", os.ErrInvalid)
+	}
+	return m, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckMountpoint(t *testing.T) {
+	for _, tt := range []struct {
+		m    string
+		want string
+		err  error
+	}{
+		{m: "/tmp/cpu", want: "/tmp/cpu"},
+		{m: "/mnt/sidecore/", want: "/mnt/sidecore"},
+		{m: "/mnt/my files", err: os.ErrInvalid},
+		{m: "/mnt/tab\there", err: os.ErrInvalid},
+		{m: "mnt", err: os.ErrInvalid},
+		{m: "/", err: os.ErrInvalid},
+		{m: "//", err: os.ErrInvalid},
+	} {
+		got, err := checkMountpoint(tt.m)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("checkMountpoint(%q): (%q, %v) != (%q, %v)", tt.m, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestMountpoint(t *testing.T) {
+	defer func(m string, nfs bool) { *mountpoint, *srvnfs = m, nfs }(*mountpoint, *srvnfs)
+	*mountpoint, *srvnfs = "/mnt/sidecore", true
+
+	if got, want := namespaceToFSTab("/usr:ro"), "/mnt/sidecore/usr /usr none defaults,bind,ro 0 0\n"; got != want {
+		t.Errorf("namespaceToFSTab, -mountpoint %s: %q != %q", *mountpoint, got, want)
+	}
+	e := &nfsExport{nonce: "abc", port: 2049}
+	if f := strings.Fields(e.fstab()); len(f) != 6 || f[1] != *mountpoint {
+		t.Errorf("nfs fstab, -mountpoint %s: %q does not mount on it", *mountpoint, e.fstab())
+	}
+	home := t.TempDir()
+	cwd := filepath.Join(home, "me")
+	d, err := remoteDir(dirAuto, cwd, home)
+	if err != nil || !strings.HasPrefix(d, *mountpoint+"/") || !strings.HasSuffix(d, "/me") {
+		t.Errorf("remoteDir(auto), -mountpoint %s: (%q, %v) is not under it", *mountpoint, d, err)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The nfs mount is tuned with -nfs-rsize, -nfs-wsize, -nfs-soft and
+// -nfs-timeo, e.g. soft,timeo=50 on a slow link, or with -nfs-opts,
+// which takes any options mount.nfs(8) does, and beats them.
+var (
+	nfsRsize = flag.Int("nfs-rsize", 1048576, "nfs read size, in bytes, a multiple of 1024 from 1024 to 1048576")
+	nfsWsize = flag.Int("nfs-wsize", 1048576, "nfs write size, in bytes, a multiple of 1024 from 1024 to 1048576")
+	nfsSoft  = flag.Bool("nfs-soft", false, "mount nfs soft, so that a lost link fails reads and writes after -nfs-timeo and retrans tries, rather than hanging")
+	nfsTimeo = flag.Int("nfs-timeo", 600, "nfs timeout, in tenths of a second, from 1 to 6000, before a request is retried")
+	nfsOpts  = flag.String("nfs-opts", "", "comma-separated nfs mount options, e.g. soft,timeo=50,retrans=5, added to or replacing those of the nfs mount; they beat -nfs-rsize and the others")
+)
+
+// nfsOptions are the options, from the -nfs flags, which change those
+// of nfsDefaultOptions. flags sets them.
+var nfsOptions []string
+
+// nfsDefaultOptions are the options the nfs mount has unless they are
+// changed. %d is the nfs server's port.
+var nfsDefaultOptions = []string{"rw", "relatime", "vers=3", "rsize=1048576", "wsize=1048576", "namlen=255", "hard", "nolock", "proto=tcp", "port=%d", "timeo=600", "retrans=2", "sec=sys", "mountaddr=127.0.0.1", "mountvers=3", "mountport=%d", "mountproto=tcp", "local_lock=all", "addr=127.0.0.1"}
+
+// nfsFixed are the options sidecore's nfs server needs as they are. It
+// has no lock manager, so it must be nolock.
+var nfsFixed = map[string]bool{"vers": true, "nfsvers": true, "proto": true, "port": true, "addr": true, "mountaddr": true, "mountvers": true, "mountport": true, "mountproto": true, "lock": true, "nolock": true}
+
+// nfsRanges are the values numeric options may have.
+var nfsRanges = map[string]struct{ min, max, step int }{
+	"rsize":   {1024, 1048576, 1024},
+	"wsize":   {1024, 1048576, 1024},
+	"timeo":   {1, 6000, 1},
+	"retrans": {0, 100, 1},
+}
+
+// nfsOptionKey returns what an option sets: for key=value, key, and
+// for options which undo each other, e.g. soft and hard, the same key.
+func nfsOptionKey(o string) string {
+	k, _, _ := strings.Cut(o, "=")
+	switch k {
+	case "soft", "hard":
+		return "hard"
+	case "ro", "rw":
+		return "rw"
+	case "nfsvers":
+		return "vers"
+	}
+	return k
+}
+
+// checkNFSOption checks an option of -nfs-opts or the other -nfs flags.
+func checkNFSOption(o string) error {
+	if len(o) == 0 || strings.IndexFunc(o, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("nfs option %q: want key or key=value, with no white space:%w", o, os.ErrInvalid)
+	}
+	k, v, hasValue := strings.Cut(o, "=")
+	if nfsFixed[k] {
+		return fmt.Errorf("nfs option %q: sidecore's nfs server needs %s as it is:%w", o, k, os.ErrInvalid)
+	}
+	r, ok := nfsRanges[k]
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if !hasValue || err != nil || n < r.min || n > r.max || n%r.step != 0 {
+		s := ""
+		if r.step > 1 {
+			s = fmt.Sprintf(", a multiple of %d", r.step)
+		}
+		return fmt.Errorf("nfs option %q: want %s=n%s, from %d to %d:%w", o, k, s, r.min, r.max, os.ErrInvalid)
+	}
+	return nil
+}
+
+// nfsFlagOptions returns the options the -nfs flags set, or an error
+// if one is not valid.
+func nfsFlagOptions() ([]string, error) {
+	opts := []string{"rsize=" + strconv.Itoa(*nfsRsize), "wsize=" + strconv.Itoa(*nfsWsize), "timeo=" + strconv.Itoa(*nfsTimeo)}
+	if *nfsSoft {
+		opts = append(opts, "soft")
+	}
+	if len(*nfsOpts) > 0 {
+		opts = append(opts, strings.Split(*nfsOpts, ",")...)
+	}
+	for _, o := range opts {
+		if err := checkNFSOption(o); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// nfsMountOptions returns the options for the nfs mount, with the
+// nfs server on port: those of nfsDefaultOptions, each replaced by the
+// last of opts which sets the same thing, followed by the rest of opts.
+func nfsMountOptions(opts []string, port uint64) string {
+	all := make([]string, len(nfsDefaultOptions))
+	for i, o := range nfsDefaultOptions {
+		if strings.Contains(o, "%d") {
+			o = fmt.Sprintf(o, port)
+		}
+		all[i] = o
+	}
+	at := map[string]int{}
+	for i, o := range all {
+		at[nfsOptionKey(o)] = i
+	}
+	for _, o := range opts {
+		k := nfsOptionKey(o)
+		if i, ok := at[k]; ok {
+			all[i] = o
+			continue
+		}
+		at[k] = len(all)
+		all = append(all, o)
+	}
+	return strings.Join(all, ",")
+}
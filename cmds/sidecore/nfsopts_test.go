@@ -0,0 +1,88 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNFSOptions(t *testing.T) {
+	defer func(r, w, to int, soft bool, opts string, o []string) {
+		*nfsRsize, *nfsWsize, *nfsTimeo, *nfsSoft, *nfsOpts, nfsOptions = r, w, to, soft, opts, o
+	}(*nfsRsize, *nfsWsize, *nfsTimeo, *nfsSoft, *nfsOpts, nfsOptions)
+	for _, tt := range []struct {
+		name  string
+		rsize int
+		wsize int
+		timeo int
+		soft  bool
+		opts  string
+		want  map[string]string
+		err   error
+	}{
+		{name: "defaults", want: map[string]string{"rsize": "1048576", "wsize": "1048576", "timeo": "600", "hard": "hard", "retrans": "2", "port": "2049", "mountport": "2049"}},
+		{name: "flags", rsize: 65536, wsize: 32768, timeo: 50, soft: true, want: map[string]string{"rsize": "65536", "wsize": "32768", "timeo": "50", "hard": "soft"}},
+		{name: "opts beat flags", timeo: 50, opts: "hard,timeo=100,retrans=5", want: map[string]string{"timeo": "100", "hard": "hard", "retrans": "5"}},
+		{name: "opts add", opts: "noac,actimeo=0", want: map[string]string{"noac": "noac", "actimeo": "0", "rw": "rw"}},
+		{name: "ro", opts: "ro", want: map[string]string{"rw": "ro"}},
+		{name: "last wins", opts: "soft,hard,soft", want: map[string]string{"hard": "soft"}},
+		{name: "rsize too big", rsize: 2097152, err: os.ErrInvalid},
+		{name: "rsize not a multiple", rsize: 1000, err: os.ErrInvalid},
+		{name: "timeo 0", opts: "timeo=0", err: os.ErrInvalid},
+		{name: "timeo not a number", opts: "timeo=fast", err: os.ErrInvalid},
+		{name: "timeo no value", opts: "timeo", err: os.ErrInvalid},
+		{name: "port", opts: "port=2050", err: os.ErrInvalid},
+		{name: "vers", opts: "nfsvers=4", err: os.ErrInvalid},
+		{name: "lock", opts: "lock", err: os.ErrInvalid},
+		{name: "empty", opts: "soft,,hard", err: os.ErrInvalid},
+		{name: "space", opts: "soft, hard", err: os.ErrInvalid},
+	} {
+		*nfsRsize, *nfsWsize, *nfsTimeo, *nfsSoft, *nfsOpts = 1048576, 1048576, 600, tt.soft, tt.opts
+		if tt.rsize != 0 {
+			*nfsRsize = tt.rsize
+		}
+		if tt.wsize != 0 {
+			*nfsWsize = tt.wsize
+		}
+		if tt.timeo != 0 {
+			*nfsTimeo = tt.timeo
+		}
+		var err error
+		nfsOptions, err = nfsFlagOptions()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: nfsFlagOptions: %v != %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		l := (&nfsExport{nonce: "abc", port: 2049}).fstab()
+		f := strings.Fields(l)
+		if len(f) != 6 || f[2] != "nfs" {
+			t.Errorf("%s: %q is not an nfs fstab line", tt.name, l)
+			continue
+		}
+		got := map[string]string{}
+		for _, o := range strings.Split(f[3], ",") {
+			k := nfsOptionKey(o)
+			if _, ok := got[k]; ok {
+				t.Errorf("%s: %q sets %s more than once", tt.name, f[3], k)
+			}
+			_, v, ok := strings.Cut(o, "=")
+			if !ok {
+				v = o
+			}
+			got[k] = v
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%s: %s: %q != %q", tt.name, k, got[k], v)
+			}
+		}
+	}
+}
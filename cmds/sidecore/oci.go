@@ -0,0 +1,627 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// A container may be an image in an OCI registry, e.g.
+// oci://docker.io/library/ubuntu:24.04. It is pulled, for the arch,
+// its layers applied in order, and flattened into a cpio in
+// SIDECORE_IMAGES, named as the others are, e.g.
+// amd64-ubuntu@24.04.cpio, which is then used as any other.
+const ociPrefix = "oci://"
+
+// ociContainer returns the image of an oci: container, and whether it
+// is one.
+func ociContainer(c string) (string, bool) {
+	return strings.CutPrefix(c, ociPrefix)
+}
+
+// ociRef is an image in a registry: its registry, repository, and tag
+// or digest.
+type ociRef struct {
+	registry string
+	repo     string
+	tag      string
+	digest   string
+}
+
+// dockerHub is the registry of images which do not name one, and
+// registryHosts are the hosts which serve registries by other names.
+const dockerHub = "docker.io"
+
+var registryHosts = map[string]string{
+	"docker.io":       "registry-1.docker.io",
+	"index.docker.io": "registry-1.docker.io",
+}
+
+// parseOCIRef parses an image as docker pull names it:
+// [registry/]repository[:tag][@digest]. The registry is docker.io,
+// whose images with one name are in library/, and the tag latest,
+// unless they are named.
+func parseOCIRef(s string) (*ociRef, error) {
+	r := &ociRef{registry: dockerHub}
+	name := s
+	if h, rest, ok := strings.Cut(s, "/"); ok && (strings.ContainsAny(h, ".:") || h == "localhost") {
+		r.registry, name = h, rest
+	}
+	if n, d, ok := strings.Cut(name, "@"); ok {
+		name, r.digest = n, d
+		if _, err := digestHex(d); err != nil {
+			return nil, fmt.Errorf("%s: %w", s, err)
+		}
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.tag = name[:i], name[i+1:]
+	} else {
+		r.tag = "latest"
+	}
+	if r.registry == dockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if len(name) == 0 || path.Clean(name) != name || strings.HasPrefix(name, "/") || strings.HasPrefix(name, ".") || strings.Contains(r.tag, "/") {
+		return nil, fmt.Errorf("%s: not an image, as [registry/]repository[:tag][@digest]:%w", s, os.ErrInvalid)
+	}
+	r.repo = name
+	return r, nil
+}
+
+// ref returns the reference of the image's manifest: its digest, if it
+// was named, or its tag.
+func (r *ociRef) ref() string {
+	if len(r.digest) > 0 {
+		return r.digest
+	}
+	return r.tag
+}
+
+// container returns the name of the image's container for arch: its
+// repository's last name is the distro, and its tag, or digest, the
+// version, e.g. amd64-ubuntu@24.04.cpio.
+func (r *ociRef) container(arch string) string {
+	v := r.tag
+	if len(r.digest) > 0 {
+		h, _ := digestHex(r.digest)
+		v = "sha256-" + h[:12]
+	}
+	return containerName(arch, path.Base(r.repo), v)
+}
+
+// digestHex returns the hex of a sha256 digest, which names a blob,
+// and, in the cache, its file.
+func digestHex(d string) (string, error) {
+	h, ok := strings.CutPrefix(d, "sha256:")
+	if b, err := hex.DecodeString(h); !ok || err != nil || len(b) != sha256.Size || strings.ToLower(h) != h {
+		return "", fmt.Errorf("digest %q: not a sha256:%w", d, os.ErrInvalid)
+	}
+	return h, nil
+}
+
+// The manifests a registry is asked for: an index, of the manifests
+// of each platform, or a manifest, of one.
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// ociDescriptor names a blob, or, in an index, a manifest.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+// ociManifest is an index, with Manifests, or a manifest, with Config
+// and Layers.
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// registry pulls from one repository of a registry, with a token, if
+// it asks for one.
+type registry struct {
+	base  string
+	token string
+}
+
+func newRegistry(r *ociRef) *registry {
+	h := r.registry
+	if rh, ok := registryHosts[h]; ok {
+		h = rh
+	}
+	return &registry{base: "https://" + h + "/v2/" + r.repo}
+}
+
+// do does a request, with the registry's token. If the registry asks
+// for one, and there is none, it is got, anonymously, from where the
+// registry says, and the request done again.
+func (r *registry) do(req *http.Request) (*http.Response, error) {
+	if len(r.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || len(r.token) > 0 {
+		return resp, err
+	}
+	c := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if r.token, err = registryToken(c); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	return imageClient.Do(req)
+}
+
+// challengeParams are the params of a WWW-Authenticate challenge.
+var challengeParams = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryToken gets an anonymous token for a Bearer challenge, as
+// e.g. Docker Hub's registry makes.
+func registryToken(challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("registry wants %q authentication; only anonymous Bearer tokens are supported:%w", scheme, os.ErrPermission)
+	}
+	p := map[string]string{}
+	for _, m := range challengeParams.FindAllStringSubmatch(params, -1) {
+		p[m[1]] = m[2]
+	}
+	u, err := url.Parse(p["realm"])
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", fmt.Errorf("registry token realm %q:%w", p["realm"], os.ErrInvalid)
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := p[k]; ok {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	resp, err := imageClient.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token: %s:%w", resp.Status, os.ErrPermission)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("registry token: %w", err)
+	}
+	if len(t.Token) == 0 {
+		t.Token = t.AccessToken
+	}
+	if len(t.Token) == 0 {
+		return "", fmt.Errorf("registry token: none given:%w", os.ErrPermission)
+	}
+	return t.Token, nil
+}
+
+// get gets a small thing, a manifest or config, from the repository.
+func (r *registry) get(p string, accept ...string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, r.base+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %s:%w", r.base+p, resp.Status, os.ErrNotExist)
+	default:
+		return nil, fmt.Errorf("%s: %s", r.base+p, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+}
+
+// manifest returns the manifest of ref for linux on arch, and its
+// digest, which, if ref is an index, is of the manifest chosen from it.
+func (r *registry) manifest(ref, arch string) (*ociManifest, string, error) {
+	b, err := r.get("/manifests/"+ref, manifestTypes...)
+	if err != nil {
+		return nil, "", err
+	}
+	var m ociManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, "", fmt.Errorf("manifest %s: %w", ref, err)
+	}
+	if len(m.Manifests) == 0 {
+		return &m, fmt.Sprintf("sha256:%x", sha256.Sum256(b)), nil
+	}
+	var have []string
+	for _, d := range m.Manifests {
+		if d.Platform.OS == "linux" && d.Platform.Architecture == arch {
+			return r.manifest(d.Digest, arch)
+		}
+		have = append(have, d.Platform.OS+"/"+d.Platform.Architecture)
+	}
+	return nil, "", fmt.Errorf("no linux/%s image; there are %s:%w", arch, strings.Join(have, ", "), os.ErrNotExist)
+}
+
+// checkConfig warns if an image, which has one manifest, is not for
+// arch.
+func (r *registry) checkConfig(m *ociManifest, arch string) {
+	if len(m.Config.Digest) == 0 {
+		return
+	}
+	b, err := r.get("/blobs/" + m.Config.Digest)
+	if err != nil {
+		verbose("config %s: %v", m.Config.Digest, err)
+		return
+	}
+	var c struct {
+		Architecture string `json:"architecture"`
+	}
+	if err := json.Unmarshal(b, &c); err == nil && len(c.Architecture) > 0 && c.Architecture != arch {
+		info("warning: the image is for %s, not %s", c.Architecture, arch)
+	}
+}
+
+// blobDir returns where blobs are cached, by digest, so that images
+// which share layers, or are pulled again, download them once.
+func blobDir() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "sidecore", "blobs", "sha256"), nil
+}
+
+// fetchBlob returns the cached file of a blob, downloading it, as
+// fetchImage does, if it is not cached.
+func (r *registry) fetchBlob(digest string) (string, error) {
+	h, err := digestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	d, err := blobDir()
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(d, h)
+	if _, err := os.Stat(p); err == nil {
+		verbose("blob %s: cached", digest)
+		return p, nil
+	}
+	if err := os.MkdirAll(d, 0755); err != nil {
+		return "", err
+	}
+	sum, _ := hex.DecodeString(h)
+	part := p + ".part"
+	err = fetchPart(r.base+"/blobs/"+digest, part, r.do)
+	if err == nil {
+		err = checkSum(part, sum)
+	}
+	if errors.Is(err, errBadSum) {
+		os.Remove(part)
+	}
+	if err != nil {
+		return "", err
+	}
+	return p, os.Rename(part, p)
+}
+
+// pullImage returns the container of an oci: image, for arch. The
+// manifest is always got, so that a tag which has moved is pulled
+// again; the digest it was pulled at is kept beside the container,
+// in name.digest. If the registry can not be reached, a container
+// pulled before is used. Without pull, e.g. for -dry-run, only the
+// name of the container is returned.
+func pullImage(image, arch string, pull bool) (string, error) {
+	ref, err := parseOCIRef(image)
+	if err != nil {
+		return "", fmt.Errorf("%s%s: %w", ociPrefix, image, err)
+	}
+	dst, _ := searchContainer(ref.container(arch))
+	if !pull {
+		return dst, nil
+	}
+	r := newRegistry(ref)
+	m, digest, err := r.manifest(ref.ref(), arch)
+	if err != nil {
+		if _, serr := os.Stat(dst); serr == nil {
+			info("warning: %s%s: %v; using %s, pulled before", ociPrefix, image, err, dst)
+			return dst, nil
+		}
+		return "", fmt.Errorf("%s%s: %w", ociPrefix, image, err)
+	}
+	if b, err := os.ReadFile(dst + ".digest"); err == nil && strings.TrimSpace(string(b)) == digest {
+		if _, err := os.Stat(dst); err == nil {
+			verbose("%s%s: %s is %s", ociPrefix, image, dst, digest)
+			return dst, nil
+		}
+	}
+	r.checkConfig(m, arch)
+	var layers []io.Reader
+	for _, l := range m.Layers {
+		p, err := r.fetchBlob(l.Digest)
+		if err != nil {
+			return "", fmt.Errorf("%s%s: layer %s: %w", ociPrefix, image, l.Digest, err)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		layers = append(layers, f)
+	}
+	if err := flattenImage(layers, dst); err != nil {
+		return "", fmt.Errorf("%s%s: %w", ociPrefix, image, err)
+	}
+	if err := writeFileAtomic(dst+".digest", []byte(digest+"\n")); err != nil {
+		verbose("%s.digest: %v", dst, err)
+	}
+	info("%s%s: pulled into %s", ociPrefix, image, dst)
+	return dst, nil
+}
+
+// ociEntry is a file of an image: its header, the layer it is from,
+// and, for a regular file, where its contents are in the spool, and,
+// for a hard link, the file it links to.
+type ociEntry struct {
+	hdr   tar.Header
+	layer int
+	off   int64
+	link  string
+}
+
+// ociTree is an image, as its layers are applied: its files, by name,
+// and the spool which holds their contents.
+type ociTree struct {
+	files map[string]*ociEntry
+	spool *os.File
+	size  int64
+}
+
+// removeUnder removes the files in dir from layers before layer.
+func (t *ociTree) removeUnder(dir string, layer int) {
+	for n, e := range t.files {
+		if under(n, dir) && e.layer < layer {
+			delete(t.files, n)
+		}
+	}
+}
+
+// apply applies a layer, a tar, which may be gzipped. A whiteout,
+// .wh.name, removes name, and an opaque whiteout, .wh..wh..opq, what
+// is in its directory, from the layers before.
+func (t *ociTree) apply(r io.Reader, layer int) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		z, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		r = z
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return fmt.Errorf("zstd layers are not supported:%w", os.ErrInvalid)
+	default:
+		r = br
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n := archiveName(h.Name)
+		dir, base := path.Dir(n), path.Base(n)
+		if base == ".wh..wh..opq" {
+			t.removeUnder(dir, layer)
+			continue
+		}
+		if w, ok := strings.CutPrefix(base, ".wh."); ok {
+			w = path.Join(dir, w)
+			t.removeUnder(w, layer)
+			delete(t.files, w)
+			continue
+		}
+		e := &ociEntry{hdr: *h, layer: layer}
+		switch h.Typeflag {
+		case tar.TypeReg:
+			e.off = t.size
+			m, err := io.Copy(t.spool, tr)
+			if err != nil {
+				return fmt.Errorf("%s: %w", h.Name, err)
+			}
+			t.size += m
+		case tar.TypeLink:
+			// A hard link is a copy of what it links to,
+			// sharing its contents in the spool, and, in
+			// the cpio, its inode.
+			l, ok := t.files[archiveName(h.Linkname)]
+			if !ok || l.hdr.Typeflag != tar.TypeReg {
+				verbose("%s: link to %s, which is not a file; skipped", h.Name, h.Linkname)
+				continue
+			}
+			e.hdr, e.off, e.link = l.hdr, l.off, archiveName(h.Linkname)
+			if len(l.link) > 0 {
+				e.link = l.link
+			}
+		case tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			continue
+		}
+		if o, ok := t.files[n]; ok && o.hdr.Typeflag == tar.TypeDir && h.Typeflag != tar.TypeDir {
+			t.removeUnder(n, layer+1)
+		}
+		t.files[n] = e
+	}
+}
+
+// record returns the cpio record of a file.
+func (t *ociTree) record(n string, e *ociEntry, ino uint64) cpio.Record {
+	return tarRecord(n, &e.hdr, io.NewSectionReader(t.spool, e.off, e.hdr.Size), ino)
+}
+
+// tarRecord returns the cpio record of a file in a tar, named n, whose
+// contents, if it is a regular file, are in data.
+func tarRecord(n string, h *tar.Header, data io.ReaderAt, ino uint64) cpio.Record {
+	var mtime uint64
+	if s := h.ModTime.Unix(); s > 0 {
+		mtime = uint64(s)
+	}
+	r := cpio.Record{Info: cpio.Info{
+		Ino:   ino,
+		Mode:  uint64(h.Mode) & 07777,
+		UID:   uint64(h.Uid),
+		GID:   uint64(h.Gid),
+		NLink: 1,
+		MTime: mtime,
+		Name:  n,
+	}}
+	switch h.Typeflag {
+	case tar.TypeDir:
+		r.Mode |= cpio.S_IFDIR
+		r.NLink = 2
+	case tar.TypeReg:
+		r.Mode |= cpio.S_IFREG
+		r.FileSize = uint64(h.Size)
+		r.ReaderAt = data
+	case tar.TypeSymlink:
+		r.Mode |= cpio.S_IFLNK
+		r.FileSize = uint64(len(h.Linkname))
+		r.ReaderAt = strings.NewReader(h.Linkname)
+	case tar.TypeChar:
+		r.Mode |= cpio.S_IFCHR
+		r.Rmajor, r.Rminor = uint64(h.Devmajor), uint64(h.Devminor)
+	case tar.TypeBlock:
+		r.Mode |= cpio.S_IFBLK
+		r.Rmajor, r.Rminor = uint64(h.Devmajor), uint64(h.Devminor)
+	case tar.TypeFifo:
+		r.Mode |= cpio.S_IFIFO
+	}
+	return r
+}
+
+// write writes the tree as a newc cpio. The root is first, and each
+// directory before what is in it, as fsCPIO needs; directories which
+// no layer has are made. A hard link has the inode of the file it
+// links to, if a later layer has not replaced it, and its contents.
+func (t *ociTree) write(w io.Writer) error {
+	for n := range t.files {
+		for d := path.Dir(n); d != "."; d = path.Dir(d) {
+			if _, ok := t.files[d]; !ok {
+				t.files[d] = &ociEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Mode: 0755}}
+			}
+		}
+	}
+	if _, ok := t.files["."]; !ok {
+		t.files["."] = &ociEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Mode: 0755}}
+	}
+	names := make([]string, 0, len(t.files))
+	for n := range t.files {
+		names = append(names, n)
+	}
+	sortArchiveNames(names)
+	inos := make(map[string]uint64, len(names))
+	for i, n := range names {
+		inos[n] = uint64(i + 1)
+	}
+	nlink := map[uint64]uint64{}
+	for _, n := range names {
+		e := t.files[n]
+		if l, ok := t.files[e.link]; ok && len(e.link) > 0 && l.hdr.Typeflag == tar.TypeReg && l.off == e.off {
+			inos[n] = inos[e.link]
+		}
+		nlink[inos[n]]++
+	}
+	rw := cpio.Newc.Writer(w)
+	for _, n := range names {
+		r := t.record(n, t.files[n], inos[n])
+		if l := nlink[r.Ino]; l > 1 {
+			r.NLink = l
+		}
+		if err := rw.WriteRecord(r); err != nil {
+			return err
+		}
+	}
+	return cpio.WriteTrailer(rw)
+}
+
+// flattenImage applies layers, in order, and writes the result, as a
+// cpio, to dst, by way of a temporary file, so that dst is only ever
+// whole. The contents of the files are spooled beside it.
+func flattenImage(layers []io.Reader, dst string) error {
+	d := filepath.Dir(dst)
+	if err := os.MkdirAll(d, 0755); err != nil {
+		return err
+	}
+	spool, err := os.CreateTemp(d, ".sidecore-spool-*")
+	if err != nil {
+		return err
+	}
+	remove := func() { spool.Close(); os.Remove(spool.Name()) }
+	atExit(remove)
+	defer remove()
+	t := &ociTree{files: map[string]*ociEntry{}, spool: spool}
+	for i, l := range layers {
+		if err := t.apply(l, i); err != nil {
+			return fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+	out, err := os.CreateTemp(d, filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	atExit(func() { os.Remove(out.Name()) })
+	defer os.Remove(out.Name())
+	bw := bufio.NewWriter(out)
+	err = t.write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
@@ -0,0 +1,387 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseOCIRef(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want ociRef
+		name string
+		err  error
+	}{
+		{in: "ubuntu", want: ociRef{registry: "docker.io", repo: "library/ubuntu", tag: "latest"}, name: "amd64-ubuntu@latest.cpio"},
+		{in: "ubuntu:24.04", want: ociRef{registry: "docker.io", repo: "library/ubuntu", tag: "24.04"}, name: "amd64-ubuntu@24.04.cpio"},
+		{in: "docker.io/library/ubuntu:24.04", want: ociRef{registry: "docker.io", repo: "library/ubuntu", tag: "24.04"}, name: "amd64-ubuntu@24.04.cpio"},
+		{in: "ghcr.io/u-root/alpine", want: ociRef{registry: "ghcr.io", repo: "u-root/alpine", tag: "latest"}, name: "amd64-alpine@latest.cpio"},
+		{in: "localhost:5000/x/debian:12", want: ociRef{registry: "localhost:5000", repo: "x/debian", tag: "12"}, name: "amd64-debian@12.cpio"},
+		{in: "u-root/alpine:edge", want: ociRef{registry: "docker.io", repo: "u-root/alpine", tag: "edge"}, name: "amd64-alpine@edge.cpio"},
+		{
+			in:   "alpine@sha256:" + strings.Repeat("ab", 32),
+			want: ociRef{registry: "docker.io", repo: "library/alpine", digest: "sha256:" + strings.Repeat("ab", 32)},
+			name: "amd64-alpine@sha256-abababababab.cpio",
+		},
+		{in: "alpine@sha256:abab", err: os.ErrInvalid},
+		{in: "", err: os.ErrInvalid},
+		{in: "quay.io/../etc", err: os.ErrInvalid},
+	} {
+		r, err := parseOCIRef(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("parseOCIRef(%q): %v != %v", tt.in, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(*r, tt.want) {
+			t.Errorf("parseOCIRef(%q): %+v != %+v", tt.in, *r, tt.want)
+		}
+		if got := r.container("amd64"); got != tt.name {
+			t.Errorf("parseOCIRef(%q).container(amd64): %q != %q", tt.in, got, tt.name)
+		}
+	}
+}
+
+// tarFile is a file in a test layer.
+type tarFile struct {
+	name, body, link string
+	typ              byte
+}
+
+// layer returns a layer, a tar, gzipped if z.
+func layer(t *testing.T, z bool, files ...tarFile) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	var w io.Writer = &b
+	var zw *gzip.Writer
+	if z {
+		zw = gzip.NewWriter(&b)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		h := &tar.Header{Name: f.name, Typeflag: f.typ, Mode: 0644, Size: int64(len(f.body)), Linkname: f.link, ModTime: time.Unix(1700000000, 0)}
+		if f.typ == tar.TypeDir {
+			h.Mode = 0755
+		}
+		if f.typ != tar.TypeReg {
+			h.Size = 0
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil && f.typ == tar.TypeReg {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// testLayers are two layers, the second with whiteouts.
+func testLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		layer(t, true,
+			tarFile{name: "./", typ: tar.TypeDir},
+			tarFile{name: "etc/", typ: tar.TypeDir},
+			tarFile{name: "etc/passwd", body: "root:x:0:0::/root:/bin/sh\n", typ: tar.TypeReg},
+			tarFile{name: "etc/gone", body: "gone", typ: tar.TypeReg},
+			tarFile{name: "usr/lib/old", body: "old", typ: tar.TypeReg},
+			tarFile{name: "bin/sh", body: "#!sh", typ: tar.TypeReg},
+			tarFile{name: "bin/ash", link: "bin/sh", typ: tar.TypeLink},
+			tarFile{name: "var", typ: tar.TypeDir},
+			tarFile{name: "var/log/x", body: "x", typ: tar.TypeReg},
+		),
+		layer(t, false,
+			tarFile{name: "etc/.wh.gone", typ: tar.TypeReg},
+			tarFile{name: "usr/lib/new", body: "new", typ: tar.TypeReg},
+			tarFile{name: "usr/lib/.wh..wh..opq", typ: tar.TypeReg},
+			tarFile{name: "var", link: "/tmp", typ: tar.TypeSymlink},
+		),
+	}
+}
+
+// cpioFiles returns the names of the files in a cpio, in order, and
+// the contents of the regular ones and symlinks.
+func cpioFiles(t *testing.T, c string) ([]string, map[string]string) {
+	t.Helper()
+	fs, err := NewfsCPIO(c)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%s): %v", c, err)
+	}
+	var names []string
+	body := map[string]string{}
+	for i, r := range fs.recs {
+		if i == len(fs.recs)-1 && r.Name == "TRAILER!!!" {
+			break
+		}
+		names = append(names, r.Name)
+		if r.ReaderAt != nil && r.FileSize > 0 {
+			b := make([]byte, r.FileSize)
+			if _, err := r.ReadAt(b, 0); err != nil && err != io.EOF {
+				t.Fatalf("%s: %v", r.Name, err)
+			}
+			body[r.Name] = string(b)
+		}
+	}
+	return names, body
+}
+
+func TestFlattenImage(t *testing.T) {
+	d := t.TempDir()
+	var layers []io.Reader
+	for _, l := range testLayers(t) {
+		layers = append(layers, bytes.NewReader(l))
+	}
+	dst := filepath.Join(d, "images", "amd64-test@1.cpio")
+	if err := flattenImage(layers, dst); err != nil {
+		t.Fatalf("flattenImage: %v != nil", err)
+	}
+	names, body := cpioFiles(t, dst)
+	want := []string{".", "bin", "bin/ash", "bin/sh", "etc", "etc/passwd", "usr", "usr/lib", "usr/lib/new", "var"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files: %q != %q", names, want)
+	}
+	for n, b := range map[string]string{"etc/passwd": "root:x:0:0::/root:/bin/sh\n", "bin/ash": "#!sh", "usr/lib/new": "new", "var": "/tmp"} {
+		if body[n] != b {
+			t.Errorf("%s: %q != %q", n, body[n], b)
+		}
+	}
+	// bin/ash is a hard link to bin/sh.
+	fs, err := NewfsCPIO(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inos := map[string]uint64{}
+	for _, r := range fs.recs {
+		if r.Name == "bin/sh" || r.Name == "bin/ash" {
+			inos[r.Name] = r.Ino
+			if r.NLink != 2 {
+				t.Errorf("%s: nlink %d != 2", r.Name, r.NLink)
+			}
+		}
+	}
+	if inos["bin/sh"] != inos["bin/ash"] {
+		t.Errorf("bin/sh, bin/ash: inode %d != %d", inos["bin/sh"], inos["bin/ash"])
+	}
+	// Only the cpio is left.
+	f, err := filepath.Glob(filepath.Join(d, "images", "*"))
+	if err != nil || len(f) != 1 {
+		t.Errorf("images: %q, %v != just the cpio", f, err)
+	}
+}
+
+// testRegistry is a registry of one image, with an index for amd64 and
+// arm64, which, as Docker Hub does, wants a token.
+type testRegistry struct {
+	t      *testing.T
+	blobs  map[string][]byte
+	index  []byte
+	mu     sync.Mutex
+	pulled []string
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{t: t, blobs: map[string][]byte{}}
+	add := func(b []byte) ociDescriptor {
+		d := fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+		r.blobs[d] = b
+		return ociDescriptor{Digest: d, Size: int64(len(b))}
+	}
+	var m ociManifest
+	m.Config = add([]byte(`{"architecture":"amd64","os":"linux"}`))
+	for _, l := range testLayers(t) {
+		m.Layers = append(m.Layers, add(l))
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd := add(b)
+	amd.Platform.OS, amd.Platform.Architecture = "linux", "amd64"
+	arm := add([]byte(`{"layers":[]}`))
+	arm.Platform.OS, arm.Platform.Architecture = "linux", "arm64"
+	if r.index, err = json.Marshal(ociManifest{Manifests: []ociDescriptor{arm, amd}}); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if req.URL.Query().Get("scope") != "repository:library/test:pull" {
+			http.Error(w, "bad scope", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token":"t0k3n"}`)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer t0k3n" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test",scope="repository:library/test:pull"`, req.Host))
+		http.Error(w, "token", http.StatusUnauthorized)
+		return
+	}
+	p, ok := strings.CutPrefix(req.URL.Path, "/v2/library/test/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	r.mu.Lock()
+	r.pulled = append(r.pulled, p)
+	r.mu.Unlock()
+	switch {
+	case p == "manifests/1":
+		w.Write(r.index)
+	case strings.HasPrefix(p, "manifests/"):
+		b, ok := r.blobs[strings.TrimPrefix(p, "manifests/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(b)
+	case strings.HasPrefix(p, "blobs/"):
+		b, ok := r.blobs[strings.TrimPrefix(p, "blobs/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, p, time.Time{}, bytes.NewReader(b))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// blobsPulled returns how many layers, of the image's manifest, were
+// pulled.
+func (r *testRegistry) blobsPulled() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int
+	for _, p := range r.pulled {
+		if strings.HasPrefix(p, "blobs/") {
+			n++
+		}
+	}
+	r.pulled = nil
+	return n
+}
+
+func TestPullImage(t *testing.T) {
+	defer func(c *http.Client) { imageClient = c }(imageClient)
+	reg := newTestRegistry(t)
+	ts := httptest.NewTLSServer(reg)
+	defer ts.Close()
+	imageClient = ts.Client()
+	images := t.TempDir()
+	t.Setenv("SIDECORE_IMAGES", images)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	img := strings.TrimPrefix(ts.URL, "https://") + "/library/test:1"
+
+	// Without pulling, only the name is returned.
+	p, err := pullImage(img, "amd64", false)
+	want := filepath.Join(images, "amd64-test@1.cpio")
+	if err != nil || p != want {
+		t.Fatalf("pullImage(%s, amd64, false): %q, %v != %q, nil", img, p, err, want)
+	}
+	if _, err := os.Stat(want); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("%s: %v != %v", want, err, os.ErrNotExist)
+	}
+
+	if p, err = pullImage(img, "amd64", true); err != nil || p != want {
+		t.Fatalf("pullImage(%s, amd64, true): %q, %v != %q, nil", img, p, err, want)
+	}
+	names, _ := cpioFiles(t, p)
+	if len(names) != 10 || names[0] != "." {
+		t.Errorf("%s: %q, want 10 files, the root first", p, names)
+	}
+	// The config, and two layers.
+	if n := reg.blobsPulled(); n != 3 {
+		t.Errorf("blobs pulled: %d != 3", n)
+	}
+
+	// Pulling again, at the same digest, uses the container.
+	if p, err = pullImage(img, "amd64", true); err != nil || p != want {
+		t.Fatalf("pullImage again: %q, %v != %q, nil", p, err, want)
+	}
+	if n := reg.blobsPulled(); n != 0 {
+		t.Errorf("blobs pulled again: %d != 0", n)
+	}
+
+	// A new container for the digest is flattened from the cache.
+	if err := os.Remove(want + ".digest"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = pullImage(img, "amd64", true); err != nil || p != want {
+		t.Fatalf("pullImage with no digest: %q, %v != %q, nil", p, err, want)
+	}
+	if n := reg.blobsPulled(); n != 1 {
+		t.Errorf("blobs pulled with the layers cached: %d != 1, the config", n)
+	}
+
+	// The registry has no riscv64 image.
+	if _, err := pullImage(img, "riscv64", true); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("pullImage(%s, riscv64): %v != %v", img, err, os.ErrNotExist)
+	}
+
+	// If the registry can not be reached, the container pulled
+	// before is used.
+	ts.Close()
+	if p, err = pullImage(img, "amd64", true); err != nil || p != want {
+		t.Errorf("pullImage with no registry: %q, %v != %q, nil", p, err, want)
+	}
+	left, _ := filepath.Glob(filepath.Join(images, "*"))
+	sort.Strings(left)
+	if !reflect.DeepEqual(left, []string{want, want + ".digest"}) {
+		t.Errorf("images: %q != the cpio and its digest", left)
+	}
+}
+
+func TestCheckContainerOCI(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		err error
+	}{
+		{in: "oci://docker.io/library/ubuntu:24.04"},
+		{in: "oci://alpine"},
+		{in: "oci://", err: os.ErrInvalid},
+		{in: "oci://alpine@md5:1234", err: os.ErrInvalid},
+	} {
+		got, err := checkContainer(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("checkContainer(%q): %v != %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && got != tt.in {
+			t.Errorf("checkContainer(%q): %q != %q", tt.in, got, tt.in)
+		}
+	}
+}
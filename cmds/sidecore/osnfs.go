@@ -8,32 +8,49 @@ import (
 	osfs "github.com/go-git/go-billy/v5/osfs"
 )
 
+// NewOSFS returns a billy.Filesystem of the directory r. It is a
+// billy.Change, so that the files of a mount of it may be chmodded,
+// chowned and touched.
 func NewOSFS(r string) billy.Filesystem {
 	bfs := osfs.New(r, osfs.WithBoundOS())
-	return bfs
+	return COS{bfs}
 }
 
 // COS or OSFS + Change wraps a billy.FS to not fail the `Change` interface.
+// A billy.FS which is a billy.Change, e.g. an fsCPIO, changes its own
+// files.
 type COS struct {
 	billy.Filesystem
 }
 
 // Chmod changes mode
 func (fs COS) Chmod(name string, mode os.FileMode) error {
+	if c, ok := fs.Filesystem.(billy.Change); ok {
+		return c.Chmod(name, mode)
+	}
 	return os.Chmod(fs.Join(fs.Root(), name), mode)
 }
 
 // Lchown changes ownership
 func (fs COS) Lchown(name string, uid, gid int) error {
+	if c, ok := fs.Filesystem.(billy.Change); ok {
+		return c.Lchown(name, uid, gid)
+	}
 	return os.Lchown(fs.Join(fs.Root(), name), uid, gid)
 }
 
 // Chown changes ownership
 func (fs COS) Chown(name string, uid, gid int) error {
+	if c, ok := fs.Filesystem.(billy.Change); ok {
+		return c.Chown(name, uid, gid)
+	}
 	return os.Chown(fs.Join(fs.Root(), name), uid, gid)
 }
 
 // Chtimes changes access time
 func (fs COS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if c, ok := fs.Filesystem.(billy.Change); ok {
+		return c.Chtimes(name, atime, mtime)
+	}
 	return os.Chtimes(fs.Join(fs.Root(), name), atime, mtime)
 }
@@ -0,0 +1,79 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// prefixWriter is an io.WriteCloser which writes each line
+// to an underlying writer with a prefix, as pdsh does.
+// Partial lines are held until they are complete, or
+// until Close is called.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+var _ io.WriteCloser = &prefixWriter{}
+
+// errPrefix returns the prefix for a cpu's stderr, given that for its
+// stdout, e.g. "a:17010! " for "a:17010 ", so that the two can still be
+// told apart once they are merged, e.g. with 2>&1.
+func errPrefix(prefix string) string {
+	return strings.TrimSuffix(prefix, " ") + "! "
+}
+
+// newPrefixWriter returns a prefixWriter.
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+// Write implements io.Writer. Each complete line is written
+// to the underlying writer in one Write, so that lines from
+// several prefixWriters sharing a writer do not interleave.
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.line(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// line writes one line, with the prefix.
+func (p *prefixWriter) line(l []byte) error {
+	out := make([]byte, 0, len(p.prefix)+len(l))
+	out = append(out, p.prefix...)
+	out = append(out, l...)
+	_, err := p.w.Write(out)
+	return err
+}
+
+// Close flushes any partial line, adding a newline.
+// The underlying writer is not closed.
+func (p *prefixWriter) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) == 0 {
+		return nil
+	}
+	l := append(p.buf, '\n')
+	p.buf = nil
+	return p.line(l)
+}
@@ -0,0 +1,43 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := newPrefixWriter(&b, "h:17010 ")
+	for _, s := range []string{"a line\nanother", " line\n", "", "partial"} {
+		if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("Write(%q): (%d, %v) != (%d, nil)", s, n, err, len(s))
+		}
+	}
+	want := "h:17010 a line\nh:17010 another line\n"
+	if b.String() != want {
+		t.Errorf("before Close: %q != %q", b.String(), want)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v != nil", err)
+	}
+	want += "h:17010 partial\n"
+	if b.String() != want {
+		t.Errorf("after Close: %q != %q", b.String(), want)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("second Close: %v != nil", err)
+	}
+	if b.String() != want {
+		t.Errorf("after second Close: %q != %q", b.String(), want)
+	}
+}
+
+func TestErrPrefix(t *testing.T) {
+	if got, want := errPrefix("h:17010 "), "h:17010! "; got != want {
+		t.Errorf("errPrefix: %q != %q", got, want)
+	}
+}
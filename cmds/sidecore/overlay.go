@@ -0,0 +1,567 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// A cpio container, served with nfs, may be written: what is written
+// outside the mounts goes to an overlay, a temporary directory which
+// is removed at exit, and reads look in it first. A file of the
+// container is copied up into it when it is first written, or its
+// mode or times changed; one which is removed, or renamed, is covered
+// by a whiteout, with what is under it, until it is made again in the
+// overlay. -overlay=off leaves the container read only.
+var overlayFlag = flag.String("overlay", "on", "with nfs, on, to write changes to a cpio container to a temporary overlay, which is discarded at exit, or off, for the container to be read only")
+
+// checkOverlay checks -overlay, which is on or off.
+func checkOverlay(o string) error {
+	if o != "on" && o != "off" {
+		return fmt.Errorf("-overlay %q: want on or off:%w", o, os.ErrInvalid)
+	}
+	return nil
+}
+
+// overlay is the writable layer of an fsCPIO. What is written is in
+// upper; files are copied up in work, and renamed into upper, so what
+// is in upper is never half copied.
+type overlay struct {
+	upper string
+	work  string
+	fs    billy.Filesystem
+	// mu serializes changes, so that a file is copied up once.
+	mu        sync.Mutex
+	whiteouts whiteouts
+}
+
+// whiteouts are the names of records which were removed, or renamed.
+// They, and what is under them, are not there, though what the
+// overlay has of the same names is.
+type whiteouts struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+// add adds a whiteout for n.
+func (w *whiteouts) add(n string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.m == nil {
+		w.m = map[string]bool{}
+	}
+	w.m[n] = true
+	verbose("overlay: whiteout %q; %d in all", n, len(w.m))
+}
+
+// covers returns whether n, or a directory it is in, has a whiteout.
+func (w *whiteouts) covers(n string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.m) == 0 {
+		return false
+	}
+	for ; n != "."; n = path.Dir(n) {
+		if w.m[n] {
+			return true
+		}
+	}
+	return false
+}
+
+// overlayDir is the CPIOOption WithOverlay returns.
+type overlayDir string
+
+// apply adds an overlay, in d, to an fsCPIO.
+func (d overlayDir) apply(fs *fsCPIO) error {
+	o := &overlay{upper: filepath.Join(string(d), "upper"), work: filepath.Join(string(d), "work")}
+	for _, p := range []string{o.upper, o.work} {
+		if err := os.MkdirAll(p, 0700); err != nil {
+			return fmt.Errorf("overlay: %w", err)
+		}
+	}
+	o.fs = NewOSFS(o.upper)
+	fs.overlay = o
+	return nil
+}
+
+// WithOverlay makes an fsCPIO writable, with what is written kept in
+// dir.
+func WithOverlay(dir string) CPIOOption {
+	return overlayDir(dir)
+}
+
+// newOverlayDir returns a temporary directory for an overlay, which is
+// removed at exit.
+func newOverlayDir() (string, error) {
+	d, err := os.MkdirTemp("", "sidecore-overlay-")
+	if err != nil {
+		return "", err
+	}
+	atExit(func() { os.RemoveAll(d) })
+	verbose("overlay in %s", d)
+	return d, nil
+}
+
+// overlayPerm returns the mode a file has in the overlay: the owner,
+// sidecore, may always read and write it, and search a directory, as
+// it must to write what is in it, whatever mode it is given.
+func overlayPerm(m os.FileMode) os.FileMode {
+	if m.IsDir() {
+		return m.Perm() | 0700
+	}
+	return m.Perm() | 0600
+}
+
+// hostPath returns where n is in upper, if the directories it is in
+// are directories, not symlinks, which could lead out of it.
+func (o *overlay) hostPath(n string) (string, error) {
+	p := o.upper
+	parts := strings.Split(n, "/")
+	for _, e := range parts[:len(parts)-1] {
+		p = filepath.Join(p, e)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", &os.PathError{Op: "lstat", Path: n, Err: syscall.ENOTDIR}
+		}
+	}
+	return filepath.Join(o.upper, filepath.FromSlash(n)), nil
+}
+
+// mkdir makes the directory n, in a directory upper has.
+func (o *overlay) mkdir(n string, perm os.FileMode) error {
+	p, err := o.hostPath(n)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(p, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(p, overlayPerm(perm|os.ModeDir))
+}
+
+// Chmod implements billy.Change. A symlink has no mode of its own.
+func (o *overlay) Chmod(n string, mode os.FileMode) error {
+	p, err := o.hostPath(n)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chmod(p, overlayPerm(fi.Mode().Type()|mode.Perm()))
+}
+
+// Lchown implements billy.Change.
+func (o *overlay) Lchown(n string, uid, gid int) error {
+	p, err := o.hostPath(n)
+	if err != nil {
+		return err
+	}
+	return os.Lchown(p, uid, gid)
+}
+
+// Chown implements billy.Change. A symlink is not followed, since
+// what it links to is a name in the container, not in upper.
+func (o *overlay) Chown(n string, uid, gid int) error {
+	return o.Lchown(n, uid, gid)
+}
+
+// Chtimes implements billy.Change. A symlink's times can not be set.
+func (o *overlay) Chtimes(n string, atime time.Time, mtime time.Time) error {
+	p, err := o.hostPath(n)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+var _ billy.Change = &overlay{}
+
+// upper returns what the overlay has of n, if it has it.
+func (fs *fsCPIO) upper(n string) (os.FileInfo, bool) {
+	if fs.overlay == nil {
+		return nil, false
+	}
+	if n = archiveName(n); n == "." {
+		return nil, false
+	}
+	fi, err := fs.overlay.fs.Lstat(n)
+	return fi, err == nil
+}
+
+// base returns the record of n, if the container has it, and it has
+// no whiteout.
+func (fs *fsCPIO) base(n string) (*cpio.Record, bool) {
+	l, err := fs.lookup(n)
+	if err != nil {
+		return nil, false
+	}
+	return &fs.recs[l.(*file).Path], true
+}
+
+// mergeDir returns what the directory n has: what the overlay has,
+// and what the container has, of other names, less the whiteouts.
+// base and err are what the container has, and whether it has n.
+func (fs *fsCPIO) mergeDir(n string, base []os.FileInfo, err error) ([]os.FileInfo, error) {
+	up, uerr := fs.overlay.fs.ReadDir(n)
+	if uerr != nil {
+		if err != nil {
+			return nil, err
+		}
+		up = nil
+	}
+	names := map[string]bool{}
+	for _, f := range up {
+		names[f.Name()] = true
+	}
+	fi := up
+	for _, f := range base {
+		if !names[f.Name()] && !fs.overlay.whiteouts.covers(path.Join(n, f.Name())) {
+			fi = append(fi, f)
+		}
+	}
+	sort.Slice(fi, func(i, j int) bool { return fi[i].Name() < fi[j].Name() })
+	return fi, nil
+}
+
+// copyUpParents makes the directories n is in, as the container has
+// them, in the overlay.
+func (fs *fsCPIO) copyUpParents(n string) error {
+	d := path.Dir(n)
+	if d == "." {
+		return nil
+	}
+	if fi, ok := fs.upper(d); ok {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "open", Path: n, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	fi, err := fs.Lstat(d)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: "open", Path: n, Err: syscall.ENOTDIR}
+	}
+	if err := fs.copyUpParents(d); err != nil {
+		return err
+	}
+	return fs.overlay.mkdir(d, fi.Mode())
+}
+
+// copyUp copies the record n, a directory, symlink or file, into the
+// overlay, with the directories it is in, if it is not there.
+func (fs *fsCPIO) copyUp(n string) error {
+	if _, ok := fs.upper(n); ok {
+		return nil
+	}
+	r, ok := fs.base(n)
+	if !ok {
+		return &os.PathError{Op: "open", Path: n, Err: os.ErrNotExist}
+	}
+	if err := fs.copyUpParents(n); err != nil {
+		return err
+	}
+	o := fs.overlay
+	m := uToGo(r.Mode)
+	switch {
+	case m.IsDir():
+		return o.mkdir(n, m)
+	case m&os.ModeSymlink != 0:
+		l, err := recordLink(*r)
+		if err != nil {
+			return err
+		}
+		return o.fs.Symlink(l, n)
+	case !m.IsRegular():
+		return &os.PathError{Op: "open", Path: n, Err: fmt.Errorf("%v can not be copied up:%w", m.Type(), os.ErrPermission)}
+	}
+	verbose("overlay: copying up %q", n)
+	p, err := o.hostPath(n)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(o.work, "copyup")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, recordData(*r))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", n, err)
+	}
+	if err := os.Chmod(f.Name(), overlayPerm(m)); err != nil {
+		return err
+	}
+	t := recordTime(r, fs.mtime)
+	if err := os.Chtimes(f.Name(), t, t); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// writeFlags are the flags of OpenFile which write.
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+// overlayOpenFile opens n, to write it, in the overlay: copied up, if
+// the container has it, or made, with O_CREATE, if it does not.
+func (fs *fsCPIO) overlayOpenFile(n string, flag int, perm os.FileMode) (billy.File, error) {
+	o := fs.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n = archiveName(n); n == "." {
+		return nil, &os.PathError{Op: "open", Path: n, Err: syscall.EISDIR}
+	}
+	if _, ok := fs.upper(n); !ok {
+		r, ok := fs.base(n)
+		switch {
+		case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+			return nil, &os.PathError{Op: "open", Path: n, Err: os.ErrExist}
+		case ok && uToGo(r.Mode).IsDir():
+			return nil, &os.PathError{Op: "open", Path: n, Err: syscall.EISDIR}
+		case ok:
+			if err := fs.copyUp(n); err != nil {
+				return nil, err
+			}
+		case flag&os.O_CREATE == 0:
+			return nil, &os.PathError{Op: "open", Path: n, Err: os.ErrNotExist}
+		default:
+			if err := fs.copyUpParents(n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return o.fs.OpenFile(n, flag, overlayPerm(perm))
+}
+
+// overlayTempFile makes a temporary file in dir, in the overlay.
+func (fs *fsCPIO) overlayTempFile(dir, prefix string) (billy.File, error) {
+	o := fs.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	dir = archiveName(dir)
+	fi, err := fs.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: syscall.ENOTDIR}
+	}
+	if dir != "." {
+		if err := fs.copyUp(dir); err != nil {
+			return nil, err
+		}
+	}
+	f, err := o.fs.TempFile(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &tempFile{File: f, name: mergedName(".", o.fs, f.Name())}, nil
+}
+
+// overlayMkdirAll makes the directory n, and those it is in, which
+// are not there, in the overlay.
+func (fs *fsCPIO) overlayMkdirAll(n string, perm os.FileMode) error {
+	o := fs.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n = archiveName(n)
+	if fi, err := fs.Lstat(n); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: n, Err: syscall.ENOTDIR}
+	}
+	// d is the first directory which is not there.
+	d := n
+	for p := path.Dir(d); p != "."; p = path.Dir(p) {
+		if _, err := fs.Lstat(p); err == nil {
+			break
+		}
+		d = p
+	}
+	if err := fs.copyUpParents(d); err != nil {
+		return err
+	}
+	return o.fs.MkdirAll(n, overlayPerm(perm|os.ModeDir))
+}
+
+// overlaySymlink makes the symlink n, to target, in the overlay.
+func (fs *fsCPIO) overlaySymlink(target, n string) error {
+	o := fs.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n = archiveName(n)
+	if _, err := fs.Lstat(n); err == nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: n, Err: os.ErrExist}
+	}
+	if err := fs.copyUpParents(n); err != nil {
+		return err
+	}
+	return o.fs.Symlink(target, n)
+}
+
+// overlayRemove removes n, a file, or an empty directory, from the
+// overlay, and adds a whiteout for the record of it, if there is one.
+func (fs *fsCPIO) overlayRemove(n string) error {
+	o := fs.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n = archiveName(n); n == "." {
+		return &os.PathError{Op: "remove", Path: n, Err: os.ErrPermission}
+	}
+	fi, err := fs.Lstat(n)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		ents, err := fs.ReadDir(n)
+		if err != nil {
+			return err
+		}
+		if len(ents) > 0 {
+			return &os.PathError{Op: "remove", Path: n, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if _, ok := fs.upper(n); ok {
+		if err := o.fs.Remove(n); err != nil {
+			return err
+		}
+	}
+	if _, ok := fs.base(n); ok {
+		o.whiteouts.add(n)
+	}
+	return nil
+}
+
+// overlayRename renames a file, or symlink, or a directory the
+// container does not have, in the overlay, copying it up first. A
+// directory of the container is EXDEV, as it is across file systems,
+// so mv copies what is in it, and removes it, itself.
+func (fs *fsCPIO) overlayRename(from, to string) error {
+	o := fs.overlay
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	from, to = archiveName(from), archiveName(to)
+	if _, _, err := fs.getfs(to); err == nil || from == "." || to == "." {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+	fi, err := fs.Lstat(from)
+	if err != nil {
+		return err
+	}
+	_, inBase := fs.base(from)
+	if fi.IsDir() && inBase {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+	if tfi, err := fs.Lstat(to); err == nil {
+		switch {
+		case tfi.IsDir() && !fi.IsDir():
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EISDIR}
+		case !tfi.IsDir() && fi.IsDir():
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.ENOTDIR}
+		case tfi.IsDir():
+			ents, err := fs.ReadDir(to)
+			if err != nil {
+				return err
+			}
+			if len(ents) > 0 {
+				return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+	if err := fs.copyUp(from); err != nil {
+		return err
+	}
+	if err := fs.copyUpParents(to); err != nil {
+		return err
+	}
+	if err := o.fs.Rename(from, to); err != nil {
+		return err
+	}
+	if inBase {
+		o.whiteouts.add(from)
+	}
+	return nil
+}
+
+// change changes n, with f: in its mount, if it is in one and the
+// mount can be changed, or else, copied up, in the overlay.
+func (fs *fsCPIO) change(n string, f func(c billy.Change, n string) error) error {
+	if osfs, rel, err := fs.getfs(n); err == nil {
+		c, ok := osfs.(billy.Change)
+		if !ok {
+			return os.ErrPermission
+		}
+		return f(c, rel)
+	}
+	o := fs.overlay
+	if o == nil {
+		return os.ErrPermission
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n = archiveName(n); n == "." {
+		return os.ErrPermission
+	}
+	if err := fs.copyUp(n); err != nil {
+		return err
+	}
+	return f(o, n)
+}
+
+// Chmod implements billy.Change.
+func (fs *fsCPIO) Chmod(n string, mode os.FileMode) error {
+	return fs.change(n, func(c billy.Change, n string) error { return c.Chmod(n, mode) })
+}
+
+// Lchown implements billy.Change.
+func (fs *fsCPIO) Lchown(n string, uid, gid int) error {
+	return fs.change(n, func(c billy.Change, n string) error { return c.Lchown(n, uid, gid) })
+}
+
+// Chown implements billy.Change.
+func (fs *fsCPIO) Chown(n string, uid, gid int) error {
+	return fs.change(n, func(c billy.Change, n string) error { return c.Chown(n, uid, gid) })
+}
+
+// Chtimes implements billy.Change.
+func (fs *fsCPIO) Chtimes(n string, atime time.Time, mtime time.Time) error {
+	return fs.change(n, func(c billy.Change, n string) error { return c.Chtimes(n, atime, mtime) })
+}
+
+var _ billy.Change = &fsCPIO{}
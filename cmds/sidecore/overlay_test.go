@@ -0,0 +1,369 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// testOverlay returns an fsCPIO, with an overlay, of a cpio with etc,
+// with hosts and passwd in it, and a symlink, lib, to usr/lib.
+func testOverlay(t *testing.T, opts ...CPIOOption) *fsCPIO {
+	t.Helper()
+	c := writeCPIO(t, t.TempDir(), "o.cpio",
+		cpio.Directory(".", 0755),
+		cpio.Directory("etc", 0755),
+		cpio.StaticFile("etc/hosts", "127.0.0.1 localhost\n", 0644),
+		cpio.StaticFile("etc/passwd", "root:x:0:0::/root:/bin/sh\n", 0644),
+		cpio.Symlink("lib", "usr/lib"),
+		cpio.Directory("usr", 0755),
+		cpio.Directory("usr/lib", 0755),
+	)
+	fs, err := NewfsCPIO(c, append([]CPIOOption{WithOverlay(t.TempDir())}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%q, WithOverlay(...)): %v != nil", c, err)
+	}
+	return fs
+}
+
+// readAll reads all of n.
+func readAll(t *testing.T, fs *fsCPIO, n string) string {
+	t.Helper()
+	f, err := fs.Open(n)
+	if err != nil {
+		t.Fatalf("Open(%q): %v != nil", n, err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll(%q): %v != nil", n, err)
+	}
+	return string(b)
+}
+
+// dirNames returns the names ReadDir returns for n.
+func dirNames(t *testing.T, fs *fsCPIO, n string) []string {
+	t.Helper()
+	fi, err := fs.ReadDir(n)
+	if err != nil {
+		t.Fatalf("ReadDir(%q): %v != nil", n, err)
+	}
+	var names []string
+	for _, f := range fi {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+func TestOverlayWrite(t *testing.T) {
+	fs := testOverlay(t)
+	f, err := fs.Create("etc/motd")
+	if err != nil {
+		t.Fatalf("Create(\"etc/motd\"): %v != nil", err)
+	}
+	if _, err := f.Write([]byte("hi\n")); err != nil {
+		t.Fatalf("Write(\"etc/motd\"): %v != nil", err)
+	}
+	f.Close()
+	if got := readAll(t, fs, "etc/motd"); got != "hi\n" {
+		t.Errorf("etc/motd: %q != %q", got, "hi\n")
+	}
+
+	// The file is copied up, and written where it is written.
+	f, err = fs.OpenFile("/etc/hosts", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(\"/etc/hosts\", O_RDWR): %v != nil", err)
+	}
+	if _, err := f.Write([]byte("10")); err != nil {
+		t.Fatalf("Write(\"etc/hosts\"): %v != nil", err)
+	}
+	f.Close()
+	if got, want := readAll(t, fs, "etc/hosts"), "107.0.0.1 localhost\n"; got != want {
+		t.Errorf("etc/hosts: %q != %q", got, want)
+	}
+	fi, err := fs.Stat("etc/hosts")
+	if err != nil || fi.Mode() != 0644 {
+		t.Errorf("Stat(\"etc/hosts\"): %v, %v != %v, nil", fi.Mode(), err, os.FileMode(0644))
+	}
+	r, _ := fs.base("etc/hosts")
+	if b, _ := io.ReadAll(recordData(*r)); string(b) != "127.0.0.1 localhost\n" {
+		t.Errorf("the record of etc/hosts: %q != %q", b, "127.0.0.1 localhost\n")
+	}
+
+	if err := fs.MkdirAll("usr/local/bin", 0755); err != nil {
+		t.Fatalf("MkdirAll(\"usr/local/bin\"): %v != nil", err)
+	}
+	if fi, err := fs.Stat("usr/local/bin"); err != nil || !fi.IsDir() {
+		t.Errorf("Stat(\"usr/local/bin\"): %v, %v != a directory, nil", fi, err)
+	}
+	if err := fs.MkdirAll("etc/hosts/x", 0755); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("MkdirAll(\"etc/hosts/x\"): %v != %v", err, syscall.ENOTDIR)
+	}
+	if _, err := fs.OpenFile("etc", os.O_WRONLY, 0); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("OpenFile(\"etc\", O_WRONLY): %v != %v", err, syscall.EISDIR)
+	}
+	if _, err := fs.OpenFile("etc/passwd", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !errors.Is(err, os.ErrExist) {
+		t.Errorf("OpenFile(\"etc/passwd\", O_CREATE|O_EXCL): %v != %v", err, os.ErrExist)
+	}
+	if _, err := fs.OpenFile("var/log/x", os.O_WRONLY|os.O_CREATE, 0644); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("OpenFile(\"var/log/x\", O_CREATE): %v != %v", err, os.ErrNotExist)
+	}
+
+	if err := fs.Symlink("hosts", "etc/h"); err != nil {
+		t.Fatalf("Symlink(\"hosts\", \"etc/h\"): %v != nil", err)
+	}
+	if l, err := fs.Readlink("etc/h"); err != nil || l != "hosts" {
+		t.Errorf("Readlink(\"etc/h\"): %q, %v != \"hosts\", nil", l, err)
+	}
+	if err := fs.Symlink("x", "lib"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Symlink(\"x\", \"lib\"): %v != %v", err, os.ErrExist)
+	}
+	if got, want := dirNames(t, fs, "etc"), []string{"h", "hosts", "motd", "passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"etc\"): %q != %q", got, want)
+	}
+	if got, want := dirNames(t, fs, "/"), []string{"etc", "lib", "usr"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"/\"): %q != %q", got, want)
+	}
+}
+
+func TestOverlayRemove(t *testing.T) {
+	fs := testOverlay(t)
+	if err := fs.Remove("etc"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("Remove(\"etc\"): %v != %v", err, syscall.ENOTEMPTY)
+	}
+	for _, n := range []string{"etc/passwd", "etc/hosts", "lib"} {
+		if err := fs.Remove(n); err != nil {
+			t.Errorf("Remove(%q): %v != nil", n, err)
+		}
+		if _, err := fs.Lstat(n); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Lstat(%q) after Remove: %v != %v", n, err, os.ErrNotExist)
+		}
+	}
+	if err := fs.Remove("etc/passwd"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Remove(\"etc/passwd\") again: %v != %v", err, os.ErrNotExist)
+	}
+	if got := dirNames(t, fs, "etc"); len(got) != 0 {
+		t.Errorf("ReadDir(\"etc\"): %q != []", got)
+	}
+	if err := fs.Remove("etc"); err != nil {
+		t.Fatalf("Remove(\"etc\"): %v != nil", err)
+	}
+	if got, want := dirNames(t, fs, "."), []string{"usr"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\".\"): %q != %q", got, want)
+	}
+
+	// What is made again is not hidden, but what was under it is.
+	if err := fs.MkdirAll("etc", 0755); err != nil {
+		t.Fatalf("MkdirAll(\"etc\"): %v != nil", err)
+	}
+	if _, err := fs.Lstat("etc/hosts"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lstat(\"etc/hosts\") in a new etc: %v != %v", err, os.ErrNotExist)
+	}
+	if got := dirNames(t, fs, "etc"); len(got) != 0 {
+		t.Errorf("ReadDir(\"etc\"): %q != []", got)
+	}
+}
+
+func TestOverlayRename(t *testing.T) {
+	fs := testOverlay(t)
+	if err := fs.Rename("etc/hosts", "etc/hosts.old"); err != nil {
+		t.Fatalf("Rename(\"etc/hosts\", \"etc/hosts.old\"): %v != nil", err)
+	}
+	if _, err := fs.Lstat("etc/hosts"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lstat(\"etc/hosts\") after Rename: %v != %v", err, os.ErrNotExist)
+	}
+	if got := readAll(t, fs, "etc/hosts.old"); got != "127.0.0.1 localhost\n" {
+		t.Errorf("etc/hosts.old: %q != %q", got, "127.0.0.1 localhost\n")
+	}
+	if err := fs.Rename("etc/hosts.old", "usr/hosts"); err != nil {
+		t.Fatalf("Rename(\"etc/hosts.old\", \"usr/hosts\"): %v != nil", err)
+	}
+	if got, want := dirNames(t, fs, "etc"), []string{"passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"etc\"): %q != %q", got, want)
+	}
+	if got, want := dirNames(t, fs, "usr"), []string{"hosts", "lib"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"usr\"): %q != %q", got, want)
+	}
+	if err := fs.Rename("etc", "etc2"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("Rename(\"etc\", \"etc2\"): %v != %v", err, syscall.EXDEV)
+	}
+	if err := fs.Rename("usr/hosts", "usr/lib"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("Rename(\"usr/hosts\", \"usr/lib\"): %v != %v", err, syscall.EISDIR)
+	}
+	if err := fs.Rename("nothere", "etc/x"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Rename(\"nothere\", \"etc/x\"): %v != %v", err, os.ErrNotExist)
+	}
+}
+
+func TestOverlayChange(t *testing.T) {
+	fs := testOverlay(t)
+	if err := fs.Chmod("etc/hosts", 0640); err != nil {
+		t.Fatalf("Chmod(\"etc/hosts\", 0640): %v != nil", err)
+	}
+	mtime := time.Unix(1<<30, 0)
+	if err := fs.Chtimes("etc/hosts", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes(\"etc/hosts\"): %v != nil", err)
+	}
+	fi, err := fs.Stat("etc/hosts")
+	if err != nil {
+		t.Fatalf("Stat(\"etc/hosts\"): %v != nil", err)
+	}
+	if fi.Mode() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Stat(\"etc/hosts\"): %v, %v != %v, %v", fi.Mode(), fi.ModTime(), os.FileMode(0640), mtime)
+	}
+	if got := readAll(t, fs, "etc/hosts"); got != "127.0.0.1 localhost\n" {
+		t.Errorf("etc/hosts: %q != %q", got, "127.0.0.1 localhost\n")
+	}
+	if err := fs.Chmod(".", 0700); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Chmod(\".\"): %v != %v", err, os.ErrPermission)
+	}
+}
+
+func TestOverlayOff(t *testing.T) {
+	fs, err := NewfsCPIO("data/a.cpio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Create("a/x"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Create(\"a/x\"): %v != %v", err, os.ErrPermission)
+	}
+	if _, err := fs.OpenFile("a/b/c/d/hosts", os.O_RDWR, 0); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("OpenFile(\"a/b/c/d/hosts\", O_RDWR): %v != %v", err, os.ErrPermission)
+	}
+	if err := fs.Chmod("a/b/c/d/hosts", 0600); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Chmod(\"a/b/c/d/hosts\"): %v != %v", err, os.ErrPermission)
+	}
+	if err := fs.Remove("a/b/c/d/hosts"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Remove(\"a/b/c/d/hosts\"): %v != %v", err, os.ErrPermission)
+	}
+	if f, err := fs.OpenFile("a/b/c/d/hosts", os.O_RDONLY, 0); err != nil {
+		t.Errorf("OpenFile(\"a/b/c/d/hosts\", O_RDONLY): %v != nil", err)
+	} else {
+		f.Close()
+	}
+
+	if err := checkOverlay("maybe"); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("checkOverlay(\"maybe\"): %v != %v", err, os.ErrInvalid)
+	}
+}
+
+func TestOverlayWhiteout(t *testing.T) {
+	fs := testOverlay(t)
+	// rm /etc/hosts && ln -s /run/hosts /etc/hosts
+	if err := fs.Remove("etc/hosts"); err != nil {
+		t.Fatalf("Remove(\"etc/hosts\"): %v != nil", err)
+	}
+	for _, n := range []string{"etc/hosts", "/etc/hosts", "./etc/hosts"} {
+		if _, err := fs.Stat(n); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat(%q) after Remove: %v != %v", n, err, os.ErrNotExist)
+		}
+		if _, err := fs.Open(n); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Open(%q) after Remove: %v != %v", n, err, os.ErrNotExist)
+		}
+	}
+	if got, want := dirNames(t, fs, "etc"), []string{"passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"etc\") after Remove: %q != %q", got, want)
+	}
+	if err := fs.Symlink("/run/hosts", "etc/hosts"); err != nil {
+		t.Fatalf("Symlink(\"/run/hosts\", \"etc/hosts\"): %v != nil", err)
+	}
+	if l, err := fs.Readlink("etc/hosts"); err != nil || l != "/run/hosts" {
+		t.Errorf("Readlink(\"etc/hosts\"): %q, %v != \"/run/hosts\", nil", l, err)
+	}
+
+	// A file removed, and made again, has only what it was made with.
+	if err := fs.Remove("etc/passwd"); err != nil {
+		t.Fatalf("Remove(\"etc/passwd\"): %v != nil", err)
+	}
+	f, err := fs.Create("etc/passwd")
+	if err != nil {
+		t.Fatalf("Create(\"etc/passwd\") after Remove: %v != nil", err)
+	}
+	f.Write([]byte("glenda:x:1000:1000::/home/glenda:/bin/rc\n"))
+	f.Close()
+	if got, want := readAll(t, fs, "etc/passwd"), "glenda:x:1000:1000::/home/glenda:/bin/rc\n"; got != want {
+		t.Errorf("etc/passwd: %q != %q", got, want)
+	}
+	if got, want := dirNames(t, fs, "etc"), []string{"hosts", "passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"etc\"): %q != %q", got, want)
+	}
+	// Removed again, the record is still covered.
+	if err := fs.Remove("etc/passwd"); err != nil {
+		t.Fatalf("Remove(\"etc/passwd\") again: %v != nil", err)
+	}
+	if _, err := fs.Lstat("etc/passwd"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lstat(\"etc/passwd\") after the second Remove: %v != %v", err, os.ErrNotExist)
+	}
+}
+
+func TestOverlayRenameOverBase(t *testing.T) {
+	fs := testOverlay(t)
+	f, err := fs.Create("etc/hosts.new")
+	if err != nil {
+		t.Fatalf("Create(\"etc/hosts.new\"): %v != nil", err)
+	}
+	f.Write([]byte("::1 localhost\n"))
+	f.Close()
+	if err := fs.Rename("etc/hosts.new", "etc/hosts"); err != nil {
+		t.Fatalf("Rename(\"etc/hosts.new\", \"etc/hosts\"): %v != nil", err)
+	}
+	if got, want := readAll(t, fs, "etc/hosts"), "::1 localhost\n"; got != want {
+		t.Errorf("etc/hosts: %q != %q", got, want)
+	}
+	if got, want := dirNames(t, fs, "etc"), []string{"hosts", "passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"etc\"): %q != %q", got, want)
+	}
+
+	// A file of the container, renamed over another, is copied up,
+	// and leaves a whiteout.
+	if err := fs.Rename("etc/passwd", "etc/hosts"); err != nil {
+		t.Fatalf("Rename(\"etc/passwd\", \"etc/hosts\"): %v != nil", err)
+	}
+	if got, want := readAll(t, fs, "etc/hosts"), "root:x:0:0::/root:/bin/sh\n"; got != want {
+		t.Errorf("etc/hosts: %q != %q", got, want)
+	}
+	if got, want := dirNames(t, fs, "etc"), []string{"hosts"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(\"etc\"): %q != %q", got, want)
+	}
+	if err := fs.Remove("etc/hosts"); err != nil {
+		t.Fatalf("Remove(\"etc/hosts\"): %v != nil", err)
+	}
+	if _, err := fs.Lstat("etc/hosts"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lstat(\"etc/hosts\") after Remove: %v != %v", err, os.ErrNotExist)
+	}
+	if err := fs.Remove("etc"); err != nil {
+		t.Errorf("Remove(\"etc\"), empty: %v != nil", err)
+	}
+}
+
+func TestOverlayTempFile(t *testing.T) {
+	fs := testOverlay(t)
+	f, err := fs.TempFile("/etc", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile(\"/etc\", \"tmp\"): %v != nil", err)
+	}
+	defer f.Close()
+	if !strings.HasPrefix(f.Name(), "etc/tmp") {
+		t.Errorf("TempFile(\"/etc\", \"tmp\"): Name() %q does not start with \"etc/tmp\"", f.Name())
+	}
+	if _, err := fs.Lstat(f.Name()); err != nil {
+		t.Errorf("Lstat(%q): %v != nil", f.Name(), err)
+	}
+	if got := dirNames(t, fs, "etc"); len(got) != 3 {
+		t.Errorf("ReadDir(\"etc\"): %q != hosts, passwd and the temporary file", got)
+	}
+	if _, err := fs.TempFile("etc/hosts", "tmp"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("TempFile(\"etc/hosts\", \"tmp\"): %v != %v", err, syscall.ENOTDIR)
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// getProxy reads ProxyJump and ProxyCommand for a host alias from
+// the ssh config. As in ssh, ProxyJump wins if both are set.
+// The ProxyCommand is returned with its %h, %p, %r, and %n
+// tokens expanded, using host, port, and user.
+func getProxy(alias, host, port, user string) ([]string, string) {
+	if j := sshConfig.Get(alias, "ProxyJump"); len(j) > 0 && j != "none" {
+		verbose("ProxyJump for %q is %q", alias, j)
+		return splitHosts(j), ""
+	}
+	pc := sshConfig.Get(alias, "ProxyCommand")
+	if len(pc) == 0 || pc == "none" {
+		return nil, ""
+	}
+	verbose("ProxyCommand for %q is %q", alias, pc)
+	return nil, strings.NewReplacer("%%", "%", "%h", host, "%p", port, "%r", user, "%n", alias).Replace(pc)
+}
+
+// hop is one ProxyJump host.
+type hop struct {
+	user, host, port string
+}
+
+// parseHop parses a ProxyJump host, which is
+// [user@]host[:port] or ssh://[user@]host[:port].
+func parseHop(s string) hop {
+	user, host := splitUser(strings.TrimPrefix(s, "ssh://"))
+	h := hop{user: user, host: host}
+	if hh, p, err := net.SplitHostPort(host); err == nil {
+		h.host, h.port = hh, p
+	}
+	return h
+}
+
+// sshIdentities are the keys ssh tries if none are named.
+var sshIdentities = []string{"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519"}
+
+// hopKeyFiles returns the key files for a jump host. As for ssh,
+// these are the keys given with -i, and the host's IdentityFiles
+// from the ssh config, or, if there are none, the keys ssh tries
+// by default. cpu_rsa is for cpud, so it is not used.
+func hopKeyFiles(host, port string) ([]string, error) {
+	cfs, err := configKeyFiles(host, port)
+	if err != nil {
+		return nil, err
+	}
+	kfs := append(append([]string{}, identities...), cfs...)
+	if len(kfs) == 0 {
+		kfs = sshIdentities
+	}
+	return getKeyFile(host, port, kfs)
+}
+
+// dialHop logs in to a jump host, through prev if it is not nil.
+// The user, port, and keys for the jump host are found
+// in the ssh config, as they are for ssh. Unlike cpud,
+// jump hosts run a normal sshd, so the default port is 22.
+func dialHop(prev *ossh.Client, h hop) (*ossh.Client, error) {
+	port := h.port
+	if len(port) == 0 {
+		port = sshConfig.Get(h.host, "Port")
+	}
+	user := h.user
+	if len(user) == 0 {
+		user = getUser(h.host)
+	}
+	a := dialAgent()
+	defer a.Close()
+	kfs, err := hopKeyFiles(h.host, port)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %q: %w", h.host, err)
+	}
+	signers, err := keys(a, kfs, certFiles(h.host))
+	if err != nil {
+		return nil, fmt.Errorf("jump host %q: %w", h.host, err)
+	}
+	host, err := getHostName(h.host, port)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, port)
+	verbose("jump to %s@%s", user, addr)
+	var conn net.Conn
+	if prev == nil {
+		conn, err = net.Dial("tcp", addr)
+	} else {
+		conn, err = prev.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jump host %q: %w", h.host, err)
+	}
+	cc, chans, reqs, err := ossh.NewClientConn(conn, addr, &ossh.ClientConfig{
+		User:            user,
+		Auth:            []ossh.AuthMethod{ossh.PublicKeys(signers...)},
+		HostKeyCallback: trustOnFirstUse(),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("jump host %q: %w", h.host, err)
+	}
+	return ossh.NewClient(cc, chans, reqs), nil
+}
+
+// jumpConn is a connection through jump hosts.
+// Closing it logs out of the jump hosts.
+type jumpConn struct {
+	net.Conn
+	clients []*ossh.Client
+}
+
+// Close implements net.Conn.
+func (j *jumpConn) Close() error {
+	err := j.Conn.Close()
+	logout(j.clients)
+	return err
+}
+
+// logout closes jump host clients, last first.
+func logout(clients []*ossh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
+
+// dialJumps returns a connection to addr, made by
+// logging in to each of the jumps in turn.
+func dialJumps(jumps []string, addr string) (net.Conn, error) {
+	var (
+		cl      *ossh.Client
+		clients []*ossh.Client
+		err     error
+	)
+	for _, j := range jumps {
+		if cl, err = dialHop(cl, parseHop(j)); err != nil {
+			logout(clients)
+			return nil, err
+		}
+		clients = append(clients, cl)
+	}
+	conn, err := cl.Dial("tcp", addr)
+	if err != nil {
+		logout(clients)
+		return nil, fmt.Errorf("%s from %q: %w", addr, jumps[len(jumps)-1], err)
+	}
+	return &jumpConn{Conn: conn, clients: clients}, nil
+}
+
+// cmdAddr is the net.Addr of a cmdConn.
+type cmdAddr string
+
+// Network implements net.Addr.
+func (cmdAddr) Network() string { return "proxycommand" }
+
+// String implements net.Addr.
+func (c cmdAddr) String() string { return string(c) }
+
+// cmdConn is a net.Conn to the stdin and stdout of a ProxyCommand.
+type cmdConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+var _ net.Conn = &cmdConn{}
+
+// Close implements net.Conn. The command is expected to
+// exit when its stdin is closed; if it does not, it is killed.
+func (c *cmdConn) Close() error {
+	err := c.WriteCloser.Close()
+	t := time.AfterFunc(time.Second, func() { c.cmd.Process.Kill() })
+	defer t.Stop()
+	c.cmd.Wait()
+	return err
+}
+
+// LocalAddr implements net.Conn.
+func (c *cmdConn) LocalAddr() net.Addr { return cmdAddr(c.cmd.String()) }
+
+// RemoteAddr implements net.Conn.
+func (c *cmdConn) RemoteAddr() net.Addr { return cmdAddr(c.cmd.String()) }
+
+// SetDeadline implements net.Conn. Deadlines are not supported.
+func (c *cmdConn) SetDeadline(time.Time) error { return nil }
+
+// SetReadDeadline implements net.Conn. Deadlines are not supported.
+func (c *cmdConn) SetReadDeadline(time.Time) error { return nil }
+
+// SetWriteDeadline implements net.Conn. Deadlines are not supported.
+func (c *cmdConn) SetWriteDeadline(time.Time) error { return nil }
+
+// proxyCommand starts a ProxyCommand, and returns
+// a connection to its stdin and stdout.
+func proxyCommand(command string) (net.Conn, error) {
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/c", command)
+	}
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	verbose("ProxyCommand %q", command)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ProxyCommand %q: %w", command, err)
+	}
+	return &cmdConn{Reader: out, WriteCloser: in, cmd: cmd}, nil
+}
+
+// dialProxy returns a connection to a cpu through its ProxyJump
+// hosts, ProxyCommand, or proxy, or nil if it has none of them.
+func dialProxy(cpu *cpu) (net.Conn, error) {
+	switch {
+	case len(cpu.jumps) > 0:
+		return dialJumps(cpu.jumps, net.JoinHostPort(cpu.host, cpu.port))
+	case len(cpu.proxyCommand) > 0:
+		return proxyCommand(cpu.proxyCommand)
+	case cpu.proxy != nil:
+		return dialViaProxy(cpu.proxy, net.JoinHostPort(cpu.host, cpu.port))
+	}
+	return nil, nil
+}
+
+// errConnectTimeout is returned when a cpu can not be
+// connected to in -connect-timeout.
+var errConnectTimeout = errors.New("connect timeout")
+
+// timeoutError is returned by dialTimeout. It is a net.Error,
+// so it is treated as any other connect timeout.
+type timeoutError time.Duration
+
+// Error implements error.
+func (t timeoutError) Error() string {
+	return fmt.Sprintf("no connection in %v", time.Duration(t))
+}
+
+// Timeout implements net.Error.
+func (timeoutError) Timeout() bool { return true }
+
+// Temporary implements net.Error.
+func (timeoutError) Temporary() bool { return true }
+
+// dialTimeout calls dial, and returns a timeoutError if it does
+// not return in d. A connection made too late is closed. If d is
+// 0, there is no limit.
+func dialTimeout(d time.Duration, dial func() (net.Conn, error)) (net.Conn, error) {
+	if d <= 0 {
+		return dial()
+	}
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	c := make(chan dialed, 1)
+	go func() {
+		conn, err := dial()
+		c <- dialed{conn: conn, err: err}
+	}()
+	select {
+	case r := <-c:
+		return r.conn, r.err
+	case <-time.After(d):
+		go func() {
+			if r := <-c; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, timeoutError(d)
+	}
+}
+
+// firstEnv returns the first of the environment variables
+// which is set, or "".
+func firstEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// getProxyURL returns the proxy to reach host:port through, if any.
+// It is -proxy, if set; otherwise, ALL_PROXY or HTTPS_PROXY, unless
+// NO_PROXY names the host. Local addresses are never proxied.
+func getProxyURL(host, port string) (*url.URL, error) {
+	cfg := httpproxy.Config{
+		HTTPSProxy: firstEnv("ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy"),
+		NoProxy:    firstEnv("NO_PROXY", "no_proxy"),
+	}
+	if len(*proxyFlag) > 0 {
+		cfg = httpproxy.Config{HTTPSProxy: *proxyFlag}
+	}
+	return cfg.ProxyFunc()(&url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)})
+}
+
+// bufConn is a net.Conn with data already read into a bufio.Reader.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements net.Conn.
+func (b *bufConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// httpConnect returns a connection to addr through an
+// HTTP proxy, made with CONNECT.
+func httpConnect(u *url.URL, addr string) (net.Conn, error) {
+	host := u.Host
+	if len(u.Port()) == 0 {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if u.Scheme == "https" {
+		conn, err = tls.Dial("tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		p, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+p)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// After a 200, what follows is the cpu's, not a body.
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	return &bufConn{Conn: conn, r: br}, nil
+}
+
+// dialViaProxy returns a connection to addr through an HTTP
+// (CONNECT) or SOCKS5 proxy.
+func dialViaProxy(u *url.URL, addr string) (net.Conn, error) {
+	verbose("dial %s through proxy %s", addr, u.Redacted())
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch u.Scheme {
+	case "http", "https":
+		conn, err = httpConnect(u, addr)
+	case "socks5", "socks5h":
+		var d proxy.Dialer
+		if d, err = proxy.FromURL(u, proxy.Direct); err == nil {
+			conn, err = d.Dial("tcp", addr)
+		}
+	default:
+		err = fmt.Errorf("%q proxies are not supported:%w", u.Scheme, os.ErrInvalid)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", u.Redacted(), err)
+	}
+	return conn, nil
+}
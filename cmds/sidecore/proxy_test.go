@@ -0,0 +1,516 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/u-root/sidecore/internal/cpu/client"
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// forward is the payload of direct-tcpip and forwarded-tcpip channels.
+type forward struct {
+	Addr     string
+	Port     uint32
+	OrigAddr string
+	OrigPort uint32
+}
+
+// pipe copies between a channel and a connection until either is done.
+func pipe(ch ossh.Channel, c net.Conn) {
+	defer ch.Close()
+	defer c.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(ch, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, ch)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// testServer starts a minimal ssh server, which accepts any key.
+// It supports direct-tcpip, as a jump host must, and tcpip-forward,
+// which the nfs server needs. It returns the server's address.
+func testServer(t *testing.T) string {
+	t.Helper()
+	return testServerFunc(t, serveTestConn)
+}
+
+// testServerFunc starts an ssh server, which accepts any key,
+// and serves connections with serve.
+func testServerFunc(t *testing.T, serve func(net.Conn, *ossh.ServerConfig)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v != nil", err)
+	}
+	return testServerOn(t, l, serve)
+}
+
+// testServerOn is testServerFunc, listening on l.
+func testServerOn(t *testing.T, l net.Listener, serve func(net.Conn, *ossh.ServerConfig)) string {
+	t.Helper()
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v != nil", err)
+	}
+	s, err := ossh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v != nil", err)
+	}
+	cfg := &ossh.ServerConfig{
+		PublicKeyCallback: func(ossh.ConnMetadata, ossh.PublicKey) (*ossh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(s)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c, cfg)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveTestConn(c net.Conn, cfg *ossh.ServerConfig) {
+	sc, chans, reqs, err := ossh.NewServerConn(c, cfg)
+	if err != nil {
+		return
+	}
+	go func() {
+		for r := range reqs {
+			var req struct {
+				Addr string
+				Port uint32
+			}
+			if r.Type != "tcpip-forward" || ossh.Unmarshal(r.Payload, &req) != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			l, err := net.Listen("tcp", net.JoinHostPort(req.Addr, "0"))
+			if err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			port := uint32(l.Addr().(*net.TCPAddr).Port)
+			r.Reply(true, ossh.Marshal(struct{ Port uint32 }{port}))
+			go func() {
+				defer l.Close()
+				for {
+					fc, err := l.Accept()
+					if err != nil {
+						return
+					}
+					ra := fc.RemoteAddr().(*net.TCPAddr)
+					ch, creqs, err := sc.OpenChannel("forwarded-tcpip", ossh.Marshal(&forward{Addr: req.Addr, Port: port, OrigAddr: ra.IP.String(), OrigPort: uint32(ra.Port)}))
+					if err != nil {
+						fc.Close()
+						return
+					}
+					go ossh.DiscardRequests(creqs)
+					go pipe(ch, fc)
+				}
+			}()
+		}
+	}()
+	for nc := range chans {
+		var f forward
+		if nc.ChannelType() != "direct-tcpip" || ossh.Unmarshal(nc.ExtraData(), &f) != nil {
+			nc.Reject(ossh.UnknownChannelType, nc.ChannelType())
+			continue
+		}
+		tc, err := net.Dial("tcp", net.JoinHostPort(f.Addr, strconv.Itoa(int(f.Port))))
+		if err != nil {
+			nc.Reject(ossh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			tc.Close()
+			continue
+		}
+		go ossh.DiscardRequests(creqs)
+		go pipe(ch, tc)
+	}
+}
+
+func TestParseHop(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want hop
+	}{
+		{in: "bastion", want: hop{host: "bastion"}},
+		{in: "me@bastion:2222", want: hop{user: "me", host: "bastion", port: "2222"}},
+		{in: "ssh://me@bastion:2222", want: hop{user: "me", host: "bastion", port: "2222"}},
+		{in: "[fe80::1]:22", want: hop{host: "fe80::1", port: "22"}},
+	} {
+		if got := parseHop(tt.in); got != tt.want {
+			t.Errorf("parseHop(%q): %+v != %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestJumps dials a cpu through two jumps, and checks that a
+// port forwarded from the cpu, as the nfs server uses, works.
+func TestJumps(t *testing.T) {
+	key := testKey(t)
+	ids := identities
+	identities = stringList{key}
+	defer func() { identities = ids }()
+	setHome(t)
+	setConfirm(t, true)
+
+	jump := testServer(t)
+	target := testServer(t)
+	c := client.Command(target, "true")
+	dial := func(string, string) (net.Conn, error) {
+		return dialJumps([]string{jump, jump}, target)
+	}
+	if err := c.SetOptions(withKeys(nil, []string{key}, nil), client.WithDialer(dial), client.WithTimeout("5s")); err != nil {
+		t.Fatalf("SetOptions: %v != nil", err)
+	}
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial: %v != nil", err)
+	}
+	defer c.Close()
+	l, err := c.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v != nil", err)
+	}
+	defer l.Close()
+
+	// Connect as cpud would, on the far side.
+	deadline := time.Now().Add(5 * time.Second)
+	rc, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial(%q): %v != nil", l.Addr(), err)
+	}
+	defer rc.Close()
+	rc.SetDeadline(deadline)
+	if _, err := rc.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write: %v != nil", err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if lc, err := l.Accept(); err == nil {
+			accepted <- lc
+		}
+	}()
+	var lc net.Conn
+	select {
+	case lc = <-accepted:
+	case <-time.After(time.Until(deadline)):
+		t.Fatalf("Accept: timed out")
+	}
+	defer lc.Close()
+	lc.SetDeadline(deadline)
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(lc, b); err != nil {
+		t.Fatalf("ReadFull: %v != nil", err)
+	}
+	if string(b) != "hi" {
+		t.Errorf("forwarded data: %q != \"hi\"", b)
+	}
+}
+
+func TestJumpsFail(t *testing.T) {
+	ids := identities
+	identities = stringList{testKey(t)}
+	defer func() { identities = ids }()
+	setHome(t)
+	setConfirm(t, true)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v != nil", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if _, err := dialJumps([]string{testServer(t), addr}, addr); err == nil {
+		t.Errorf("dialJumps through closed %q: nil != an error", addr)
+	}
+}
+
+func TestGetProxy(t *testing.T) {
+	setSSHConfig(t, `Host jumped
+	ProxyJump me@bastion:2222,ssh://gw
+	ProxyCommand nc %h %p
+
+Host proxied
+	ProxyCommand ssh -W %h:%p -l %r gw %n 100%%
+
+Host none
+	ProxyJump none
+`)
+	for _, tt := range []struct {
+		alias string
+		jumps []string
+		cmd   string
+	}{
+		{alias: "jumped", jumps: []string{"me@bastion:2222", "ssh://gw"}},
+		{alias: "proxied", cmd: "ssh -W cpu.lab:17010 -l me gw proxied 100%"},
+		{alias: "none"},
+		{alias: "other"},
+	} {
+		jumps, cmd := getProxy(tt.alias, "cpu.lab", "17010", "me")
+		if !reflect.DeepEqual(jumps, tt.jumps) || cmd != tt.cmd {
+			t.Errorf("getProxy(%q): (%q, %q) != (%q, %q)", tt.alias, jumps, cmd, tt.jumps, tt.cmd)
+		}
+	}
+}
+
+func TestHopKeyFiles(t *testing.T) {
+	t.Setenv("HOME", "/home/glenda")
+	setSSHConfig(t, `Host keyed
+	IdentityFile /keys/keyed
+`)
+	ids := identities
+	defer func() { identities = ids }()
+	for _, tt := range []struct {
+		host string
+		ids  stringList
+		want []string
+	}{
+		{host: "keyed", want: []string{"/keys/keyed"}},
+		{host: "keyed", ids: stringList{"/keys/i"}, want: []string{"/keys/i", "/keys/keyed"}},
+		{host: "other", ids: stringList{"/keys/i"}, want: []string{"/keys/i"}},
+		{host: "other", want: []string{"/home/glenda/.ssh/id_rsa", "/home/glenda/.ssh/id_ecdsa", "/home/glenda/.ssh/id_ed25519"}},
+	} {
+		identities = tt.ids
+		if got, err := hopKeyFiles(tt.host, "22"); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hopKeyFiles(%q) with -i %q: (%q, %v) != (%q, nil)", tt.host, tt.ids, got, err, tt.want)
+		}
+	}
+}
+
+func TestProxyCommand(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skipf("no cat: %v", err)
+	}
+	conn, err := proxyCommand("cat")
+	if err != nil {
+		t.Fatalf("proxyCommand(cat): %v != nil", err)
+	}
+	done := make(chan error, 1)
+	b := make([]byte, 2)
+	go func() {
+		if _, err := conn.Write([]byte("hi")); err != nil {
+			done <- err
+			return
+		}
+		_, err := io.ReadFull(conn, b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("echo through cat: %v != nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("echo through cat: timed out")
+	}
+	if string(b) != "hi" {
+		t.Errorf("echo through cat: %q != \"hi\"", b)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close: %v != nil", err)
+	}
+	if got := conn.RemoteAddr().Network(); got != "proxycommand" {
+		t.Errorf("RemoteAddr().Network(): %q != \"proxycommand\"", got)
+	}
+}
+
+func TestProxyCommandFail(t *testing.T) {
+	conn, err := proxyCommand("exit 1")
+	if err != nil {
+		t.Fatalf("proxyCommand(exit 1): %v != nil", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read: (%d, %v) != (0, %v)", n, err, io.EOF)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	late := make(chan struct{})
+	conn, err := dialTimeout(10*time.Millisecond, func() (net.Conn, error) {
+		<-late
+		return c, nil
+	})
+	var ne net.Error
+	if conn != nil || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("dialTimeout, dial too slow: (%v, %v) != (nil, a timeout)", conn, err)
+	}
+	// The connection made too late is closed.
+	close(late)
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("late connection: Read: %v != %v", err, io.EOF)
+	}
+
+	if conn, err := dialTimeout(0, func() (net.Conn, error) { return s, nil }); conn != s || err != nil {
+		t.Errorf("dialTimeout(0): (%v, %v) != (%v, nil)", conn, err, s)
+	}
+}
+
+func TestGetProxyURL(t *testing.T) {
+	for _, v := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(v, "")
+	}
+	defer func(p string) { *proxyFlag = p }(*proxyFlag)
+	*proxyFlag = ""
+	t.Setenv("ALL_PROXY", "socks5://proxy:1080")
+	t.Setenv("NO_PROXY", "direct.example.com")
+	for _, tt := range []struct {
+		host, flag, want string
+	}{
+		{host: "cpu.example.com", want: "socks5://proxy:1080"},
+		{host: "direct.example.com"},
+		{host: "localhost"},
+		{host: "direct.example.com", flag: "http://user:pw@other:3128", want: "http://user:pw@other:3128"},
+	} {
+		*proxyFlag = tt.flag
+		u, err := getProxyURL(tt.host, "17010")
+		if err != nil {
+			t.Errorf("getProxyURL(%q, -proxy %q): %v != nil", tt.host, tt.flag, err)
+			continue
+		}
+		var got string
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.want {
+			t.Errorf("getProxyURL(%q, -proxy %q): %q != %q", tt.host, tt.flag, got, tt.want)
+		}
+	}
+}
+
+// testConnectProxy returns the URL of an HTTP proxy which only
+// allows CONNECT, with Basic auth for user and password.
+func testConnectProxy(t *testing.T, user, password string) *url.URL {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization")); !ok || u != user || p != password {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		c, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dst.Close()
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		if err := buf.Flush(); err != nil {
+			dst.Close()
+			c.Close()
+			return
+		}
+		go func() {
+			io.Copy(dst, c)
+			dst.Close()
+		}()
+		io.Copy(c, dst)
+		c.Close()
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword(user, password)
+	return u
+}
+
+// parseProxyAuth parses a Basic Proxy-Authorization header.
+func parseProxyAuth(h string) (string, string, bool) {
+	r := http.Request{Header: http.Header{"Authorization": {h}}}
+	return r.BasicAuth()
+}
+
+// testEcho returns the address of a server which echoes what it reads.
+func testEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// Hide ReaderFrom: splicing a conn to itself hangs.
+				io.Copy(struct{ io.Writer }{c}, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDialViaProxy(t *testing.T) {
+	addr := testEcho(t)
+	u := testConnectProxy(t, "user", "pw")
+	conn, err := dialViaProxy(u, addr)
+	if err != nil {
+		t.Fatalf("dialViaProxy(%v, %q): %v != nil", u.Redacted(), addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write: %v != nil", err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hi" {
+		t.Errorf("ReadFull: (%q, %v) != (\"hi\", nil)", b, err)
+	}
+
+	u.User = url.UserPassword("user", "wrong")
+	if conn, err := dialViaProxy(u, addr); err == nil {
+		conn.Close()
+		t.Errorf("dialViaProxy, wrong password: nil != an error")
+	}
+
+	u = &url.URL{Scheme: "gopher", Host: "proxy:70"}
+	if _, err := dialViaProxy(u, addr); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("dialViaProxy(%v): %v != %v", u, err, os.ErrInvalid)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var rankEnv = flag.String("rank-env", "SIDECORE_RANK,SIDECORE_SIZE,SIDECORE_HOSTS", "names of the variables which tell each command its rank, from 0, how many cpus there are, and their hosts, e.g. OMPI_COMM_WORLD_RANK,OMPI_COMM_WORLD_SIZE,; an empty name is not set")
+
+// rankEnvNames returns the names of the rank, size, and hosts
+// variables, from -rank-env.
+func rankEnvNames(names string) ([]string, error) {
+	n := strings.Split(names, ",")
+	if len(n) != 3 {
+		return nil, fmt.Errorf("-rank-env %q: want three comma-separated names, for the rank, size and hosts:%w", names, os.ErrInvalid)
+	}
+	for _, v := range n {
+		if strings.ContainsAny(v, "= ") {
+			return nil, fmt.Errorf("-rank-env: %q is not a variable name:%w", v, os.ErrInvalid)
+		}
+	}
+	return n, nil
+}
+
+// setRankEnv tells each cpu's command which of the cpus it is
+// running on, how many there are, and what they are, so that a
+// command run on many cpus can share the work out.
+func setRankEnv(cpus []cpu, names []string) {
+	var hosts []string
+	for _, c := range cpus {
+		hosts = append(hosts, c.host)
+	}
+	for i := range cpus {
+		for j, v := range []string{strconv.Itoa(i), strconv.Itoa(len(cpus)), strings.Join(hosts, ",")} {
+			if len(names[j]) > 0 {
+				cpus[i].env = append(cpus[i].env, names[j]+"="+v)
+			}
+		}
+	}
+}
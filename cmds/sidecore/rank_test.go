@@ -0,0 +1,100 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRankEnvNames(t *testing.T) {
+	for _, tt := range []struct {
+		names string
+		want  []string
+		err   error
+	}{
+		{names: "SIDECORE_RANK,SIDECORE_SIZE,SIDECORE_HOSTS", want: []string{"SIDECORE_RANK", "SIDECORE_SIZE", "SIDECORE_HOSTS"}},
+		{names: "OMPI_COMM_WORLD_RANK,OMPI_COMM_WORLD_SIZE,", want: []string{"OMPI_COMM_WORLD_RANK", "OMPI_COMM_WORLD_SIZE", ""}},
+		{names: "RANK,SIZE", err: os.ErrInvalid},
+		{names: "RANK=1,SIZE,HOSTS", err: os.ErrInvalid},
+	} {
+		got, err := rankEnvNames(tt.names)
+		if !errors.Is(err, tt.err) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rankEnvNames(%q): (%q, %v) != (%q, %v)", tt.names, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSetRankEnv(t *testing.T) {
+	cpus := []cpu{{host: "a"}, {host: "b"}}
+	setRankEnv(cpus, []string{"R", "", "H"})
+	for i, want := range [][]string{{"R=0", "H=a,b"}, {"R=1", "H=a,b"}} {
+		if !reflect.DeepEqual(cpus[i].env, want) {
+			t.Errorf("cpu %d env: %q != %q", i, cpus[i].env, want)
+		}
+	}
+}
+
+func TestRunCPURank(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool) { *network, *srvnfs = n, nfs }(*network, *srvnfs)
+	*network, *srvnfs = "unix", false
+
+	var (
+		mu    sync.Mutex
+		ranks = map[string]string{}
+		cpus  []cpu
+	)
+	for _, n := range []string{"a", "b", "c"} {
+		sock := filepath.Join(t.TempDir(), n+".sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+		}
+		env := make(chan string)
+		go func() {
+			for e := range env {
+				if r, ok := strings.CutPrefix(e, "SIDECORE_RANK="); ok {
+					mu.Lock()
+					ranks[sock] = r
+					mu.Unlock()
+				}
+			}
+		}()
+		testServerOn(t, l, fakeCPUD(env))
+		cpus = append(cpus, cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true})
+	}
+	names, err := rankEnvNames(*rankEnv)
+	if err != nil {
+		t.Fatalf("rankEnvNames(%q): %v != nil", *rankEnv, err)
+	}
+	setRankEnv(cpus, names)
+	var wg sync.WaitGroup
+	for i := range cpus {
+		if err := runCPU(nil, &wg, "", &cpus[i], "date"); exitStatus(err) != 3 {
+			t.Fatalf("runCPU on %s: %v, not exit status 3", cpus[i].host, err)
+		}
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	seen := map[string]bool{}
+	for _, c := range cpus {
+		r, ok := ranks[c.host]
+		if !ok || seen[r] {
+			t.Errorf("%s: rank %q is missing, or not unique, in %v", c.host, r, ranks)
+		}
+		seen[r] = true
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// reconnectBackoff is the wait before the first reconnect. It doubles
+// with each try, up to maxReconnectBackoff. It is a variable so that
+// tests can shorten it.
+var reconnectBackoff = time.Second
+
+// maxReconnectBackoff is the longest wait between reconnects.
+const maxReconnectBackoff = 30 * time.Second
+
+// connectionLost returns true if err means the connection to a cpu
+// was lost, rather than the command exiting, or failing to start.
+func connectionLost(err error) bool {
+	var em *ossh.ExitMissingError
+	return errors.Is(err, errConnectionLost) || errors.As(err, &em) || errors.Is(err, io.EOF)
+}
+
+// reconnectCPU calls dial up to tries times, backing off between
+// tries, until it succeeds. A signal, e.g. ^C, stops it.
+func reconnectCPU(tries int, sigs <-chan os.Signal, dial func() error) error {
+	wait := reconnectBackoff
+	var err error
+	for i := 1; i <= tries; i++ {
+		t := time.NewTimer(wait)
+		select {
+		case sig := <-sigs:
+			t.Stop()
+			return fmt.Errorf("reconnect stopped by %v", sig)
+		case <-t.C:
+		}
+		if err = dial(); err == nil {
+			return nil
+		}
+		verbose("reconnect %d of %d: %v", i, tries, err)
+		if wait *= 2; wait > maxReconnectBackoff {
+			wait = maxReconnectBackoff
+		}
+	}
+	return fmt.Errorf("%d reconnects failed, the last with %w", tries, err)
+}
+
+// restartLost calls run, and, each time its connection is lost, up to
+// tries times, reconnects, with dial, and calls it again. cpud can not
+// resume a session, so the remote command was ended with it, and is
+// run again from the start, which is said. If the cpu can not be
+// reconnected to, the job is lost, and the error says so.
+func restartLost(name string, tries int, sigs <-chan os.Signal, run, dial func() error) error {
+	err := run()
+	for i := 1; i <= tries && connectionLost(err); i++ {
+		info("%s: %v; reconnecting", name, err)
+		// A ^C the command had is not one to stop reconnecting.
+		select {
+		case <-sigs:
+		default:
+		}
+		if rerr := reconnectCPU(tries, sigs, dial); rerr != nil {
+			return fmt.Errorf("%w; %v, so the job was lost", err, rerr)
+		}
+		info("%s: reconnected; cpud can not resume the command, so it is restarted, not resumed (%d of %d)", name, i, tries)
+		err = run()
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+func TestConnectionLost(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: fmt.Errorf("no reply:%w", errConnectionLost), want: true},
+		{err: &ossh.ExitMissingError{}, want: true},
+		{err: io.EOF, want: true},
+		{err: &ossh.ExitError{}, want: false},
+		{err: os.ErrNotExist, want: false},
+	} {
+		if got := connectionLost(tt.err); got != tt.want {
+			t.Errorf("connectionLost(%v): %v != %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestReconnectCPU(t *testing.T) {
+	old := reconnectBackoff
+	reconnectBackoff = time.Millisecond
+	defer func() { reconnectBackoff = old }()
+
+	errDown := errors.New("down")
+	tries := 0
+	dial := func() error {
+		if tries++; tries < 3 {
+			return errDown
+		}
+		return nil
+	}
+	if err := reconnectCPU(3, nil, dial); err != nil || tries != 3 {
+		t.Errorf("reconnectCPU(3), up on the third try: (%v, %d tries) != (nil, 3 tries)", err, tries)
+	}
+
+	tries = 0
+	if err := reconnectCPU(2, nil, dial); !errors.Is(err, errDown) || tries != 2 {
+		t.Errorf("reconnectCPU(2), up on the third try: (%v, %d tries) != (%v, 2 tries)", err, tries, errDown)
+	}
+
+	// A signal stops reconnecting.
+	reconnectBackoff = time.Hour
+	sigs := make(chan os.Signal, 1)
+	sigs <- os.Interrupt
+	tries = 0
+	if err := reconnectCPU(3, sigs, dial); err == nil || tries != 0 {
+		t.Errorf("reconnectCPU, interrupted: (%v, %d tries) != (an error, 0 tries)", err, tries)
+	}
+}
+
+func TestRestartLost(t *testing.T) {
+	old := reconnectBackoff
+	reconnectBackoff = time.Millisecond
+	defer func() { reconnectBackoff = old }()
+
+	lost := fmt.Errorf("no reply:%w", errConnectionLost)
+	errDown := errors.New("down")
+	for _, tt := range []struct {
+		name  string
+		runs  []error
+		dial  error
+		tries int
+		want  error
+		ran   int
+	}{
+		{name: "exits", runs: []error{nil}, tries: 2, ran: 1},
+		{name: "fails", runs: []error{os.ErrNotExist}, tries: 2, want: os.ErrNotExist, ran: 1},
+		{name: "restarted", runs: []error{lost, nil}, tries: 2, ran: 2},
+		{name: "lost twice", runs: []error{lost, io.EOF, nil}, tries: 2, ran: 3},
+		{name: "lost too often", runs: []error{lost, lost, lost}, tries: 2, want: errConnectionLost, ran: 3},
+		{name: "not reconnected", runs: []error{lost}, dial: errDown, tries: 2, want: errConnectionLost, ran: 1},
+		{name: "no reconnects", runs: []error{lost}, want: errConnectionLost, ran: 1},
+	} {
+		ran := 0
+		run := func() error {
+			ran++
+			return tt.runs[ran-1]
+		}
+		err := restartLost("cpu", tt.tries, nil, run, func() error { return tt.dial })
+		if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) || ran != tt.ran {
+			t.Errorf("%s: (%v, %d runs) != (%v, %d runs)", tt.name, err, ran, tt.want, tt.ran)
+		}
+		if tt.dial != nil && !strings.Contains(fmt.Sprint(err), "job was lost") {
+			t.Errorf("%s: %v != an error saying the job was lost", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+// requirements are the -requirements, each a comma-separated
+// list of txt attributes which cpus found for "." must have.
+var requirements stringList
+
+// parseRequirements returns the dnssd query values for requirements,
+// each key=value, key!=value, key>=number or key<=number. The
+// comparisons are written as ds.Parse wants them, e.g. cores>=16 as
+// cores=>16, which may also be used. A key given more than once with
+// = matches any of its values.
+func parseRequirements(reqs []string) (url.Values, error) {
+	vals := url.Values{}
+	for _, r := range reqs {
+		for _, kv := range strings.Split(r, ",") {
+			if len(kv) == 0 {
+				continue
+			}
+			i := strings.IndexAny(kv, "=<>!")
+			if i < 1 {
+				return nil, fmt.Errorf("requirement %q: want key=value, key!=value, key>=number or key<=number:%w", kv, os.ErrInvalid)
+			}
+			k, op, v := kv[:i], kv[i:], ""
+			for _, o := range []string{"!=", ">=", "<=", "="} {
+				if strings.HasPrefix(op, o) {
+					op, v = o, op[len(o):]
+					break
+				}
+			}
+			switch op {
+			case "=":
+			case "!=", ">=", "<=":
+				// ds only compares inclusively.
+				v = op[:1] + v
+			default:
+				return nil, fmt.Errorf("requirement %q: %s is not supported; use >= or <=:%w", kv, op[:1], os.ErrInvalid)
+			}
+			vals.Add(k, v)
+		}
+	}
+	return vals, nil
+}
+
+// requiredArch returns the arch the requirements name, if any.
+// Since the container is chosen by arch, only one may be named.
+func requiredArch(vals url.Values) (string, error) {
+	a := vals["arch"]
+	switch {
+	case len(a) == 0:
+		return "", nil
+	case len(a) > 1 || len(a[0]) == 0 || strings.IndexAny(a[0], "<>!*") == 0:
+		return "", fmt.Errorf("requirements may name only one arch, with =, not %q:%w", a, os.ErrInvalid)
+	}
+	return a[0], nil
+}
+
+// dotQuery returns the dnssd query for the "." host: cpus of arch,
+// unless the requirements name another, which meet the requirements.
+func dotQuery(arch string, vals url.Values) string {
+	q := url.Values{"arch": {arch}}
+	for k, v := range vals {
+		q[k] = v
+	}
+	return ds.Default + "&" + q.Encode()
+}
@@ -0,0 +1,85 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+func TestParseRequirements(t *testing.T) {
+	for _, tt := range []struct {
+		reqs []string
+		want url.Values
+		err  error
+	}{
+		{want: url.Values{}},
+		{reqs: []string{"os=linux,cores>=16"}, want: url.Values{"os": {"linux"}, "cores": {">16"}}},
+		{reqs: []string{"mem<=4096", "os!=plan9", "cores=>8"}, want: url.Values{"mem": {"<4096"}, "os": {"!plan9"}, "cores": {">8"}}},
+		{reqs: []string{"arch=amd64,arch=arm64,,"}, want: url.Values{"arch": {"amd64", "arm64"}}},
+		{reqs: []string{"cores>16"}, err: os.ErrInvalid},
+		{reqs: []string{"=linux"}, err: os.ErrInvalid},
+		{reqs: []string{"linux"}, err: os.ErrInvalid},
+	} {
+		got, err := parseRequirements(tt.reqs)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("parseRequirements(%q): %v != %v", tt.reqs, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRequirements(%q): %v != %v", tt.reqs, got, tt.want)
+		}
+	}
+}
+
+func TestRequiredArch(t *testing.T) {
+	for _, tt := range []struct {
+		vals url.Values
+		want string
+		err  error
+	}{
+		{vals: url.Values{"os": {"linux"}}},
+		{vals: url.Values{"arch": {"arm64"}}, want: "arm64"},
+		{vals: url.Values{"arch": {"amd64", "arm64"}}, err: os.ErrInvalid},
+		{vals: url.Values{"arch": {"!amd64"}}, err: os.ErrInvalid},
+		{vals: url.Values{"arch": {""}}, err: os.ErrInvalid},
+	} {
+		got, err := requiredArch(tt.vals)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("requiredArch(%v): (%q, %v) != (%q, %v)", tt.vals, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestDotQuery(t *testing.T) {
+	for _, tt := range []struct {
+		reqs []string
+		want map[string][]string
+	}{
+		{want: map[string][]string{"arch": {"amd64"}, "os": {"linux"}}},
+		// An arch in the requirements beats SIDECORE_ARCH.
+		{reqs: []string{"arch=arm64,cores>=16"}, want: map[string][]string{"arch": {"arm64"}, "cores": {">16"}, "os": {"linux"}}},
+	} {
+		vals, err := parseRequirements(tt.reqs)
+		if err != nil {
+			t.Fatalf("parseRequirements(%q): %v != nil", tt.reqs, err)
+		}
+		q, err := ds.Parse(dotQuery("amd64", vals))
+		if err != nil {
+			t.Fatalf("ds.Parse(dotQuery(amd64, %v)): %v != nil", vals, err)
+		}
+		// ds.Parse adds os, if it is not set, and the default sort.
+		q.Text["os"] = []string{"linux"}
+		delete(q.Text, "sort")
+		if !reflect.DeepEqual(q.Text, tt.want) {
+			t.Errorf("dotQuery(amd64, %q): %v != %v", tt.reqs, q.Text, tt.want)
+		}
+	}
+}
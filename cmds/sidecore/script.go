@@ -0,0 +1,80 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// With -script, a local script is run on the cpus: it is copied, as an
+// executable, to a temporary file in $HOME, which the cpus see under
+// -mountpoint, and that is the command, with the arguments passed on to
+// it. The copy is removed when sidecore exits.
+var scriptFlag = flag.String("script", "", "run this local script, e.g. a shell or python script, on the cpus; the arguments are passed on to it")
+
+// checkScript checks that -script can be read, and can be seen by the
+// cpu, before any cpu is dialed.
+func checkScript(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	if !*srvnfs {
+		return fmt.Errorf("-script %s: the cpu can not see it with -nfs=false:%w", s, os.ErrInvalid)
+	}
+	fi, err := os.Stat(s)
+	if err != nil {
+		return fmt.Errorf("-script: %w", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("-script %s: not a file:%w", s, os.ErrInvalid)
+	}
+	return nil
+}
+
+// stageScript copies the script s to a temporary file in dir, which is
+// under home, the directory shared with the cpu, and makes it
+// executable. It returns the copy's path on the cpu, and a function
+// which removes it.
+func stageScript(s, dir, home string) (string, func(), error) {
+	in, err := os.Open(s)
+	if err != nil {
+		return "", nil, fmt.Errorf("-script: %w", err)
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(dir, ".sidecore-*-"+filepath.Base(s))
+	if err != nil {
+		return "", nil, fmt.Errorf("-script: %w", err)
+	}
+	remove := func() {
+		if err := os.Remove(out.Name()); err != nil {
+			verbose("-script: %v", err)
+		}
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		remove()
+		return "", nil, fmt.Errorf("-script: copying %s: %w", s, err)
+	}
+	if err := out.Close(); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("-script: %w", err)
+	}
+	// CreateTemp makes it 0600.
+	if err := os.Chmod(out.Name(), 0700); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("-script: %w", err)
+	}
+	r, err := exportedPath(home, out.Name())
+	if err != nil {
+		remove()
+		return "", nil, fmt.Errorf("-script: %w", err)
+	}
+	verbose("-script %s: %s, on the cpu %s", s, out.Name(), r)
+	return r, remove, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheckScript(t *testing.T) {
+	defer func(nfs bool) { *srvnfs = nfs }(*srvnfs)
+	d := t.TempDir()
+	s := filepath.Join(d, "run.sh")
+	if err := os.WriteFile(s, []byte("#!/bin/sh\necho hi\n"), 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v != nil", s, err)
+	}
+	for _, tt := range []struct {
+		name   string
+		script string
+		noNFS  bool
+		want   error
+	}{
+		{name: "none"},
+		{name: "script", script: s},
+		{name: "missing", script: filepath.Join(d, "none"), want: os.ErrNotExist},
+		{name: "directory", script: d, want: os.ErrInvalid},
+		{name: "no nfs", script: s, noNFS: true, want: os.ErrInvalid},
+	} {
+		*srvnfs = !tt.noNFS
+		if err := checkScript(tt.script); !errors.Is(err, tt.want) {
+			t.Errorf("%s: checkScript(%q): %v != %v", tt.name, tt.script, err, tt.want)
+		}
+	}
+}
+
+func TestStageScript(t *testing.T) {
+	home := t.TempDir()
+	dir := filepath.Join(home, "me")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Mkdir(%q): %v != nil", dir, err)
+	}
+	s := filepath.Join(t.TempDir(), "run.sh")
+	script := "#!/bin/sh\necho \"$@\"\n"
+	if err := os.WriteFile(s, []byte(script), 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v != nil", s, err)
+	}
+	r, remove, err := stageScript(s, dir, home)
+	if err != nil {
+		t.Fatalf("stageScript: %v != nil", err)
+	}
+	e, err := exportedPath(home, dir)
+	if err != nil {
+		t.Fatalf("exportedPath(%q, %q): %v != nil", home, dir, err)
+	}
+	if path.Dir(r) != e || !strings.HasSuffix(r, "-run.sh") {
+		t.Errorf("stageScript: %q is not in %q, or does not end in -run.sh", r, e)
+	}
+	l := filepath.Join(dir, path.Base(r))
+	b, err := os.ReadFile(l)
+	if err != nil || string(b) != script {
+		t.Errorf("staged script: (%q, %v) != (%q, nil)", b, err, script)
+	}
+	fi, err := os.Stat(l)
+	if err != nil {
+		t.Fatalf("Stat(%q): %v != nil", l, err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0700 {
+		t.Errorf("staged script: mode %v != %v", fi.Mode().Perm(), os.FileMode(0700))
+	}
+	remove()
+	if _, err := os.Stat(l); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("staged script, removed: %v != %v", err, os.ErrNotExist)
+	}
+}
+
+func TestStageScriptOutsideHome(t *testing.T) {
+	s := filepath.Join(t.TempDir(), "run.sh")
+	if err := os.WriteFile(s, []byte("#!/bin/sh\n"), 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v != nil", s, err)
+	}
+	dir := t.TempDir()
+	if _, _, err := stageScript(s, dir, filepath.Join(t.TempDir(), "home")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stageScript, outside home: %v != %v", err, os.ErrNotExist)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, ".sidecore-*")); len(m) != 0 {
+		t.Errorf("stageScript, outside home: left %q", m)
+	}
+}
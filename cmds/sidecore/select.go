@@ -0,0 +1,158 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+var (
+	selectFlag     = flag.String("select", "first", "which cpus a dnssd query runs on, if it finds more than -n: first, as dnssd sorts them, random, or round-robin, which takes the next ones each run")
+	seed           = flag.Int64("seed", 0, "with -select random, seed the choice, so that it can be repeated; 0 for a different choice each run")
+	allowDuplicate = flag.Bool("allow-duplicate", false, "let a dnssd query run more than once on a cpu which it finds on more than one interface")
+)
+
+// dedupeCPUs collapses the cpus found for a dnssd query which are the
+// same cpu, seen on more than one interface: they have the same
+// instance name. The first is kept, with the addresses of all of them,
+// link-local ones last.
+func dedupeCPUs(found []*ds.LookupResult) []*ds.LookupResult {
+	var (
+		c    []*ds.LookupResult
+		seen = map[string]*ds.LookupResult{}
+	)
+	for _, e := range found {
+		d, ok := seen[e.Entry.Name]
+		if !ok {
+			d = &ds.LookupResult{Entry: e.Entry, Error: e.Error}
+			d.Entry.IPs = nil
+			seen[e.Entry.Name] = d
+			c = append(c, d)
+		} else {
+			verbose("%s: seen on %s and %s", e.Entry.UnescapedName(), d.Entry.IfaceName, e.Entry.IfaceName)
+		}
+		for _, ip := range e.Entry.IPs {
+			// A link-local address is only any use on its own
+			// interface, and only the first entry's is kept.
+			if ip.IsLinkLocalUnicast() && e.Entry.IfaceName != d.Entry.IfaceName {
+				continue
+			}
+			dup := false
+			for _, o := range d.Entry.IPs {
+				dup = dup || o.Equal(ip)
+			}
+			if !dup {
+				d.Entry.IPs = append(d.Entry.IPs, ip)
+			}
+		}
+	}
+	for _, d := range c {
+		ips := d.Entry.IPs
+		sort.SliceStable(ips, func(i, j int) bool { return !ips[i].IsLinkLocalUnicast() && ips[j].IsLinkLocalUnicast() })
+	}
+	return c
+}
+
+// checkSelect returns an error if how is not a -select strategy.
+func checkSelect(how string) error {
+	switch how {
+	case "first", "random", "round-robin":
+		return nil
+	}
+	return fmt.Errorf("-select %s: want first, random or round-robin:%w", how, os.ErrInvalid)
+}
+
+// selectCPUs chooses n of the cpus found for a dnssd query, the way
+// -select says. All of them are chosen if n is 0, or there are no
+// more than n. The choice is logged, since it is not obvious.
+func selectCPUs(found []*ds.LookupResult, n int, how, query string) []*ds.LookupResult {
+	if n == 0 || len(found) <= n {
+		return found
+	}
+	var c []*ds.LookupResult
+	switch how {
+	case "random":
+		s := *seed
+		if s == 0 {
+			s = time.Now().UnixNano()
+		}
+		for _, i := range rand.New(rand.NewSource(s)).Perm(len(found))[:n] {
+			c = append(c, found[i])
+		}
+	case "round-robin":
+		// dnssd sorts by load, which changes from run to run,
+		// so go round the cpus by name instead.
+		sort.SliceStable(found, func(i, j int) bool { return found[i].Entry.Name < found[j].Entry.Name })
+		next := roundRobin(query, n, len(found))
+		for i := 0; i < n; i++ {
+			c = append(c, found[(next+i)%len(found)])
+		}
+	default:
+		c = found[:n]
+	}
+	var names []string
+	for _, e := range c {
+		names = append(names, e.Entry.UnescapedName())
+	}
+	info("%s: %d of %d cpus, %s: %s", query, n, len(found), how, strings.Join(names, ", "))
+	return c
+}
+
+// roundRobinFile returns the file holding the -select round-robin
+// cursors, one for each query.
+func roundRobinFile() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d, "sidecore", "round-robin"), nil
+}
+
+// roundRobin returns the cursor for a query which found m cpus, and
+// moves it on by n. If the cursor can not be read, it starts again
+// at 0; if it can not be saved, the next run starts at the same
+// place. Neither stops the run.
+func roundRobin(query string, n, m int) int {
+	f, err := roundRobinFile()
+	if err != nil {
+		verbose("round-robin: %v", err)
+		return 0
+	}
+	cursors := map[string]int{}
+	if b, err := os.ReadFile(f); err == nil {
+		if err := json.Unmarshal(b, &cursors); err != nil {
+			verbose("round-robin: %s: %v", f, err)
+		}
+	}
+	next := cursors[query] % m
+	if next < 0 {
+		next = 0
+	}
+	cursors[query] = (next + n) % m
+	if err := writeRoundRobin(f, cursors); err != nil {
+		verbose("round-robin: %v", err)
+	}
+	return next
+}
+
+// writeRoundRobin saves the round-robin cursors, so that a run which
+// reads them at the same time sees either the old ones or the new ones.
+func writeRoundRobin(f string, cursors map[string]int) error {
+	b, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f, b)
+}
@@ -0,0 +1,115 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/brutella/dnssd"
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+// testFound returns lookup results for cpus with the given names.
+func testFound(names ...string) []*ds.LookupResult {
+	var found []*ds.LookupResult
+	for _, n := range names {
+		found = append(found, &ds.LookupResult{Entry: dnssd.BrowseEntry{Name: n}})
+	}
+	return found
+}
+
+// foundNames returns the names of the cpus in lookup results.
+func foundNames(found []*ds.LookupResult) []string {
+	var names []string
+	for _, e := range found {
+		names = append(names, e.Entry.Name)
+	}
+	return names
+}
+
+func TestCheckSelect(t *testing.T) {
+	for _, how := range []string{"first", "random", "round-robin"} {
+		if err := checkSelect(how); err != nil {
+			t.Errorf("checkSelect(%q): %v != nil", how, err)
+		}
+	}
+	if err := checkSelect("last"); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("checkSelect(last): %v != %v", err, os.ErrInvalid)
+	}
+}
+
+func TestSelectFirst(t *testing.T) {
+	for _, tt := range []struct {
+		n    int
+		want []string
+	}{
+		{n: 0, want: []string{"c", "a", "b"}},
+		{n: 2, want: []string{"c", "a"}},
+		{n: 5, want: []string{"c", "a", "b"}},
+	} {
+		got := foundNames(selectCPUs(testFound("c", "a", "b"), tt.n, "first", "q"))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("selectCPUs(c a b, %d, first): %q != %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSelectRandom(t *testing.T) {
+	defer func(s int64) { *seed = s }(*seed)
+	*seed = 42
+	a := foundNames(selectCPUs(testFound("a", "b", "c", "d", "e"), 3, "random", "q"))
+	b := foundNames(selectCPUs(testFound("a", "b", "c", "d", "e"), 3, "random", "q"))
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("selectCPUs, -seed 42: %q != %q", a, b)
+	}
+	seen := map[string]bool{}
+	for _, n := range a {
+		seen[n] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("selectCPUs(a b c d e, 3, random): %q: want 3 different cpus", a)
+	}
+}
+
+func TestSelectRoundRobin(t *testing.T) {
+	d := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", d)
+	t.Setenv("HOME", d)
+	for i, want := range [][]string{{"a", "b"}, {"c", "a"}, {"b", "c"}, {"a", "b"}} {
+		got := foundNames(selectCPUs(testFound("c", "a", "b"), 2, "round-robin", "q"))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("run %d: selectCPUs(c a b, 2, round-robin): %q != %q", i, got, want)
+		}
+	}
+	// Each query has its own cursor.
+	if got := foundNames(selectCPUs(testFound("a", "b", "c"), 1, "round-robin", "other")); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("selectCPUs(a b c, 1, round-robin), another query: %q != [a]", got)
+	}
+}
+
+func TestDedupeCPUs(t *testing.T) {
+	ll, v4, v6 := net.ParseIP("fe80::1"), net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")
+	found := []*ds.LookupResult{
+		{Entry: dnssd.BrowseEntry{Name: "a", IfaceName: "wlan0", IPs: []net.IP{ll}}},
+		{Entry: dnssd.BrowseEntry{Name: "b", IfaceName: "eth0", IPs: []net.IP{net.ParseIP("10.0.0.2")}}},
+		{Entry: dnssd.BrowseEntry{Name: "a", IfaceName: "eth0", IPs: []net.IP{v4, v6}}},
+		{Entry: dnssd.BrowseEntry{Name: "a", IfaceName: "docker0", IPs: []net.IP{v4}}},
+	}
+	c := dedupeCPUs(found)
+	if got, want := foundNames(c), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("dedupeCPUs: %q != %q", got, want)
+	}
+	if got, want := c[0].Entry.IPs, []net.IP{v4, v6, ll}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dedupeCPUs: a's IPs %v != %v", got, want)
+	}
+	// The lookup results are not changed.
+	if len(found[0].Entry.IPs) != 1 {
+		t.Errorf("dedupeCPUs changed its argument: %v", found[0].Entry.IPs)
+	}
+}
@@ -0,0 +1,593 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/ulikunitz/xz"
+)
+
+// A container may be a squashfs image, as build systems make them.
+// Its inodes and directories are read when it is served, and it is
+// served as a cpio is, from records whose contents are read, a block
+// at a time, from the image, so that a read decompresses only the
+// blocks it needs. Only squashfs 4.0, compressed with gzip, zstd or xz,
+// is supported. Blocks are decompressed here, not with the zstd or xz
+// command, which would be run for each.
+
+const (
+	sqfsMagic = 0x73717368 // "hsqs"
+
+	// sqfsUncompressed is set in the size of a block which is
+	// stored as it is.
+	sqfsUncompressed = 1 << 24
+	// sqfsMetaUncompressed is set in the header of a metadata
+	// block which is stored as it is.
+	sqfsMetaUncompressed = 1 << 15
+	// sqfsNoFragment is the fragment of a file whose tail is in a
+	// block of its own.
+	sqfsNoFragment = 0xffffffff
+)
+
+// sqfsSuper is a squashfs superblock.
+type sqfsSuper struct {
+	Magic, Inodes, MTime, BlockSize, Fragments uint32
+
+	Compressor, BlockLog, Flags, IDs, Major, Minor uint16
+
+	RootInode, BytesUsed, IDTable, XattrTable, InodeTable, DirTable, FragTable, ExportTable uint64
+}
+
+// The types of squashfs inodes. The extended types are these plus 7.
+const (
+	sqfsDir = iota + 1
+	sqfsFile
+	sqfsSymlink
+	sqfsBlock
+	sqfsChar
+	sqfsFifo
+	sqfsSocket
+)
+
+// sqfsInode is what is needed of a squashfs inode.
+type sqfsInode struct {
+	typ              uint16
+	perm             uint16
+	uid, gid         uint16
+	mtime            uint32
+	ino              uint32
+	nlink            uint32
+	size             uint64
+	dirBlock         uint32
+	dirOffset        uint16
+	start            uint64
+	frag, fragOffset uint32
+	blocks           []uint32
+	target           string
+	dev              uint32
+}
+
+// sqfsFrag is a squashfs fragment table entry.
+type sqfsFrag struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+// squashfs is an image being served.
+type squashfs struct {
+	f          io.ReaderAt
+	sb         sqfsSuper
+	decompress func([]byte) ([]byte, error)
+	ids        []uint32
+	frags      []sqfsFrag
+
+	mu sync.Mutex
+	// meta is the metadata blocks read, by where they are.
+	meta map[int64]sqfsMeta
+	// blocks are the data blocks read last, by where they are.
+	blocks map[int64][]byte
+	order  []int64
+}
+
+// sqfsMeta is a metadata block, and where the one after it is.
+type sqfsMeta struct {
+	data []byte
+	next int64
+}
+
+// sqfsCachedBlocks is how many data blocks are kept, so that reading
+// a file in small pieces does not decompress a block each time.
+const sqfsCachedBlocks = 16
+
+// isSquashfs reports whether a file is a squashfs image.
+func isSquashfs(f io.ReaderAt) bool {
+	var b [4]byte
+	n, _ := f.ReadAt(b[:], 0)
+	return n == len(b) && binary.LittleEndian.Uint32(b[:]) == sqfsMagic
+}
+
+// sqfsDecompressor returns how blocks of an image are decompressed.
+func sqfsDecompressor(id uint16) (func([]byte) ([]byte, error), error) {
+	switch id {
+	case 1:
+		return func(b []byte) ([]byte, error) {
+			r, err := zlib.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		}, nil
+	case 4:
+		return func(b []byte) ([]byte, error) {
+			r, err := xz.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(r)
+		}, nil
+	case 6:
+		// DecodeAll may be called by many goroutines at once.
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) ([]byte, error) {
+			return d.DecodeAll(b, nil)
+		}, nil
+	}
+	names := map[uint16]string{2: "lzma", 3: "lzo", 5: "lz4"}
+	if n, ok := names[id]; ok {
+		return nil, fmt.Errorf("%s compression is not supported; use gzip, zstd or xz:%w", n, os.ErrInvalid)
+	}
+	return nil, fmt.Errorf("compressor %d is not known:%w", id, os.ErrInvalid)
+}
+
+// newSquashfs reads the superblock, ids and fragments of an image.
+func newSquashfs(f io.ReaderAt) (*squashfs, error) {
+	s := &squashfs{f: f, meta: map[int64]sqfsMeta{}, blocks: map[int64][]byte{}}
+	if err := binary.Read(io.NewSectionReader(f, 0, 96), binary.LittleEndian, &s.sb); err != nil {
+		return nil, err
+	}
+	if s.sb.Magic != sqfsMagic {
+		return nil, fmt.Errorf("not a squashfs image:%w", os.ErrInvalid)
+	}
+	if s.sb.Major != 4 || s.sb.Minor != 0 {
+		return nil, fmt.Errorf("squashfs %d.%d is not supported; only 4.0 is:%w", s.sb.Major, s.sb.Minor, os.ErrInvalid)
+	}
+	if s.sb.BlockSize == 0 || s.sb.BlockSize > 1<<20 {
+		return nil, fmt.Errorf("block size %d:%w", s.sb.BlockSize, os.ErrInvalid)
+	}
+	var err error
+	if s.decompress, err = sqfsDecompressor(s.sb.Compressor); err != nil {
+		return nil, err
+	}
+	ids, err := s.table(s.sb.IDTable, int(s.sb.IDs)*4)
+	if err != nil {
+		return nil, fmt.Errorf("ids: %w", err)
+	}
+	s.ids = make([]uint32, s.sb.IDs)
+	if err := binary.Read(bytes.NewReader(ids), binary.LittleEndian, s.ids); err != nil {
+		return nil, fmt.Errorf("ids: %w", err)
+	}
+	if s.sb.Fragments > 0 {
+		frags, err := s.table(s.sb.FragTable, int(s.sb.Fragments)*16)
+		if err != nil {
+			return nil, fmt.Errorf("fragments: %w", err)
+		}
+		s.frags = make([]sqfsFrag, s.sb.Fragments)
+		if err := binary.Read(bytes.NewReader(frags), binary.LittleEndian, s.frags); err != nil {
+			return nil, fmt.Errorf("fragments: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// metaBlock returns the metadata block at pos.
+func (s *squashfs) metaBlock(pos int64) (sqfsMeta, error) {
+	s.mu.Lock()
+	m, ok := s.meta[pos]
+	s.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	var h [2]byte
+	if _, err := s.f.ReadAt(h[:], pos); err != nil {
+		return m, err
+	}
+	hdr := binary.LittleEndian.Uint16(h[:])
+	b := make([]byte, hdr&^sqfsMetaUncompressed)
+	if _, err := s.f.ReadAt(b, pos+2); err != nil {
+		return m, err
+	}
+	if hdr&sqfsMetaUncompressed == 0 {
+		var err error
+		if b, err = s.decompress(b); err != nil {
+			return m, err
+		}
+	}
+	m = sqfsMeta{data: b, next: pos + 2 + int64(hdr&^sqfsMetaUncompressed)}
+	s.mu.Lock()
+	s.meta[pos] = m
+	s.mu.Unlock()
+	return m, nil
+}
+
+// readMeta reads n bytes of metadata, from off in the block at pos,
+// and on into the blocks after it.
+func (s *squashfs) readMeta(pos int64, off int, n int) ([]byte, error) {
+	r := &metaReader{s: s, pos: pos, off: off}
+	b := r.read(n)
+	return b, r.err
+}
+
+// table reads n bytes of a table, e.g. the ids, whose metadata blocks,
+// one after another, are listed at pos.
+func (s *squashfs) table(pos uint64, n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	var b [8]byte
+	if _, err := s.f.ReadAt(b[:], int64(pos)); err != nil {
+		return nil, err
+	}
+	return s.readMeta(int64(binary.LittleEndian.Uint64(b[:])), 0, n)
+}
+
+// metaReader reads metadata on from an offset in a block.
+type metaReader struct {
+	s   *squashfs
+	pos int64
+	off int
+	err error
+}
+
+// read reads n bytes, and remembers the first error.
+func (r *metaReader) read(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	var b []byte
+	for len(b) < n {
+		m, err := r.s.metaBlock(r.pos)
+		if err != nil {
+			r.err = err
+			return make([]byte, n)
+		}
+		if r.off > len(m.data) {
+			r.err = fmt.Errorf("metadata at %d+%d: %w", r.pos, r.off, io.ErrUnexpectedEOF)
+			return make([]byte, n)
+		}
+		d := m.data[r.off:]
+		if rem := n - len(b); len(d) > rem {
+			d = d[:rem]
+		}
+		b = append(b, d...)
+		r.off += len(d)
+		if len(b) < n {
+			if len(m.data) == 0 {
+				r.err = io.ErrUnexpectedEOF
+				return make([]byte, n)
+			}
+			r.pos, r.off = m.next, 0
+		}
+	}
+	return b
+}
+
+func (r *metaReader) u16() uint16 { return binary.LittleEndian.Uint16(r.read(2)) }
+func (r *metaReader) u32() uint32 { return binary.LittleEndian.Uint32(r.read(4)) }
+func (r *metaReader) u64() uint64 { return binary.LittleEndian.Uint64(r.read(8)) }
+
+// inode reads the inode ref refers to: the block it is in, from the
+// start of the inode table, and where in it.
+func (s *squashfs) inode(ref uint64) (*sqfsInode, error) {
+	r := &metaReader{s: s, pos: int64(s.sb.InodeTable + ref>>16), off: int(ref & 0xffff)}
+	in := &sqfsInode{}
+	in.typ, in.perm, in.uid, in.gid = r.u16(), r.u16(), r.u16(), r.u16()
+	in.mtime, in.ino = r.u32(), r.u32()
+	switch in.typ {
+	case sqfsDir:
+		in.dirBlock, in.nlink = r.u32(), r.u32()
+		in.size, in.dirOffset = uint64(r.u16()), r.u16()
+		r.u32()
+	case sqfsDir + 7:
+		in.nlink, in.size, in.dirBlock = r.u32(), uint64(r.u32()), r.u32()
+		r.u32()
+		r.u16()
+		in.dirOffset = r.u16()
+		r.u32()
+	case sqfsFile:
+		in.start, in.frag, in.fragOffset, in.size = uint64(r.u32()), r.u32(), r.u32(), uint64(r.u32())
+		in.nlink = 1
+	case sqfsFile + 7:
+		in.start, in.size = r.u64(), r.u64()
+		r.u64()
+		in.nlink, in.frag, in.fragOffset = r.u32(), r.u32(), r.u32()
+		r.u32()
+	case sqfsSymlink, sqfsSymlink + 7:
+		in.nlink = r.u32()
+		n := r.u32()
+		if n > 4096 {
+			return nil, fmt.Errorf("inode %d: symlink of %d bytes:%w", in.ino, n, os.ErrInvalid)
+		}
+		in.target = string(r.read(int(n)))
+	case sqfsBlock, sqfsChar, sqfsBlock + 7, sqfsChar + 7:
+		in.nlink, in.dev = r.u32(), r.u32()
+	case sqfsFifo, sqfsSocket, sqfsFifo + 7, sqfsSocket + 7:
+		in.nlink = r.u32()
+	default:
+		return nil, fmt.Errorf("inode type %d:%w", in.typ, os.ErrInvalid)
+	}
+	if in.typ > sqfsSocket {
+		in.typ -= 7
+	}
+	if in.typ == sqfsFile {
+		bs := uint64(s.sb.BlockSize)
+		n := (in.size + bs - 1) / bs
+		if in.frag != sqfsNoFragment {
+			n = in.size / bs
+			if int(in.frag) >= len(s.frags) {
+				return nil, fmt.Errorf("inode %d: fragment %d of %d:%w", in.ino, in.frag, len(s.frags), os.ErrInvalid)
+			}
+		}
+		if n > 1<<24 {
+			return nil, fmt.Errorf("inode %d: %d blocks:%w", in.ino, n, os.ErrInvalid)
+		}
+		in.blocks = make([]uint32, n)
+		for i := range in.blocks {
+			in.blocks[i] = r.u32()
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("inode at %#x: %w", ref, r.err)
+	}
+	return in, nil
+}
+
+// sqfsDirent is an entry of a squashfs directory.
+type sqfsDirent struct {
+	name string
+	ref  uint64
+}
+
+// readDir reads the entries of a directory.
+func (s *squashfs) readDir(in *sqfsInode) ([]sqfsDirent, error) {
+	// The size of a directory is 3 more than that of its entries.
+	if in.size <= 3 {
+		return nil, nil
+	}
+	b, err := s.readMeta(int64(s.sb.DirTable)+int64(in.dirBlock), int(in.dirOffset), int(in.size-3))
+	if err != nil {
+		return nil, err
+	}
+	var ents []sqfsDirent
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		count, start := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		b = b[12:]
+		for i := uint32(0); i <= count; i++ {
+			if len(b) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			off := binary.LittleEndian.Uint16(b)
+			n := int(binary.LittleEndian.Uint16(b[6:])) + 1
+			if len(b) < 8+n {
+				return nil, io.ErrUnexpectedEOF
+			}
+			ents = append(ents, sqfsDirent{name: string(b[8 : 8+n]), ref: uint64(start)<<16 | uint64(off)})
+			b = b[8+n:]
+		}
+	}
+	return ents, nil
+}
+
+// dataBlock returns the data block at pos, of size as a squashfs block
+// size is, from the cache, if it is there.
+func (s *squashfs) dataBlock(pos int64, size uint32) ([]byte, error) {
+	s.mu.Lock()
+	b, ok := s.blocks[pos]
+	s.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+	b = make([]byte, size&^sqfsUncompressed)
+	if _, err := s.f.ReadAt(b, pos); err != nil {
+		return nil, err
+	}
+	if size&sqfsUncompressed == 0 {
+		var err error
+		if b, err = s.decompress(b); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	if _, ok := s.blocks[pos]; !ok {
+		s.blocks[pos] = b
+		s.order = append(s.order, pos)
+		if len(s.order) > sqfsCachedBlocks {
+			delete(s.blocks, s.order[0])
+			s.order = s.order[1:]
+		}
+	}
+	s.mu.Unlock()
+	return b, nil
+}
+
+// sqfsData is the contents of a file in a squashfs image.
+type sqfsData struct {
+	s  *squashfs
+	in *sqfsInode
+	// offs are where the blocks are.
+	offs []int64
+}
+
+func newSqfsData(s *squashfs, in *sqfsInode) *sqfsData {
+	f := &sqfsData{s: s, in: in, offs: make([]int64, len(in.blocks))}
+	pos := int64(in.start)
+	for i, b := range in.blocks {
+		f.offs[i] = pos
+		pos += int64(b &^ sqfsUncompressed)
+	}
+	return f
+}
+
+// block returns the i'th block of the file, the last of which may be
+// a fragment.
+func (f *sqfsData) block(i int) ([]byte, error) {
+	bs := int64(f.s.sb.BlockSize)
+	n := int64(f.in.size) - int64(i)*bs
+	if n > bs {
+		n = bs
+	}
+	if i < len(f.in.blocks) {
+		// A block of size 0 is a hole.
+		if f.in.blocks[i] == 0 {
+			return make([]byte, n), nil
+		}
+		b, err := f.s.dataBlock(f.offs[i], f.in.blocks[i])
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(b)) < n {
+			return nil, fmt.Errorf("inode %d: block %d is %d bytes, not %d:%w", f.in.ino, i, len(b), n, io.ErrUnexpectedEOF)
+		}
+		return b[:n], nil
+	}
+	fr := f.s.frags[f.in.frag]
+	b, err := f.s.dataBlock(int64(fr.Start), fr.Size)
+	if err != nil {
+		return nil, err
+	}
+	o := int64(f.in.fragOffset)
+	if o+n > int64(len(b)) {
+		return nil, fmt.Errorf("inode %d: fragment %d is %d bytes, not %d:%w", f.in.ino, f.in.frag, len(b), o+n, io.ErrUnexpectedEOF)
+	}
+	return b[o : o+n], nil
+}
+
+// ReadAt implements io.ReaderAt, decompressing only the blocks which
+// are read.
+func (f *sqfsData) ReadAt(p []byte, off int64) (int, error) {
+	size := int64(f.in.size)
+	bs := int64(f.s.sb.BlockSize)
+	var n int
+	for n < len(p) {
+		if off >= size {
+			return n, io.EOF
+		}
+		b, err := f.block(int(off / bs))
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], b[off%bs:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// record returns the cpio record of an inode, named n.
+func (s *squashfs) record(n string, in *sqfsInode) cpio.Record {
+	r := cpio.Record{Info: cpio.Info{
+		Ino:   uint64(in.ino),
+		Mode:  uint64(in.perm) & 07777,
+		NLink: uint64(in.nlink),
+		MTime: uint64(in.mtime),
+		Name:  n,
+	}}
+	if int(in.uid) < len(s.ids) {
+		r.UID = uint64(s.ids[in.uid])
+	}
+	if int(in.gid) < len(s.ids) {
+		r.GID = uint64(s.ids[in.gid])
+	}
+	switch in.typ {
+	case sqfsDir:
+		r.Mode |= cpio.S_IFDIR
+	case sqfsFile:
+		r.Mode |= cpio.S_IFREG
+		r.FileSize = in.size
+		r.ReaderAt = newSqfsData(s, in)
+	case sqfsSymlink:
+		r.Mode |= cpio.S_IFLNK
+		r.FileSize = uint64(len(in.target))
+		r.ReaderAt = bytes.NewReader([]byte(in.target))
+	case sqfsBlock, sqfsChar:
+		if in.typ == sqfsChar {
+			r.Mode |= cpio.S_IFCHR
+		} else {
+			r.Mode |= cpio.S_IFBLK
+		}
+		r.Rmajor = uint64(in.dev&0xfff00) >> 8
+		r.Rminor = uint64(in.dev&0xff | in.dev>>12&0xfff00)
+	case sqfsFifo:
+		r.Mode |= cpio.S_IFIFO
+	case sqfsSocket:
+		r.Mode |= cpio.S_IFSOCK
+	}
+	return r
+}
+
+// readSquashfs reads the inodes and directories of a squashfs image,
+// and returns its files as cpio records, as fsCPIO needs them.
+func readSquashfs(f io.ReaderAt) ([]cpio.Record, error) {
+	s, err := newSquashfs(f)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.inode(s.sb.RootInode)
+	if err != nil {
+		return nil, err
+	}
+	if root.typ != sqfsDir {
+		return nil, fmt.Errorf("root is not a directory:%w", os.ErrInvalid)
+	}
+	recs := []cpio.Record{s.record(".", root)}
+	var walk func(dir string, in *sqfsInode, depth int) error
+	walk = func(dir string, in *sqfsInode, depth int) error {
+		if depth > 256 {
+			return fmt.Errorf("%s: too deep:%w", dir, os.ErrInvalid)
+		}
+		ents, err := s.readDir(in)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+		for _, e := range ents {
+			if e.name == "." || e.name == ".." || len(e.name) == 0 {
+				continue
+			}
+			n := archiveName(path.Join(dir, e.name))
+			c, err := s.inode(e.ref)
+			if err != nil {
+				return fmt.Errorf("%s: %w", n, err)
+			}
+			recs = append(recs, s.record(n, c))
+			if c.typ == sqfsDir {
+				if err := walk(n, c, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(".", root, 0); err != nil {
+		return nil, err
+	}
+	return mergeCPIO([][]cpio.Record{recs}), nil
+}
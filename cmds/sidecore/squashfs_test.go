@@ -0,0 +1,455 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// sqfsTestFile is a file of a squashfs image which writeSquashfs
+// writes.
+type sqfsTestFile struct {
+	typ  uint16
+	perm uint16
+	uid  uint16
+	// data is what is in a file, or a symlink's target.
+	data string
+	dev  uint32
+	// ext writes an extended inode.
+	ext bool
+}
+
+// sqfsZlib compresses b, or, if that does not make it smaller, returns
+// it as it is, and false.
+func sqfsZlib(b []byte) ([]byte, bool) {
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(b)
+	w.Close()
+	if z.Len() >= len(b) {
+		return b, false
+	}
+	return z.Bytes(), true
+}
+
+// sqfsMetaWriter writes metadata blocks.
+type sqfsMetaWriter struct {
+	buf, out []byte
+}
+
+// ref returns where the next byte written will be: the block, from the
+// start of the table, and where in it.
+func (m *sqfsMetaWriter) ref() uint64 {
+	return uint64(len(m.out))<<16 | uint64(len(m.buf))
+}
+
+func (m *sqfsMetaWriter) write(v ...any) {
+	var b bytes.Buffer
+	for _, x := range v {
+		if s, ok := x.(string); ok {
+			b.WriteString(s)
+			continue
+		}
+		binary.Write(&b, binary.LittleEndian, x)
+	}
+	m.buf = append(m.buf, b.Bytes()...)
+	for len(m.buf) >= 8192 {
+		m.flush(8192)
+	}
+}
+
+func (m *sqfsMetaWriter) flush(n int) {
+	b, ok := sqfsZlib(m.buf[:n])
+	h := uint16(len(b))
+	if !ok {
+		h |= sqfsMetaUncompressed
+	}
+	m.out = binary.LittleEndian.AppendUint16(m.out, h)
+	m.out = append(m.out, b...)
+	m.buf = m.buf[n:]
+}
+
+func (m *sqfsMetaWriter) finish() []byte {
+	if len(m.buf) > 0 {
+		m.flush(len(m.buf))
+	}
+	return m.out
+}
+
+// writeSquashfs writes a squashfs image of files, compressed with gzip,
+// as mksquashfs would. Files larger than a block have blocks of their
+// own for their tails; others share a fragment.
+func writeSquashfs(t *testing.T, p string, files map[string]sqfsTestFile) {
+	t.Helper()
+	const bs = 4096
+	img := make([]byte, 96)
+	children := map[string][]string{}
+	for n := range files {
+		for d := n; d != "."; d = path.Dir(d) {
+			children[path.Dir(d)] = append(children[path.Dir(d)], d)
+		}
+	}
+	for d, c := range children {
+		sort.Strings(c)
+		var u []string
+		for i, n := range c {
+			if i == 0 || c[i-1] != n {
+				u = append(u, n)
+			}
+		}
+		children[d] = u
+	}
+
+	type data struct {
+		start      uint64
+		blocks     []uint32
+		frag       uint32
+		fragOffset uint32
+	}
+	datas := map[string]*data{}
+	var frag []byte
+	for n, f := range files {
+		if f.typ != sqfsFile {
+			continue
+		}
+		d := &data{start: uint64(len(img)), frag: sqfsNoFragment}
+		b := []byte(f.data)
+		if len(b) < bs {
+			d.frag, d.fragOffset = 0, uint32(len(frag))
+			frag = append(frag, b...)
+			b = nil
+		}
+		for len(b) > 0 {
+			blk := b
+			if len(blk) > bs {
+				blk = blk[:bs]
+			}
+			b = b[len(blk):]
+			if bytes.Count(blk, []byte{0}) == len(blk) {
+				d.blocks = append(d.blocks, 0)
+				continue
+			}
+			z, ok := sqfsZlib(blk)
+			size := uint32(len(z))
+			if !ok {
+				size |= sqfsUncompressed
+			}
+			d.blocks = append(d.blocks, size)
+			img = append(img, z...)
+		}
+		datas[n] = d
+	}
+	fragStart := uint64(len(img))
+	fz, ok := sqfsZlib(frag)
+	fragSize := uint32(len(fz))
+	if !ok {
+		fragSize |= sqfsUncompressed
+	}
+	img = append(img, fz...)
+
+	var inodes, dirs sqfsMetaWriter
+	ino := uint32(0)
+	// write writes the inode of n, after those of what is in it, if
+	// it is a directory, and returns its ref and number.
+	var write func(n string) (uint64, uint32)
+	write = func(n string) (uint64, uint32) {
+		f, ok := files[n]
+		if !ok {
+			f = sqfsTestFile{typ: sqfsDir, perm: 0755}
+		}
+		type ent struct {
+			name string
+			ref  uint64
+			ino  uint32
+			typ  uint16
+		}
+		var ents []ent
+		subdirs := uint32(0)
+		if f.typ == sqfsDir {
+			for _, c := range children[n] {
+				r, i := write(c)
+				ct := uint16(sqfsDir)
+				if cf, ok := files[c]; ok {
+					ct = cf.typ
+				}
+				if ct == sqfsDir {
+					subdirs++
+				}
+				ents = append(ents, ent{name: path.Base(c), ref: r, ino: i, typ: ct})
+			}
+		}
+		listing := dirs.ref()
+		size := 3
+		for _, e := range ents {
+			dirs.write(uint32(0), uint32(e.ref>>16), e.ino, uint16(e.ref&0xffff), int16(0), e.typ, uint16(len(e.name)-1), e.name)
+			size += 12 + 8 + len(e.name)
+		}
+		ino++
+		ref := inodes.ref()
+		typ := f.typ
+		if f.ext {
+			typ += 7
+		}
+		inodes.write(typ, f.perm, f.uid, uint16(0), uint32(1700000000), ino)
+		switch typ {
+		case sqfsDir:
+			inodes.write(uint32(listing>>16), 2+subdirs, uint16(size), uint16(listing&0xffff), uint32(0))
+		case sqfsFile:
+			d := datas[n]
+			inodes.write(uint32(d.start), d.frag, d.fragOffset, uint32(len(f.data)), d.blocks)
+		case sqfsFile + 7:
+			d := datas[n]
+			inodes.write(d.start, uint64(len(f.data)), uint64(0), uint32(1), d.frag, d.fragOffset, uint32(0xffffffff), d.blocks)
+		case sqfsSymlink:
+			inodes.write(uint32(1), uint32(len(f.data)), f.data)
+		case sqfsChar, sqfsBlock:
+			inodes.write(uint32(1), f.dev)
+		case sqfsFifo, sqfsSocket:
+			inodes.write(uint32(1))
+		default:
+			t.Fatalf("%s: type %d", n, typ)
+		}
+		return ref, ino
+	}
+	root, _ := write(".")
+
+	inodeTable := uint64(len(img))
+	img = append(img, inodes.finish()...)
+	dirTable := uint64(len(img))
+	img = append(img, dirs.finish()...)
+	table := func(v ...any) uint64 {
+		var m sqfsMetaWriter
+		m.write(v...)
+		p := uint64(len(img))
+		img = append(img, m.finish()...)
+		index := uint64(len(img))
+		img = binary.LittleEndian.AppendUint64(img, p)
+		return index
+	}
+	fragTable := table(fragStart, fragSize, uint32(0))
+	idTable := table(uint32(0), uint32(1000))
+
+	var sb bytes.Buffer
+	binary.Write(&sb, binary.LittleEndian, sqfsSuper{
+		Magic: sqfsMagic, Inodes: ino, MTime: 1700000000, BlockSize: bs, Fragments: 1,
+		Compressor: 1, BlockLog: 12, IDs: 2, Major: 4,
+		RootInode: root, BytesUsed: uint64(len(img)), IDTable: idTable, XattrTable: ^uint64(0),
+		InodeTable: inodeTable, DirTable: dirTable, FragTable: fragTable, ExportTable: ^uint64(0),
+	})
+	copy(img, sb.Bytes())
+	if err := os.WriteFile(p, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSquashfs writes a squashfs image, and returns it, and its files.
+func testSquashfs(t *testing.T) (string, map[string]string) {
+	big := make([]byte, 3*4096+100)
+	copy(big, strings.Repeat("compressible ", 4096/13))
+	// The second block is a hole, and the third does not compress.
+	rand.New(rand.NewSource(1)).Read(big[2*4096:])
+	files := map[string]sqfsTestFile{
+		"etc":            {typ: sqfsDir, perm: 0755},
+		"etc/os-release": {typ: sqfsFile, perm: 0644, data: "ID=ubuntu"},
+		"etc/hostname":   {typ: sqfsFile, perm: 0600, uid: 1, data: "box"},
+		"bin/big":        {typ: sqfsFile, perm: 0755, data: string(big), ext: true},
+		"lib":            {typ: sqfsSymlink, perm: 0777, data: "usr/lib"},
+		"dev/null":       {typ: sqfsChar, perm: 0666, dev: 1<<8 | 3},
+		"empty":          {typ: sqfsDir, perm: 0700},
+	}
+	// Enough files that the inodes and directories take more than a
+	// metadata block.
+	for i := 0; i < 400; i++ {
+		files[path.Join("usr/share/doc", strings.Repeat("x", 20)+string(rune('a'+i%26))+strings.Repeat("y", i/26))] = sqfsTestFile{typ: sqfsFile, perm: 0644, data: "doc"}
+	}
+	p := filepath.Join(t.TempDir(), "rootfs.sqfs")
+	writeSquashfs(t, p, files)
+	want := map[string]string{}
+	for n, f := range files {
+		if f.typ == sqfsFile {
+			want[n] = f.data
+		}
+	}
+	return p, want
+}
+
+func TestSquashfsfsCPIO(t *testing.T) {
+	p, files := testSquashfs(t)
+	f, err := NewfsCPIO(p)
+	if err != nil {
+		t.Fatalf("NewfsCPIO(%s): %v != nil", p, err)
+	}
+	for n, want := range files {
+		h, err := f.Open(n)
+		if err != nil {
+			t.Errorf("Open(%q): %v != nil", n, err)
+			continue
+		}
+		// Read in pieces which cross blocks.
+		var got []byte
+		b := make([]byte, 1000)
+		for off := int64(0); ; {
+			m, err := h.ReadAt(b, off)
+			got = append(got, b[:m]...)
+			off += int64(m)
+			if err != nil {
+				break
+			}
+		}
+		if string(got) != want {
+			t.Errorf("%s: %d bytes != the %d written", n, len(got), len(want))
+		}
+	}
+	ents, err := f.ReadDir(".")
+	if err != nil {
+		t.Fatalf("ReadDir(.): %v != nil", err)
+	}
+	var got []string
+	for _, e := range ents {
+		got = append(got, e.Name())
+	}
+	sort.Strings(got)
+	if want := []string{"bin", "dev", "empty", "etc", "lib", "usr"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir(.): %q != %q", got, want)
+	}
+	if ents, err := f.ReadDir("usr/share/doc"); err != nil || len(ents) != 400 {
+		t.Errorf("ReadDir(usr/share/doc): %d entries, %v != 400, nil", len(ents), err)
+	}
+	for n, want := range map[string]fs.FileMode{"lib": fs.ModeSymlink, "dev/null": fs.ModeCharDevice, "empty": fs.ModeDir} {
+		fi, err := f.Lstat(n)
+		if err != nil || fi.Mode().Type()&want != want {
+			t.Errorf("Lstat(%q): %v, %v != %v, nil", n, fi.Mode().Type(), err, want)
+		}
+	}
+	if fi, err := f.Lstat("etc/hostname"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Lstat(etc/hostname): %v, %v != %v, nil", fi.Mode().Perm(), err, fs.FileMode(0600))
+	}
+	if l, err := f.Readlink("lib"); err != nil || l != "usr/lib" {
+		t.Errorf("Readlink(lib): %q, %v != %q, nil", l, err, "usr/lib")
+	}
+}
+
+func TestSquashfsRecords(t *testing.T) {
+	p, _ := testSquashfs(t)
+	fi, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fi.Close()
+	recs, err := readSquashfs(fi)
+	if err != nil {
+		t.Fatalf("readSquashfs(%s): %v != nil", p, err)
+	}
+	for _, r := range recs {
+		switch r.Name {
+		case "etc/hostname":
+			if r.UID != 1000 {
+				t.Errorf("%s: uid %d != 1000", r.Name, r.UID)
+			}
+		case "dev/null":
+			if r.Rmajor != 1 || r.Rminor != 3 {
+				t.Errorf("%s: %d, %d != 1, 3", r.Name, r.Rmajor, r.Rminor)
+			}
+		}
+	}
+}
+
+func TestSquashfs9P(t *testing.T) {
+	p, files := testSquashfs(t)
+	u, err := newServer(p, nil, "home")
+	if err != nil {
+		t.Fatalf("newServer(%s): %v != nil", p, err)
+	}
+	root, err := u.Attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, want := "etc/os-release", files["etc/os-release"]
+	_, f, err := root.Walk(strings.Split(n, "/"))
+	if err != nil {
+		t.Fatalf("Walk(%q): %v != nil", n, err)
+	}
+	if _, _, err := f.Open(p9.ReadOnly); err != nil {
+		t.Fatalf("Open(%q): %v != nil", n, err)
+	}
+	b := make([]byte, 64)
+	m, _ := f.ReadAt(b, 0)
+	if got := string(b[:m]); got != want {
+		t.Errorf("%s: %q != %q", n, got, want)
+	}
+}
+
+func TestSqfsDecompressor(t *testing.T) {
+	want := bytes.Repeat([]byte("compressible "), 1024)
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xb bytes.Buffer
+	xw, err := xz.NewWriter(&xb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := xw.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Blocks are not decompressed with a command.
+	t.Setenv("PATH", "")
+	for _, tt := range []struct {
+		name string
+		id   uint16
+		b    []byte
+	}{
+		{name: "xz", id: 4, b: xb.Bytes()},
+		{name: "zstd", id: 6, b: zw.EncodeAll(want, nil)},
+	} {
+		d, err := sqfsDecompressor(tt.id)
+		if err != nil {
+			t.Fatalf("sqfsDecompressor(%d), %s: %v != nil", tt.id, tt.name, err)
+		}
+		got, err := d(tt.b)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: %d bytes, %v != %d bytes, nil", tt.name, len(got), err, len(want))
+		}
+		if _, err := d(tt.b[:len(tt.b)/2]); err == nil {
+			t.Errorf("%s, truncated: nil != an error", tt.name)
+		}
+	}
+}
+
+func TestSquashfsCompressor(t *testing.T) {
+	p, _ := testSquashfs(t)
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lz4
+	binary.LittleEndian.PutUint16(b[20:], 5)
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewfsCPIO(p); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("NewfsCPIO(%s), lz4: %v != %v", p, err, os.ErrInvalid)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/brutella/dnssd"
+	"github.com/u-root/sidecore/internal/cpu/ds"
+)
+
+// mDNS does not cross subnets, so cpus can also be found in DNS
+// SRV records, with hosts written as srv:domain, e.g.
+// srv:example.com?arch=arm64, which finds the targets of the
+// _cpu._tcp.example.com SRV records. A name with its own
+// _service._proto, e.g. srv:_ncpu._tcp.example.com, is used as is.
+
+// srvService is the service looked up for srv:domain.
+const srvService = "_cpu._tcp"
+
+// resolver looks up SRV and TXT records. Tests replace it.
+var resolver = net.DefaultResolver
+
+// srvQuery returns the SRV name, and the query, for a srv: host.
+// The query's requirements are written as for dnssd: queries.
+func srvQuery(host string) (string, ds.Query, error) {
+	dq, err := ds.Parse("dnssd://" + host)
+	if err != nil {
+		return "", ds.Query{}, err
+	}
+	if !strings.HasPrefix(host, "_") {
+		dq.Type = srvService
+	}
+	return dq.Type + "." + dq.Domain, dq, nil
+}
+
+// srvText returns the txt attributes of an SRV target, from its TXT
+// records, which are key=value, separated by spaces. The resolver
+// joins the strings of a record, so the attributes may also be
+// in records of their own, but not in strings of their own.
+func srvText(ctx context.Context, target string) map[string]string {
+	txt, err := resolver.LookupTXT(ctx, target)
+	if err != nil {
+		verbose("srv: TXT %s: %v", target, err)
+		return nil
+	}
+	text := map[string]string{}
+	for _, t := range txt {
+		for _, kv := range strings.Fields(t) {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				text[k] = v
+			}
+		}
+	}
+	return text
+}
+
+// lookupSRV finds the cpus in the SRV records for a srv: host, which
+// meet its requirements, in the order the records' priorities and
+// weights give: lowest priority first, and, among those of the same
+// priority, chosen at random, the heavier more likely to come first.
+// Targets with no TXT records are assumed to meet the requirements.
+func lookupSRV(host string) ([]*ds.LookupResult, error) {
+	name, dq, err := srvQuery(host)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("srv: %s: %w", name, err)
+	}
+	var c []*ds.LookupResult
+	for _, s := range srvs {
+		text := srvText(ctx, s.Target)
+		if len(text) > 0 && !ds.Required(dq, text) {
+			verbose("srv: %s: %v does not meet %v", s.Target, text, dq.Text)
+			continue
+		}
+		c = append(c, &ds.LookupResult{Entry: dnssd.BrowseEntry{Name: strings.TrimSuffix(s.Target, "."), Host: s.Target, Port: int(s.Port), Text: text}})
+	}
+	if len(c) == 0 {
+		return nil, fmt.Errorf("srv: %s: %w (%d answered)", name, ds.ErrNoMatch, len(srvs))
+	}
+	return c, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/u-root/sidecore/internal/cpu/ds"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNS serves SRV and TXT records, and makes the resolver use it.
+func testDNS(t *testing.T, srv map[string][]dnsmessage.SRVResource, txt map[string][]string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v != nil", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var m dnsmessage.Message
+			if err := m.Unpack(b[:n]); err != nil || len(m.Questions) != 1 {
+				continue
+			}
+			q := m.Questions[0]
+			m.Header.Response, m.Header.Authoritative = true, true
+			name := q.Name.String()
+			switch q.Type {
+			case dnsmessage.TypeSRV:
+				for _, r := range srv[name] {
+					r := r
+					m.Answers = append(m.Answers, dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}, Body: &r})
+				}
+			case dnsmessage.TypeTXT:
+				// One record for each key=value, as the
+				// resolver joins the strings of a record.
+				for _, t := range txt[name] {
+					m.Answers = append(m.Answers, dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}, Body: &dnsmessage.TXTResource{TXT: []string{t}}})
+				}
+			}
+			if len(m.Answers) == 0 {
+				m.Header.RCode = dnsmessage.RCodeNameError
+			}
+			r, err := m.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(r, addr)
+		}
+	}()
+	old := resolver
+	t.Cleanup(func() { resolver = old })
+	resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+	}}
+}
+
+// testSRV returns an SRV record.
+func testSRV(target string, port, priority, weight uint16) dnsmessage.SRVResource {
+	return dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port, Priority: priority, Weight: weight}
+}
+
+func TestSRVQuery(t *testing.T) {
+	for _, tt := range []struct {
+		host, name string
+	}{
+		{host: "example.com", name: "_cpu._tcp.example.com"},
+		{host: "example.com?arch=arm64", name: "_cpu._tcp.example.com"},
+		{host: "_ncpu._tcp.example.com", name: "_ncpu._tcp.example.com"},
+	} {
+		name, _, err := srvQuery(tt.host)
+		if err != nil || name != tt.name {
+			t.Errorf("srvQuery(%q): (%q, %v) != (%q, nil)", tt.host, name, err, tt.name)
+		}
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	testDNS(t, map[string][]dnsmessage.SRVResource{
+		"_cpu._tcp.example.com.": {
+			testSRV("c.example.com.", 17012, 20, 0),
+			testSRV("a.example.com.", 17010, 10, 0),
+			testSRV("x86.example.com.", 17013, 10, 0),
+			testSRV("b.example.com.", 17011, 15, 0),
+		},
+		"_cpu._tcp.x86.example.com.": {
+			testSRV("x86.example.com.", 17013, 10, 0),
+		},
+	}, map[string][]string{
+		"a.example.com.":   {"arch=arm64", "os=linux"},
+		"x86.example.com.": {"arch=amd64 os=linux"},
+	})
+	c, err := lookupSRV("example.com?arch=arm64")
+	if err != nil {
+		t.Fatalf("lookupSRV: %v != nil", err)
+	}
+	// b and c have no TXT records, so may be anything.
+	var got []string
+	for _, e := range c {
+		got = append(got, e.Entry.Name+":"+strconv.Itoa(e.Entry.Port))
+	}
+	if want := []string{"a.example.com:17010", "b.example.com:17011", "c.example.com:17012"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lookupSRV: %q != %q", got, want)
+	}
+
+	if _, err := lookupSRV("x86.example.com?arch=riscv64&os=linux"); !errors.Is(err, ds.ErrNoMatch) {
+		t.Errorf("lookupSRV, no match: %v != %v", err, ds.ErrNoMatch)
+	}
+	if _, err := lookupSRV("nowhere.example.com"); err == nil {
+		t.Errorf("lookupSRV, no records: nil != an error")
+	}
+}
+
+func TestLookupSRVWeights(t *testing.T) {
+	// With the same priority, the heavier should usually come first.
+	testDNS(t, map[string][]dnsmessage.SRVResource{
+		"_cpu._tcp.example.com.": {
+			testSRV("light.example.com.", 17010, 10, 1),
+			testSRV("heavy.example.com.", 17010, 10, 1000),
+		},
+	}, nil)
+	heavy := 0
+	for i := 0; i < 20; i++ {
+		c, err := lookupSRV("example.com")
+		if err != nil {
+			t.Fatalf("lookupSRV: %v != nil", err)
+		}
+		if c[0].Entry.Name == "heavy.example.com" {
+			heavy++
+		}
+	}
+	if heavy < 15 {
+		t.Errorf("heavy.example.com first %d times in 20; want nearly all", heavy)
+	}
+}
+
+func TestLookupHostSRV(t *testing.T) {
+	defer func(n cpuCount) { numCPUs = n }(numCPUs)
+	numCPUs = 2
+	testDNS(t, map[string][]dnsmessage.SRVResource{
+		"_cpu._tcp.example.com.": {
+			testSRV("a.example.com.", 17010, 10, 0),
+			testSRV("b.example.com.", 17011, 20, 0),
+			testSRV("c.example.com.", 17012, 30, 0),
+		},
+	}, nil)
+	c, err := lookupHost("srv:example.com", nil)
+	if err != nil {
+		t.Fatalf("lookupHost(srv:example.com): %v != nil", err)
+	}
+	want := []cpu{{host: "a.example.com", port: "17010"}, {host: "b.example.com", port: "17011"}}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("lookupHost(srv:example.com): %+v != %+v", c, want)
+	}
+	if _, err := lookupHost("srv:example.com", []string{"*.example.com"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lookupHost(srv:example.com), all excluded: %v != %v", err, os.ErrNotExist)
+	}
+}
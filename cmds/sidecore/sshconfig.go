@@ -0,0 +1,74 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	config "github.com/kevinburke/ssh_config"
+)
+
+var sshConfigFile = flag.String("ssh-config", "", "ssh_config file to use instead of ~/.ssh/config and /etc/ssh/ssh_config; the default is SIDECORE_SSH_CONFIG")
+
+// fileSSHConfig is an ssh_config read from one file, which, like
+// the user's, returns the default for keys which are not set.
+type fileSSHConfig struct {
+	c *config.Config
+}
+
+// Get returns the first value of key for alias.
+func (f *fileSSHConfig) Get(alias, key string) string {
+	if v, err := f.c.Get(alias, key); err == nil && len(v) > 0 {
+		return v
+	}
+	return config.Default(key)
+}
+
+// GetAll returns all the values of key for alias.
+func (f *fileSSHConfig) GetAll(alias, key string) []string {
+	if v, err := f.c.GetAll(alias, key); err == nil && len(v) > 0 {
+		return v
+	}
+	if d := config.Default(key); len(d) > 0 {
+		return []string{d}
+	}
+	return nil
+}
+
+// loadSSHConfig reads the ssh_config file n.
+func loadSSHConfig(n string) (*fileSSHConfig, error) {
+	f, err := os.Open(n)
+	if err != nil {
+		return nil, fmt.Errorf("-ssh-config: %w", err)
+	}
+	defer f.Close()
+	c, err := config.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("-ssh-config %s: %v:%w", n, err, os.ErrInvalid)
+	}
+	return &fileSSHConfig{c: c}, nil
+}
+
+// setSSHConfigFile makes sshConfig the file of -ssh-config, or, if it
+// is not set, SIDECORE_SSH_CONFIG. If neither is, ~/.ssh/config and
+// /etc/ssh/ssh_config are used, as ssh does.
+func setSSHConfigFile() error {
+	n := *sshConfigFile
+	if len(n) == 0 {
+		n = os.Getenv("SIDECORE_SSH_CONFIG")
+	}
+	if len(n) == 0 {
+		return nil
+	}
+	c, err := loadSSHConfig(n)
+	if err != nil {
+		return err
+	}
+	verbose("ssh_config is %s", n)
+	sshConfig = c
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetSSHConfigFile(t *testing.T) {
+	old := sshConfig
+	t.Cleanup(func() { sshConfig = old })
+	defer func(f string) { *sshConfigFile = f }(*sshConfigFile)
+	d := t.TempDir()
+	envConf, flagConf := filepath.Join(d, "env"), filepath.Join(d, "flag")
+	if err := os.WriteFile(envConf, []byte("Host *.lab\n\tPort 17011\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(flagConf, []byte("Host *.lab\n\tPort 17012\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		flag, env string
+		port      string
+		err       error
+	}{
+		{env: envConf, port: "17011"},
+		{flag: flagConf, env: envConf, port: "17012"},
+		{flag: filepath.Join(d, "nosuch"), err: os.ErrNotExist},
+		{env: filepath.Join(d, "nosuch"), err: os.ErrNotExist},
+	} {
+		sshConfig = old
+		*sshConfigFile = tt.flag
+		t.Setenv("SIDECORE_SSH_CONFIG", tt.env)
+		err := setSSHConfigFile()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("setSSHConfigFile(%q, %q): %v != %v", tt.flag, tt.env, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := getPort("rpi.lab", ""); got != tt.port {
+			t.Errorf("setSSHConfigFile(%q, %q): getPort(rpi.lab): %q != %q", tt.flag, tt.env, got, tt.port)
+		}
+	}
+
+	sshConfig = old
+	*sshConfigFile = ""
+	t.Setenv("SIDECORE_SSH_CONFIG", "")
+	if err := setSSHConfigFile(); err != nil || sshConfig != old {
+		t.Errorf("setSSHConfigFile, unset: %v, changed sshConfig %v", err, sshConfig != old)
+	}
+}
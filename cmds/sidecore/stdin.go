@@ -0,0 +1,54 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The remote command reads sidecore's stdin, unless -stdin gives it a
+// file, or -no-stdin nothing. Only a terminal gets a pty; other input,
+// e.g. a pipe, is copied as it is, and its end is passed on, so that
+// the command sees end of file.
+var (
+	stdinFlag   = flag.String("stdin", "", "file for the remote command to read as its stdin; with more than one cpu, each reads all of it")
+	noStdinFlag = flag.Bool("no-stdin", false, "give the remote command no input, as ssh -n does")
+)
+
+// checkStdin checks -stdin and -no-stdin, so that a file which can
+// not be read is found before any cpu is dialed.
+func checkStdin() error {
+	if len(*stdinFlag) == 0 {
+		return nil
+	}
+	if *noStdinFlag {
+		return fmt.Errorf("-stdin and -no-stdin can not both be set:%w", os.ErrInvalid)
+	}
+	fi, err := os.Stat(*stdinFlag)
+	if err != nil {
+		return fmt.Errorf("-stdin: %w", err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("-stdin %s: is a directory:%w", *stdinFlag, os.ErrInvalid)
+	}
+	return nil
+}
+
+// cpuStdin returns the input for a cpu's command: the file of -stdin,
+// nothing, for -no-stdin, or when cpus run in parallel, so that they
+// do not fight over reading stdin, or, if neither, nil, for stdin.
+func cpuStdin(cpu *cpu) (io.ReadCloser, error) {
+	switch {
+	case len(*stdinFlag) > 0:
+		return os.Open(*stdinFlag)
+	case *noStdinFlag || cpu.noStdin:
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return nil, nil
+}
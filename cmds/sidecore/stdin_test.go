@@ -0,0 +1,79 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckStdin(t *testing.T) {
+	defer func(in string, no bool) { *stdinFlag, *noStdinFlag = in, no }(*stdinFlag, *noStdinFlag)
+	d := t.TempDir()
+	f := filepath.Join(d, "in")
+	if err := os.WriteFile(f, []byte("input"), 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v != nil", f, err)
+	}
+	for _, tt := range []struct {
+		name  string
+		stdin string
+		no    bool
+		want  error
+	}{
+		{name: "neither"},
+		{name: "-no-stdin", no: true},
+		{name: "-stdin", stdin: f},
+		{name: "both", stdin: f, no: true, want: os.ErrInvalid},
+		{name: "missing", stdin: filepath.Join(d, "none"), want: os.ErrNotExist},
+		{name: "directory", stdin: d, want: os.ErrInvalid},
+	} {
+		*stdinFlag, *noStdinFlag = tt.stdin, tt.no
+		if err := checkStdin(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: checkStdin: %v != %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCPUStdin(t *testing.T) {
+	defer func(in string, no bool) { *stdinFlag, *noStdinFlag = in, no }(*stdinFlag, *noStdinFlag)
+	f := filepath.Join(t.TempDir(), "in")
+	if err := os.WriteFile(f, []byte("input"), 0600); err != nil {
+		t.Fatalf("WriteFile(%q): %v != nil", f, err)
+	}
+	for _, tt := range []struct {
+		name    string
+		stdin   string
+		no      bool
+		noStdin bool
+		want    string
+		own     bool
+	}{
+		{name: "stdin", own: true},
+		{name: "-stdin", stdin: f, want: "input"},
+		{name: "-stdin, in parallel", stdin: f, noStdin: true, want: "input"},
+		{name: "-no-stdin", no: true},
+		{name: "in parallel", noStdin: true},
+	} {
+		*stdinFlag, *noStdinFlag = tt.stdin, tt.no
+		in, err := cpuStdin(&cpu{noStdin: tt.noStdin})
+		if err != nil {
+			t.Fatalf("%s: cpuStdin: %v != nil", tt.name, err)
+		}
+		if tt.own {
+			if in != nil {
+				t.Errorf("%s: cpuStdin: %v != nil", tt.name, in)
+			}
+			continue
+		}
+		b, err := io.ReadAll(in)
+		in.Close()
+		if err != nil || string(b) != tt.want {
+			t.Errorf("%s: cpuStdin: (%q, %v) != (%q, nil)", tt.name, b, err, tt.want)
+		}
+	}
+}
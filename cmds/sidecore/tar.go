@@ -0,0 +1,94 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// A container may be a tar, e.g. what docker export writes, or an
+// Ubuntu base tarball, rather than a cpio. Its headers are read once,
+// and it is served as a cpio is, from records whose contents are read
+// from where they are in the tar.
+
+// isTar reports whether a file is a tar: it has the ustar magic, or, as
+// old tars do not, it is named .tar.
+func isTar(f io.ReaderAt, name string) bool {
+	b := make([]byte, 5)
+	if n, _ := f.ReadAt(b, 257); n == len(b) && string(b) == "ustar" {
+		return true
+	}
+	return strings.HasSuffix(trimCompressedSuffix(name), ".tar")
+}
+
+// sparse reports whether a tar file is sparse, which, since its
+// contents are not as they are in the tar, can not be served.
+func sparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// readTar reads the headers of a tar, and returns its files as cpio
+// records, as fsCPIO needs them. A file which is in the tar more than
+// once is the last; a hard link is a copy of what it links to.
+func readTar(f *os.File) ([]cpio.Record, error) {
+	tr := tar.NewReader(f)
+	var recs []cpio.Record
+	files := map[string]int{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sparse(h) {
+			return nil, fmt.Errorf("%s: sparse files are not supported:%w", h.Name, os.ErrInvalid)
+		}
+		n := archiveName(h.Name)
+		var data io.ReaderAt
+		switch h.Typeflag {
+		case tar.TypeReg:
+			// tar reads no further than the header, so the
+			// contents start where the file is.
+			off, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			data = io.NewSectionReader(f, off, h.Size)
+		case tar.TypeLink:
+			i, ok := files[archiveName(h.Linkname)]
+			if !ok || recs[i].Mode&cpio.S_IFMT != cpio.S_IFREG {
+				verbose("%s: link to %s, which is not a file; skipped", h.Name, h.Linkname)
+				continue
+			}
+			r := recs[i]
+			r.Name = n
+			files[n] = len(recs)
+			recs = append(recs, r)
+			continue
+		case tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			continue
+		}
+		files[n] = len(recs)
+		recs = append(recs, tarRecord(n, h, data, uint64(len(recs)+1)))
+	}
+	return mergeCPIO([][]cpio.Record{recs}), nil
+}
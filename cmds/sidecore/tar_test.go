@@ -0,0 +1,151 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+)
+
+// testTar writes a tar, as docker export would, to dir, gzipped if z.
+func testTar(t *testing.T, dir, name string, z bool) string {
+	t.Helper()
+	long := strings.Repeat("d", 60) + "/" + strings.Repeat("f", 60)
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for _, e := range []struct {
+		h    tar.Header
+		data string
+	}{
+		{h: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}},
+		{h: tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{h: tar.Header{Name: "./etc/os-release", Typeflag: tar.TypeReg, Mode: 0644}, data: "old"},
+		{h: tar.Header{Name: "./etc/os-release", Typeflag: tar.TypeReg, Mode: 0644}, data: "ID=ubuntu"},
+		{h: tar.Header{Name: "./bin/ls", Typeflag: tar.TypeReg, Mode: 0755}, data: "ls"},
+		{h: tar.Header{Name: "./bin/dir", Typeflag: tar.TypeLink, Linkname: "./bin/ls"}},
+		{h: tar.Header{Name: "./lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"}},
+		{h: tar.Header{Name: "./dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		{h: tar.Header{Name: "./" + long, Typeflag: tar.TypeReg, Mode: 0644, Format: tar.FormatPAX}, data: "long"},
+	} {
+		e.h.Size = int64(len(e.data))
+		if err := w.WriteHeader(&e.h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if z {
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		zw.Write(b.Bytes())
+		zw.Close()
+		b = zb
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// tarFiles are the files of testTar, and what is in them.
+var tarFiles = map[string]string{
+	"etc/os-release": "ID=ubuntu",
+	"bin/ls":         "ls",
+	"bin/dir":        "ls",
+	strings.Repeat("d", 60) + "/" + strings.Repeat("f", 60): "long",
+}
+
+func TestTarfsCPIO(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	d := t.TempDir()
+	for _, c := range []string{
+		testTar(t, d, "rootfs.tar", false),
+		testTar(t, d, "rootfs.tar.gz", true),
+		// The magic is enough.
+		testTar(t, d, "rootfs", false),
+	} {
+		f, err := NewfsCPIO(c)
+		if err != nil {
+			t.Fatalf("NewfsCPIO(%s): %v != nil", c, err)
+		}
+		for n, want := range tarFiles {
+			h, err := f.Open(n)
+			if err != nil {
+				t.Errorf("%s: Open(%q): %v != nil", c, n, err)
+				continue
+			}
+			b := make([]byte, 16)
+			m, _ := h.ReadAt(b, 0)
+			if got := string(b[:m]); got != want {
+				t.Errorf("%s: %s: %q != %q", c, n, got, want)
+			}
+		}
+		ents, err := f.ReadDir(".")
+		if err != nil {
+			t.Fatalf("%s: ReadDir(.): %v != nil", c, err)
+		}
+		var got []string
+		for _, e := range ents {
+			got = append(got, e.Name())
+		}
+		sort.Strings(got)
+		if want := []string{"bin", "dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd", "dev", "etc", "lib"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: ReadDir(.): %q != %q", c, got, want)
+		}
+		for n, want := range map[string]fs.FileMode{"lib": fs.ModeSymlink, "dev/null": fs.ModeCharDevice, "etc": fs.ModeDir} {
+			fi, err := f.Lstat(n)
+			if err != nil || fi.Mode().Type()&want != want {
+				t.Errorf("%s: Lstat(%q): %v, %v != %v, nil", c, n, fi.Mode().Type(), err, want)
+			}
+		}
+		if l, err := f.Readlink("lib"); err != nil || l != "usr/lib" {
+			t.Errorf("%s: Readlink(lib): %q, %v != %q, nil", c, l, err, "usr/lib")
+		}
+	}
+}
+
+func TestTar9P(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	c := testTar(t, t.TempDir(), "rootfs.tar.gz", true)
+	u, err := newServer(c, nil, "home")
+	if err != nil {
+		t.Fatalf("newServer(%s): %v != nil", c, err)
+	}
+	root, err := u.Attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range tarFiles {
+		_, f, err := root.Walk(strings.Split(n, "/"))
+		if err != nil {
+			t.Errorf("Walk(%q): %v != nil", n, err)
+			continue
+		}
+		if _, _, err := f.Open(p9.ReadOnly); err != nil {
+			t.Errorf("Open(%q): %v != nil", n, err)
+			continue
+		}
+		b := make([]byte, 16)
+		m, _ := f.ReadAt(b, 0)
+		if got := string(b[:m]); got != want {
+			t.Errorf("%s: %q != %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sshTokens returns the ssh_config % tokens for a host, as OpenSSH
+// has them: %h is the host, as given, %p the port, %r the user,
+// %d the home directory, and %% is a %.
+func sshTokens(host, port string) map[byte]string {
+	return map[byte]string{
+		'%': "%",
+		'h': host,
+		'p': port,
+		'r': getUser(host),
+		'd': os.Getenv("HOME"),
+	}
+}
+
+// expandTokens expands the % tokens in s. It is an error if s has
+// one which is not in tokens, rather than a path which is no use.
+func expandTokens(s string, tokens map[byte]string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", fmt.Errorf("%q: %% at the end:%w", s, os.ErrInvalid)
+		}
+		v, ok := tokens[s[i]]
+		if !ok {
+			return "", fmt.Errorf("%q: unknown token %%%c:%w", s, s[i], os.ErrInvalid)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
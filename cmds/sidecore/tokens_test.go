@@ -0,0 +1,60 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExpandTokens(t *testing.T) {
+	tokens := map[byte]string{'%': "%", 'h': "rpi.lab", 'p': "17010", 'r': "glenda", 'd': "/home/glenda"}
+	for _, tt := range []struct {
+		in, want string
+		err      error
+	}{
+		{in: "~/.ssh/cpu_rsa", want: "~/.ssh/cpu_rsa"},
+		{in: "~/.ssh/%h_ed25519", want: "~/.ssh/rpi.lab_ed25519"},
+		{in: "%d/.ssh/%r@%h:%p", want: "/home/glenda/.ssh/glenda@rpi.lab:17010"},
+		{in: "%%h.example.com", want: "%h.example.com"},
+		{in: "%h.%%", want: "rpi.lab.%"},
+		{in: "~/.ssh/%C", err: os.ErrInvalid},
+		{in: "~/.ssh/%", err: os.ErrInvalid},
+	} {
+		got, err := expandTokens(tt.in, tokens)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("expandTokens(%q): (%q, %v) != (%q, %v)", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestConfigTokens(t *testing.T) {
+	t.Setenv("HOME", "/home/glenda")
+	setSSHConfig(t, `Host *.lab
+	User glenda
+	IdentityFile ~/.ssh/%h_ed25519
+	IdentityFile %d/.ssh/%r_%p
+	HostName %h.example.com
+Host bad
+	IdentityFile ~/.ssh/%C
+	HostName %C.example.com
+`)
+	got, err := getKeyFile("rpi.lab", "17011", nil)
+	want := []string{"/home/glenda/.ssh/rpi.lab_ed25519", "/home/glenda/.ssh/glenda_17011"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("getKeyFile(rpi.lab): (%q, %v) != (%q, nil)", got, err, want)
+	}
+	if h, err := getHostName("rpi.lab", "17011"); err != nil || h != "rpi.lab.example.com" {
+		t.Errorf("getHostName(rpi.lab): (%q, %v) != (%q, nil)", h, err, "rpi.lab.example.com")
+	}
+	if _, err := getKeyFile("bad", "17011", nil); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("getKeyFile(bad): %v != %v", err, os.ErrInvalid)
+	}
+	if _, err := getHostName("bad", "17011"); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("getHostName(bad): %v != %v", err, os.ErrInvalid)
+	}
+}
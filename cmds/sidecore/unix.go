@@ -0,0 +1,25 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// unixPath returns the socket path of a -net unix host, which
+// is an absolute path, or any path following unix:, e.g.
+// /run/cpud.sock or unix:cpud.sock.
+func unixPath(host string) (string, error) {
+	p, ok := strings.CutPrefix(host, "unix:")
+	if !ok && !strings.HasPrefix(host, "/") {
+		return "", fmt.Errorf("unix host %q must be an absolute path, or start with unix::%w", host, os.ErrInvalid)
+	}
+	if len(p) == 0 {
+		return "", fmt.Errorf("unix host %q has no path:%w", host, os.ErrInvalid)
+	}
+	return p, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+func TestUnixPath(t *testing.T) {
+	for _, tt := range []struct {
+		host, want string
+		err        error
+	}{
+		{host: "/run/cpud.sock", want: "/run/cpud.sock"},
+		{host: "unix:/run/cpud.sock", want: "/run/cpud.sock"},
+		{host: "unix:cpud.sock", want: "cpud.sock"},
+		{host: "cpud.sock", err: os.ErrInvalid},
+		{host: "unix:", err: os.ErrInvalid},
+	} {
+		got, err := unixPath(tt.host)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("unixPath(%q): (%q, %v) != (%q, %v)", tt.host, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// fakeCPUD returns a function which serves an ssh connection as
+// a fake cpud: it runs no commands, but says each command exits
+// with status 3. If env is not nil, it is sent each environment
+// variable set, as NAME=VALUE.
+func fakeCPUD(env chan<- string) func(net.Conn, *ossh.ServerConfig) {
+	return func(c net.Conn, cfg *ossh.ServerConfig) {
+		_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+		if err != nil {
+			return
+		}
+		go ossh.DiscardRequests(reqs)
+		for nc := range chans {
+			if nc.ChannelType() != "session" {
+				nc.Reject(ossh.UnknownChannelType, nc.ChannelType())
+				continue
+			}
+			ch, creqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for r := range creqs {
+					r.Reply(true, nil)
+					var e struct{ Name, Value string }
+					if r.Type == "env" && env != nil && ossh.Unmarshal(r.Payload, &e) == nil {
+						env <- e.Name + "=" + e.Value
+					}
+					if r.Type == "exec" {
+						ch.SendRequest("exit-status", false, ossh.Marshal(struct{ Status uint32 }{3}))
+						return
+					}
+				}
+			}()
+		}
+	}
+}
+
+func TestRunCPUUnix(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool) { *network, *srvnfs = n, nfs }(*network, *srvnfs)
+	*network, *srvnfs = "unix", false
+
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	testServerOn(t, l, fakeCPUD(nil))
+
+	host, err := unixPath("unix:" + sock)
+	if err != nil {
+		t.Fatalf("unixPath: %v != nil", err)
+	}
+	cpu := &cpu{host: host, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true}
+	var wg sync.WaitGroup
+	err = runCPU(nil, &wg, "", cpu, "date")
+	wg.Wait()
+	if got := exitStatus(err); got != 3 {
+		t.Errorf("runCPU over %s: exit status %d (%v) != 3", sock, got, err)
+	}
+}
+
+// signalCPUD serves an ssh connection as a fake cpud whose commands
+// run until they are sent a signal, which kills them.
+func signalCPUD(c net.Conn, cfg *ossh.ServerConfig) {
+	_, chans, reqs, err := ossh.NewServerConn(c, cfg)
+	if err != nil {
+		return
+	}
+	go ossh.DiscardRequests(reqs)
+	for nc := range chans {
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for r := range creqs {
+				r.Reply(true, nil)
+				var sig struct{ Signal string }
+				if r.Type == "signal" && ossh.Unmarshal(r.Payload, &sig) == nil {
+					ch.SendRequest("exit-signal", false, ossh.Marshal(struct {
+						Signal     string
+						CoreDumped bool
+						Error      string
+						Lang       string
+					}{Signal: sig.Signal}))
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestRunCPUStop(t *testing.T) {
+	setHome(t)
+	setConfirm(t, true)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	defer func(n string, nfs bool) { *network, *srvnfs = n, nfs }(*network, *srvnfs)
+	*network, *srvnfs = "unix", false
+
+	sock := filepath.Join(t.TempDir(), "cpud.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen(unix, %q): %v != nil", sock, err)
+	}
+	testServerOn(t, l, signalCPUD)
+
+	stop := make(chan struct{})
+	close(stop)
+	cpu := &cpu{host: sock, port: defaultPort, user: "cpu", keyfiles: []string{testKey(t)}, noStdin: true, stop: stop}
+	var wg sync.WaitGroup
+	err = runCPU(nil, &wg, "", cpu, "sleep", "1000")
+	wg.Wait()
+	if got, want := exitStatus(err), 128+15; got != want {
+		t.Errorf("runCPU, stopped: exit status %d (%v) != %d", got, err, want)
+	}
+}
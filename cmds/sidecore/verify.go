@@ -0,0 +1,107 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// A container is hashed before it is served, and the hash logged,
+// so that a run can be traced to the image it used. If there is a
+// sum for it, SIDECORE_IMAGE_SHA256, or, beside it, name.sha256, as
+// sha256sum writes it, a container which does not match is not used,
+// unless -insecure-no-verify is set.
+var insecureNoVerify = flag.Bool("insecure-no-verify", false, "use a container whose sha256 does not match SIDECORE_IMAGE_SHA256, or its .sha256 file")
+
+// verification is the check of a container, which the cpus which use
+// it share.
+type verification struct {
+	once sync.Once
+	err  error
+}
+
+var (
+	verifiedMu sync.Mutex
+	verified   = map[string]*verification{}
+)
+
+// verifyContainer checks a cpio container, once, against its sum, if
+// it has one. A dir: container is not checked.
+func verifyContainer(c string) error {
+	if _, ok := dirContainer(c); ok {
+		return nil
+	}
+	verifiedMu.Lock()
+	v, ok := verified[c]
+	if !ok {
+		v = &verification{}
+		verified[c] = v
+	}
+	verifiedMu.Unlock()
+	v.once.Do(func() {
+		v.err = checkContainerSum(c)
+	})
+	return v.err
+}
+
+// containerSum returns the sum a container must have, and where it is
+// from, or nil if it has none.
+func containerSum(c string) ([]byte, string, error) {
+	if s, ok := os.LookupEnv("SIDECORE_IMAGE_SHA256"); ok && len(s) > 0 {
+		sum, err := parseSum(s)
+		if err != nil {
+			return nil, "", fmt.Errorf("SIDECORE_IMAGE_SHA256: %w", err)
+		}
+		return sum, "SIDECORE_IMAGE_SHA256", nil
+	}
+	b, err := os.ReadFile(c + ".sha256")
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	sum, err := parseSum(string(b))
+	if err != nil {
+		return nil, "", fmt.Errorf("%s.sha256: %w", c, err)
+	}
+	return sum, c + ".sha256", nil
+}
+
+// checkContainerSum hashes a container, logs its hash, and checks it
+// against its sum.
+func checkContainerSum(c string) error {
+	want, from, err := containerSum(c)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(c)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("%s: %w", c, err)
+	}
+	got := h.Sum(nil)
+	verbose("container %s: sha256 %x", c, got)
+	switch {
+	case want == nil:
+		verbose("container %s: no sha256 to check it against", c)
+	case string(got) == string(want):
+		verbose("container %s: matches %s", c, from)
+	case *insecureNoVerify:
+		info("warning: container %s: sha256 %x, not %x, from %s; using it, as -insecure-no-verify is set", c, got, want, from)
+	default:
+		return fmt.Errorf("container %s: sha256 %x, not %x, from %s; it may be corrupt, or have been changed; -insecure-no-verify uses it anyway:%w", c, got, want, from, errBadSum)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyContainer(t *testing.T) {
+	defer func(v bool) { *insecureNoVerify = v }(*insecureNoVerify)
+	image := []byte("a container")
+	good := fmt.Sprintf("%x", sha256.Sum256(image))
+	bad := fmt.Sprintf("%x", sha256.Sum256(nil))
+	for _, tt := range []struct {
+		name     string
+		sidecar  string
+		env      string
+		insecure bool
+		dir      bool
+		err      error
+	}{
+		{name: "no sum"},
+		{name: "sidecar", sidecar: good + "  c.cpio\n"},
+		{name: "bare sidecar", sidecar: good},
+		{name: "bad sidecar", sidecar: bad + "  c.cpio\n", err: errBadSum},
+		{name: "bad sidecar, insecure", sidecar: bad, insecure: true},
+		{name: "not a sidecar", sidecar: "c.cpio\n", err: os.ErrInvalid},
+		{name: "env", env: good},
+		{name: "env beats sidecar", sidecar: bad, env: good},
+		{name: "bad env", sidecar: good, env: bad, err: errBadSum},
+		{name: "not an env", env: "xyz", err: os.ErrInvalid},
+		{name: "dir", env: bad, dir: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			*insecureNoVerify = tt.insecure
+			t.Setenv("SIDECORE_IMAGE_SHA256", tt.env)
+			c := filepath.Join(t.TempDir(), "c.cpio")
+			if err := os.WriteFile(c, image, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.sidecar) > 0 {
+				if err := os.WriteFile(c+".sha256", []byte(tt.sidecar), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.dir {
+				c = dirPrefix + filepath.Dir(c)
+			}
+			if err := verifyContainer(c); !errors.Is(err, tt.err) {
+				t.Errorf("verifyContainer(%s): %v != %v", c, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNewContainerFSVerifies(t *testing.T) {
+	c := filepath.Join(t.TempDir(), "c.cpio")
+	if err := os.WriteFile(c, []byte("not what was summed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c+".sha256", []byte(fmt.Sprintf("%x\n", sha256.Sum256(nil))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newContainerFS(c); !errors.Is(err, errBadSum) {
+		t.Errorf("newContainerFS(%s): %v != %v", c, err, errBadSum)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	rdebug "runtime/debug"
+	"strings"
+
+	"github.com/u-root/sidecore/internal/cpu/client"
+)
+
+// buildDate is set at link time, e.g.
+// go build -ldflags "-X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var buildDate string
+
+// versionDeps are the dependencies whose versions are worth
+// knowing when debugging interactions with cpud.
+var versionDeps = []string{
+	"github.com/willscott/go-nfs",
+	"github.com/hugelgupf/p9",
+}
+
+// version returns a description of the sidecore binary: the
+// module version, VCS information, build date, and the versions
+// of key dependencies.
+func version() string {
+	var b strings.Builder
+	bi, ok := rdebug.ReadBuildInfo()
+	if !ok {
+		fmt.Fprintf(&b, "sidecore: no build information (%s)\n", runtime.Version())
+		return b.String()
+	}
+	fmt.Fprintf(&b, "sidecore %s (%s %s/%s)\n", bi.Main.Version, bi.GoVersion, runtime.GOOS, runtime.GOARCH)
+	settings := map[string]string{}
+	for _, s := range bi.Settings {
+		settings[s.Key] = s.Value
+	}
+	if r, ok := settings["vcs.revision"]; ok {
+		if settings["vcs.modified"] == "true" {
+			r += " (modified)"
+		}
+		fmt.Fprintf(&b, "revision: %s\n", r)
+	}
+	if t, ok := settings["vcs.time"]; ok {
+		fmt.Fprintf(&b, "commit time: %s\n", t)
+	}
+	if len(buildDate) > 0 {
+		fmt.Fprintf(&b, "build date: %s\n", buildDate)
+	}
+	// The cpu client is a copy, in internal/cpu.
+	fmt.Fprintf(&b, "github.com/u-root/cpu %s (copy)\n", client.Upstream)
+	for _, d := range bi.Deps {
+		for _, n := range versionDeps {
+			if d.Path != n {
+				continue
+			}
+			if d.Replace != nil {
+				d = d.Replace
+			}
+			fmt.Fprintf(&b, "%s %s\n", n, d.Version)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,33 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// vsockAddr returns the context ID and port of a -net vsock host,
+// written as cid:port, e.g. 3:17010. A cid with no port uses
+// port, or, if that is not set, the default port. Both may be
+// decimal or hex, e.g. 0x3.
+func vsockAddr(host, port string) (string, string, error) {
+	cid, p, ok := strings.Cut(host, ":")
+	if !ok || len(p) == 0 {
+		p = port
+	}
+	if len(p) == 0 {
+		p = defaultPort
+	}
+	if _, err := strconv.ParseUint(cid, 0, 32); err != nil {
+		return "", "", fmt.Errorf("vsock host %q: context ID %q is not a number:%w", host, cid, os.ErrInvalid)
+	}
+	if _, err := strconv.ParseUint(p, 0, 32); err != nil {
+		return "", "", fmt.Errorf("vsock host %q: port %q is not a number:%w", host, p, os.ErrInvalid)
+	}
+	return cid, p, nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// vsockAvailable returns an error if there is no vsock device,
+// as when no vsock transport, e.g. vhost_vsock, is loaded.
+func vsockAvailable() error {
+	if _, err := os.Stat("/dev/vsock"); err != nil {
+		return fmt.Errorf("vsock is not available (is vhost_vsock loaded?): %w", err)
+	}
+	return nil
+}
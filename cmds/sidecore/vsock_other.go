@@ -0,0 +1,17 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// vsockAvailable returns an error: vsock is only supported on linux.
+func vsockAvailable() error {
+	return fmt.Errorf("vsock is only supported on linux:%w", os.ErrInvalid)
+}
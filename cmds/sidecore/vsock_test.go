@@ -0,0 +1,39 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestVsockAddr(t *testing.T) {
+	for _, tt := range []struct {
+		host, port, cid, wantPort string
+		err                       error
+	}{
+		{host: "3:17011", cid: "3", wantPort: "17011"},
+		{host: "0x3:0x4000", port: "17011", cid: "0x3", wantPort: "0x4000"},
+		{host: "3", port: "17011", cid: "3", wantPort: "17011"},
+		{host: "3", cid: "3", wantPort: defaultPort},
+		{host: "3:", cid: "3", wantPort: defaultPort},
+		{host: "vm:17010", err: os.ErrInvalid},
+		{host: "3:ssh", err: os.ErrInvalid},
+		{host: "4294967296:17010", err: os.ErrInvalid},
+	} {
+		cid, port, err := vsockAddr(tt.host, tt.port)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("vsockAddr(%q, %q): %v != %v", tt.host, tt.port, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if cid != tt.cid || port != tt.wantPort {
+			t.Errorf("vsockAddr(%q, %q): (%q, %q) != (%q, %q)", tt.host, tt.port, cid, port, tt.cid, tt.wantPort)
+		}
+	}
+}
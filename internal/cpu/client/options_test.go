@@ -0,0 +1,89 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestWithUser(t *testing.T) {
+	c := Command("localhost", "true")
+	if err := c.SetOptions(WithUser("glenda")); err != nil {
+		t.Fatalf("SetOptions(WithUser(\"glenda\")): %v != nil", err)
+	}
+	if c.config.User != "glenda" {
+		t.Errorf("User: %q != \"glenda\"", c.config.User)
+	}
+	if err := c.SetOptions(WithUser("")); err != nil {
+		t.Fatalf("SetOptions(WithUser(\"\")): %v != nil", err)
+	}
+	if c.config.User != "glenda" {
+		t.Errorf("WithUser(\"\"): User %q != \"glenda\"", c.config.User)
+	}
+}
+
+func TestWithAuth(t *testing.T) {
+	c := Command("localhost", "true")
+	if err := c.SetOptions(WithAuth(ssh.Password("a"), ssh.Password("b"))); err != nil {
+		t.Fatalf("SetOptions(WithAuth(...)): %v != nil", err)
+	}
+	if len(c.config.Auth) != 2 {
+		t.Errorf("len(Auth): %d != 2", len(c.config.Auth))
+	}
+}
+
+func TestWithHostKeyCallback(t *testing.T) {
+	c := Command("localhost", "true")
+	errReject := errors.New("rejected")
+	cb := func(string, net.Addr, ssh.PublicKey) error { return errReject }
+	if err := c.SetOptions(WithHostKeyCallback(cb)); err != nil {
+		t.Fatalf("SetOptions(WithHostKeyCallback(...)): %v != nil", err)
+	}
+	if err := c.config.HostKeyCallback("localhost:22", nil, nil); err != errReject {
+		t.Errorf("HostKeyCallback: %v != %v", err, errReject)
+	}
+}
+
+func TestWithConnectTimeout(t *testing.T) {
+	// A server which accepts, but never says anything.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v != nil", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Command("127.0.0.1", "true")
+	if err := c.SetOptions(WithPort(port), WithAuth(ssh.Password("a")), WithConnectTimeout(50*time.Millisecond)); err != nil {
+		t.Fatalf("SetOptions: %v != nil", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Dial() }()
+	select {
+	case err := <-errc:
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Errorf("Dial: %v != a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Dial: no timeout after 5s")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// nopCloser is a bytes.Buffer which is an io.WriteCloser.
+type nopCloser struct {
+	bytes.Buffer
+}
+
+func (*nopCloser) Close() error {
+	return nil
+}
+
+func TestTTYIn(t *testing.T) {
+	for _, tt := range []struct {
+		in, out string
+		escape  int
+		suspend int
+		help    bool
+	}{
+		{in: "ls\r", out: "ls\r", escape: '~'},
+		{in: "~~x", out: "~x", escape: '~'},
+		{in: "a~b", out: "a~b", escape: '~'},
+		{in: "~x", out: "~x", escape: '~'},
+		{in: "ls\r~~\r", out: "ls\r~\r", escape: '~'},
+		{in: "ls\r~?\r", out: "ls\r\r", escape: '~', help: true},
+		{in: "~\x1als\r~\x1a", out: "ls\r", escape: '~', suspend: 2},
+		{in: "~.~~", out: "~.~~", escape: NoEscape},
+		{in: "^^x~~", out: "^x~~", escape: '^'},
+	} {
+		c := Command("localhost", "true")
+		suspended := 0
+		if err := c.SetOptions(WithEscape(tt.escape), WithSuspend(func() { suspended++ })); err != nil {
+			t.Fatalf("SetOptions: %v != nil", err)
+		}
+		var stderr bytes.Buffer
+		c.Stderr = &stderr
+		w := &nopCloser{}
+		c.TTYIn(nil, w, strings.NewReader(tt.in))
+		if got := w.String(); got != tt.out {
+			t.Errorf("TTYIn(%q, escape %q): %q != %q", tt.in, rune(tt.escape), got, tt.out)
+		}
+		if suspended != tt.suspend {
+			t.Errorf("TTYIn(%q): suspended %d times != %d", tt.in, suspended, tt.suspend)
+		}
+		if help := strings.Contains(stderr.String(), "escape sequences"); help != tt.help {
+			t.Errorf("TTYIn(%q): help %v != %v", tt.in, help, tt.help)
+		}
+	}
+}
+
+func TestWithEscape(t *testing.T) {
+	c := Command("localhost", "true")
+	if err := c.SetOptions(WithEscape(0x100)); err == nil {
+		t.Errorf("WithEscape(0x100): nil != an error")
+	}
+}